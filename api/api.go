@@ -17,6 +17,7 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -24,6 +25,7 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -38,10 +40,12 @@ import (
 	apiTypes "github.com/mudler/edgevpn/api/types"
 
 	"github.com/labstack/echo/v4"
+	"github.com/mudler/edgevpn/pkg/blockchain"
 	"github.com/mudler/edgevpn/pkg/node"
 	"github.com/mudler/edgevpn/pkg/protocol"
 	"github.com/mudler/edgevpn/pkg/services"
 	"github.com/mudler/edgevpn/pkg/types"
+	"github.com/mudler/edgevpn/pkg/vpn"
 )
 
 const (
@@ -49,12 +53,20 @@ const (
 	UsersURL      = "/api/users"
 	ServiceURL    = "/api/services"
 	BlockchainURL = "/api/blockchain"
+	HistoryURL    = "/api/blockchain/history"
 	LedgerURL     = "/api/ledger"
+	WatchURL      = "/api/ledger/watch"
+	SignedURL     = "/api/ledger/signed"
 	SummaryURL    = "/api/summary"
 	FileURL       = "/api/files"
 	NodesURL      = "/api/nodes"
 	DNSURL        = "/api/dns"
+	LeasesURL     = "/api/dhcp/leases"
+	ReservedURL   = "/api/dhcp/reservations"
 	MetricsURL    = "/api/metrics"
+	CaptureURL    = "/api/vpn/capture"
+	LimitsURL     = "/api/vpn/limits"
+	PrometheusURL = "/metrics"
 	PeerstoreURL  = "/api/peerstore"
 	PeerGateURL   = "/api/peergate"
 
@@ -68,6 +80,10 @@ const (
 	// blocks every other process on the host, which is the right
 	// default for a hardened local control plane.
 	defaultUnixSocketMode os.FileMode = 0o660
+
+	// watchKeepalive is how often an idle ledger watch stream sends a
+	// comment, so proxies in between do not time it out.
+	watchKeepalive = 15 * time.Second
 )
 
 // unixSocketMode resolves the file mode that should be applied to
@@ -214,7 +230,39 @@ func listenUnix(path string) (net.Listener, error) {
 	return l, nil
 }
 
-func API(ctx context.Context, l string, defaultInterval, timeout time.Duration, e *node.Node, bwc metrics.Reporter, debugMode bool) error {
+// Config holds the optional parts of the API.
+type Config struct {
+	// VPNMetrics, if set, is served under MetricsURL/vpn.
+	VPNMetrics *vpn.Metrics
+	// VPNCapture, if set, captures the VPN packets on CaptureURL.
+	VPNCapture *vpn.Capture
+}
+
+type Option func(cfg *Config) error
+
+// WithVPNMetrics serves the state of the VPN packet queues.
+func WithVPNMetrics(m *vpn.Metrics) Option {
+	return func(cfg *Config) error {
+		cfg.VPNMetrics = m
+		return nil
+	}
+}
+
+// WithVPNCapture lets the API clients capture the VPN packets.
+func WithVPNCapture(c *vpn.Capture) Option {
+	return func(cfg *Config) error {
+		cfg.VPNCapture = c
+		return nil
+	}
+}
+
+func API(ctx context.Context, l string, defaultInterval, timeout time.Duration, e *node.Node, bwc metrics.Reporter, debugMode bool, opts ...Option) error {
+	cfg := &Config{}
+	for _, o := range opts {
+		if err := o(cfg); err != nil {
+			return err
+		}
+	}
 
 	ledger, _ := e.Ledger()
 
@@ -281,6 +329,62 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 			return c.JSON(http.StatusOK, bwc.GetBandwidthForProtocol(p2pprotocol.ID(c.Param("protocol"))))
 		})
 	}
+	if cfg.VPNMetrics != nil {
+		ec.GET(filepath.Join(MetricsURL, "vpn"), func(c echo.Context) error {
+			return c.JSON(http.StatusOK, cfg.VPNMetrics.Snapshot())
+		})
+		ec.GET(filepath.Join(MetricsURL, "vpn", "traffic"), func(c echo.Context) error {
+			return c.JSON(http.StatusOK, cfg.VPNMetrics.Traffic())
+		})
+		ec.GET(PrometheusURL, echo.WrapHandler(prometheusHandler(cfg.VPNMetrics)))
+	}
+	if cfg.VPNCapture != nil {
+		// Streams a pcap of the VPN packets matching filter, until duration,
+		// bytes or packets is reached or the client goes away. duration and
+		// bytes are refused above vpn.MaxCaptureDuration and vpn.MaxCaptureSize.
+		ec.GET(CaptureURL, func(c echo.Context) error {
+			o := vpn.CaptureOptions{Filter: c.QueryParam("filter")}
+			if _, err := vpn.ParseCaptureFilter(o.Filter); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			var err error
+			if d := c.QueryParam("duration"); d != "" {
+				if o.Duration, err = time.ParseDuration(d); err != nil {
+					return echo.NewHTTPError(http.StatusBadRequest, "invalid duration")
+				}
+				if o.Duration > vpn.MaxCaptureDuration {
+					return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("duration above %s", vpn.MaxCaptureDuration))
+				}
+			}
+			if b := c.QueryParam("bytes"); b != "" {
+				if o.MaxBytes, err = strconv.ParseInt(b, 10, 64); err != nil {
+					return echo.NewHTTPError(http.StatusBadRequest, "invalid bytes")
+				}
+				if o.MaxBytes > vpn.MaxCaptureSize {
+					return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("bytes above %d", vpn.MaxCaptureSize))
+				}
+			}
+			if p := c.QueryParam("packets"); p != "" {
+				if o.MaxPackets, err = strconv.Atoi(p); err != nil {
+					return echo.NewHTTPError(http.StatusBadRequest, "invalid packets")
+				}
+			}
+
+			w := c.Response()
+			w.Header().Set(echo.HeaderContentType, "application/vnd.tcpdump.pcap")
+			w.Header().Set(echo.HeaderContentDisposition, `attachment; filename="edgevpn.pcap"`)
+			_, err = cfg.VPNCapture.Run(c.Request().Context(), flushWriter{w}, o)
+			if err != nil && !w.Committed {
+				w.Header().Del(echo.HeaderContentType)
+				w.Header().Del(echo.HeaderContentDisposition)
+				if errors.Is(err, vpn.ErrCaptureRunning) {
+					return echo.NewHTTPError(http.StatusConflict, err.Error())
+				}
+				return err
+			}
+			return nil
+		})
+	}
 	// Get data from ledger
 	ec.GET(FileURL, func(c echo.Context) error {
 		list := []*types.File{}
@@ -436,33 +540,179 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 		return c.JSON(http.StatusOK, ledger.LastBlock())
 	})
 
+	// Revisions recorded in the retained block history, optionally filtered
+	// by bucket, key and block range (from, to).
+	ec.GET(HistoryURL, func(c echo.Context) error {
+		from, to := 0, -1
+		if v := c.QueryParam("from"); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid from")
+			}
+			from = i
+		}
+		if v := c.QueryParam("to"); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid to")
+			}
+			to = i
+		}
+
+		changes := []blockchain.Change{}
+		for _, ch := range ledger.History(c.QueryParam("bucket"), c.QueryParam("key")) {
+			if ch.Block >= from && (to < 0 || ch.Block <= to) {
+				changes = append(changes, ch)
+			}
+		}
+		return c.JSON(http.StatusOK, changes)
+	})
+
 	ec.GET(LedgerURL, func(c echo.Context) error {
 		return c.JSON(http.StatusOK, ledger.CurrentData())
 	})
 
+	// Stream ledger changes as server-sent events, optionally restricted to a
+	// bucket and a key prefix. Registered before /api/ledger/:bucket, which it
+	// shadows for a bucket named "watch".
+	ec.GET(WatchURL, func(c echo.Context) error {
+		ctx := c.Request().Context()
+		events := ledger.Watch(ctx, c.QueryParam("bucket"), c.QueryParam("prefix"))
+
+		w := c.Response()
+		w.Header().Set(echo.HeaderContentType, "text/event-stream")
+		w.Header().Set(echo.HeaderCacheControl, "no-cache")
+		w.Header().Set(echo.HeaderConnection, "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		w.Flush()
+
+		keepalive := time.NewTicker(watchKeepalive)
+		defer keepalive.Stop()
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return nil
+				}
+				dat, err := json.Marshal(e)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, dat)
+				w.Flush()
+			case <-keepalive.C:
+				// A comment line keeps idle proxies from closing the stream.
+				fmt.Fprint(w, ": keepalive\n\n")
+				w.Flush()
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+
 	ec.GET(fmt.Sprintf("%s/:bucket/:key", LedgerURL), func(c echo.Context) error {
 		bucket := c.Param("bucket")
 		key := c.Param("key")
 		return c.JSON(http.StatusOK, ledger.CurrentData()[bucket][key])
 	})
 
+	// With filter (repeatable, all must match) or fields (comma separated)
+	// query parameters, the decoded JSON values are returned instead of the
+	// raw data, e.g. /api/ledger/machines?filter=OS==linux&fields=Hostname,Address
 	ec.GET(fmt.Sprintf("%s/:bucket", LedgerURL), func(c echo.Context) error {
 		bucket := c.Param("bucket")
-		return c.JSON(http.StatusOK, ledger.CurrentData()[bucket])
+		params := c.QueryParams()
+		if _, ok := params["filter"]; !ok && c.QueryParam("fields") == "" {
+			return c.JSON(http.StatusOK, ledger.CurrentData()[bucket])
+		}
+
+		var fields []string
+		if f := c.QueryParam("fields"); f != "" {
+			fields = strings.Split(f, ",")
+		}
+		q, err := blockchain.ParseQuery(params["filter"], fields)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusOK, ledger.Query(bucket, q))
 	})
 
 	announcing := struct{ State string }{"Announcing"}
+	// Peers would reject these writes: say so instead of announcing them.
+	adminOnly := "the bucket takes admin-signed writes only, see " + SignedURL
 
 	// Store arbitrary data
 	ec.PUT(fmt.Sprintf("%s/:bucket/:key/:value", LedgerURL), func(c echo.Context) error {
 		bucket := c.Param("bucket")
 		key := c.Param("key")
 		value := c.Param("value")
+		if !ledger.CanWrite(bucket) {
+			return echo.NewHTTPError(http.StatusForbidden, adminOnly)
+		}
 
 		ledger.Persist(context.Background(), defaultInterval, timeout, bucket, key, value)
 		return c.JSON(http.StatusOK, announcing)
 	})
 
+	// Conditional write: the raw JSON body is stored at bucket/key if the
+	// key's current version is ?version= (0: the key must not exist). Without
+	// ?version= the write is unconditional. Either way it is committed
+	// before the response, which carries the written entry and its version.
+	ec.POST(fmt.Sprintf("%s/:bucket/:key", LedgerURL), func(c echo.Context) error {
+		var value interface{}
+		if err := json.NewDecoder(c.Request().Body).Decode(&value); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		op := blockchain.Op{Bucket: c.Param("bucket"), Key: c.Param("key"), Value: value}
+		if !ledger.CanWrite(op.Bucket) {
+			return echo.NewHTTPError(http.StatusForbidden, adminOnly)
+		}
+		if v := c.QueryParam("version"); v != "" {
+			version, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid version")
+			}
+			op.ExpectedVersion = &version
+		}
+		res, err := ledger.Batch([]blockchain.Op{op})
+		if err != nil {
+			return writeError(c, err)
+		}
+		return c.JSON(http.StatusOK, res[0])
+	})
+
+	// Writes signed elsewhere (e.g. with an offline admin key, see
+	// `edgevpn ledger sign`), checked like gossip and committed together.
+	ec.POST(SignedURL, func(c echo.Context) error {
+		writes := []blockchain.SignedWrite{}
+		if err := json.NewDecoder(c.Request().Body).Decode(&writes); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if err := ledger.Apply(writes...); err != nil {
+			return writeError(c, err)
+		}
+		return c.JSON(http.StatusOK, writes)
+	})
+
+	// Atomic batch of writes and deletes across buckets, committed in one
+	// block or not at all.
+	ec.POST(LedgerURL, func(c echo.Context) error {
+		ops := []blockchain.Op{}
+		if err := json.NewDecoder(c.Request().Body).Decode(&ops); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		for _, op := range ops {
+			if !ledger.CanWrite(op.Bucket) {
+				return echo.NewHTTPError(http.StatusForbidden, op.Bucket+": "+adminOnly)
+			}
+		}
+		res, err := ledger.Batch(ops)
+		if err != nil {
+			return writeError(c, err)
+		}
+		return c.JSON(http.StatusOK, res)
+	})
+
 	ec.GET(DNSURL, func(c echo.Context) error {
 		res := []apiTypes.DNS{}
 		for r, e := range ledger.CurrentData()[protocol.DNSKey] {
@@ -490,6 +740,10 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 		}
 
+		if !ledger.CanWrite(protocol.DNSKey) {
+			return echo.NewHTTPError(http.StatusForbidden, adminOnly)
+		}
+
 		entry := make(types.DNS)
 		for r, e := range d.Records {
 			entry[dns.Type(dns.StringToType[r])] = e
@@ -498,9 +752,111 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 		return c.JSON(http.StatusOK, announcing)
 	})
 
+	ec.GET(LeasesURL, func(c echo.Context) error {
+		res := []types.DHCPLease{}
+		for _, e := range ledger.CurrentData()[protocol.DHCPLeasesKey] {
+			var l types.DHCPLease
+			if e.Unmarshal(&l) == nil {
+				res = append(res, l)
+			}
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i].Address < res[j].Address })
+		return c.JSON(http.StatusOK, res)
+	})
+
+	// Release the address of a node that is gone: its lease and machine
+	// entry are deleted. A running node announces them again.
+	ec.DELETE(fmt.Sprintf("%s/:ip", LeasesURL), func(c echo.Context) error {
+		ip := c.Param("ip")
+		if net.ParseIP(ip) == nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid address")
+		}
+		ledger.AnnounceDeleteBucketKey(context.Background(), defaultInterval, timeout, protocol.DHCPLeasesKey, ip)
+		ledger.AnnounceDeleteBucketKey(context.Background(), defaultInterval, timeout, protocol.MachinesLedgerKey, ip)
+		return c.JSON(http.StatusOK, announcing)
+	})
+
+	ec.GET(ReservedURL, func(c echo.Context) error {
+		res := []types.DHCPReservation{}
+		for _, e := range ledger.CurrentData()[protocol.DHCPReservedKey] {
+			var r types.DHCPReservation
+			if e.Unmarshal(&r) == nil {
+				res = append(res, r)
+			}
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i].Address < res[j].Address })
+		return c.JSON(http.StatusOK, res)
+	})
+
+	// Reserve an address for a peer ID or a hostname
+	ec.POST(ReservedURL, func(c echo.Context) error {
+		r := new(types.DHCPReservation)
+		if err := c.Bind(r); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if net.ParseIP(r.Address) == nil || (r.PeerID == "") == (r.Hostname == "") {
+			return echo.NewHTTPError(http.StatusBadRequest, "a reservation takes an Address and either a PeerID or a Hostname")
+		}
+		if !ledger.CanWrite(protocol.DHCPReservedKey) {
+			return echo.NewHTTPError(http.StatusForbidden, adminOnly)
+		}
+		ledger.Persist(context.Background(), defaultInterval, timeout, protocol.DHCPReservedKey, r.Address, r)
+		return c.JSON(http.StatusOK, announcing)
+	})
+
+	ec.DELETE(fmt.Sprintf("%s/:ip", ReservedURL), func(c echo.Context) error {
+		if !ledger.CanWrite(protocol.DHCPReservedKey) {
+			return echo.NewHTTPError(http.StatusForbidden, adminOnly)
+		}
+		ledger.AnnounceDeleteBucketKey(context.Background(), defaultInterval, timeout, protocol.DHCPReservedKey, c.Param("ip"))
+		return c.JSON(http.StatusOK, announcing)
+	})
+
+	ec.GET(LimitsURL, func(c echo.Context) error {
+		res := []types.TrafficLimit{}
+		for _, e := range ledger.CurrentData()[protocol.TrafficLimitsKey] {
+			var l types.TrafficLimit
+			if e.Unmarshal(&l) == nil {
+				res = append(res, l)
+			}
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i].PeerID < res[j].PeerID })
+		return c.JSON(http.StatusOK, res)
+	})
+
+	// Limit the VPN traffic of a peer
+	ec.POST(LimitsURL, func(c echo.Context) error {
+		l := new(types.TrafficLimit)
+		if err := c.Bind(l); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if _, err := peer.Decode(l.PeerID); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "a traffic limit takes the PeerID of the limited peer")
+		}
+		if !ledger.AdminEnforced(protocol.TrafficLimitsKey) {
+			return echo.NewHTTPError(http.StatusForbidden, "traffic limits need ledger admin keys and ownership enforced, else any peer could change them")
+		}
+		if !ledger.CanWrite(protocol.TrafficLimitsKey) {
+			return echo.NewHTTPError(http.StatusForbidden, adminOnly)
+		}
+		ledger.Persist(context.Background(), defaultInterval, timeout, protocol.TrafficLimitsKey, l.PeerID, l)
+		return c.JSON(http.StatusOK, announcing)
+	})
+
+	ec.DELETE(fmt.Sprintf("%s/:peer", LimitsURL), func(c echo.Context) error {
+		if !ledger.CanWrite(protocol.TrafficLimitsKey) {
+			return echo.NewHTTPError(http.StatusForbidden, adminOnly)
+		}
+		ledger.AnnounceDeleteBucketKey(context.Background(), defaultInterval, timeout, protocol.TrafficLimitsKey, c.Param("peer"))
+		return c.JSON(http.StatusOK, announcing)
+	})
+
 	// Delete data from ledger
 	ec.DELETE(fmt.Sprintf("%s/:bucket", LedgerURL), func(c echo.Context) error {
 		bucket := c.Param("bucket")
+		if !ledger.CanWrite(bucket) {
+			return echo.NewHTTPError(http.StatusForbidden, adminOnly)
+		}
 
 		ledger.AnnounceDeleteBucket(context.Background(), defaultInterval, timeout, bucket)
 		return c.JSON(http.StatusOK, announcing)
@@ -509,6 +865,9 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 	ec.DELETE(fmt.Sprintf("%s/:bucket/:key", LedgerURL), func(c echo.Context) error {
 		bucket := c.Param("bucket")
 		key := c.Param("key")
+		if !ledger.CanWrite(bucket) {
+			return echo.NewHTTPError(http.StatusForbidden, adminOnly)
+		}
 
 		ledger.AnnounceDeleteBucketKey(context.Background(), defaultInterval, timeout, bucket, key)
 		return c.JSON(http.StatusOK, announcing)
@@ -543,3 +902,31 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 	}
 	return nil
 }
+
+// writeError maps a ledger write error to its HTTP status. A version
+// conflict is answered with 409 and the ConflictError as body, so clients can
+// re-read the key and retry.
+func writeError(c echo.Context, err error) error {
+	var conflict *blockchain.ConflictError
+	switch {
+	case errors.As(err, &conflict):
+		return c.JSON(http.StatusConflict, conflict)
+	case errors.Is(err, blockchain.ErrForbidden):
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	case errors.Is(err, blockchain.ErrUnversioned):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return err
+}
+
+// flushWriter sends every write to the client right away, so that a stream
+// can be followed live.
+type flushWriter struct {
+	*echo.Response
+}
+
+func (w flushWriter) Write(p []byte) (int, error) {
+	n, err := w.Response.Write(p)
+	w.Flush()
+	return n, err
+}
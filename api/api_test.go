@@ -16,6 +16,7 @@ package api_test
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -34,6 +35,9 @@ import (
 	"github.com/mudler/edgevpn/pkg/blockchain"
 	"github.com/mudler/edgevpn/pkg/logger"
 	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+	"github.com/mudler/edgevpn/pkg/vpn"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
@@ -154,6 +158,256 @@ var _ = Describe("API", func() {
 		})
 	})
 
+	Context("Ledger watch", func() {
+		It("streams ledger changes to the client", func() {
+			d, _ := ioutil.TempDir("", "xxx-watch")
+			defer os.RemoveAll(d)
+			socket := filepath.Join(d, "socket")
+
+			token := node.GenerateNewConnectionData().Base64()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			l := node.Logger(logger.New(log.LevelFatal))
+			e, _ := node.New(node.FromBase64(true, true, token, nil, nil), node.WithStore(&blockchain.MemoryStore{}), l)
+			e.Start(ctx)
+
+			go func() {
+				_ = API(ctx, "unix://"+socket, 10*time.Second, 20*time.Second, e, nil, false)
+			}()
+
+			c := client.NewClient(client.WithHost("unix://" + socket))
+			var events <-chan blockchain.Event
+			Eventually(func() (err error) {
+				events, err = c.Watch(ctx, "watched", "")
+				return
+			}, 5*time.Second, 100*time.Millisecond).ShouldNot(HaveOccurred())
+
+			ledger, _ := e.Ledger()
+			ledger.Add("watched", map[string]interface{}{"key": "value"})
+
+			var ev blockchain.Event
+			Eventually(events, 10*time.Second).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(blockchain.EventAdd))
+			Expect(ev.Key).To(Equal("key"))
+
+			var v string
+			Expect(ev.Value.Unmarshal(&v)).To(Succeed())
+			Expect(v).To(Equal("value"))
+		})
+	})
+
+	Context("Conditional writes", func() {
+		It("answers a stale version with a conflict", func() {
+			d, _ := ioutil.TempDir("", "xxx-cas")
+			defer os.RemoveAll(d)
+			socket := filepath.Join(d, "socket")
+
+			token := node.GenerateNewConnectionData().Base64()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			l := node.Logger(logger.New(log.LevelFatal))
+			e, _ := node.New(node.FromBase64(true, true, token, nil, nil), node.WithStore(&blockchain.MemoryStore{}), node.WithOwnership(blockchain.OwnershipEnforce, 0), l)
+			e.Start(ctx)
+
+			go func() {
+				_ = API(ctx, "unix://"+socket, 10*time.Second, 20*time.Second, e, nil, false)
+			}()
+
+			c := client.NewClient(client.WithHost("unix://" + socket))
+			var first blockchain.SignedData
+			Eventually(func() (err error) {
+				first, err = c.AddIf("cas", "key", 0, "a")
+				return
+			}, 5*time.Second, 100*time.Millisecond).ShouldNot(HaveOccurred())
+
+			_, err := c.AddIf("cas", "key", 0, "b")
+			Expect(errors.Is(err, blockchain.ErrConflict)).To(BeTrue())
+
+			res, err := c.Batch([]blockchain.Op{
+				{Bucket: "cas", Key: "key", Value: "b", ExpectedVersion: &first.Version},
+				{Bucket: "other", Key: "key", Value: "c"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(HaveLen(2))
+			Expect(res[0].Version).To(BeNumerically(">", first.Version))
+		})
+	})
+
+	Context("Ledger queries", func() {
+		It("filters and projects bucket values", func() {
+			d, _ := ioutil.TempDir("", "xxx-query")
+			defer os.RemoveAll(d)
+			socket := filepath.Join(d, "socket")
+
+			token := node.GenerateNewConnectionData().Base64()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			l := node.Logger(logger.New(log.LevelFatal))
+			e, _ := node.New(node.FromBase64(true, true, token, nil, nil), node.WithStore(&blockchain.MemoryStore{}), l)
+			e.Start(ctx)
+
+			go func() {
+				_ = API(ctx, "unix://"+socket, 10*time.Second, 20*time.Second, e, nil, false)
+			}()
+
+			ledger, _ := e.Ledger()
+			ledger.Add("hosts", map[string]interface{}{
+				"a": types.Machine{Hostname: "a", OS: "linux", Address: "10.1.0.1"},
+				"b": types.Machine{Hostname: "b", OS: "windows", Address: "10.1.0.2"},
+			})
+
+			c := client.NewClient(client.WithHost("unix://" + socket))
+			var res map[string]blockchain.Data
+			Eventually(func() (err error) {
+				res, err = c.Query("hosts", []string{"OS==linux"}, "Hostname", "Address")
+				return
+			}, 5*time.Second, 100*time.Millisecond).ShouldNot(HaveOccurred())
+			Expect(res).To(HaveLen(1))
+
+			m := map[string]string{}
+			Expect(res["a"].Unmarshal(&m)).To(Succeed())
+			Expect(m).To(Equal(map[string]string{"Hostname": "a", "Address": "10.1.0.1"}))
+
+			_, err := c.Query("hosts", []string{"OS"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Admin-signed writes", func() {
+		It("accepts trust zone writes only when admin-signed", func() {
+			d, _ := ioutil.TempDir("", "xxx-admin")
+			defer os.RemoveAll(d)
+			socket := filepath.Join(d, "socket")
+
+			priv, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+			Expect(err).ToNot(HaveOccurred())
+			admin, err := blockchain.NewSigner(priv)
+			Expect(err).ToNot(HaveOccurred())
+
+			token := node.GenerateNewConnectionData().Base64()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			l := node.Logger(logger.New(log.LevelFatal))
+			e, _ := node.New(node.FromBase64(true, true, token, nil, nil), node.WithStore(&blockchain.MemoryStore{}),
+				node.WithOwnership(blockchain.OwnershipEnforce, 0), node.WithLedgerAdmins(admin.ID()), l)
+			e.Start(ctx)
+
+			go func() {
+				_ = API(ctx, "unix://"+socket, 10*time.Second, 20*time.Second, e, nil, false)
+			}()
+
+			c := client.NewClient(client.WithHost("unix://" + socket))
+			w, err := blockchain.SignWrite(admin, protocol.TrustZoneAuthKey, "ops", "pubkey", false, 0, time.Now())
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(func() error {
+				return c.ApplySigned(w)
+			}, 5*time.Second, 100*time.Millisecond).ShouldNot(HaveOccurred())
+
+			ledger, _ := e.Ledger()
+			_, found := ledger.GetKey(protocol.TrustZoneAuthKey, "ops")
+			Expect(found).To(BeTrue())
+
+			Expect(c.Put(protocol.TrustZoneAuthKey, "rogue", "pubkey")).To(HaveOccurred())
+			forged, err := blockchain.SignWrite(admin, protocol.TrustZoneAuthKey, "ops", "other", false, 0, time.Now())
+			Expect(err).ToNot(HaveOccurred())
+			forged.Entry.Value = `"rogue"`
+			Expect(c.ApplySigned(forged)).To(HaveOccurred())
+		})
+	})
+
+	Context("DHCP", func() {
+		It("reserves addresses and releases them", func() {
+			d, _ := ioutil.TempDir("", "xxx-dhcp")
+			defer os.RemoveAll(d)
+			socket := filepath.Join(d, "socket")
+
+			c := client.NewClient(client.WithHost("unix://" + socket))
+
+			token := node.GenerateNewConnectionData().Base64()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			l := node.Logger(logger.New(log.LevelFatal))
+			e, _ := node.New(node.FromBase64(true, true, token, nil, nil), node.WithStore(&blockchain.MemoryStore{}), l)
+			e.Start(ctx)
+
+			go func() {
+				_ = API(ctx, "unix://"+socket, 1*time.Second, 20*time.Second, e, nil, false)
+			}()
+
+			Eventually(func() error {
+				return c.Reserve(types.DHCPReservation{Address: "10.1.0.20", Hostname: "printer"})
+			}, 10*time.Second, 1*time.Second).ShouldNot(HaveOccurred())
+			Expect(c.Reserve(types.DHCPReservation{Address: "10.1.0.21"})).To(HaveOccurred())
+
+			Eventually(c.Reservations, 10*time.Second, 1*time.Second).Should(Equal([]types.DHCPReservation{{Address: "10.1.0.20", Hostname: "printer"}}))
+
+			Expect(c.Unreserve("10.1.0.20")).To(Succeed())
+			Eventually(c.Reservations, 10*time.Second, 1*time.Second).Should(BeEmpty())
+
+			ledger, _ := e.Ledger()
+			ledger.Add(protocol.DHCPLeasesKey, map[string]interface{}{"10.1.0.30": types.DHCPLease{Address: "10.1.0.30", PeerID: "gone"}})
+			Eventually(c.Leases, 10*time.Second, 1*time.Second).Should(HaveLen(1))
+			Expect(c.Release("10.1.0.30")).To(Succeed())
+			Eventually(c.Leases, 10*time.Second, 1*time.Second).Should(BeEmpty())
+		})
+	})
+
+	Context("Traffic limits", func() {
+		It("sets and lifts the limits of peers", func() {
+			d, _ := ioutil.TempDir("", "xxx-limits")
+			defer os.RemoveAll(d)
+			socket := filepath.Join(d, "socket")
+
+			c := client.NewClient(client.WithHost("unix://" + socket))
+
+			token := node.GenerateNewConnectionData().Base64()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Limits are only taken from admins: the node is the admin
+			key, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+			Expect(err).ToNot(HaveOccurred())
+			admin, err := peer.IDFromPrivateKey(key)
+			Expect(err).ToNot(HaveOccurred())
+			raw, err := crypto.MarshalPrivateKey(key)
+			Expect(err).ToNot(HaveOccurred())
+
+			l := node.Logger(logger.New(log.LevelFatal))
+			e, _ := node.New(node.FromBase64(true, true, token, nil, nil), node.WithStore(&blockchain.MemoryStore{}),
+				node.WithPrivKey(raw), node.WithOwnership(blockchain.OwnershipEnforce, 0), node.WithLedgerAdmins(admin.String()), l)
+			e.Start(ctx)
+
+			go func() {
+				_ = API(ctx, "unix://"+socket, 1*time.Second, 20*time.Second, e, nil, false, WithVPNMetrics(vpn.NewMetrics()))
+			}()
+
+			priv, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+			Expect(err).ToNot(HaveOccurred())
+			pid, err := peer.IDFromPrivateKey(priv)
+			Expect(err).ToNot(HaveOccurred())
+			limit := types.TrafficLimit{PeerID: pid.String(), Rate: 1 << 20, Quota: 10 << 30}
+
+			Eventually(func() error {
+				return c.SetTrafficLimit(limit)
+			}, 10*time.Second, 1*time.Second).ShouldNot(HaveOccurred())
+			Expect(c.SetTrafficLimit(types.TrafficLimit{PeerID: "nope", Rate: 1})).To(HaveOccurred())
+			Eventually(c.TrafficLimits, 10*time.Second, 1*time.Second).Should(Equal([]types.TrafficLimit{limit}))
+
+			Expect(c.RemoveTrafficLimit(pid.String())).To(Succeed())
+			Eventually(c.TrafficLimits, 10*time.Second, 1*time.Second).Should(BeEmpty())
+
+			traffic, err := c.Traffic()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(traffic.Flows).To(BeEmpty())
+			Expect(traffic.Limit).To(BeNil())
+		})
+	})
+
 	Context("Bandwidth metrics", func() {
 		It("keys per-peer bandwidth by a base58 peer ID", func() {
 			d, _ := ioutil.TempDir("", "xxx-metrics")
@@ -222,5 +476,94 @@ var _ = Describe("API", func() {
 			Expect(err).ToNot(HaveOccurred())
 			Expect(protos).To(HaveKey("/edgevpn/0.1"))
 		})
+
+		It("serves the VPN queue metrics", func() {
+			d, _ := ioutil.TempDir("", "xxx-metrics")
+			defer os.RemoveAll(d)
+			socket := filepath.Join(d, "socket")
+
+			token := node.GenerateNewConnectionData().Base64()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			l := node.Logger(logger.New(log.LevelFatal))
+			e, _ := node.New(node.FromBase64(true, true, token, nil, nil), node.WithStore(&blockchain.MemoryStore{}), l)
+			e.Start(ctx)
+
+			go func() {
+				_ = API(ctx, "unix://"+socket, 10*time.Second, 20*time.Second, e, nil, false, WithVPNMetrics(vpn.NewMetrics()))
+			}()
+
+			httpc := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			}}
+			out := map[string]json.RawMessage{}
+			Eventually(func() error {
+				resp, err := httpc.Get("http://unix/api/metrics/vpn")
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				return json.NewDecoder(resp.Body).Decode(&out)
+			}, 10*time.Second, 200*time.Millisecond).ShouldNot(HaveOccurred())
+			Expect(out).To(HaveKey("Peers"))
+			Expect(out).To(HaveKey("Dropped"))
+
+			resp, err := httpc.Get("http://unix/metrics")
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("streams VPN packet captures", func() {
+			d, _ := ioutil.TempDir("", "xxx-capture")
+			defer os.RemoveAll(d)
+			socket := filepath.Join(d, "socket")
+
+			token := node.GenerateNewConnectionData().Base64()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			l := node.Logger(logger.New(log.LevelFatal))
+			e, _ := node.New(node.FromBase64(true, true, token, nil, nil), node.WithStore(&blockchain.MemoryStore{}), l)
+			e.Start(ctx)
+
+			go func() {
+				_ = API(ctx, "unix://"+socket, 10*time.Second, 20*time.Second, e, nil, false, WithVPNCapture(vpn.NewCapture()))
+			}()
+
+			httpc := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			}}
+			var resp *http.Response
+			Eventually(func() (err error) {
+				resp, err = httpc.Get("http://unix/api/vpn/capture?filter=tcp+port+22&duration=2s")
+				return err
+			}, 10*time.Second, 200*time.Millisecond).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Content-Type")).To(Equal("application/vnd.tcpdump.pcap"))
+
+			busy, err := httpc.Get("http://unix/api/vpn/capture")
+			Expect(err).ToNot(HaveOccurred())
+			busy.Body.Close()
+			Expect(busy.StatusCode).To(Equal(http.StatusConflict))
+
+			// Nothing crosses the VPN here: the capture is the pcap header
+			pcap, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pcap).To(HaveLen(24))
+
+			for _, q := range []string{"filter=port+http", "duration=1h", "bytes=2000000000"} {
+				bad, err := httpc.Get("http://unix/api/vpn/capture?" + q)
+				Expect(err).ToNot(HaveOccurred())
+				bad.Body.Close()
+				Expect(bad.StatusCode).To(Equal(http.StatusBadRequest), q)
+			}
+		})
 	})
 })
@@ -14,19 +14,25 @@ limitations under the License.
 package client
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/mudler/edgevpn/api"
 	"github.com/mudler/edgevpn/pkg/blockchain"
 	"github.com/mudler/edgevpn/pkg/types"
+	"github.com/mudler/edgevpn/pkg/vpn"
 )
 
 type (
@@ -109,6 +115,46 @@ func (c *Client) do(method, endpoint string, params map[string]string) (*http.Re
 	return c.httpClient.Do(req)
 }
 
+// post sends body as JSON and decodes a 200 answer into out. A 409 answer is
+// returned as a *blockchain.ConflictError.
+func (c *Client) post(endpoint string, params map[string]string, body, out interface{}) error {
+	dat, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s%s", c.host, endpoint), bytes.NewReader(dat))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	q := req.URL.Query()
+	for key, val := range params {
+		q.Set(key, val)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resp, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return json.Unmarshal(resp, out)
+	case http.StatusConflict:
+		conflict := &blockchain.ConflictError{}
+		if err := json.Unmarshal(resp, conflict); err != nil {
+			return fmt.Errorf("%w: %s", blockchain.ErrConflict, string(resp))
+		}
+		return conflict
+	}
+	return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(resp)))
+}
+
 // Get methods (Services, Users, Files, Ledger, Blockchain, Machines)
 func (c *Client) Services() (resp []types.Service, err error) {
 	res, err := c.do(http.MethodGet, api.ServiceURL, nil)
@@ -206,6 +252,118 @@ func (c *Client) Blockchain() (data blockchain.Block, err error) {
 	return
 }
 
+// History returns the revisions of bucket/key recorded in the ledger block
+// history. Empty bucket or key match everything.
+func (c *Client) History(bucket, key string) (data []blockchain.Change, err error) {
+	params := map[string]string{}
+	if bucket != "" {
+		params["bucket"] = bucket
+	}
+	if key != "" {
+		params["key"] = key
+	}
+	res, err := c.do(http.MethodGet, api.HistoryURL, params)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return data, err
+	}
+	if err = json.Unmarshal(body, &data); err != nil {
+		return data, err
+	}
+	return
+}
+
+// Watch streams the ledger changes to bucket (every bucket if empty) whose
+// key starts with prefix. The channel is closed when ctx is done or the
+// server ends the stream; a client timeout set with WithTimeout does not
+// apply to it.
+func (c *Client) Watch(ctx context.Context, bucket, prefix string) (<-chan blockchain.Event, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s%s", c.host, api.WatchURL), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "text/event-stream")
+	q := req.URL.Query()
+	q.Set("bucket", bucket)
+	q.Set("prefix", prefix)
+	req.URL.RawQuery = q.Encode()
+
+	hc := *c.httpClient
+	hc.Timeout = 0
+	res, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("watch failed: %s", res.Status)
+	}
+
+	events := make(chan blockchain.Event)
+	go func() {
+		defer close(events)
+		defer res.Body.Close()
+		scanner := bufio.NewScanner(res.Body)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			e := blockchain.Event{}
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				continue
+			}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Capture writes to w a pcap of the VPN packets of the node matching
+// o.Filter, until a limit of o is reached or ctx is done. As for Watch, a
+// client timeout does not apply.
+func (c *Client) Capture(ctx context.Context, w io.Writer, o vpn.CaptureOptions) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s%s", c.host, api.CaptureURL), nil)
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	q.Set("filter", o.Filter)
+	if o.Duration > 0 {
+		q.Set("duration", o.Duration.String())
+	}
+	if o.MaxBytes > 0 {
+		q.Set("bytes", strconv.FormatInt(o.MaxBytes, 10))
+	}
+	if o.MaxPackets > 0 {
+		q.Set("packets", strconv.Itoa(o.MaxPackets))
+	}
+	req.URL.RawQuery = q.Encode()
+
+	hc := *c.httpClient
+	hc.Timeout = 0
+	res, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
 func (c *Client) Machines() (resp []types.Machine, err error) {
 	res, err := c.do(http.MethodGet, api.MachineURL, nil)
 	if err != nil {
@@ -222,6 +380,129 @@ func (c *Client) Machines() (resp []types.Machine, err error) {
 	return
 }
 
+// Leases returns the DHCP leases of the network.
+func (c *Client) Leases() (resp []types.DHCPLease, err error) {
+	res, err := c.do(http.MethodGet, api.LeasesURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	err = json.Unmarshal(body, &resp)
+	return
+}
+
+// Reservations returns the addresses reserved to DHCP peers or hostnames.
+func (c *Client) Reservations() (resp []types.DHCPReservation, err error) {
+	res, err := c.do(http.MethodGet, api.ReservedURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	err = json.Unmarshal(body, &resp)
+	return
+}
+
+// Reserve reserves r.Address to the peer r.PeerID, or to the machine named
+// r.Hostname.
+func (c *Client) Reserve(r types.DHCPReservation) error {
+	s := struct{ State string }{}
+	if err := c.post(api.ReservedURL, nil, r, &s); err != nil {
+		return err
+	}
+	if s.State != "Announcing" {
+		return fmt.Errorf("unexpected state '%s'", s.State)
+	}
+	return nil
+}
+
+// Unreserve removes the reservation of ip.
+func (c *Client) Unreserve(ip string) error {
+	return c.announceDelete(fmt.Sprintf("%s/%s", api.ReservedURL, ip))
+}
+
+// Release frees the address ip of a node that is gone.
+func (c *Client) Release(ip string) error {
+	return c.announceDelete(fmt.Sprintf("%s/%s", api.LeasesURL, ip))
+}
+
+// Traffic returns the VPN traffic of the node and its limit.
+func (c *Client) Traffic() (resp vpn.TrafficSnapshot, err error) {
+	res, err := c.do(http.MethodGet, api.MetricsURL+"/vpn/traffic", nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	err = json.Unmarshal(body, &resp)
+	return
+}
+
+// TrafficLimits returns the limits set on the VPN traffic of the peers.
+func (c *Client) TrafficLimits() (resp []types.TrafficLimit, err error) {
+	res, err := c.do(http.MethodGet, api.LimitsURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	err = json.Unmarshal(body, &resp)
+	return
+}
+
+// SetTrafficLimit limits the VPN traffic of the peer l.PeerID.
+func (c *Client) SetTrafficLimit(l types.TrafficLimit) error {
+	s := struct{ State string }{}
+	if err := c.post(api.LimitsURL, nil, l, &s); err != nil {
+		return err
+	}
+	if s.State != "Announcing" {
+		return fmt.Errorf("unexpected state '%s'", s.State)
+	}
+	return nil
+}
+
+// RemoveTrafficLimit lifts the limit on the VPN traffic of the peer.
+func (c *Client) RemoveTrafficLimit(peerID string) error {
+	return c.announceDelete(fmt.Sprintf("%s/%s", api.LimitsURL, peerID))
+}
+
+func (c *Client) announceDelete(endpoint string) error {
+	s := struct{ State string }{}
+	res, err := c.do(http.MethodDelete, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	if err = json.Unmarshal(body, &s); err != nil {
+		return err
+	}
+	if s.State != "Announcing" {
+		return fmt.Errorf("unexpected state '%s'", s.State)
+	}
+	return nil
+}
+
 func (c *Client) GetBucket(b string) (resp map[string]blockchain.Data, err error) {
 	res, err := c.do(http.MethodGet, fmt.Sprintf("%s/%s", api.LedgerURL, b), nil)
 	if err != nil {
@@ -238,6 +519,47 @@ func (c *Client) GetBucket(b string) (resp map[string]blockchain.Data, err error
 	return
 }
 
+// ApplySigned submits writes signed elsewhere (see blockchain.SignWrite).
+// They are committed together or not at all; a write that peers would reject
+// makes the whole call fail.
+func (c *Client) ApplySigned(writes ...blockchain.SignedWrite) error {
+	return c.post(api.SignedURL, nil, writes, &[]blockchain.SignedWrite{})
+}
+
+// Query returns the values of the entries of bucket matching every filter
+// (e.g. "OS==linux", see blockchain.ParseFilter), reduced to fields if any
+// are given. Values are returned as JSON, ready for Data.Unmarshal.
+func (c *Client) Query(bucket string, filters []string, fields ...string) (resp map[string]blockchain.Data, err error) {
+	q := url.Values{}
+	for _, f := range filters {
+		q.Add("filter", f)
+	}
+	if len(fields) > 0 {
+		q.Set("fields", strings.Join(fields, ","))
+	}
+	res, err := c.do(http.MethodGet, fmt.Sprintf("%s/%s?%s", api.LedgerURL, bucket, q.Encode()), nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	raw := map[string]json.RawMessage{}
+	if err = json.Unmarshal(body, &raw); err != nil {
+		return resp, err
+	}
+	resp = map[string]blockchain.Data{}
+	for k, v := range raw {
+		resp[k] = blockchain.Data(v)
+	}
+	return
+}
+
 func (c *Client) GetBucketKeys(b string) (resp []string, err error) {
 	d, err := c.GetBucket(b)
 	if err != nil {
@@ -288,6 +610,22 @@ func (c *Client) GetBucketKey(b, k string) (resp blockchain.Data, err error) {
 	return
 }
 
+// AddIf writes v at bucket/key if the key's current version is
+// expectedVersion (0: the key must not exist), and returns the entry written.
+// On a version mismatch the error is a *blockchain.ConflictError, which
+// matches blockchain.ErrConflict.
+func (c *Client) AddIf(b, k string, expectedVersion uint64, v interface{}) (data blockchain.SignedData, err error) {
+	err = c.post(fmt.Sprintf("%s/%s/%s", api.LedgerURL, b, k), map[string]string{"version": fmt.Sprint(expectedVersion)}, v, &data)
+	return
+}
+
+// Batch applies ops atomically in a single ledger block, and returns the
+// resulting entries in the order of ops.
+func (c *Client) Batch(ops []blockchain.Op) (data []blockchain.SignedData, err error) {
+	err = c.post(api.LedgerURL, nil, ops, &data)
+	return
+}
+
 func (c *Client) Put(b, k string, v interface{}) (err error) {
 	s := struct{ State string }{}
 
@@ -0,0 +1,101 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/mudler/edgevpn/pkg/vpn"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	vpnPacketsDesc = prometheus.NewDesc("edgevpn_vpn_packets_total",
+		"VPN packets sent and received, by source and destination address. Both are empty for the flows not counted one by one.",
+		[]string{"source", "destination"}, nil)
+	vpnBytesDesc = prometheus.NewDesc("edgevpn_vpn_bytes_total",
+		"VPN bytes sent and received, by source and destination address. Both are empty for the flows not counted one by one.",
+		[]string{"source", "destination"}, nil)
+	vpnPeerSentDesc = prometheus.NewDesc("edgevpn_vpn_peer_sent_packets_total",
+		"VPN packets sent to a peer.",
+		[]string{"peer"}, nil)
+	vpnPeerDroppedDesc = prometheus.NewDesc("edgevpn_vpn_peer_dropped_packets_total",
+		"VPN packets to a peer dropped because its queue was full or it could not be reached.",
+		[]string{"peer"}, nil)
+	vpnLimitDroppedDesc = prometheus.NewDesc("edgevpn_vpn_limit_dropped_packets_total",
+		"VPN packets dropped by the traffic limit of the node.",
+		nil, nil)
+	vpnQuotaDesc = prometheus.NewDesc("edgevpn_vpn_quota_bytes",
+		"Monthly VPN traffic quota of the node.",
+		nil, nil)
+	vpnQuotaUsedDesc = prometheus.NewDesc("edgevpn_vpn_quota_used_bytes",
+		"VPN traffic of the node this month, counted against its quota.",
+		nil, nil)
+	vpnClassPacketsDesc = prometheus.NewDesc("edgevpn_vpn_class_packets_total",
+		"VPN packets queued to be sent, by QoS class.",
+		[]string{"class"}, nil)
+	vpnClassBytesDesc = prometheus.NewDesc("edgevpn_vpn_class_bytes_total",
+		"VPN bytes queued to be sent, by QoS class.",
+		[]string{"class"}, nil)
+	vpnClassDroppedDesc = prometheus.NewDesc("edgevpn_vpn_class_dropped_packets_total",
+		"VPN packets of a QoS class dropped over its rate (shaped) or because the queue of their peer was full (queue).",
+		[]string{"class", "reason"}, nil)
+)
+
+// vpnCollector exports the VPN metrics to Prometheus.
+type vpnCollector struct {
+	metrics *vpn.Metrics
+}
+
+func (c vpnCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{vpnPacketsDesc, vpnBytesDesc, vpnPeerSentDesc, vpnPeerDroppedDesc, vpnLimitDroppedDesc, vpnQuotaDesc, vpnQuotaUsedDesc, vpnClassPacketsDesc, vpnClassBytesDesc, vpnClassDroppedDesc} {
+		ch <- d
+	}
+}
+
+func (c vpnCollector) Collect(ch chan<- prometheus.Metric) {
+	traffic := c.metrics.Traffic()
+	for _, f := range traffic.Flows {
+		ch <- prometheus.MustNewConstMetric(vpnPacketsDesc, prometheus.CounterValue, float64(f.Packets), f.Source, f.Destination)
+		ch <- prometheus.MustNewConstMetric(vpnBytesDesc, prometheus.CounterValue, float64(f.Bytes), f.Source, f.Destination)
+	}
+	snapshot := c.metrics.Snapshot()
+	for name, p := range snapshot.Peers {
+		ch <- prometheus.MustNewConstMetric(vpnPeerSentDesc, prometheus.CounterValue, float64(p.Sent), name)
+		ch <- prometheus.MustNewConstMetric(vpnPeerDroppedDesc, prometheus.CounterValue, float64(p.Dropped), name)
+	}
+	for _, q := range snapshot.Classes {
+		ch <- prometheus.MustNewConstMetric(vpnClassPacketsDesc, prometheus.CounterValue, float64(q.Packets), q.Name)
+		ch <- prometheus.MustNewConstMetric(vpnClassBytesDesc, prometheus.CounterValue, float64(q.Bytes), q.Name)
+		ch <- prometheus.MustNewConstMetric(vpnClassDroppedDesc, prometheus.CounterValue, float64(q.Shaped), q.Name, "shaped")
+		ch <- prometheus.MustNewConstMetric(vpnClassDroppedDesc, prometheus.CounterValue, float64(q.Dropped), q.Name, "queue")
+	}
+	if l := traffic.Limit; l != nil {
+		ch <- prometheus.MustNewConstMetric(vpnLimitDroppedDesc, prometheus.CounterValue, float64(l.Dropped))
+		if l.Quota > 0 {
+			ch <- prometheus.MustNewConstMetric(vpnQuotaDesc, prometheus.GaugeValue, float64(l.Quota))
+			ch <- prometheus.MustNewConstMetric(vpnQuotaUsedDesc, prometheus.GaugeValue, float64(l.Used))
+		}
+	}
+}
+
+// prometheusHandler serves the VPN metrics in the Prometheus format.
+func prometheusHandler(m *vpn.Metrics) http.Handler {
+	r := prometheus.NewRegistry()
+	r.MustRegister(vpnCollector{metrics: m})
+	return promhttp.HandlerFor(r, promhttp.HandlerOpts{})
+}
@@ -30,6 +30,7 @@ func NewApp(version string) *cli.App {
 			FileSend(),
 			DNS(),
 			Peergate(),
+			Ledger(),
 		},
 		Action: Main(),
 	}
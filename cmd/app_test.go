@@ -8,7 +8,7 @@ import (
 
 func TestNewAppHasAllCommands(t *testing.T) {
 	app := cmd.NewApp("v0.0.0-test")
-	want := []string{"start", "api", "service-add", "service-connect", "file-receive", "proxy", "file-send", "dns", "peergater"}
+	want := []string{"start", "api", "service-add", "service-connect", "file-receive", "proxy", "file-send", "dns", "peergater", "ledger"}
 	got := map[string]bool{}
 	for _, c := range app.Commands {
 		got[c.Name] = true
@@ -0,0 +1,408 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/mudler/edgevpn/api/client"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/urfave/cli/v2"
+)
+
+// openStateDir opens an existing ledger state directory, whatever its store.
+// It must not be in use by a running node. The returned function releases it.
+func openStateDir(dir string) (blockchain.PersistentStore, func(), error) {
+	if dir == "" {
+		return nil, nil, errors.New("a ledger state directory is required")
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, nil, err
+	}
+	return openStore(dir, "")
+}
+
+func openStore(dir, backend string) (blockchain.PersistentStore, func(), error) {
+	s, err := blockchain.OpenStateDir(dir, blockchain.StateOptions{Backend: backend})
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, func() {
+		if c, ok := s.(io.Closer); ok {
+			c.Close()
+		}
+	}, nil
+}
+
+func Ledger() *cli.Command {
+	return &cli.Command{
+		Name:        "ledger",
+		Usage:       "ledger inspect|compact|export|import|migrate|admin-key|sign|submit",
+		Description: `Offline utilities for a ledger state directory (--ledger-state). Stop the node using the directory before changing it.`,
+		Subcommands: cli.Commands{
+			{
+				Name:      "inspect",
+				Usage:     "Show the blocks held in a ledger state directory",
+				ArgsUsage: "<state dir>",
+				Action: func(c *cli.Context) error {
+					s, done, err := openStateDir(c.Args().First())
+					if err != nil {
+						return err
+					}
+					defer done()
+					info := s.Inspect()
+					fmt.Printf("Blocks: %d (%d to %d)\n", info.Blocks, info.First, info.Last)
+					fmt.Printf("Last block valid: %t\n", info.LastValid)
+					if len(info.Breaks) == 0 {
+						fmt.Println("Chain: continuous")
+					} else {
+						fmt.Printf("Chain: breaks at %v\n", info.Breaks)
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "compact",
+				Usage:     "Keep only the last blocks of a ledger state directory",
+				ArgsUsage: "<state dir>",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "keep",
+						Usage: "Number of blocks to keep",
+						Value: 100,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					s, done, err := openStateDir(c.Args().First())
+					if err != nil {
+						return err
+					}
+					defer done()
+					res, err := s.Compact(c.Int("keep"))
+					if err != nil {
+						return err
+					}
+					fmt.Printf("Kept %d blocks (%d to %d), removed %d\n", res.Kept, res.Checkpoint, res.Last, res.Removed)
+					if res.Truncated {
+						fmt.Println("The chain was not continuous: kept only the blocks after the last break")
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "export",
+				Usage:     "Dump the current ledger state, signatures included, to a JSON file",
+				ArgsUsage: "[<state dir>]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "Output file (stdout if empty). A .gz suffix implies --gzip",
+					},
+					&cli.BoolFlag{
+						Name:  "gzip",
+						Usage: "Compress the output",
+					},
+					&cli.StringFlag{
+						Name:  "api",
+						Usage: "Export from a running node API (e.g. http://127.0.0.1:8080 or unix:///path) instead of a state directory",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					var snap blockchain.Snapshot
+					if api := c.String("api"); api != "" {
+						b, err := client.NewClient(client.WithHost(api)).Blockchain()
+						if err != nil {
+							return err
+						}
+						snap = blockchain.Snapshot{Version: blockchain.SnapshotVersion, Index: b.Index, Hash: b.Hash, Storage: b.Storage}
+					} else {
+						s, done, err := openStateDir(c.Args().First())
+						if err != nil {
+							return err
+						}
+						defer done()
+						snap = blockchain.New(io.Discard, s).Snapshot()
+					}
+
+					var w io.Writer = os.Stdout
+					if out := c.String("output"); out != "" {
+						f, err := os.Create(out)
+						if err != nil {
+							return err
+						}
+						defer f.Close()
+						w = f
+					}
+					return blockchain.WriteSnapshot(w, snap, c.Bool("gzip") || strings.HasSuffix(c.String("output"), ".gz"))
+				},
+			},
+			{
+				Name:      "import",
+				Usage:     "Seed a ledger state directory from an exported file, verifying every entry",
+				ArgsUsage: "<file> <state dir>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "store",
+						Usage: "Store to create the state directory with (disk or bolt); an existing directory keeps its own",
+					},
+					&cli.StringFlag{
+						Name:  "ownership",
+						Usage: "Ownership mode of the network (enforce, observe or off): unless off, entries are checked against the bucket policies as peers would",
+						Value: "enforce",
+					},
+					&cli.StringSliceFlag{
+						Name:  "admin",
+						Usage: "Admin key ID of the network, next to the ledger_admins of its config, so that privileged buckets only take their writes",
+					},
+					&cli.StringFlag{
+						Name:    "config",
+						Usage:   "Network config file, whose ledger_policies and ledger_admins the entries are checked against",
+						EnvVars: []string{"EDGEVPNCONFIG"},
+					},
+					&cli.StringFlag{
+						Name:    "token",
+						Usage:   "Network token, in place of a config file",
+						EnvVars: []string{"EDGEVPNTOKEN"},
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 2 {
+						return errors.New("usage: edgevpn ledger import <file> <state dir>")
+					}
+					f, err := os.Open(c.Args().Get(0))
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+					snap, err := blockchain.ReadSnapshot(f)
+					if err != nil {
+						return err
+					}
+					mode, err := blockchain.ParseOwnershipMode(c.String("ownership"))
+					if err != nil {
+						return err
+					}
+					network := &node.Config{}
+					if err := network.Apply(
+						node.FromYaml(false, false, c.String("config"), nil, nil),
+						node.FromBase64(false, false, c.String("token"), nil, nil),
+					); err != nil {
+						return err
+					}
+					admins := append(network.LedgerAdmins, c.StringSlice("admin")...)
+					if err := blockchain.ValidateAdminKeys(admins); err != nil {
+						return err
+					}
+					opts := []blockchain.LedgerOption{blockchain.WithAdminKeys(admins...)}
+					if mode != blockchain.OwnershipOff {
+						registry, err := blockchain.DefaultRegistry(node.DefaultOwnershipTTL).Extend(network.LedgerPolicies)
+						if err != nil {
+							return fmt.Errorf("invalid ledger policies: %w", err)
+						}
+						opts = append(opts, blockchain.WithOwnership(mode, registry, node.DefaultOwnershipTTL))
+					}
+
+					s, done, err := openStore(c.Args().Get(1), c.String("store"))
+					if err != nil {
+						return err
+					}
+					defer done()
+					res := blockchain.New(io.Discard, s, opts...).Import(snap)
+
+					fmt.Printf("Imported %d entries (%d unsigned), skipped %d older than the ledger\n", res.Imported, res.Unsigned, res.Stale)
+					for _, r := range res.Rejected {
+						fmt.Printf("Rejected %s\n", r)
+					}
+					if len(res.Rejected) > 0 {
+						return fmt.Errorf("%d entries were rejected", len(res.Rejected))
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "migrate",
+				Usage:     "Move a disk ledger state directory to the bolt store",
+				ArgsUsage: "<state dir>",
+				Action: func(c *cli.Context) error {
+					dir := c.Args().First()
+					if _, err := os.Stat(filepath.Join(dir, blockchain.BoltFile)); err == nil {
+						return fmt.Errorf("%s already holds a bolt store", dir)
+					}
+					if _, err := os.Stat(dir); err != nil {
+						return err
+					}
+					s, done, err := openStore(dir, blockchain.StoreBolt)
+					if err != nil {
+						return err
+					}
+					defer done()
+					info := s.Inspect()
+					fmt.Printf("Migrated %d blocks (%d to %d) to %s\n", info.Blocks, info.First, info.Last, filepath.Join(dir, blockchain.BoltFile))
+					fmt.Println("Start the node with --ledger-store bolt; the diskv block files can be removed once it runs fine")
+					return nil
+				},
+			},
+			{
+				Name:      "admin-key",
+				Usage:     "Create a ledger admin key, or show the ID of an existing one",
+				ArgsUsage: "<key file>",
+				Description: `Prints the admin ID to list under ledger_admins in the network config.
+Keep the key file offline: it is only needed to sign writes with "edgevpn ledger sign".`,
+				Action: func(c *cli.Context) error {
+					file := c.Args().First()
+					if file == "" {
+						return errors.New("a key file is required")
+					}
+					var signer blockchain.Signer
+					if _, err := os.Stat(file); err == nil {
+						s, err := readAdminKey(file)
+						if err != nil {
+							return err
+						}
+						signer = s
+					} else {
+						priv, err := node.GenPrivKey(0)
+						if err != nil {
+							return err
+						}
+						dat, err := crypto.MarshalPrivateKey(priv)
+						if err != nil {
+							return err
+						}
+						if err := os.WriteFile(file, dat, 0600); err != nil {
+							return err
+						}
+						if signer, err = blockchain.NewSigner(priv); err != nil {
+							return err
+						}
+					}
+					fmt.Println(signer.ID())
+					return nil
+				},
+			},
+			{
+				Name:      "sign",
+				Usage:     "Sign a ledger write with an admin key, to submit it later",
+				ArgsUsage: "<bucket> <key> [<value>]",
+				Description: `The value is stored as JSON if it parses as such, as a string otherwise.
+Signed writes accumulate in --output, so several can be submitted together.`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "key",
+						Usage:    "Admin key file (see edgevpn ledger admin-key)",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "File to add the signed write to (stdout if empty)",
+					},
+					&cli.BoolFlag{
+						Name:  "delete",
+						Usage: "Sign the deletion of the key instead",
+					},
+					&cli.Uint64Flag{
+						Name:  "version",
+						Usage: "Entry version, higher than the current one (0: derived from the clock)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					args := c.Args()
+					if args.Len() < 2 || (args.Len() < 3 && !c.Bool("delete")) {
+						return errors.New("usage: edgevpn ledger sign --key <file> <bucket> <key> <value>")
+					}
+					signer, err := readAdminKey(c.String("key"))
+					if err != nil {
+						return err
+					}
+
+					var value interface{} = args.Get(2)
+					if err := json.Unmarshal([]byte(args.Get(2)), &value); err != nil {
+						value = args.Get(2)
+					}
+					w, err := blockchain.SignWrite(signer, args.Get(0), args.Get(1), value, c.Bool("delete"), c.Uint64("version"), time.Now())
+					if err != nil {
+						return err
+					}
+
+					writes := []blockchain.SignedWrite{}
+					out := c.String("output")
+					if out != "" {
+						if dat, err := os.ReadFile(out); err == nil {
+							if err := json.Unmarshal(dat, &writes); err != nil {
+								return fmt.Errorf("%s: %w", out, err)
+							}
+						}
+					}
+					dat, err := json.MarshalIndent(append(writes, w), "", "  ")
+					if err != nil {
+						return err
+					}
+					if out == "" {
+						fmt.Println(string(dat))
+						return nil
+					}
+					return os.WriteFile(out, dat, 0644)
+				},
+			},
+			{
+				Name:      "submit",
+				Usage:     "Submit signed writes to a running node",
+				ArgsUsage: "<file>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "api",
+						Usage:    "Node API (e.g. http://127.0.0.1:8080 or unix:///path)",
+						Required: true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					dat, err := os.ReadFile(c.Args().First())
+					if err != nil {
+						return err
+					}
+					writes := []blockchain.SignedWrite{}
+					if err := json.Unmarshal(dat, &writes); err != nil {
+						return err
+					}
+					if err := client.NewClient(client.WithHost(c.String("api"))).ApplySigned(writes...); err != nil {
+						return err
+					}
+					fmt.Printf("Submitted %d writes\n", len(writes))
+					return nil
+				},
+			},
+		},
+	}
+}
+
+func readAdminKey(file string) (blockchain.Signer, error) {
+	dat, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := crypto.UnmarshalPrivateKey(dat)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return blockchain.NewSigner(priv)
+}
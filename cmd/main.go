@@ -73,11 +73,22 @@ func MainFlags() []cli.Flag {
 			Usage:   "API listen address. Accepts a TCP host:port or a unix socket path with the 'unix://' prefix (e.g. unix:///run/edgevpn.sock). Socket mode defaults to 0660 and can be overridden via APILISTENUNIXMODE.",
 			EnvVars: []string{"APILISTEN"},
 		},
+		&cli.BoolFlag{
+			Name:    "capture",
+			Usage:   "Lets the API clients capture the VPN packets (pcap) on /api/vpn/capture, with --api",
+			EnvVars: []string{"EDGEVPNCAPTURE"},
+		},
 		&cli.BoolFlag{
 			Name:    "dhcp",
 			Usage:   "Enables p2p ip negotiation (experimental)",
 			EnvVars: []string{"DHCP"},
 		},
+		&cli.StringFlag{
+			Name:    "dhcp-allocator",
+			Usage:   "How --dhcp picks addresses: 'leader' (elected among the nodes without one) or 'hash' (derived from the peer ID, no leader)",
+			Value:   "leader",
+			EnvVars: []string{"DHCPALLOCATOR"},
+		},
 		&cli.BoolFlag{
 			Name:    "transient-conn",
 			Usage:   "Allow transient connections",
@@ -86,7 +97,7 @@ func MainFlags() []cli.Flag {
 		&cli.StringFlag{
 			Name:    "lease-dir",
 			Value:   filepath.Join(basedir, ".edgevpn", "leases"),
-			Usage:   "DHCP leases directory",
+			Usage:   "Directory of the DHCP leases, and of the VPN traffic counted against the quota of the node",
 			EnvVars: []string{"DHCPLEASEDIR"},
 		},
 		&cli.StringFlag{
@@ -112,6 +123,16 @@ func MainFlags() []cli.Flag {
 			Usage:   "Enables nodes for egress",
 			EnvVars: []string{"EGRESS"},
 		},
+		&cli.BoolFlag{
+			Name:    "exit-node",
+			Usage:   "Offers the node as exit for the VPN traffic of the peers, NATed out of the host",
+			EnvVars: []string{"EXITNODE"},
+		},
+		&cli.StringFlag{
+			Name:    "exit-via",
+			Usage:   "Sends all the non-VPN traffic through an exit node: its peer ID, or 'auto' for any live one",
+			EnvVars: []string{"EXITVIA"},
+		},
 		&cli.IntFlag{
 			Name:    "egress-announce-time",
 			Usage:   "Egress announce time (s)",
@@ -135,11 +156,95 @@ func MainFlags() []cli.Flag {
 			Usage:   "Sends all packets to this node",
 			EnvVars: []string{"ROUTER"},
 		},
+		&cli.StringSliceFlag{
+			Name:    "advertise-route",
+			Usage:   "Subnet (CIDR) reachable through this node, advertised to the peers. Forwarding must be enabled on the host",
+			EnvVars: []string{"EDGEVPNADVERTISEROUTES"},
+		},
+		&cli.BoolFlag{
+			Name:    "ipv6",
+			Usage:   "Gives the node an IPv6 address too, derived from its peer ID",
+			EnvVars: []string{"EDGEVPNIPV6"},
+		},
+		&cli.StringFlag{
+			Name:    "ipv6-prefix",
+			Usage:   "IPv6 prefix (/64 or larger) the addresses are taken from with --ipv6. Must be the same on every node",
+			Value:   vpn.DefaultIPv6Prefix,
+			EnvVars: []string{"EDGEVPNIPV6PREFIX"},
+		},
 		&cli.StringFlag{
 			Name:    "interface",
 			Usage:   "Interface name",
 			Value:   "edgevpn0",
 			EnvVars: []string{"IFACE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "firewall-rule",
+			Usage:   "VPN packet filter rule, first match wins: allow|deny [from <ip|cidr>] [to <ip|cidr>] [proto tcp|udp|icmp] [port <n>[-<m>]]",
+			EnvVars: []string{"EDGEVPNFIREWALLRULES"},
+		},
+		&cli.StringFlag{
+			Name:    "firewall-default",
+			Usage:   "Action for VPN packets no firewall rule matches (allow or deny)",
+			Value:   "allow",
+			EnvVars: []string{"EDGEVPNFIREWALLDEFAULT"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "qos-class",
+			Usage:   "VPN traffic class, first match wins, higher priorities are sent first: <name> [priority <0-7>] [dscp <0-63|ef|csN|afXY>] [proto tcp|udp|icmp] [port <n>[-<m>]] [rate <bytes/s>] [burst <bytes>]",
+			EnvVars: []string{"EDGEVPNQOSCLASSES"},
+		},
+		&cli.BoolFlag{
+			Name:    "mss-clamp",
+			Usage:   "Lowers the MSS of the TCP connections over the VPN to fit the MTU, or the MTU of the peer with --mtu-exchange",
+			Value:   true,
+			EnvVars: []string{"EDGEVPNMSSCLAMP"},
+		},
+		&cli.BoolFlag{
+			Name:    "mtu-exchange",
+			Usage:   "Asks each peer for its MTU, answering larger packets with ICMP fragmentation needed/packet too big",
+			EnvVars: []string{"EDGEVPNMTUEXCHANGE"},
+		},
+		&cli.BoolFlag{
+			Name:    "multicast",
+			Usage:   "Forwards multicast and broadcast packets (e.g. mDNS) to the peers listening to them",
+			EnvVars: []string{"EDGEVPNMULTICAST"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "multicast-group",
+			Usage:   "Multicast group to listen to with --multicast, next to the ones the host joins (e.g. 224.0.0.251 for mDNS)",
+			EnvVars: []string{"EDGEVPNMULTICASTGROUPS"},
+		},
+		&cli.IntFlag{
+			Name:    "multicast-rate",
+			Usage:   "Multicast and broadcast packets per second sent and received at most with --multicast",
+			Value:   vpn.DefaultMulticastRate,
+			EnvVars: []string{"EDGEVPNMULTICASTRATE"},
+		},
+		&cli.BoolFlag{
+			Name:    "netstack",
+			Usage:   "Runs the VPN on a userspace network stack instead of a TUN device: no privileges needed. Reach it with --netstack-proxy and the forwards",
+			EnvVars: []string{"EDGEVPNNETSTACK"},
+		},
+		&cli.StringFlag{
+			Name:    "netstack-proxy",
+			Usage:   "Listen address of a SOCKS5 and HTTP proxy to the VPN, with --netstack",
+			EnvVars: []string{"EDGEVPNNETSTACKPROXY"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "netstack-dns",
+			Usage:   "DNS server reached through the VPN resolving the names given to the proxy, with --netstack",
+			EnvVars: []string{"EDGEVPNNETSTACKDNS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "forward",
+			Usage:   "Relays a local port to the VPN, with --netstack: <listen host:port>=<vpn host:port>",
+			EnvVars: []string{"EDGEVPNFORWARDS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "remote-forward",
+			Usage:   "Relays a port of the node VPN address to the host, with --netstack: <port>=<host:port>",
+			EnvVars: []string{"EDGEVPNREMOTEFORWARDS"},
 		}}, CommonFlags...)
 }
 
@@ -172,7 +277,21 @@ func Main() func(c *cli.Context) error {
 			if err != nil {
 				return err
 			}
-			nodeOpts, vO := vpn.DHCP(ll, 15*time.Minute, c.String("lease-dir"), address.String())
+			var nodeOpts []node.Option
+			var vO []vpn.Option
+			switch c.String("dhcp-allocator") {
+			case "leader":
+				nodeOpts, vO = vpn.DHCP(ll, 15*time.Minute, c.String("lease-dir"), address.String())
+			case "hash":
+				if _, err := vpn.ParseDHCPPrefix(c.String("address")); err != nil {
+					return err
+				}
+				// Claims settle once the ledger has been synchronized a few times
+				settle := 3 * time.Duration(c.Int("ledger-synchronization-interval")) * time.Second
+				nodeOpts, vO = vpn.HashDHCP(ll, 15*time.Minute, settle, c.String("lease-dir"), c.String("address"))
+			default:
+				return fmt.Errorf("invalid dhcp allocator %q (want leader or hash)", c.String("dhcp-allocator"))
+			}
 			o = append(o, nodeOpts...)
 			vpnOpts = append(vpnOpts, vO...)
 		}
@@ -181,6 +300,15 @@ func Main() func(c *cli.Context) error {
 			o = append(o, services.Egress(time.Duration(c.Int("egress-announce-time"))*time.Second)...)
 		}
 
+		if c.Bool("exit-node") {
+			vpnOpts = append(vpnOpts, vpn.AdvertiseExitNode)
+		}
+
+		if via := c.String("exit-via"); via != "" {
+			// Exit nodes are picked among the ones the Alive service sees
+			vpnOpts = append(vpnOpts, vpn.WithExitVia(via, time.Duration(c.Int("aliveness-healthcheck-max-interval"))*time.Second))
+		}
+
 		dns := c.String("dns")
 		if dns != "" {
 			// Adds DNS Server
@@ -197,6 +325,15 @@ func Main() func(c *cli.Context) error {
 			o = append(o, node.WithLibp2pAdditionalOptions(libp2p.BandwidthReporter(bwc)))
 		}
 
+		vpnMetrics := vpn.NewMetrics()
+		vpnOpts = append(vpnOpts, vpn.WithMetrics(vpnMetrics), vpn.WithStateDir(c.String("lease-dir")))
+		apiOpts := []api.Option{api.WithVPNMetrics(vpnMetrics)}
+		if c.Bool("capture") {
+			capture := vpn.NewCapture()
+			vpnOpts = append(vpnOpts, vpn.WithCapture(capture))
+			apiOpts = append(apiOpts, api.WithVPNCapture(capture))
+		}
+
 		opts, err := vpn.Register(vpnOpts...)
 		if err != nil {
 			return err
@@ -216,7 +353,7 @@ func Main() func(c *cli.Context) error {
 		}
 
 		if c.Bool("api") {
-			go api.API(ctx, c.String("api-listen"), 5*time.Second, 20*time.Second, e, bwc, c.Bool("debug"))
+			go api.API(ctx, c.String("api-listen"), 5*time.Second, 20*time.Second, e, bwc, c.Bool("debug"), apiOpts...)
 		}
 		go handleStopSignals()
 		return e.Start(ctx)
@@ -115,6 +115,17 @@ var CommonFlags []cli.Flag = []cli.Flag{
 		EnvVars: []string{"EDGEVPNLEDGERSYNCINTERVAL"},
 		Value:   10,
 	},
+	&cli.BoolFlag{
+		Name:    "ledger-delta-sync",
+		Usage:   "Gossip only the ledger entries changed since the last announced block, with periodic full snapshots. Nodes without delta support keep converging through the snapshots.",
+		EnvVars: []string{"EDGEVPNLEDGERDELTASYNC"},
+	},
+	&cli.IntFlag{
+		Name:    "ledger-delta-snapshot-every",
+		Usage:   "Number of synchronization intervals between full ledger snapshots when delta sync is enabled",
+		EnvVars: []string{"EDGEVPNLEDGERSNAPSHOTEVERY"},
+		Value:   blockchain.DefaultSnapshotEvery,
+	},
 	&cli.IntFlag{
 		Name:    "nat-ratelimit-global",
 		Usage:   "Rate limit global requests",
@@ -150,6 +161,38 @@ var CommonFlags []cli.Flag = []cli.Flag{
 		Usage:   "Specify a ledger state directory",
 		EnvVars: []string{"EDGEVPNLEDGERSTATE"},
 	},
+	&cli.StringFlag{
+		Name:    "ledger-store",
+		Usage:   "Store for --ledger-state: disk (one file per block) or bolt (single database, migrated from a disk directory on first use). Empty keeps what the directory holds",
+		EnvVars: []string{"EDGEVPNLEDGERSTORE"},
+	},
+	&cli.BoolFlag{
+		Name:    "ledger-nosync",
+		Usage:   "Do not fsync the bolt ledger store after every block. Faster on slow flash; the last blocks may be lost on power failure and are recovered from peers",
+		EnvVars: []string{"EDGEVPNLEDGERNOSYNC"},
+	},
+	&cli.IntFlag{
+		Name:    "ledger-history",
+		Usage:   "Number of past ledger blocks to retain for the history API (0 keeps only the last block in memory, and every block with --ledger-state)",
+		EnvVars: []string{"EDGEVPNLEDGERHISTORY"},
+	},
+	&cli.IntFlag{
+		Name:    "ledger-history-max-age",
+		Usage:   "Drop retained ledger blocks older than this many seconds (0 disables the age bound)",
+		EnvVars: []string{"EDGEVPNLEDGERHISTORYMAXAGE"},
+	},
+	&cli.IntFlag{
+		Name:    "ledger-compact-interval",
+		Usage:   "Compact the --ledger-state directory every this many seconds, keeping the last --ledger-compact-keep blocks (0 disables it)",
+		EnvVars: []string{"EDGEVPNLEDGERCOMPACTINTERVAL"},
+		Value:   3600,
+	},
+	&cli.IntFlag{
+		Name:    "ledger-compact-keep",
+		Usage:   "Number of blocks kept by ledger compaction",
+		EnvVars: []string{"EDGEVPNLEDGERCOMPACTKEEP"},
+		Value:   100,
+	},
 	&cli.BoolFlag{
 		Name:    "mdns",
 		Usage:   "Enable mDNS for peer discovery",
@@ -488,6 +531,11 @@ func ConfigFromContext(c *cli.Context) *config.Config {
 	d := map[string]map[string]interface{}{}
 	json.Unmarshal([]byte(pa), &d)
 
+	ipv6Prefix := ""
+	if c.Bool("ipv6") {
+		ipv6Prefix = c.String("ipv6-prefix")
+	}
+
 	return &config.Config{
 		NetworkConfig:     c.String("config"),
 		NetworkToken:      c.String("token"),
@@ -495,6 +543,8 @@ func ConfigFromContext(c *cli.Context) *config.Config {
 		DHTAnnounceMaddrs: stringsToMultiAddr(c.StringSlice("dht-announce-maddrs")),
 		Address:           c.String("address"),
 		Router:            c.String("router"),
+		Routes:            c.StringSlice("advertise-route"),
+		IPv6Prefix:        ipv6Prefix,
 		Interface:         c.String("interface"),
 		Libp2pLogLevel:    c.String("libp2p-log-level"),
 		LogLevel:          c.String("log-level"),
@@ -507,10 +557,37 @@ func ConfigFromContext(c *cli.Context) *config.Config {
 		PacketMTU:         c.Int("packet-mtu"),
 		BootstrapIface:    c.Bool("bootstrap-iface"),
 		Whitelist:         stringsToMultiAddr(c.StringSlice("whitelist")),
+		Firewall: config.Firewall{
+			Rules:   c.StringSlice("firewall-rule"),
+			Default: c.String("firewall-default"),
+		},
+		QoSClasses:   c.StringSlice("qos-class"),
+		MSSClamp:     c.Bool("mss-clamp"),
+		MTUExchange:  c.Bool("mtu-exchange"),
+		Multicast: config.Multicast{
+			Enable: c.Bool("multicast"),
+			Groups: c.StringSlice("multicast-group"),
+			Rate:   c.Int("multicast-rate"),
+		},
+		Netstack: config.Netstack{
+			Enable:         c.Bool("netstack"),
+			Proxy:          c.String("netstack-proxy"),
+			DNS:            c.StringSlice("netstack-dns"),
+			Forwards:       c.StringSlice("forward"),
+			RemoteForwards: c.StringSlice("remote-forward"),
+		},
 		Ledger: config.Ledger{
 			StateDir:         c.String("ledger-state"),
 			AnnounceInterval: time.Duration(c.Int("ledger-announce-interval")) * time.Second,
 			SyncInterval:     time.Duration(c.Int("ledger-synchronization-interval")) * time.Second,
+			DeltaSync:        c.Bool("ledger-delta-sync"),
+			SnapshotEvery:    c.Int("ledger-delta-snapshot-every"),
+			HistoryBlocks:    c.Int("ledger-history"),
+			HistoryMaxAge:    time.Duration(c.Int("ledger-history-max-age")) * time.Second,
+			CompactInterval:  time.Duration(c.Int("ledger-compact-interval")) * time.Second,
+			CompactKeep:      c.Int("ledger-compact-keep"),
+			Store:            c.String("ledger-store"),
+			NoSync:           c.Bool("ledger-nosync"),
 		},
 		NAT: config.NAT{
 			Service:           c.Bool("natservice"),
@@ -0,0 +1,140 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/mudler/edgevpn/pkg/protocol"
+)
+
+// WithAdminKeys declares the peer IDs whose signatures are required for
+// writes to buckets with an Admin policy.
+func WithAdminKeys(ids ...string) LedgerOption {
+	return func(l *Ledger) { l.admins = adminSet(ids) }
+}
+
+// SetAdminKeys replaces the admin keys at runtime (called during node
+// startup, like SetOwnership).
+func (l *Ledger) SetAdminKeys(ids ...string) {
+	l.Lock()
+	l.admins = adminSet(ids)
+	l.Unlock()
+}
+
+// ValidateAdminKeys checks that every admin key is a valid peer ID.
+func ValidateAdminKeys(ids []string) error {
+	for _, id := range ids {
+		if _, err := peer.Decode(id); err != nil {
+			return fmt.Errorf("invalid admin key %q: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func adminSet(ids []string) map[string]bool {
+	if len(ids) == 0 {
+		return nil
+	}
+	m := map[string]bool{}
+	for _, id := range ids {
+		m[id] = true
+	}
+	return m
+}
+
+// adminOnly reports whether writes to a bucket with policy pol must be
+// admin-signed.
+func (l *Ledger) adminOnly(pol BucketPolicy) bool { return pol.Admin && len(l.admins) > 0 }
+
+// AdminEnforced reports whether only admin keys may write bucket: its policy
+// is Admin, admin keys are declared and ownership is enforced.
+func (l *Ledger) AdminEnforced(bucket string) bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.mode == OwnershipEnforce && l.adminOnly(l.registry.Policy(bucket))
+}
+
+// CanWrite reports whether the entries this ledger signs in bucket are
+// accepted by enforcing peers as far as admin keys go: false for an admin
+// bucket when the local signer is not an admin key.
+func (l *Ledger) CanWrite(bucket string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.mode != OwnershipEnforce || !l.adminOnly(l.registry.Policy(bucket)) {
+		return true
+	}
+	return l.signer != nil && l.admins[l.signer.ID()]
+}
+
+// SignedWrite is a write signed away from the ledger, typically with an admin
+// key kept offline, to be submitted to a node with Apply.
+type SignedWrite struct {
+	Bucket string
+	Key    string
+	Entry  SignedData
+}
+
+// SignWrite signs value (marshalled to JSON, as with Add) for bucket/key with
+// s. version must be higher than the one of the entry it replaces; 0 derives
+// one from now, as the ledger does for its own writes. A nil value with
+// del set signs a tombstone.
+func SignWrite(s Signer, bucket, key string, value interface{}, del bool, version uint64, now time.Time) (SignedWrite, error) {
+	if version == 0 {
+		version = versionAfter(0, now)
+	}
+	d := SignedData{Owner: s.ID(), Version: version, UpdatedAt: now.Unix(), Deleted: del}
+	if !del {
+		dat, err := json.Marshal(value)
+		if err != nil {
+			return SignedWrite{}, err
+		}
+		d.Value = Data(dat)
+	}
+	sig, err := s.Sign(canonical(bucket, key, d))
+	if err != nil {
+		return SignedWrite{}, err
+	}
+	d.Sig = sig
+	return SignedWrite{Bucket: bucket, Key: key, Entry: d}, nil
+}
+
+// Apply merges entries signed elsewhere into the ledger and broadcasts them,
+// all or nothing. Each entry must pass the checks a peer applies to it on
+// gossip (signature, admin key, ownership); a failing one is reported with
+// ErrForbidden.
+func (l *Ledger) Apply(writes ...SignedWrite) error {
+	var err error
+	l.commit(true, func(cur map[string]map[string]SignedData) bool {
+		now := l.clock()
+		health := projectValues(cur[protocol.HealthCheckKey])
+		for _, w := range writes {
+			if cur[w.Bucket] == nil {
+				cur[w.Bucket] = map[string]SignedData{}
+			}
+			ex, exists := cur[w.Bucket][w.Key]
+			if reason := l.authorize(w.Bucket, w.Key, w.Entry, ex, exists, l.registry.Policy(w.Bucket), cur, health, now); reason != "" {
+				err = fmt.Errorf("%s/%s: %s: %w", w.Bucket, w.Key, reason, ErrForbidden)
+				return false
+			}
+			cur[w.Bucket][w.Key] = w.Entry
+		}
+		return len(writes) > 0
+	})
+	return err
+}
@@ -0,0 +1,104 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/protocol"
+)
+
+var _ = Describe("Admin keys", func() {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var (
+		admin, peer Signer
+		l           *Ledger
+	)
+
+	BeforeEach(func() {
+		admin, peer = newTestSigner(), newTestSigner()
+		l = New(io.Discard, &MemoryStore{},
+			WithEnforcedOwnership(DefaultRegistry(time.Minute), time.Minute),
+			WithAdminKeys(admin.ID()),
+			WithSigner(peer),
+			WithClock(func() time.Time { return now }))
+	})
+
+	It("rejects trust zone writes not signed by an admin", func() {
+		feed(l, map[string]map[string]SignedData{
+			protocol.TrustZoneAuthKey: {"rogue": mkSignedEntry(peer, protocol.TrustZoneAuthKey, "rogue", "key", 1, now)},
+		})
+		_, found := l.GetKey(protocol.TrustZoneAuthKey, "rogue")
+		Expect(found).To(BeFalse())
+
+		feed(l, map[string]map[string]SignedData{
+			protocol.TrustZoneAuthKey: {"ops": mkSignedEntry(admin, protocol.TrustZoneAuthKey, "ops", "key", 1, now)},
+		})
+		_, found = l.GetKey(protocol.TrustZoneAuthKey, "ops")
+		Expect(found).To(BeTrue())
+	})
+
+	It("keeps admin-owned DNS records without a heartbeat", func() {
+		w, err := SignWrite(admin, protocol.DNSKey, "app.edgevpn.", map[string]string{"A": "10.1.0.10"}, false, 0, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(l.Apply(w)).To(Succeed())
+
+		// The reaper skips it, and a peer cannot take it over.
+		l.Reap(time.Hour)
+		_, found := l.GetKey(protocol.DNSKey, "app.edgevpn.")
+		Expect(found).To(BeTrue())
+		feed(l, map[string]map[string]SignedData{
+			protocol.DNSKey: {"app.edgevpn.": mkSignedEntry(peer, protocol.DNSKey, "app.edgevpn.", map[string]string{"A": "10.1.0.66"}, w.Entry.Version+1, now)},
+		})
+		Expect(storedOwnerOf(l, protocol.DNSKey, "app.edgevpn.")).To(Equal(admin.ID()))
+	})
+
+	It("refuses signed writes peers would reject", func() {
+		w, err := SignWrite(peer, protocol.TrustZoneKey, "someone", "", false, 0, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(errors.Is(l.Apply(w), ErrForbidden)).To(BeTrue())
+
+		w, err = SignWrite(admin, protocol.TrustZoneKey, "someone", "", false, 0, now)
+		Expect(err).NotTo(HaveOccurred())
+		w.Entry.Value = `"tampered"`
+		Expect(errors.Is(l.Apply(w), ErrForbidden)).To(BeTrue())
+	})
+
+	It("refuses batches into admin buckets from a non-admin signer", func() {
+		_, err := l.Batch([]Op{{Bucket: protocol.TrustZoneAuthKey, Key: "rogue", Value: "key"}})
+		Expect(errors.Is(err, ErrForbidden)).To(BeTrue())
+		_, found := l.GetKey(protocol.TrustZoneAuthKey, "rogue")
+		Expect(found).To(BeFalse())
+
+		_, err = l.Batch([]Op{{Bucket: "anything", Key: "k", Value: "v"}})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("reports whether the local signer may write a bucket", func() {
+		Expect(l.CanWrite(protocol.TrustZoneKey)).To(BeFalse())
+		Expect(l.CanWrite("anything")).To(BeTrue())
+		l.SetAdminKeys()
+		Expect(l.CanWrite(protocol.TrustZoneKey)).To(BeTrue())
+	})
+})
+
+func storedOwnerOf(l *Ledger, bucket, key string) string {
+	return l.LastBlock().Storage[bucket][key].Owner
+}
@@ -0,0 +1,198 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Compacter is a Store that can drop old blocks.
+type Compacter interface {
+	Store
+	// Compact keeps at most the last keep blocks (at least one) and deletes
+	// everything older.
+	Compact(keep int) (CompactResult, error)
+}
+
+// CompactResult describes the chain left after a compaction.
+type CompactResult struct {
+	// Checkpoint is the oldest retained block. Every block carries the full
+	// ledger state, so it is a complete snapshot the tail builds on.
+	Checkpoint int
+	Last       int
+	Kept       int
+	Removed    int
+	// Truncated is set when the retained chain was cut short of keep blocks
+	// because a block was missing, corrupt, or did not follow on from its
+	// predecessor.
+	Truncated bool
+}
+
+// ChainInfo summarises the blocks held in a store.
+type ChainInfo struct {
+	First, Last int
+	Blocks      int
+	// Breaks lists the indexes of the blocks that do not follow on from the
+	// block before them. Gaps appear when the ledger adopts a block from a
+	// peer further ahead.
+	Breaks []int
+	// LastValid reports whether the last block matches its own hash.
+	LastValid bool
+}
+
+// PersistentStore is implemented by the stores that keep the chain in a
+// --ledger-state directory.
+type PersistentStore interface {
+	HistoryStore
+	Compacter
+	// Inspect walks the stored blocks and reports their continuity.
+	Inspect() ChainInfo
+}
+
+// chainStore is what compaction and retention pruning need from a store that
+// keeps one record per block.
+type chainStore interface {
+	Store
+	Get(index int) (Block, bool)
+	// indexes returns the block indexes present, in order.
+	indexes() []int
+	erase(index int) error
+	// first returns the lowest index that may still be present.
+	first() int
+	setFirst(index int) error
+}
+
+// compactChain keeps the longest valid chain ending at the last block, capped
+// at keep blocks, and deletes every other block. Nothing is deleted if the
+// last block itself is corrupt.
+func compactChain(s chainStore, keep int) (CompactResult, error) {
+	res := CompactResult{}
+	if keep < 1 {
+		keep = 1
+	}
+	if len(s.indexes()) == 0 {
+		return res, nil
+	}
+
+	last := s.Last()
+	if last.Checksum() != last.Hash {
+		return res, errors.Errorf("last block %d does not match its hash, refusing to compact", last.Index)
+	}
+
+	checkpoint := last
+	res.Kept = 1
+	for res.Kept < keep && checkpoint.Index > 0 {
+		prev, ok := s.Get(checkpoint.Index - 1)
+		if !ok || !checkpoint.IsValid(prev) || prev.Checksum() != prev.Hash {
+			res.Truncated = true
+			break
+		}
+		checkpoint = prev
+		res.Kept++
+	}
+
+	// Oldest first, so an interrupted compaction still leaves a suffix of
+	// the chain.
+	for _, i := range s.indexes() {
+		if i < checkpoint.Index || i > last.Index {
+			if err := s.erase(i); err != nil {
+				return res, errors.Wrapf(err, "erasing block %d", i)
+			}
+			res.Removed++
+		}
+	}
+	if err := s.setFirst(checkpoint.Index); err != nil {
+		return res, errors.Wrap(err, "writing first index")
+	}
+
+	res.Checkpoint, res.Last = checkpoint.Index, last.Index
+	return res, nil
+}
+
+// pruneChain drops the blocks before last that fell out of r.
+func pruneChain(s chainStore, r Retention, last int, now time.Time) {
+	first := s.first()
+	i := first
+	for ; i < last; i++ {
+		b, ok := s.Get(i)
+		if !ok {
+			// Gaps are left by blocks adopted from a peer further ahead.
+			continue
+		}
+		if r.keep(b, last-i+1, now) {
+			break
+		}
+		s.erase(i)
+	}
+	if i != first {
+		s.setFirst(i)
+	}
+}
+
+func inspectChain(s chainStore) ChainInfo {
+	info := ChainInfo{}
+	idx := s.indexes()
+	if len(idx) == 0 {
+		return info
+	}
+	info.First, info.Last, info.Blocks = idx[0], idx[len(idx)-1], len(idx)
+
+	var prev *Block
+	for _, i := range idx {
+		b, ok := s.Get(i)
+		if !ok {
+			info.Breaks = append(info.Breaks, i)
+			prev = nil
+			continue
+		}
+		if prev != nil && !b.IsValid(*prev) {
+			info.Breaks = append(info.Breaks, i)
+		}
+		prev = &b
+	}
+	if prev != nil {
+		info.LastValid = prev.Checksum() == prev.Hash
+	}
+	return info
+}
+
+// Compactor periodically compacts the ledger store down to its last keep
+// blocks. It does nothing if the store cannot be compacted.
+func (l *Ledger) Compactor(ctx context.Context, interval time.Duration, keep int) {
+	c, ok := l.blockchain.(Compacter)
+	if !ok || interval <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				// Hold the lock so no block is added mid-compaction.
+				l.Lock()
+				_, err := c.Compact(keep)
+				l.Unlock()
+				if err != nil {
+					l.warn("ledger compaction failed: %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,109 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/peterbourgon/diskv"
+)
+
+func mustJSON(b Block) []byte {
+	dat, err := json.Marshal(b)
+	Expect(err).NotTo(HaveOccurred())
+	return dat
+}
+
+var _ = Describe("DiskStore compaction", func() {
+	var (
+		dir string
+		s   *DiskStore
+		l   *Ledger
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "compact")
+		Expect(err).NotTo(HaveOccurred())
+		s = NewDiskStore(diskv.New(diskv.Options{BasePath: dir}))
+		l = New(io.Discard, s)
+		for i := 0; i < 10; i++ {
+			l.Add("x", map[string]interface{}{"k": fmt.Sprint(i)})
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("keeps the last blocks and the current state", func() {
+		data := l.CurrentData()
+		res, err := s.Compact(3)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Kept).To(Equal(3))
+		Expect(res.Checkpoint).To(Equal(8))
+		Expect(res.Last).To(Equal(10))
+		Expect(res.Truncated).To(BeFalse())
+
+		Expect(indexes(s.Range(0, -1))).To(Equal([]int{8, 9, 10}))
+		Expect(l.CurrentData()).To(Equal(data))
+
+		info := s.Inspect()
+		Expect(info.Blocks).To(Equal(3))
+		Expect(info.Breaks).To(BeEmpty())
+		Expect(info.LastValid).To(BeTrue())
+
+		// The ledger keeps growing on top of the checkpoint.
+		l.Add("x", map[string]interface{}{"k": "more"})
+		Expect(s.Inspect().Last).To(Equal(11))
+	})
+
+	It("stops at a break in the chain", func() {
+		b, _ := s.Get(7)
+		b.PrevHash = "forged"
+		s.chain.Write("7", mustJSON(b))
+
+		Expect(s.Inspect().Breaks).To(Equal([]int{7}))
+
+		res, err := s.Compact(5)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Truncated).To(BeTrue())
+		Expect(res.Checkpoint).To(Equal(8))
+		Expect(indexes(s.Range(0, -1))).To(Equal([]int{8, 9, 10}))
+	})
+
+	It("refuses to compact a corrupt last block", func() {
+		b := s.Last()
+		b.Hash = "bad"
+		s.chain.Write("10", mustJSON(b))
+
+		_, err := s.Compact(1)
+		Expect(err).To(HaveOccurred())
+		Expect(s.Inspect().Blocks).To(Equal(11))
+	})
+
+	It("runs in the background", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		l.Compactor(ctx, 10*time.Millisecond, 2)
+		Eventually(func() int { return s.Inspect().Blocks }).Should(Equal(2))
+	})
+})
@@ -0,0 +1,298 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/utils"
+)
+
+// DefaultSnapshotEvery is how many sync ticks a delta-syncing ledger lets pass
+// between two unconditional full-block broadcasts.
+const DefaultSnapshotEvery = 12
+
+// resyncBackoff bounds how often we ask the same origin for a snapshot, so a
+// burst of deltas we cannot apply does not turn into a burst of requests.
+const resyncBackoff = 5 * time.Second
+
+// maxTrackedHeads caps the per-origin head table. Origins are per process, so
+// the table only grows with restarts; resetting it merely costs one resync per
+// origin.
+const maxTrackedHeads = 4096
+
+// Delta is an incremental sync message: the entries that changed between two
+// of the sender's blocks, plus the header of the newer block. A receiver that
+// holds the older block (Base) can rebuild the newer one exactly and verify it
+// against Hash; any other receiver either merges the entries (ownership
+// enabled) or asks the origin for a full snapshot.
+type Delta struct {
+	Base      string // hash of the block the delta applies to
+	Index     int
+	Timestamp string
+	Hash      string
+	PrevHash  string
+
+	// Entries holds every (bucket,key) that was added or changed. A bucket
+	// present with no keys was created empty.
+	Entries map[string]map[string]SignedData
+	// Removed and Dropped carry physical deletions (legacy Delete and
+	// DeleteBucket, tombstone pruning). Signed tombstones travel as Entries.
+	Removed map[string][]string `json:",omitempty"`
+	Dropped []string            `json:",omitempty"`
+}
+
+// syncMessage is the wire form of everything the Syncronizer sends. A plain
+// full block marshals exactly as before; a delta or a resync request leaves
+// the embedded Block zero, which nodes predating delta sync decode as an
+// index-0 block and ignore.
+type syncMessage struct {
+	Block
+	Origin     string `json:",omitempty"`
+	Delta      *Delta `json:",omitempty"`
+	ResyncFrom string `json:",omitempty"`
+}
+
+// WithDeltaSync makes the ledger gossip only the entries that changed since
+// the block it last announced, instead of the whole last block on every tick.
+// A full block is still sent every snapshotEvery ticks (DefaultSnapshotEvery
+// if zero or negative) and whenever a peer that could not apply a delta asks
+// for one, so nodes without delta support keep converging.
+func WithDeltaSync(snapshotEvery int) LedgerOption {
+	return func(l *Ledger) {
+		if snapshotEvery <= 0 {
+			snapshotEvery = DefaultSnapshotEvery
+		}
+		l.snapshotEvery = snapshotEvery
+	}
+}
+
+// DeltaSyncEnabled reports whether the ledger gossips deltas.
+func (l *Ledger) DeltaSyncEnabled() bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.snapshotEvery > 0
+}
+
+// diffBlocks returns the delta that turns old into new.
+func diffBlocks(old, new Block) *Delta {
+	d := &Delta{
+		Base:      old.Hash,
+		Index:     new.Index,
+		Timestamp: new.Timestamp,
+		Hash:      new.Hash,
+		PrevHash:  new.PrevHash,
+		Entries:   map[string]map[string]SignedData{},
+	}
+
+	for b, kv := range new.Storage {
+		okv, existed := old.Storage[b]
+		if !existed {
+			d.Entries[b] = map[string]SignedData{}
+		}
+		for k, v := range kv {
+			if ov, ok := okv[k]; ok && sameEntry(ov, v) {
+				continue
+			}
+			if d.Entries[b] == nil {
+				d.Entries[b] = map[string]SignedData{}
+			}
+			d.Entries[b][k] = v
+		}
+	}
+
+	for b, okv := range old.Storage {
+		kv, ok := new.Storage[b]
+		if !ok {
+			d.Dropped = append(d.Dropped, b)
+			continue
+		}
+		for k := range okv {
+			if _, ok := kv[k]; !ok {
+				if d.Removed == nil {
+					d.Removed = map[string][]string{}
+				}
+				d.Removed[b] = append(d.Removed[b], k)
+			}
+		}
+	}
+	return d
+}
+
+// rebuild applies the delta on top of base and returns the resulting block.
+// It reports false unless the result hashes to exactly what the origin had,
+// which guards against a stale base or a lossy encoding.
+func (d *Delta) rebuild(base Block) (Block, bool) {
+	s := copyStorage(base.Storage)
+	for _, b := range d.Dropped {
+		delete(s, b)
+	}
+	for b, keys := range d.Removed {
+		for _, k := range keys {
+			delete(s[b], k)
+		}
+	}
+	for b, kv := range d.Entries {
+		if s[b] == nil {
+			s[b] = map[string]SignedData{}
+		}
+		for k, v := range kv {
+			s[b][k] = v
+		}
+	}
+
+	nb := Block{Index: d.Index, Timestamp: d.Timestamp, Storage: s, Hash: d.Hash, PrevHash: d.PrevHash}
+	return nb, nb.Checksum() == d.Hash
+}
+
+// syncPayload returns the next message the Syncronizer should send. Must be
+// called with the lock held.
+func (l *Ledger) syncPayload() []byte {
+	last := l.blockchain.Last()
+	if l.snapshotEvery <= 0 {
+		return marshalSync(last)
+	}
+
+	l.syncTicks++
+	if l.synced == nil || l.resync || l.syncTicks%l.snapshotEvery == 0 {
+		return l.snapshotPayload(last)
+	}
+	// An unchanged ledger still sends an empty delta: it advertises our head,
+	// so a peer that joined since the last snapshot notices the gap and asks.
+	return l.deltaPayload(last)
+}
+
+// broadcastPayload is the message commit sends after a local write. Must be
+// called with the lock held.
+func (l *Ledger) broadcastPayload() []byte {
+	last := l.blockchain.Last()
+	if l.snapshotEvery <= 0 {
+		return marshalSync(last)
+	}
+	if l.synced == nil || l.resync {
+		return l.snapshotPayload(last)
+	}
+	return l.deltaPayload(last)
+}
+
+func (l *Ledger) snapshotPayload(last Block) []byte {
+	l.resync = false
+	l.synced = &last
+	return marshalSync(syncMessage{Block: last, Origin: l.syncID})
+}
+
+func (l *Ledger) deltaPayload(last Block) []byte {
+	d := diffBlocks(*l.synced, last)
+	l.synced = &last
+	return marshalSync(syncMessage{Origin: l.syncID, Delta: d})
+}
+
+func marshalSync(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return compress(b).Bytes()
+}
+
+// applyDelta consumes a delta from origin.
+//
+// With ownership off the ledger replaces whole blocks, so a delta is only
+// usable when we hold exactly its base: we rebuild the origin's block and
+// adopt it by the usual height rule. With ownership enabled every entry is
+// self-authenticating, so the entries go through the authorized merge no
+// matter what we hold; a gap in the origin's chain only means we may have
+// missed earlier entries. Either way, when we cannot be sure we are caught
+// up we ask the origin for a snapshot.
+func (l *Ledger) applyDelta(origin string, d *Delta) {
+	l.Lock()
+	gap := l.trackHead(origin, d.Base, d.Hash)
+	mode := l.mode
+	resync := false
+
+	if mode == OwnershipOff {
+		last := l.blockchain.Last()
+		switch {
+		case last.Hash == d.Hash:
+		case last.Hash == d.Base:
+			if nb, ok := d.rebuild(last); ok && nb.Index > last.Index {
+				l.appendBlock(nb)
+			} else {
+				resync = true
+			}
+		case d.Index > last.Index || (d.Index == last.Index && d.Hash > last.Hash):
+			// The origin is ahead of us on a chain we do not hold.
+			resync = true
+		}
+	} else {
+		resync = gap
+	}
+	l.Unlock()
+
+	if mode != OwnershipOff && len(d.Entries) > 0 {
+		l.commit(false, func(cur map[string]map[string]SignedData) bool {
+			_, changed := l.merge(cur, &Block{Storage: d.Entries}, l.clock())
+			return changed
+		})
+	}
+
+	if resync {
+		l.requestResync(origin)
+	}
+}
+
+// trackHead records the head origin just announced and reports whether it did
+// not follow on from the previous one we saw. Must be called with the lock held.
+func (l *Ledger) trackHead(origin, base, head string) bool {
+	if origin == "" {
+		return false
+	}
+	if len(l.heads) >= maxTrackedHeads {
+		l.heads = map[string]string{}
+	}
+	prev, seen := l.heads[origin]
+	l.heads[origin] = head
+	return !seen || prev != base
+}
+
+// requestResync asks origin to send a full snapshot on its next tick.
+func (l *Ledger) requestResync(origin string) {
+	if origin == "" {
+		return
+	}
+	l.Lock()
+	now := l.clock()
+	if t, ok := l.resyncAsked[origin]; ok && now.Sub(t) < resyncBackoff {
+		l.Unlock()
+		return
+	}
+	if len(l.resyncAsked) >= maxTrackedHeads {
+		l.resyncAsked = map[string]time.Time{}
+	}
+	l.resyncAsked[origin] = now
+	l.Unlock()
+
+	if payload := marshalSync(syncMessage{ResyncFrom: origin}); payload != nil {
+		l.channel.Write(payload)
+	}
+}
+
+// newSyncID returns the identifier this ledger tags its sync messages with. It only
+// has to be unique per process: it scopes the head table, not authorship.
+func newSyncID() string {
+	return utils.RandStringRunes(16)
+}
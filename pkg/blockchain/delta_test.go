@@ -0,0 +1,197 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/hub"
+	"github.com/mudler/edgevpn/pkg/protocol"
+)
+
+// recorder captures every message a ledger writes to its channel.
+type recorder struct{ msgs []string }
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.msgs = append(r.msgs, string(p))
+	return len(p), nil
+}
+
+// drain returns the recorded messages and forgets them.
+func (r *recorder) drain() []*hub.Message {
+	out := []*hub.Message{}
+	for _, m := range r.msgs {
+		out = append(out, hub.NewMessage(m))
+	}
+	r.msgs = nil
+	return out
+}
+
+// tick runs one Syncronizer round without the ticker.
+func tick(l *Ledger) {
+	l.Lock()
+	payload := l.syncPayload()
+	l.Unlock()
+	l.channel.Write(payload)
+}
+
+func deliver(to *Ledger, msgs []*hub.Message) {
+	for _, m := range msgs {
+		Expect(to.Update(to, m, nil)).To(Succeed())
+	}
+}
+
+func decodeSync(m *hub.Message) *syncMessage {
+	b, err := deCompress([]byte(m.Message))
+	Expect(err).NotTo(HaveOccurred())
+	s := &syncMessage{}
+	Expect(json.Unmarshal(b.Bytes(), s)).To(Succeed())
+	return s
+}
+
+var _ = Describe("Delta sync", func() {
+	It("sends only the changed entries and lets a follower rebuild the block", func() {
+		ra := &recorder{}
+		a := New(ra, &MemoryStore{}, WithDeltaSync(100))
+		b := New(io.Discard, &MemoryStore{})
+
+		a.Add("machines", map[string]interface{}{"10.1.0.1": "a", "10.1.0.2": "b"})
+		// The first broadcast is a snapshot: there is nothing to diff against.
+		deliver(b, ra.drain())
+		Expect(b.LastBlock().Hash).To(Equal(a.LastBlock().Hash))
+
+		a.Add("machines", map[string]interface{}{"10.1.0.2": "c"})
+		msgs := ra.drain()
+		Expect(msgs).To(HaveLen(1))
+		s := decodeSync(msgs[0])
+		Expect(s.Delta).NotTo(BeNil())
+		Expect(s.Delta.Entries["machines"]).To(HaveLen(1))
+		Expect(s.Delta.Entries["machines"]).To(HaveKey("10.1.0.2"))
+
+		deliver(b, msgs)
+		Expect(b.LastBlock().Hash).To(Equal(a.LastBlock().Hash))
+		Expect(b.CurrentData()).To(Equal(a.CurrentData()))
+	})
+
+	It("propagates legacy deletions", func() {
+		ra := &recorder{}
+		a := New(ra, &MemoryStore{}, WithDeltaSync(100))
+		b := New(io.Discard, &MemoryStore{})
+
+		a.Add("x", map[string]interface{}{"k1": "1", "k2": "2"})
+		a.Add("y", map[string]interface{}{"k": "1"})
+		deliver(b, ra.drain())
+
+		a.Delete("x", "k1")
+		a.DeleteBucket("y")
+		deliver(b, ra.drain())
+
+		Expect(b.LastBlock().Hash).To(Equal(a.LastBlock().Hash))
+		Expect(b.CurrentData()).To(Equal(a.CurrentData()))
+		Expect(b.CurrentData()).NotTo(HaveKey("y"))
+	})
+
+	It("asks the origin for a snapshot when it misses a delta", func() {
+		ra, rb := &recorder{}, &recorder{}
+		a := New(ra, &MemoryStore{}, WithDeltaSync(100))
+		b := New(rb, &MemoryStore{}, WithDeltaSync(100))
+
+		a.Add("x", map[string]interface{}{"k": "1"})
+		deliver(b, ra.drain())
+
+		a.Add("x", map[string]interface{}{"k": "2"})
+		ra.drain() // lost in transit
+		a.Add("x", map[string]interface{}{"k": "3"})
+		deliver(b, ra.drain())
+
+		// b cannot rebuild a's block and asks a for a snapshot.
+		Expect(b.LastBlock().Hash).NotTo(Equal(a.LastBlock().Hash))
+		requests := rb.drain()
+		Expect(requests).To(HaveLen(1))
+		Expect(decodeSync(requests[0]).ResyncFrom).To(Equal(a.syncID))
+
+		deliver(a, requests)
+		tick(a)
+		msgs := ra.drain()
+		Expect(decodeSync(msgs[0]).Delta).To(BeNil())
+		deliver(b, msgs)
+		Expect(b.LastBlock().Hash).To(Equal(a.LastBlock().Hash))
+	})
+
+	It("sends periodic snapshots for peers without delta support", func() {
+		ra := &recorder{}
+		a := New(ra, &MemoryStore{}, WithDeltaSync(3))
+		a.Add("x", map[string]interface{}{"k": "1"})
+		ra.drain()
+
+		kinds := []bool{}
+		for i := 0; i < 3; i++ {
+			tick(a)
+			kinds = append(kinds, decodeSync(ra.drain()[0]).Delta == nil)
+		}
+		Expect(kinds).To(Equal([]bool{false, false, true}))
+	})
+
+	It("is ignored by ledgers that only understand whole blocks", func() {
+		ra := &recorder{}
+		a := New(ra, &MemoryStore{}, WithDeltaSync(100))
+		b := New(io.Discard, &MemoryStore{})
+
+		a.Add("x", map[string]interface{}{"k": "1"})
+		deliver(b, ra.drain())
+		a.Add("x", map[string]interface{}{"k": "2"})
+		msgs := ra.drain()
+
+		// Decode the delta the way a node predating delta sync does.
+		raw, err := deCompress([]byte(msgs[0].Message))
+		Expect(err).NotTo(HaveOccurred())
+		old := &Block{}
+		Expect(json.Unmarshal(raw.Bytes(), old)).To(Succeed())
+		Expect(old.Index).To(BeZero())
+		Expect(old.Storage).To(BeEmpty())
+	})
+
+	It("merges delta entries through the authorized merge", func() {
+		now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		ttl := time.Minute
+		s := newTestSigner()
+		ra := &recorder{}
+		a := New(ra, &MemoryStore{},
+			WithDeltaSync(100),
+			WithSigner(s),
+			WithEnforcedOwnership(DefaultRegistry(ttl), ttl),
+			WithClock(func() time.Time { return now }),
+		)
+		b := enforcedLedger(ttl, now)
+
+		a.Add(protocol.MachinesLedgerKey, map[string]interface{}{"10.1.0.1": machine(s.ID(), "10.1.0.1")})
+		deliver(b, ra.drain())
+		a.Add(protocol.MachinesLedgerKey, map[string]interface{}{"10.1.0.2": machine(s.ID(), "10.1.0.2")})
+		deliver(b, ra.drain())
+
+		Expect(storedOwner(b, protocol.MachinesLedgerKey, "10.1.0.2")).To(Equal(s.ID()))
+
+		// A forged entry in a delta is still rejected.
+		forger := newTestSigner()
+		e := mkSignedEntry(forger, protocol.MachinesLedgerKey, "10.1.0.1", machine(forger.ID(), "10.1.0.1"), 99, now)
+		d := &Delta{Entries: map[string]map[string]SignedData{protocol.MachinesLedgerKey: {"10.1.0.1": e}}}
+		deliver(b, []*hub.Message{hub.NewMessage(string(marshalSync(syncMessage{Origin: "forger", Delta: d})))})
+		Expect(storedOwner(b, protocol.MachinesLedgerKey, "10.1.0.1")).To(Equal(s.ID()))
+	})
+})
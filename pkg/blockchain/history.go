@@ -0,0 +1,189 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// HistoryStore is a Store that retains past blocks besides the last one.
+type HistoryStore interface {
+	Store
+	// Get returns the block at index, if it is still retained.
+	Get(index int) (Block, bool)
+	// Range returns the retained blocks with from <= Index <= to, oldest
+	// first. A negative to means up to the last block.
+	Range(from, to int) []Block
+}
+
+// Retention bounds how much block history a store keeps. The last block is
+// always kept, whatever the bounds.
+type Retention struct {
+	// Blocks keeps at most this many blocks (0: no count bound).
+	Blocks int
+	// MaxAge drops blocks whose timestamp is older than this (0: no age bound).
+	MaxAge time.Duration
+}
+
+// Bounded reports whether r limits the history at all.
+func (r Retention) Bounded() bool { return r.Blocks > 0 || r.MaxAge > 0 }
+
+// keep reports whether b, the n-th newest retained block (the last block is
+// n=1), is still within the bounds at now.
+func (r Retention) keep(b Block, n int, now time.Time) bool {
+	if n <= 1 {
+		return true
+	}
+	if r.Blocks > 0 && n > r.Blocks {
+		return false
+	}
+	if r.MaxAge > 0 {
+		if t, ok := b.Time(); ok && t.Add(r.MaxAge).Before(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// blockTimeLayout is the layout time.Time.String produces, which is how
+// block timestamps are written.
+const blockTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// Time parses the block timestamp.
+func (b Block) Time() (time.Time, bool) {
+	s := b.Timestamp
+	// Drop the monotonic clock reading time.Time.String appends when the
+	// timestamp was taken from time.Now directly (the genesis block).
+	if i := strings.Index(s, " m="); i >= 0 {
+		s = s[:i]
+	}
+	t, err := time.Parse(blockTimeLayout, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// Change is one revision of a (bucket,key) as recorded in the block history.
+type Change struct {
+	Block     int    // index of the block that introduced the revision
+	Timestamp string // timestamp of that block
+	Bucket    string
+	Key       string
+	Value     Data
+	Owner     string
+	Version   uint64
+	UpdatedAt int64
+	Deleted   bool // signed tombstone
+	Removed   bool // physically removed (unsigned delete, bucket delete, tombstone pruning)
+}
+
+// Blocks returns the retained blocks with from <= Index <= to, oldest first
+// (a negative to means up to the last block). Stores that keep no history
+// return at most the last block.
+func (l *Ledger) Blocks(from, to int) []Block {
+	l.Lock()
+	defer l.Unlock()
+	return l.blocks(from, to)
+}
+
+func (l *Ledger) blocks(from, to int) []Block {
+	if h, ok := l.blockchain.(HistoryStore); ok {
+		return h.Range(from, to)
+	}
+	last := l.blockchain.Last()
+	if last.Index >= from && (to < 0 || last.Index <= to) {
+		return []Block{last}
+	}
+	return nil
+}
+
+// History returns the revisions of the entries in bucket (or in every bucket
+// if bucket is empty) matching key (or every key if key is empty), oldest
+// first. It diffs consecutive retained blocks, so only changes introduced by
+// a retained block are reported: the oldest retained block is the baseline,
+// unless it is the genesis block.
+func (l *Ledger) History(bucket, key string) []Change {
+	l.Lock()
+	blocks := l.blocks(0, -1)
+	l.Unlock()
+
+	changes := []Change{}
+	if len(blocks) == 0 {
+		return changes
+	}
+
+	prev := blocks[0]
+	if prev.Index == 0 {
+		prev = Block{}
+	} else {
+		blocks = blocks[1:]
+	}
+
+	match := func(bkt, k string) bool {
+		return (bucket == "" || bkt == bucket) && (key == "" || k == key)
+	}
+	for _, b := range blocks {
+		changes = append(changes, blockChanges(prev, b, match)...)
+		prev = b
+	}
+	return changes
+}
+
+// blockChanges returns the changes b introduced over prev for the
+// (bucket,key) pairs accepted by match, sorted by bucket and key.
+func blockChanges(prev, b Block, match func(bucket, key string) bool) []Change {
+	d := diffBlocks(prev, b)
+	var changes []Change
+
+	for bkt, kv := range d.Entries {
+		for k, e := range kv {
+			if !match(bkt, k) {
+				continue
+			}
+			changes = append(changes, Change{
+				Block: b.Index, Timestamp: b.Timestamp, Bucket: bkt, Key: k,
+				Value: e.Value, Owner: e.Owner, Version: e.Version, UpdatedAt: e.UpdatedAt, Deleted: e.Deleted,
+			})
+		}
+	}
+
+	removed := map[string][]string{}
+	for bkt, keys := range d.Removed {
+		removed[bkt] = keys
+	}
+	for _, bkt := range d.Dropped {
+		for k := range prev.Storage[bkt] {
+			removed[bkt] = append(removed[bkt], k)
+		}
+	}
+	for bkt, keys := range removed {
+		for _, k := range keys {
+			if match(bkt, k) {
+				changes = append(changes, Change{Block: b.Index, Timestamp: b.Timestamp, Bucket: bkt, Key: k, Removed: true})
+			}
+		}
+	}
+
+	// Map iteration order is random; keep the output stable.
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Bucket != changes[j].Bucket {
+			return changes[i].Bucket < changes[j].Bucket
+		}
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
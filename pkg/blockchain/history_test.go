@@ -0,0 +1,124 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/peterbourgon/diskv"
+)
+
+func indexes(blocks []Block) []int {
+	res := []int{}
+	for _, b := range blocks {
+		res = append(res, b.Index)
+	}
+	return res
+}
+
+var _ = Describe("Block history", func() {
+	It("keeps only the last block by default", func() {
+		l := New(io.Discard, &MemoryStore{})
+		l.Add("x", map[string]interface{}{"k": "1"})
+		l.Add("x", map[string]interface{}{"k": "2"})
+
+		Expect(indexes(l.Blocks(0, -1))).To(Equal([]int{2}))
+	})
+
+	It("bounds the memory history by count", func() {
+		l := New(io.Discard, &MemoryStore{Retention: Retention{Blocks: 3}})
+		for i := 0; i < 5; i++ {
+			l.Add("x", map[string]interface{}{"k": fmt.Sprint(i)})
+		}
+		Expect(indexes(l.Blocks(0, -1))).To(Equal([]int{3, 4, 5}))
+		Expect(indexes(l.Blocks(4, 4))).To(Equal([]int{4}))
+	})
+
+	It("bounds the history by age but always keeps the last block", func() {
+		m := &MemoryStore{Retention: Retention{MaxAge: time.Hour}}
+		old := time.Now().Add(-2 * time.Hour).String()
+		m.Add(Block{Index: 1, Timestamp: old})
+		m.Add(Block{Index: 2, Timestamp: old})
+		Expect(indexes(m.Range(0, -1))).To(Equal([]int{2}))
+
+		m.Add(Block{Index: 3, Timestamp: time.Now().String()})
+		Expect(indexes(m.Range(0, -1))).To(Equal([]int{3}))
+	})
+
+	It("forgets blocks superseded by a fork", func() {
+		m := &MemoryStore{Retention: Retention{Blocks: 10}}
+		for i := 1; i <= 4; i++ {
+			m.Add(Block{Index: i, Hash: "a"})
+		}
+		m.Add(Block{Index: 3, Hash: "b"})
+		Expect(indexes(m.Range(0, -1))).To(Equal([]int{1, 2, 3}))
+		b, ok := m.Get(3)
+		Expect(ok).To(BeTrue())
+		Expect(b.Hash).To(Equal("b"))
+	})
+
+	It("prunes the disk store", func() {
+		dir, err := os.MkdirTemp("", "history")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		s := NewDiskStore(diskv.New(diskv.Options{BasePath: dir}))
+		s.Retention = Retention{Blocks: 2}
+		l := New(io.Discard, s)
+		for i := 0; i < 4; i++ {
+			l.Add("x", map[string]interface{}{"k": fmt.Sprint(i)})
+		}
+		Expect(indexes(l.Blocks(0, -1))).To(Equal([]int{3, 4}))
+		_, ok := s.Get(1)
+		Expect(ok).To(BeFalse())
+		Expect(s.Last().Index).To(Equal(4))
+	})
+
+	It("reports the revisions of a key", func() {
+		l := New(io.Discard, &MemoryStore{Retention: Retention{Blocks: 100}})
+		l.Add("x", map[string]interface{}{"k": "1", "other": "a"})
+		l.Add("x", map[string]interface{}{"k": "2"})
+		l.Add("y", map[string]interface{}{"k": "unrelated"})
+		l.Delete("x", "k")
+
+		changes := l.History("x", "k")
+		Expect(changes).To(HaveLen(3))
+
+		v := ""
+		changes[0].Value.Unmarshal(&v)
+		Expect(v).To(Equal("1"))
+		changes[1].Value.Unmarshal(&v)
+		Expect(v).To(Equal("2"))
+		Expect(changes[2].Removed).To(BeTrue())
+		Expect(changes[0].Block < changes[1].Block).To(BeTrue())
+
+		Expect(l.History("", "")).To(HaveLen(5))
+	})
+
+	It("uses the oldest retained block as the baseline", func() {
+		l := New(io.Discard, &MemoryStore{Retention: Retention{Blocks: 2}})
+		l.Add("x", map[string]interface{}{"k": "1"})
+		l.Add("x", map[string]interface{}{"k": "2"})
+		l.Add("x", map[string]interface{}{"k": "3"})
+
+		changes := l.History("x", "k")
+		Expect(changes).To(HaveLen(1))
+		Expect(changes[0].Block).To(Equal(3))
+	})
+})
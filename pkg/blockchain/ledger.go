@@ -46,6 +46,22 @@ type Ledger struct {
 	ttl      time.Duration
 	clock    func() time.Time
 	warn     func(string, ...interface{})
+
+	// Delta sync (see WithDeltaSync and delta.go). snapshotEvery is zero when
+	// the ledger broadcasts whole blocks, the legacy behaviour.
+	snapshotEvery int
+	syncTicks     int
+	syncID        string
+	synced        *Block
+	resync        bool
+	heads         map[string]string
+	resyncAsked   map[string]time.Time
+
+	watchers []*watcher
+
+	// admins are the peer IDs whose signatures are required for writes to
+	// buckets with an Admin policy (see admin.go). Empty disables the check.
+	admins map[string]bool
 }
 
 // OwnershipMode selects how the ledger handles authenticated buckets.
@@ -115,7 +131,15 @@ func (l *Ledger) SetOwnership(mode OwnershipMode, r Registry, ttl time.Duration)
 
 // New returns a new ledger which writes to the writer
 func New(w io.Writer, s Store, opts ...LedgerOption) *Ledger {
-	c := &Ledger{channel: w, blockchain: s, clock: time.Now, warn: log.Printf}
+	c := &Ledger{
+		channel:     w,
+		blockchain:  s,
+		clock:       time.Now,
+		warn:        log.Printf,
+		syncID:      newSyncID(),
+		heads:       map[string]string{},
+		resyncAsked: map[string]time.Time{},
+	}
 	for _, o := range opts {
 		o(c)
 	}
@@ -148,15 +172,12 @@ func (l *Ledger) Syncronizer(ctx context.Context, t time.Duration) {
 			select {
 			case <-t.C:
 				l.Lock()
+				payload := l.syncPayload()
+				l.Unlock()
 
-				bytes, err := json.Marshal(l.blockchain.Last())
-				if err != nil {
-					log.Println(err)
+				if payload != nil {
+					l.channel.Write(payload)
 				}
-
-				l.channel.Write(compress(bytes).Bytes())
-
-				l.Unlock()
 			case <-ctx.Done():
 				return
 			}
@@ -187,7 +208,7 @@ func deCompress(b []byte) (*bytes.Buffer, error) {
 
 // Update the blockchain from a message
 func (l *Ledger) Update(f *Ledger, h *hub.Message, c chan *hub.Message) (err error) {
-	block := &Block{}
+	msg := &syncMessage{}
 
 	b, err := deCompress([]byte(h.Message))
 	if err != nil {
@@ -195,12 +216,32 @@ func (l *Ledger) Update(f *Ledger, h *hub.Message, c chan *hub.Message) (err err
 		return
 	}
 
-	err = json.Unmarshal(b.Bytes(), block)
+	err = json.Unmarshal(b.Bytes(), msg)
 	if err != nil {
 		err = errors.Wrap(err, "failed unmarshalling blockchain data")
 		return
 	}
 
+	switch {
+	case msg.ResyncFrom != "":
+		l.Lock()
+		if msg.ResyncFrom == l.syncID {
+			l.resync = true
+		}
+		l.Unlock()
+		return
+	case msg.Delta != nil:
+		l.applyDelta(msg.Origin, msg.Delta)
+		return
+	}
+
+	block := &msg.Block
+	if msg.Origin != "" {
+		l.Lock()
+		l.trackHead(msg.Origin, block.Hash, block.Hash)
+		l.Unlock()
+	}
+
 	if l.mode == OwnershipOff {
 		l.Lock()
 		// Legacy path: adopt the incoming block when it is higher (height wins),
@@ -210,7 +251,7 @@ func (l *Ledger) Update(f *Ledger, h *hub.Message, c chan *hub.Message) (err err
 		last := l.blockchain.Last()
 		if block.Index > last.Index ||
 			(block.Index == last.Index && block.Hash > last.Hash) {
-			l.blockchain.Add(*block)
+			l.appendBlock(*block)
 		}
 		l.Unlock()
 		return
@@ -248,7 +289,7 @@ func (l *Ledger) merge(cur map[string]map[string]SignedData, incoming *Block, no
 				continue
 			}
 
-			if !pol.Owned {
+			if !pol.Owned && !pol.Restricted() && !l.adminOnly(pol) {
 				// Open/legacy bucket: take the strictly higher version, else keep.
 				if !ok || in.Version > ex.Version {
 					cur[bucket][key] = in
@@ -257,7 +298,7 @@ func (l *Ledger) merge(cur map[string]map[string]SignedData, incoming *Block, no
 				continue
 			}
 
-			if reason := l.accept(bucket, key, in, ex, ok, pol, health, now); reason != "" {
+			if reason := l.authorize(bucket, key, in, ex, ok, pol, cur, health, now); reason != "" {
 				// Rejected by policy. In observe mode we log and accept anyway so
 				// operators can see violations without breaking a live network.
 				if l.mode == OwnershipObserve {
@@ -276,6 +317,18 @@ func (l *Ledger) merge(cur map[string]map[string]SignedData, incoming *Block, no
 	return cur, changed
 }
 
+// authorize checks an incoming entry against the writer restrictions of the
+// bucket, then against its ownership rules. It returns "" to accept, or the
+// rejection reason.
+func (l *Ledger) authorize(bucket, key string, in, ex SignedData, exists bool, pol BucketPolicy, cur map[string]map[string]SignedData, health map[string]Data, now time.Time) string {
+	// Tombstones over expired entries of owned buckets come from the reaper,
+	// which need not be an allowed writer: accept vets those.
+	if pol.Restricted() && !(pol.Owned && in.Deleted) && !pol.allowed(in.Owner, cur[protocol.TrustZoneKey]) {
+		return "signer is not an allowed writer of the bucket"
+	}
+	return l.accept(bucket, key, in, ex, exists, pol, health, now)
+}
+
 // accept decides whether an authenticated entry may overwrite the existing one.
 // It returns "" to accept, or a short reason describing the rejection.
 func (l *Ledger) accept(bucket, key string, in, ex SignedData, exists bool, pol BucketPolicy, health map[string]Data, now time.Time) string {
@@ -284,6 +337,21 @@ func (l *Ledger) accept(bucket, key string, in, ex SignedData, exists bool, pol
 		return "invalid signature"
 	}
 
+	// Privileged buckets take writes signed by an admin key only. Tombstones
+	// of an owned bucket are vetted below: admin-owned entries never expire,
+	// so only an admin can delete them.
+	if l.adminOnly(pol) && !l.admins[in.Owner] && !(pol.Owned && in.Deleted) {
+		return "not signed by an admin key"
+	}
+
+	if !pol.Owned {
+		// Shared bucket: any allowed writer, newest version wins.
+		if exists && in.Version <= ex.Version {
+			return "stale version"
+		}
+		return ""
+	}
+
 	if in.Deleted {
 		// A tombstone may be authored by the current owner, or by anyone once
 		// the current owner's lease has expired (the reaper). It must out-version
@@ -329,9 +397,16 @@ func (l *Ledger) accept(bucket, key string, in, ex SignedData, exists bool, pol
 		return ""
 	}
 
-	// A different owner may only take over an expired (or reclaimable-free) slot.
-	if in.Owner != l.ownerOf(key, ex, pol) && !l.expired(bucket, key, ex, pol, health, now) {
-		return "overwrite of a live entry owned by another peer"
+	// A different owner may only take over an expired slot, and only in a
+	// reclaimable bucket; otherwise the key frees up once the reaper
+	// tombstones it.
+	if in.Owner != l.ownerOf(key, ex, pol) {
+		if !l.expired(bucket, key, ex, pol, health, now) {
+			return "overwrite of a live entry owned by another peer"
+		}
+		if !pol.Reclaimable {
+			return "takeover of an expired entry in a non-reclaimable bucket"
+		}
 	}
 
 	if in.Version < ex.Version {
@@ -375,6 +450,10 @@ func (l *Ledger) ownerOf(key string, ex SignedData, pol BucketPolicy) string {
 // expired reports whether the existing entry is past its lease and may be taken
 // over by another owner.
 func (l *Ledger) expired(bucket, key string, ex SignedData, pol BucketPolicy, health map[string]Data, now time.Time) bool {
+	if l.admins[ex.Owner] {
+		// Admin keys sign offline and publish no heartbeat.
+		return false
+	}
 	switch pol.Expiry {
 	case Absolute:
 		return time.Unix(ex.UpdatedAt, 0).Add(pol.TTL).Before(now)
@@ -694,17 +773,12 @@ func (l *Ledger) commit(broadcast bool, mutate func(cur map[string]map[string]Si
 	if changed {
 		newBlock := l.blockchain.Last().NewBlock(cur)
 		if newBlock.IsValid(l.blockchain.Last()) {
-			l.blockchain.Add(newBlock)
+			l.appendBlock(newBlock)
 		}
 	}
 	var payload []byte
 	if broadcast && changed {
-		b, err := json.Marshal(l.blockchain.Last())
-		if err != nil {
-			log.Println(err)
-		} else {
-			payload = compress(b).Bytes()
-		}
+		payload = l.broadcastPayload()
 	}
 	l.Unlock()
 
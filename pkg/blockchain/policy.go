@@ -14,6 +14,8 @@ limitations under the License.
 package blockchain
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/mudler/edgevpn/pkg/protocol"
@@ -41,6 +43,36 @@ type BucketPolicy struct {
 	Expiry      ExpiryKind
 	TTL         time.Duration // only meaningful for Absolute
 	Reclaimable bool          // may a non-owner claim the key after expiry?
+
+	// Writers, if set, restricts who may sign entries in the bucket to these
+	// peer IDs. TrustZone admits the peers in the trustzone bucket as well.
+	// A bucket with either set but not Owned is shared: any allowed writer
+	// may overwrite any key.
+	Writers   []string
+	TrustZone bool
+
+	// Admin requires writes to be signed by one of the ledger admin keys,
+	// when the network declares any.
+	Admin bool
+}
+
+// Restricted reports whether only some peers may write the bucket.
+func (p BucketPolicy) Restricted() bool { return len(p.Writers) > 0 || p.TrustZone }
+
+// allowed reports whether peer may write the bucket. trustzone is the
+// current content of the trustzone bucket.
+func (p BucketPolicy) allowed(peer string, trustzone map[string]SignedData) bool {
+	for _, w := range p.Writers {
+		if w == peer {
+			return true
+		}
+	}
+	if p.TrustZone {
+		if e, ok := trustzone[peer]; ok && !e.Deleted {
+			return true
+		}
+	}
+	return false
 }
 
 // Registry maps bucket name -> policy. The zero BucketPolicy (returned for any
@@ -51,6 +83,87 @@ type Registry map[string]BucketPolicy
 // Policy returns the policy for a bucket, or the open/legacy zero value.
 func (r Registry) Policy(bucket string) BucketPolicy { return r[bucket] }
 
+// PolicySpec is the declarative form of a BucketPolicy, as written in the
+// network config:
+//
+//	ledger_policies:
+//	  inventory:
+//	    owned: true
+//	    owner: key
+//	    expiry: liveness
+//	    reclaimable: true
+//	  settings:
+//	    writers: ["12D3KooW..."]
+//	    trustzone: true
+type PolicySpec struct {
+	Owned bool `yaml:"owned,omitempty" json:"owned,omitempty"`
+	// Owner is how the owner of an entry is found: "key" (the key is the
+	// peer ID), "peerid" (the PeerID field of the value) or empty (the first
+	// signer to claim the key).
+	Owner string `yaml:"owner,omitempty" json:"owner,omitempty"`
+	// Expiry is "none" (default), "liveness" or "absolute".
+	Expiry      string   `yaml:"expiry,omitempty" json:"expiry,omitempty"`
+	TTL         string   `yaml:"ttl,omitempty" json:"ttl,omitempty"`
+	Reclaimable bool     `yaml:"reclaimable,omitempty" json:"reclaimable,omitempty"`
+	Writers     []string `yaml:"writers,omitempty" json:"writers,omitempty"`
+	TrustZone   bool     `yaml:"trustzone,omitempty" json:"trustzone,omitempty"`
+}
+
+// Policy converts the spec to a BucketPolicy.
+func (s PolicySpec) Policy() (BucketPolicy, error) {
+	p := BucketPolicy{Owned: s.Owned, Reclaimable: s.Reclaimable, Writers: s.Writers, TrustZone: s.TrustZone}
+
+	switch s.Owner {
+	case "":
+	case "key":
+		p.OwnerOf = ownerIsKey
+	case "peerid":
+		p.OwnerOf = ownerFromPeerIDField
+	default:
+		return p, fmt.Errorf("invalid owner %q (want key, peerid or empty)", s.Owner)
+	}
+
+	switch s.Expiry {
+	case "", "none":
+	case "liveness":
+		p.Expiry = Liveness
+	case "absolute":
+		p.Expiry = Absolute
+		ttl, err := time.ParseDuration(s.TTL)
+		if err != nil || ttl <= 0 {
+			return p, fmt.Errorf("absolute expiry needs a positive ttl, got %q", s.TTL)
+		}
+		p.TTL = ttl
+	default:
+		return p, fmt.Errorf("invalid expiry %q (want none, liveness or absolute)", s.Expiry)
+	}
+
+	if !p.Owned && (p.OwnerOf != nil || p.Expiry != NoExpiry || p.Reclaimable) {
+		return p, errors.New("owner, expiry and reclaimable only apply to owned buckets")
+	}
+	return p, nil
+}
+
+// Extend returns a copy of r with the policies in specs added. Buckets that
+// already have a policy (the built-in ones) cannot be redefined.
+func (r Registry) Extend(specs map[string]PolicySpec) (Registry, error) {
+	out := Registry{}
+	for k, v := range r {
+		out[k] = v
+	}
+	for bucket, spec := range specs {
+		if _, ok := r[bucket]; ok {
+			return nil, fmt.Errorf("bucket %q has a built-in policy", bucket)
+		}
+		p, err := spec.Policy()
+		if err != nil {
+			return nil, fmt.Errorf("bucket %q: %w", bucket, err)
+		}
+		out[bucket] = p
+	}
+	return out, nil
+}
+
 // ownerIsKey is the OwnerOf for buckets where the key itself is the owner
 // peer.ID (users, healthcheck).
 func ownerIsKey(key string, _ Data) string { return key }
@@ -76,12 +189,37 @@ func DefaultRegistry(ttl time.Duration) Registry {
 		// nil OwnerOf means the first signer to claim a name owns it (first-claim
 		// + lease). This blocks hijacking an existing name; constraining which
 		// names/targets a peer may register (e.g. rejecting ".*" catch-alls) is
-		// further hardening tracked separately.
-		protocol.DNSKey: {Owned: true, OwnerOf: nil, Expiry: Liveness, Reclaimable: true},
+		// further hardening tracked separately. Networks that declare admin keys
+		// restrict it to admin-signed records.
+		protocol.DNSKey: {Owned: true, OwnerOf: nil, Expiry: Liveness, Reclaimable: true, Admin: true},
+		// The trust zone buckets decide which peers are trusted and how they
+		// authenticate: open unless the network declares admin keys, then
+		// admin-signed only.
+		protocol.TrustZoneKey:     {Admin: true},
+		protocol.TrustZoneAuthKey: {Admin: true},
 		// egress advertises a node as an HTTP egress; the key is the peer.ID, so
 		// the owner is the key. Signing it stops a peer from forging egress
 		// entries for others (which would let it intercept proxied traffic).
 		protocol.EgressService: {Owned: true, OwnerOf: ownerIsKey, Expiry: Liveness},
+		// exitnodes advertises the VPN nodes routing traffic out of the
+		// network, keyed by their peer.ID: like egress, signing it stops a
+		// peer from posing as someone else's exit.
+		protocol.ExitNodeKey: {Owned: true, OwnerOf: ownerIsKey, Expiry: Liveness},
+		// firewall holds the packet filter of each VPN peer, keyed by its
+		// peer.ID: only the peer can change the rules others see for it.
+		protocol.FirewallKey: {Owned: true, OwnerOf: ownerIsKey, Expiry: Liveness},
+		// multicast holds the groups each VPN peer listens to, keyed by its
+		// peer.ID: only the peer can subscribe itself.
+		protocol.MulticastKey: {Owned: true, OwnerOf: ownerIsKey, Expiry: Liveness},
+		// dhcpleases holds the addresses given by DHCP, each owned by the
+		// peer holding it, which renews it while it runs.
+		protocol.DHCPLeasesKey: {Owned: true, OwnerOf: ownerFromPeerIDField, Expiry: Liveness, Reclaimable: true},
+		// dhcpreservations pins addresses to peers or hostnames: open unless
+		// the network declares admin keys, then admin-signed only.
+		protocol.DHCPReservedKey: {Admin: true},
+		// trafficlimits caps the VPN traffic of peers, keyed by peer.ID: set
+		// by the network operators, not by the limited peers themselves.
+		protocol.TrafficLimitsKey: {Admin: true},
 		// NOTE: the "dhcp" bucket (IP-lease leader election) is intentionally left
 		// open. Its single shared "leader" key changes owner as leadership hands
 		// off, so self-owning it would stall handoff for a TTL; and the reader
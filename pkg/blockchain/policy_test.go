@@ -15,6 +15,7 @@ package blockchain
 
 import (
 	"encoding/json"
+	"io"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -62,4 +63,106 @@ var _ = Describe("Policy & liveness", func() {
 			Expect(r.Policy("some-unregistered-bucket").Owned).To(BeFalse())
 		})
 	})
+
+	Describe("Declared policies", func() {
+		It("converts specs and refuses to redefine built-in buckets", func() {
+			r, err := DefaultRegistry(time.Minute).Extend(map[string]PolicySpec{
+				"inventory": {Owned: true, Owner: "key", Expiry: "absolute", TTL: "1h"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Policy("inventory").Owned).To(BeTrue())
+			Expect(r.Policy("inventory").TTL).To(Equal(time.Hour))
+			Expect(r.Policy("inventory").OwnerOf("peerZ", "")).To(Equal("peerZ"))
+
+			_, err = DefaultRegistry(time.Minute).Extend(map[string]PolicySpec{protocol.MachinesLedgerKey: {}})
+			Expect(err).To(HaveOccurred())
+			_, err = DefaultRegistry(time.Minute).Extend(map[string]PolicySpec{"x": {Expiry: "absolute"}})
+			Expect(err).To(HaveOccurred())
+			_, err = DefaultRegistry(time.Minute).Extend(map[string]PolicySpec{"x": {Owner: "key"}})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("only admits allowed writers to a restricted bucket", func() {
+			a, b := newTestSigner(), newTestSigner()
+			r, err := DefaultRegistry(time.Minute).Extend(map[string]PolicySpec{
+				"settings": {Writers: []string{a.ID()}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			l := New(io.Discard, &MemoryStore{}, WithEnforcedOwnership(r, time.Minute), WithClock(func() time.Time { return now }))
+
+			feed(l, map[string]map[string]SignedData{
+				"settings": {"mtu": mkSignedEntry(b, "settings", "mtu", 1200, 1, now)},
+			})
+			_, found := l.GetKey("settings", "mtu")
+			Expect(found).To(BeFalse())
+
+			feed(l, map[string]map[string]SignedData{
+				"settings": {"mtu": mkSignedEntry(a, "settings", "mtu", 1400, 1, now)},
+			})
+			v, found := l.GetKey("settings", "mtu")
+			Expect(found).To(BeTrue())
+			Expect(string(v)).To(Equal("1400"))
+		})
+
+		It("keeps expired entries of non-reclaimable buckets from other peers", func() {
+			a, b := newTestSigner(), newTestSigner()
+			r, err := DefaultRegistry(time.Minute).Extend(map[string]PolicySpec{
+				"locks":  {Owned: true, Expiry: "absolute", TTL: "1m"},
+				"leases": {Owned: true, Expiry: "absolute", TTL: "1m", Reclaimable: true},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			clock := now
+			l := New(io.Discard, &MemoryStore{}, WithEnforcedOwnership(r, time.Minute), WithClock(func() time.Time { return clock }))
+
+			for _, bucket := range []string{"locks", "leases"} {
+				feed(l, map[string]map[string]SignedData{
+					bucket: {"k": mkSignedEntry(a, bucket, "k", "a", 1, now)},
+				})
+			}
+			clock = now.Add(2 * time.Minute)
+			for _, bucket := range []string{"locks", "leases"} {
+				feed(l, map[string]map[string]SignedData{
+					bucket: {"k": mkSignedEntry(b, bucket, "k", "b", 2, clock)},
+				})
+			}
+
+			v, _ := l.GetKey("locks", "k")
+			Expect(string(v)).To(Equal(`"a"`))
+			v, _ = l.GetKey("leases", "k")
+			Expect(string(v)).To(Equal(`"b"`))
+		})
+
+		It("admits trustzone members to a shared bucket", func() {
+			a, b := newTestSigner(), newTestSigner()
+			r, err := DefaultRegistry(time.Minute).Extend(map[string]PolicySpec{
+				"settings": {TrustZone: true},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			l := New(io.Discard, &MemoryStore{}, WithEnforcedOwnership(r, time.Minute), WithClock(func() time.Time { return now }))
+			feed(l, map[string]map[string]SignedData{
+				protocol.TrustZoneKey: {a.ID(): {Value: `""`}, b.ID(): {Value: `""`}},
+			})
+
+			feed(l, map[string]map[string]SignedData{
+				"settings": {"mtu": mkSignedEntry(a, "settings", "mtu", 1400, 1, now)},
+			})
+			// Shared bucket: another member overwrites with a newer version,
+			// but not with a stale one.
+			feed(l, map[string]map[string]SignedData{
+				"settings": {"mtu": mkSignedEntry(b, "settings", "mtu", 1300, 2, now)},
+			})
+			feed(l, map[string]map[string]SignedData{
+				"settings": {"mtu": mkSignedEntry(a, "settings", "mtu", 1500, 2, now)},
+			})
+			v, _ := l.GetKey("settings", "mtu")
+			Expect(string(v)).To(Equal("1300"))
+
+			outsider := newTestSigner()
+			feed(l, map[string]map[string]SignedData{
+				"settings": {"mtu": mkSignedEntry(outsider, "settings", "mtu", 9000, 3, now)},
+			})
+			v, _ = l.GetKey("settings", "mtu")
+			Expect(string(v)).To(Equal("1300"))
+		})
+	})
 })
@@ -0,0 +1,222 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// KeyField is the path that designates the ledger key of an entry in a
+// filter, rather than a field of its value.
+const KeyField = "$key"
+
+// filterOps are the supported comparison operators, longest first so that
+// parsing picks "==" over "=".
+var filterOps = []string{"==", "!=", "=~", "!~", ">=", "<=", ">", "<"}
+
+// Filter is a condition on a field of the JSON values of a bucket.
+type Filter struct {
+	// Path is a dot-separated path in the value (e.g. "OS" or
+	// "Labels.zone"), or KeyField.
+	Path  string
+	Op    string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// ParseFilter parses an expression such as "OS==linux", "Version!=v1",
+// "Hostname=~^edge-" or "Load<0.5".
+func ParseFilter(s string) (Filter, error) {
+	for _, op := range filterOps {
+		if i := strings.Index(s, op); i > 0 {
+			f := Filter{Path: strings.TrimSpace(s[:i]), Op: op, Value: strings.TrimSpace(s[i+len(op):])}
+			if op == "=~" || op == "!~" {
+				re, err := regexp.Compile(f.Value)
+				if err != nil {
+					return f, errors.Wrapf(err, "invalid regular expression in %q", s)
+				}
+				f.re = re
+			}
+			return f, nil
+		}
+	}
+	return Filter{}, errors.Errorf("invalid filter %q: expected <field><op><value> with op one of %s", s, strings.Join(filterOps, " "))
+}
+
+// Match reports whether the entry key, with decoded JSON value v, satisfies
+// the filter. A missing field only satisfies != and !~.
+func (f Filter) Match(key string, v interface{}) bool {
+	var (
+		field interface{}
+		ok    bool
+	)
+	if f.Path == KeyField {
+		field, ok = key, true
+	} else {
+		field, ok = lookup(v, f.Path)
+	}
+	if !ok {
+		return f.Op == "!=" || f.Op == "!~"
+	}
+
+	s := fieldString(field)
+	switch f.Op {
+	case "==":
+		return s == f.Value
+	case "!=":
+		return s != f.Value
+	case "=~":
+		return f.re.MatchString(s)
+	case "!~":
+		return !f.re.MatchString(s)
+	}
+
+	// Ordering: numeric when both sides are numbers, lexical otherwise.
+	cmp := strings.Compare(s, f.Value)
+	if a, err := strconv.ParseFloat(s, 64); err == nil {
+		if b, err := strconv.ParseFloat(f.Value, 64); err == nil {
+			switch {
+			case a < b:
+				cmp = -1
+			case a > b:
+				cmp = 1
+			default:
+				cmp = 0
+			}
+		}
+	}
+	switch f.Op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// Query selects the entries of a bucket matching every filter, and
+// optionally only some fields of their values.
+type Query struct {
+	Filters []Filter
+	// Fields, if not empty, are the paths kept in each result.
+	Fields []string
+}
+
+// ParseQuery builds a Query from filter expressions (see ParseFilter) and
+// field paths.
+func ParseQuery(filters, fields []string) (Query, error) {
+	q := Query{}
+	for _, s := range filters {
+		if s == "" {
+			continue
+		}
+		f, err := ParseFilter(s)
+		if err != nil {
+			return q, err
+		}
+		q.Filters = append(q.Filters, f)
+	}
+	for _, f := range fields {
+		if f = strings.TrimSpace(f); f != "" {
+			q.Fields = append(q.Fields, f)
+		}
+	}
+	return q, nil
+}
+
+// Query returns the decoded values of the live entries of bucket that match
+// q, by key. With q.Fields set each value is reduced to an object holding
+// those paths (dotted paths are kept as nested objects). Values that are not
+// valid JSON never match.
+func (l *Ledger) Query(bucket string, q Query) map[string]interface{} {
+	res := map[string]interface{}{}
+	for k, d := range l.CurrentData()[bucket] {
+		var v interface{}
+		if err := d.Unmarshal(&v); err != nil {
+			continue
+		}
+		match := true
+		for _, f := range q.Filters {
+			if !f.Match(k, v) {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		if len(q.Fields) > 0 {
+			v = project(v, q.Fields)
+		}
+		res[k] = v
+	}
+	return res
+}
+
+func lookup(v interface{}, path string) (interface{}, bool) {
+	for _, p := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[p]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func project(v interface{}, fields []string) map[string]interface{} {
+	out := map[string]interface{}{}
+	for _, path := range fields {
+		field, ok := lookup(v, path)
+		if !ok {
+			continue
+		}
+		parts := strings.Split(path, ".")
+		m := out
+		for _, p := range parts[:len(parts)-1] {
+			next, ok := m[p].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				m[p] = next
+			}
+			m = next
+		}
+		m[parts[len(parts)-1]] = field
+	}
+	return out
+}
+
+func fieldString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case nil:
+		return "null"
+	}
+	return fmt.Sprint(v)
+}
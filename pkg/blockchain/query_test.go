@@ -0,0 +1,76 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"io"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Queries", func() {
+	var l *Ledger
+
+	BeforeEach(func() {
+		l = New(io.Discard, &MemoryStore{})
+		l.Add("machines", map[string]interface{}{
+			"a": map[string]interface{}{"Hostname": "a", "OS": "linux", "Address": "10.1.0.1", "Labels": map[string]interface{}{"zone": "eu"}, "Load": 0.2},
+			"b": map[string]interface{}{"Hostname": "b", "OS": "linux", "Address": "10.1.0.2", "Labels": map[string]interface{}{"zone": "us"}, "Load": 10},
+			"c": map[string]interface{}{"Hostname": "c", "OS": "darwin", "Address": "10.1.0.3"},
+			"d": "not an object",
+		})
+	})
+
+	query := func(filters []string, fields ...string) map[string]interface{} {
+		q, err := ParseQuery(filters, fields)
+		Expect(err).NotTo(HaveOccurred())
+		return l.Query("machines", q)
+	}
+
+	It("filters on fields and nested paths", func() {
+		Expect(query([]string{"OS==linux"})).To(HaveLen(2))
+		Expect(query([]string{"OS==linux", "Labels.zone==eu"})).To(HaveKey("a"))
+		Expect(query([]string{"OS==linux", "Labels.zone==eu"})).To(HaveLen(1))
+		// A missing field satisfies only the negated operators.
+		Expect(query([]string{"Labels.zone!=eu"})).To(SatisfyAll(HaveKey("b"), HaveKey("c"), Not(HaveKey("a"))))
+		Expect(query([]string{"Hostname=~^[ab]$"})).To(HaveLen(2))
+		Expect(query([]string{"$key==c"})).To(HaveKey("c"))
+	})
+
+	It("compares numbers numerically", func() {
+		res := query([]string{"Load<5"})
+		Expect(res).To(HaveLen(1))
+		Expect(res).To(HaveKey("a"))
+		Expect(query([]string{"Load>=0.2"})).To(HaveLen(2))
+	})
+
+	It("projects fields", func() {
+		res := query([]string{"OS==linux"}, "Hostname", "Labels.zone")
+		Expect(res["a"]).To(Equal(map[string]interface{}{
+			"Hostname": "a",
+			"Labels":   map[string]interface{}{"zone": "eu"},
+		}))
+		Expect(query(nil, "Address")).To(HaveKeyWithValue("c", map[string]interface{}{"Address": "10.1.0.3"}))
+	})
+
+	It("rejects malformed filters", func() {
+		_, err := ParseQuery([]string{"OS"}, nil)
+		Expect(err).To(HaveOccurred())
+		_, err = ParseQuery([]string{"==linux"}, nil)
+		Expect(err).To(HaveOccurred())
+		_, err = ParseQuery([]string{"Hostname=~("}, nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,182 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/pkg/errors"
+)
+
+// SnapshotVersion is the version of the snapshot file format.
+const SnapshotVersion = 1
+
+// Snapshot is a portable dump of the ledger state, signatures included.
+type Snapshot struct {
+	Version int
+	// Index and Hash identify the block the snapshot was taken from. They
+	// are informative only: importing creates a new block.
+	Index   int
+	Hash    string
+	Storage map[string]map[string]SignedData
+}
+
+// ImportResult reports what Import did with each entry of a snapshot.
+type ImportResult struct {
+	Imported int
+	// Unsigned counts the imported entries that carry no signature (written
+	// by nodes running with ownership disabled); they cannot be verified.
+	Unsigned int
+	// Stale counts the entries skipped because the ledger already holds the
+	// same or a newer version.
+	Stale int
+	// Rejected lists the "bucket/key" of the entries whose signature did not
+	// verify or that the bucket policy refuses, with the reason.
+	Rejected []string
+}
+
+// Snapshot returns the current ledger state.
+func (l *Ledger) Snapshot() Snapshot {
+	l.Lock()
+	defer l.Unlock()
+	last := l.blockchain.Last()
+	return Snapshot{
+		Version: SnapshotVersion,
+		Index:   last.Index,
+		Hash:    last.Hash,
+		Storage: copyStorage(last.Storage),
+	}
+}
+
+// Import seeds the ledger with the entries of a snapshot, in a single new
+// block that is not broadcast. Signed entries are verified again, whatever
+// produced the file, and go through the same policy checks as the entries
+// merged from peers; an entry only replaces one the ledger holds if its
+// version is newer. Unsigned entries are only taken in buckets without
+// ownership or writer restrictions, and never over a signed entry.
+func (l *Ledger) Import(s Snapshot) ImportResult {
+	res := ImportResult{}
+	l.commit(false, func(cur map[string]map[string]SignedData) bool {
+		health := projectValues(cur[protocol.HealthCheckKey])
+		now := l.clock()
+		for b, kv := range s.Storage {
+			pol := l.registry.Policy(b)
+			guarded := pol.Owned || pol.Restricted() || pol.Admin
+			if cur[b] == nil {
+				cur[b] = map[string]SignedData{}
+			}
+			for k, e := range kv {
+				ex, exists := cur[b][k]
+				if exists && sameEntry(ex, e) {
+					res.Stale++
+					continue
+				}
+				if err := l.importable(b, k, e, ex, exists, pol, guarded, cur, health, now); err == errStale {
+					res.Stale++
+					continue
+				} else if err != nil {
+					res.Rejected = append(res.Rejected, fmt.Sprintf("%s/%s: %v", b, k, err))
+					continue
+				}
+				cur[b][k] = e
+				res.Imported++
+				if !isSigned(e) {
+					res.Unsigned++
+				}
+			}
+		}
+		return res.Imported > 0
+	})
+	sort.Strings(res.Rejected)
+	return res
+}
+
+// errStale is returned by importable for entries the ledger already holds a
+// newer version of.
+var errStale = errors.New("stale version")
+
+// importable checks whether the snapshot entry in may replace ex.
+func (l *Ledger) importable(bucket, key string, in, ex SignedData, exists bool, pol BucketPolicy, guarded bool, cur map[string]map[string]SignedData, health map[string]Data, now time.Time) error {
+	if !isSigned(in) {
+		switch {
+		case guarded:
+			return errors.New("unsigned entry in a protected bucket")
+		case exists && isSigned(ex):
+			return errors.New("unsigned entry over a signed one")
+		}
+		return nil
+	}
+	if err := Verify(bucket, key, in); err != nil {
+		return err
+	}
+	if exists && ex.Version >= in.Version {
+		return errStale
+	}
+	if guarded {
+		if reason := l.authorize(bucket, key, in, ex, exists, pol, cur, health, now); reason != "" {
+			return errors.New(reason)
+		}
+	}
+	return nil
+}
+
+// isSigned reports whether an entry carries an owner claim, as opposed to a
+// legacy bare value.
+func isSigned(e SignedData) bool { return e.Owner != "" || e.Sig != nil }
+
+// WriteSnapshot encodes s as JSON to w, gzipped if compressed is set.
+func WriteSnapshot(w io.Writer, s Snapshot, compressed bool) error {
+	if !compressed {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	}
+	gz := gzip.NewWriter(w)
+	if err := json.NewEncoder(gz).Encode(s); err != nil {
+		gz.Close()
+		return err
+	}
+	return gz.Close()
+}
+
+// ReadSnapshot decodes a snapshot written by WriteSnapshot. Gzipped input is
+// detected automatically.
+func ReadSnapshot(r io.Reader) (Snapshot, error) {
+	s := Snapshot{}
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return s, errors.Wrap(err, "failed opening gzip snapshot")
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return s, errors.Wrap(err, "failed decoding snapshot")
+	}
+	if s.Version > SnapshotVersion {
+		return s, errors.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	return s, nil
+}
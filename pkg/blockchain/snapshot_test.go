@@ -0,0 +1,122 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/protocol"
+)
+
+var _ = Describe("Snapshot export and import", func() {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, compressed := range []bool{false, true} {
+		compressed := compressed
+		It("round-trips through a file", func() {
+			s := newTestSigner()
+			l := New(io.Discard, &MemoryStore{}, WithSigner(s))
+			l.Add(protocol.TrustZoneKey, map[string]interface{}{"peer": "ok"})
+			l.Add("plain", map[string]interface{}{"k": "v"})
+
+			buf := &bytes.Buffer{}
+			Expect(WriteSnapshot(buf, l.Snapshot(), compressed)).To(Succeed())
+			snap, err := ReadSnapshot(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snap.Index).To(Equal(l.Index()))
+
+			fresh := New(io.Discard, &MemoryStore{})
+			res := fresh.Import(snap)
+			Expect(res.Rejected).To(BeEmpty())
+			Expect(res.Imported).To(Equal(2))
+			Expect(fresh.CurrentStorage()).To(Equal(l.CurrentStorage()))
+		})
+	}
+
+	It("verifies signed entries instead of trusting the file", func() {
+		s := newTestSigner()
+		good := mkSignedEntry(s, protocol.TrustZoneKey, "a", "x", 1, now)
+		forged := mkSignedEntry(s, protocol.TrustZoneKey, "b", "x", 1, now)
+		forged.Value = Data(`"tampered"`)
+
+		l := New(io.Discard, &MemoryStore{})
+		res := l.Import(Snapshot{Storage: map[string]map[string]SignedData{
+			protocol.TrustZoneKey: {"a": good, "b": forged},
+		}})
+
+		Expect(res.Imported).To(Equal(1))
+		Expect(res.Rejected).To(HaveLen(1))
+		Expect(res.Rejected[0]).To(HavePrefix(protocol.TrustZoneKey + "/b"))
+		Expect(l.CurrentStorage()[protocol.TrustZoneKey]).NotTo(HaveKey("b"))
+	})
+
+	It("keeps newer entries the ledger already holds", func() {
+		s := newTestSigner()
+		l := New(io.Discard, &MemoryStore{})
+		l.Import(Snapshot{Storage: map[string]map[string]SignedData{"b": {"k": mkSignedEntry(s, "b", "k", "new", 5, now)}}})
+
+		res := l.Import(Snapshot{Storage: map[string]map[string]SignedData{"b": {"k": mkSignedEntry(s, "b", "k", "old", 2, now)}}})
+		Expect(res.Imported).To(BeZero())
+		Expect(res.Stale).To(Equal(1))
+		Expect(l.CurrentStorage()["b"]["k"].Version).To(Equal(uint64(5)))
+	})
+
+	It("never lets an unsigned entry replace a signed one", func() {
+		s := newTestSigner()
+		l := New(io.Discard, &MemoryStore{})
+		l.Import(Snapshot{Storage: map[string]map[string]SignedData{
+			protocol.TrustZoneKey: {"a": mkSignedEntry(s, protocol.TrustZoneKey, "a", "x", 1, now)},
+		}})
+
+		res := l.Import(Snapshot{Storage: map[string]map[string]SignedData{
+			protocol.TrustZoneKey: {"a": {Value: Data(`"forged"`)}, "b": {Value: Data(`"new"`)}},
+		}})
+		Expect(res.Imported).To(Equal(1))
+		Expect(res.Unsigned).To(Equal(1))
+		Expect(res.Rejected).To(ConsistOf(ContainSubstring(protocol.TrustZoneKey + "/a")))
+		Expect(l.CurrentStorage()[protocol.TrustZoneKey]["a"].Owner).To(Equal(s.ID()))
+	})
+
+	It("checks entries against the bucket policies", func() {
+		owner, other := newTestSigner(), newTestSigner()
+		l := enforcedLedger(time.Minute, now)
+		l.Import(Snapshot{Storage: heartbeat(owner, now)})
+		l.Import(Snapshot{Storage: map[string]map[string]SignedData{
+			protocol.MachinesLedgerKey: {"10.1.0.1": mkSignedEntry(owner, protocol.MachinesLedgerKey, "10.1.0.1", machine(owner.ID(), "10.1.0.1"), 1, now)},
+		}})
+
+		res := l.Import(Snapshot{Storage: map[string]map[string]SignedData{
+			protocol.MachinesLedgerKey: {
+				// A live entry of another peer
+				"10.1.0.1": mkSignedEntry(other, protocol.MachinesLedgerKey, "10.1.0.1", machine(other.ID(), "10.1.0.1"), 2, now),
+				"10.1.0.2": {Value: Data(`{"PeerID":"x","Address":"10.1.0.2"}`)},
+			},
+		}})
+		Expect(res.Imported).To(BeZero())
+		Expect(res.Rejected).To(HaveLen(2))
+		Expect(res.Rejected[0]).To(ContainSubstring("owned by another peer"))
+		Expect(res.Rejected[1]).To(ContainSubstring("unsigned entry in a protected bucket"))
+		Expect(storedOwner(l, protocol.MachinesLedgerKey, "10.1.0.1")).To(Equal(owner.ID()))
+	})
+
+	It("rejects snapshots from a newer format", func() {
+		_, err := ReadSnapshot(bytes.NewBufferString(`{"Version": 99}`))
+		Expect(err).To(HaveOccurred())
+	})
+})
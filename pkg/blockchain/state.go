@@ -0,0 +1,105 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/peterbourgon/diskv"
+	"github.com/pkg/errors"
+)
+
+// Store backends for a --ledger-state directory.
+const (
+	// StoreDisk keeps one diskv file per block (the historical format).
+	StoreDisk = "disk"
+	// StoreBolt keeps the chain in a single bbolt database, BoltFile.
+	StoreBolt = "bolt"
+)
+
+// BoltFile is the name of the database file StoreBolt keeps in the state
+// directory.
+const BoltFile = "ledger.db"
+
+// StateOptions configures OpenStateDir.
+type StateOptions struct {
+	// Backend is StoreDisk or StoreBolt. Empty picks StoreBolt if the
+	// directory holds a BoltFile, StoreDisk otherwise.
+	Backend string
+	// NoSync disables the fsync after each block (StoreBolt only).
+	NoSync bool
+	// Retention bounds the block history kept.
+	Retention Retention
+}
+
+// OpenStateDir opens the ledger store kept in dir, creating it if needed.
+// Opening a directory that holds diskv blocks with StoreBolt for the first
+// time copies them into the database; the diskv files are left in place and
+// can be removed once the node runs fine.
+func OpenStateDir(dir string, o StateOptions) (PersistentStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	backend := o.Backend
+	if backend == "" {
+		backend = StoreDisk
+		if _, err := os.Stat(filepath.Join(dir, BoltFile)); err == nil {
+			backend = StoreBolt
+		}
+	}
+
+	disk := NewDiskStore(diskv.New(diskv.Options{
+		BasePath:     dir,
+		CacheSizeMax: uint64(50), // 50MB
+	}))
+
+	switch backend {
+	case StoreDisk:
+		disk.Retention = o.Retention
+		return disk, nil
+	case StoreBolt:
+		s, err := OpenBoltStore(filepath.Join(dir, BoltFile), o.NoSync)
+		if err != nil {
+			return nil, err
+		}
+		if len(s.indexes()) == 0 && len(disk.indexes()) > 0 {
+			if _, err := CopyBlocks(disk, s); err != nil {
+				s.Close()
+				return nil, errors.Wrap(err, "migrating diskv blocks")
+			}
+		}
+		s.Retention = o.Retention
+		return s, nil
+	}
+	return nil, errors.Errorf("unknown ledger store %q", backend)
+}
+
+// CopyBlocks adds every block held by from to to, oldest first, and returns
+// how many were copied. The last block of from ends up as the last block of
+// to.
+func CopyBlocks(from HistoryStore, to Store) (int, error) {
+	blocks := from.Range(0, -1)
+	if len(blocks) == 0 {
+		return 0, nil
+	}
+	for _, b := range blocks {
+		to.Add(b)
+	}
+	if last := to.Last(); last.Hash != blocks[len(blocks)-1].Hash {
+		return 0, errors.Errorf("copy ended at block %d, expected %d", last.Index, blocks[len(blocks)-1].Index)
+	}
+	return len(blocks), nil
+}
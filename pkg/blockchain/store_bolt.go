@@ -0,0 +1,198 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltBlocks = []byte("blocks")
+	boltMeta   = []byte("meta")
+	boltIndex  = []byte("index")
+	boltFirst  = []byte("first")
+)
+
+// BoltStore keeps the chain in a single bbolt database file. A block and the
+// index pointing at it are written in one transaction, so a crash leaves
+// either the old or the new last block, never a torn one. Retention works as
+// for DiskStore.
+type BoltStore struct {
+	db *bolt.DB
+
+	Retention Retention
+}
+
+// OpenBoltStore opens (creating it if needed) the database at path. With
+// noSync the file is not fsynced after every block: writes are much cheaper
+// on slow flash, but the last blocks may be lost on power failure (the
+// ledger recovers them from peers).
+func OpenBoltStore(path string, noSync bool) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, NoSync: noSync})
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltBlocks); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltMeta)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Close releases the database.
+func (m *BoltStore) Close() error { return m.db.Close() }
+
+func boltKey(index int) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(index))
+	return k
+}
+
+func (m *BoltStore) Add(b Block) {
+	dat, err := json.Marshal(b)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = m.db.Update(func(tx *bolt.Tx) error {
+		blocks, meta := tx.Bucket(boltBlocks), tx.Bucket(boltMeta)
+		if err := blocks.Put(boltKey(b.Index), dat); err != nil {
+			return err
+		}
+		// A block replacing ours at the same or a lower height supersedes the
+		// blocks we had above it.
+		var stale [][]byte
+		c := blocks.Cursor()
+		for k, _ := c.Seek(boltKey(b.Index + 1)); k != nil; k, _ = c.Next() {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		for _, k := range stale {
+			if err := blocks.Delete(k); err != nil {
+				return err
+			}
+		}
+		return meta.Put(boltIndex, boltKey(b.Index))
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if m.Retention.Bounded() {
+		pruneChain(m, m.Retention, b.Index, time.Now())
+	}
+}
+
+func (m *BoltStore) metaInt(key []byte) (int, bool) {
+	res, ok := 0, false
+	m.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltMeta).Get(key); len(v) == 8 {
+			res, ok = int(binary.BigEndian.Uint64(v)), true
+		}
+		return nil
+	})
+	return res, ok
+}
+
+func (m *BoltStore) Len() int {
+	i, _ := m.metaInt(boltIndex)
+	return i
+}
+
+func (m *BoltStore) Last() Block {
+	i, ok := m.metaInt(boltIndex)
+	if !ok {
+		return Block{}
+	}
+	b, _ := m.Get(i)
+	return b
+}
+
+func (m *BoltStore) Get(index int) (Block, bool) {
+	b, ok := Block{}, false
+	m.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltBlocks).Get(boltKey(index)); v != nil {
+			ok = json.Unmarshal(v, &b) == nil
+		}
+		return nil
+	})
+	return b, ok
+}
+
+func (m *BoltStore) Range(from, to int) []Block {
+	res := []Block{}
+	if from < 0 {
+		from = 0
+	}
+	m.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBlocks).Cursor()
+		for k, v := c.Seek(boltKey(from)); k != nil; k, v = c.Next() {
+			if to >= 0 && int(binary.BigEndian.Uint64(k)) > to {
+				break
+			}
+			b := Block{}
+			if json.Unmarshal(v, &b) == nil {
+				res = append(res, b)
+			}
+		}
+		return nil
+	})
+	return res
+}
+
+// Compact keeps at most the last keep blocks, see CompactResult.
+func (m *BoltStore) Compact(keep int) (CompactResult, error) { return compactChain(m, keep) }
+
+// Inspect walks the blocks in the database and reports their continuity.
+func (m *BoltStore) Inspect() ChainInfo { return inspectChain(m) }
+
+func (m *BoltStore) first() int {
+	i, _ := m.metaInt(boltFirst)
+	return i
+}
+
+func (m *BoltStore) setFirst(index int) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMeta).Put(boltFirst, boltKey(index))
+	})
+}
+
+func (m *BoltStore) erase(index int) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBlocks).Delete(boltKey(index))
+	})
+}
+
+func (m *BoltStore) indexes() []int {
+	res := []int{}
+	m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBlocks).ForEach(func(k, _ []byte) error {
+			res = append(res, int(binary.BigEndian.Uint64(k)))
+			return nil
+		})
+	})
+	return res
+}
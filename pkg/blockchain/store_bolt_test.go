@@ -0,0 +1,111 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BoltStore", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "bolt")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	open := func(backend string) PersistentStore {
+		s, err := OpenStateDir(dir, StateOptions{Backend: backend})
+		Expect(err).NotTo(HaveOccurred())
+		return s
+	}
+
+	It("persists the chain across restarts", func() {
+		s := open(StoreBolt)
+		l := New(io.Discard, s)
+		l.Add("x", map[string]interface{}{"k": "1"})
+		l.Add("x", map[string]interface{}{"k": "2"})
+		last := l.LastBlock()
+		Expect(s.(*BoltStore).Close()).To(Succeed())
+
+		s = open("")
+		Expect(s).To(BeAssignableToTypeOf(&BoltStore{}))
+		defer s.(*BoltStore).Close()
+		l = New(io.Discard, s)
+		Expect(l.LastBlock()).To(Equal(last))
+		Expect(l.CurrentData()["x"]["k"]).To(Equal(Data(`"2"`)))
+		Expect(indexes(s.Range(0, -1))).To(Equal([]int{0, 1, 2}))
+	})
+
+	It("forgets blocks superseded by a fork", func() {
+		s, err := OpenBoltStore(filepath.Join(dir, BoltFile), true)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		for i := 1; i <= 4; i++ {
+			s.Add(Block{Index: i, Hash: "a"})
+		}
+		s.Add(Block{Index: 2, Hash: "b"})
+		Expect(indexes(s.Range(0, -1))).To(Equal([]int{1, 2}))
+		Expect(s.Last().Hash).To(Equal("b"))
+	})
+
+	It("prunes and compacts", func() {
+		s, err := OpenStateDir(dir, StateOptions{Backend: StoreBolt, Retention: Retention{Blocks: 5}})
+		Expect(err).NotTo(HaveOccurred())
+		defer s.(*BoltStore).Close()
+		l := New(io.Discard, s)
+		for i := 0; i < 8; i++ {
+			l.Add("x", map[string]interface{}{"k": fmt.Sprint(i)})
+		}
+		Expect(indexes(s.Range(0, -1))).To(Equal([]int{4, 5, 6, 7, 8}))
+
+		res, err := s.Compact(2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Checkpoint).To(Equal(7))
+		info := s.Inspect()
+		Expect(info.Blocks).To(Equal(2))
+		Expect(info.LastValid).To(BeTrue())
+		Expect(info.Breaks).To(BeEmpty())
+	})
+
+	It("migrates a disk state directory", func() {
+		disk := open(StoreDisk)
+		l := New(io.Discard, disk)
+		for i := 0; i < 3; i++ {
+			l.Add("x", map[string]interface{}{"k": fmt.Sprint(i)})
+		}
+		data := l.CurrentData()
+
+		s := open(StoreBolt)
+		defer s.(*BoltStore).Close()
+		Expect(indexes(s.Range(0, -1))).To(Equal(indexes(disk.Range(0, -1))))
+		Expect(New(io.Discard, s).CurrentData()).To(Equal(data))
+	})
+
+	It("rejects unknown backends", func() {
+		_, err := OpenStateDir(dir, StateOptions{Backend: "tape"})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -16,13 +16,20 @@ package blockchain
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
+	"time"
 
 	"github.com/peterbourgon/diskv"
 )
 
+// DiskStore keeps every block on disk, one key per index. A non-zero
+// Retention prunes the blocks that fall out of its bounds as new ones are
+// added.
 type DiskStore struct {
 	chain *diskv.Diskv
+
+	Retention Retention
 }
 
 func NewDiskStore(d *diskv.Diskv) *DiskStore {
@@ -30,10 +37,19 @@ func NewDiskStore(d *diskv.Diskv) *DiskStore {
 }
 
 func (m *DiskStore) Add(b Block) {
+	prev := m.Len()
 	bb, _ := json.Marshal(b)
 	m.chain.Write(fmt.Sprint(b.Index), bb)
 	m.chain.Write("index", []byte(fmt.Sprint(b.Index)))
 
+	// A block replacing ours at the same or a lower height supersedes the
+	// blocks we had above it.
+	for i := b.Index + 1; i <= prev; i++ {
+		m.chain.Erase(fmt.Sprint(i))
+	}
+	if m.Retention.Bounded() {
+		pruneChain(m, m.Retention, b.Index, time.Now())
+	}
 }
 
 func (m *DiskStore) Len() int {
@@ -59,3 +75,69 @@ func (m *DiskStore) Last() Block {
 
 	return *b
 }
+
+func (m *DiskStore) Get(index int) (Block, bool) {
+	b := Block{}
+	dat, err := m.chain.Read(fmt.Sprint(index))
+	if err != nil {
+		return b, false
+	}
+	if err := json.Unmarshal(dat, &b); err != nil {
+		return b, false
+	}
+	return b, true
+}
+
+func (m *DiskStore) Range(from, to int) []Block {
+	res := []Block{}
+	if _, err := m.chain.Read("index"); err != nil {
+		return res
+	}
+	last := m.Len()
+	if to < 0 || to > last {
+		to = last
+	}
+	if f := m.first(); from < f {
+		from = f
+	}
+	for i := from; i <= to; i++ {
+		if b, ok := m.Get(i); ok {
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
+// Compact keeps at most the last keep blocks, see CompactResult.
+func (m *DiskStore) Compact(keep int) (CompactResult, error) { return compactChain(m, keep) }
+
+// Inspect walks the blocks on disk and reports their continuity.
+func (m *DiskStore) Inspect() ChainInfo { return inspectChain(m) }
+
+func (m *DiskStore) first() int {
+	f, err := m.chain.Read("first")
+	if err != nil {
+		return 0
+	}
+	c, _ := strconv.Atoi(string(f))
+	return c
+}
+
+func (m *DiskStore) setFirst(index int) error {
+	return m.chain.Write("first", []byte(fmt.Sprint(index)))
+}
+
+func (m *DiskStore) erase(index int) error {
+	return m.chain.Erase(strconv.Itoa(index))
+}
+
+func (m *DiskStore) indexes() []int {
+	res := []int{}
+	for k := range m.chain.Keys(nil) {
+		if i, err := strconv.Atoi(k); err == nil {
+			res = append(res, i)
+		}
+	}
+	sort.Ints(res)
+	return res
+}
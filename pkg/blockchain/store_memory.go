@@ -13,19 +13,50 @@ limitations under the License.
 
 package blockchain
 
-import "sync"
+import (
+	"sort"
+	"sync"
+	"time"
+)
 
+// MemoryStore keeps the chain in memory. With a zero Retention only the last
+// block is kept; otherwise past blocks are kept within its bounds.
 type MemoryStore struct {
 	sync.Mutex
 	block *Block
+
+	Retention Retention
+	history   []Block
 }
 
 func (m *MemoryStore) Add(b Block) {
 	m.Lock()
 	m.block = &b
+	if m.Retention.Bounded() {
+		// A block replacing ours at the same or a lower height (a fork that
+		// won) supersedes everything we had from there on.
+		i := sort.Search(len(m.history), func(i int) bool { return m.history[i].Index >= b.Index })
+		m.history = append(m.history[:i], b)
+		m.prune(time.Now())
+	}
 	m.Unlock()
 }
 
+// prune drops the blocks that fell out of the retention bounds. Must be
+// called with the lock held.
+func (m *MemoryStore) prune(now time.Time) {
+	drop := 0
+	for i := range m.history {
+		if m.Retention.keep(m.history[i], len(m.history)-i, now) {
+			break
+		}
+		drop++
+	}
+	if drop > 0 {
+		m.history = append([]Block(nil), m.history[drop:]...)
+	}
+}
+
 func (m *MemoryStore) Len() int {
 	m.Lock()
 	defer m.Unlock()
@@ -40,3 +71,38 @@ func (m *MemoryStore) Last() Block {
 	defer m.Unlock()
 	return *m.block
 }
+
+func (m *MemoryStore) Get(index int) (Block, bool) {
+	m.Lock()
+	defer m.Unlock()
+	if !m.Retention.Bounded() {
+		if m.block != nil && m.block.Index == index {
+			return *m.block, true
+		}
+		return Block{}, false
+	}
+	i := sort.Search(len(m.history), func(i int) bool { return m.history[i].Index >= index })
+	if i < len(m.history) && m.history[i].Index == index {
+		return m.history[i], true
+	}
+	return Block{}, false
+}
+
+func (m *MemoryStore) Range(from, to int) []Block {
+	m.Lock()
+	defer m.Unlock()
+	blocks := m.history
+	if !m.Retention.Bounded() {
+		blocks = nil
+		if m.block != nil {
+			blocks = []Block{*m.block}
+		}
+	}
+	res := []Block{}
+	for _, b := range blocks {
+		if b.Index >= from && (to < 0 || b.Index <= to) {
+			res = append(res, b)
+		}
+	}
+	return res
+}
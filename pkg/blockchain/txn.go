@@ -0,0 +1,171 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/mudler/edgevpn/pkg/protocol"
+)
+
+var (
+	// ErrConflict is matched (errors.Is) by the error of a conditional write
+	// whose expected version is not the current one.
+	ErrConflict = errors.New("version conflict")
+	// ErrUnversioned is returned by conditional writes on a ledger without a
+	// signer: unsigned entries carry no version to compare.
+	ErrUnversioned = errors.New("conditional writes require a signing ledger (ownership enabled)")
+	// ErrForbidden is matched by the error of a write the ownership policy
+	// would make every enforcing peer reject.
+	ErrForbidden = errors.New("write rejected by ownership policy")
+)
+
+// ConflictError reports the (bucket,key) whose version did not match.
+type ConflictError struct {
+	Bucket, Key string
+	Expected    uint64
+	Actual      uint64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s/%s: expected version %d, found %d", e.Bucket, e.Key, e.Expected, e.Actual)
+}
+
+func (e *ConflictError) Unwrap() error { return ErrConflict }
+
+// Op is a single write in a Batch.
+type Op struct {
+	Bucket string
+	Key    string
+	// Value is marshalled to JSON, as with Add. Ignored when Delete is set.
+	Value  interface{} `json:",omitempty"`
+	Delete bool        `json:",omitempty"`
+	// ExpectedVersion, when set, makes the whole batch fail unless the
+	// current version of the key is this one. 0 means the key must not exist
+	// (or be deleted).
+	ExpectedVersion *uint64 `json:",omitempty"`
+}
+
+// Version returns the current version of bucket/key, 0 if it does not exist
+// or is deleted.
+func (l *Ledger) Version(bucket, key string) uint64 {
+	l.Lock()
+	defer l.Unlock()
+	return liveVersion(l.blockchain.Last().Storage[bucket], key)
+}
+
+func liveVersion(kv map[string]SignedData, key string) uint64 {
+	if e, ok := kv[key]; ok && !e.Deleted {
+		return e.Version
+	}
+	return 0
+}
+
+// AddIf writes value at bucket/key only if the key's current version is
+// expectedVersion (0: the key must not exist). It returns the entry written,
+// whose Version is the one to expect on the next write.
+//
+// The check is atomic on this node only. Two nodes can still write the same
+// version concurrently; peers then converge on one of them through the
+// ownership merge, and the loser observes a new version on its next write.
+func (l *Ledger) AddIf(bucket, key string, expectedVersion uint64, value interface{}) (SignedData, error) {
+	res, err := l.Batch([]Op{{Bucket: bucket, Key: key, Value: value, ExpectedVersion: &expectedVersion}})
+	if err != nil {
+		return SignedData{}, err
+	}
+	return res[0], nil
+}
+
+// Batch applies ops atomically: either every op is applied, in a single new
+// block, or none is. It returns the resulting entries in the order of ops.
+func (l *Ledger) Batch(ops []Op) ([]SignedData, error) {
+	var (
+		res = make([]SignedData, len(ops))
+		err error
+	)
+
+	l.commit(true, func(cur map[string]map[string]SignedData) bool {
+		now := l.clock()
+		health := map[string]Data(nil)
+		changed := false
+
+		for i, op := range ops {
+			if op.ExpectedVersion != nil {
+				if l.signer == nil {
+					err = ErrUnversioned
+					return false
+				}
+				if v := liveVersion(cur[op.Bucket], op.Key); v != *op.ExpectedVersion {
+					err = &ConflictError{Bucket: op.Bucket, Key: op.Key, Expected: *op.ExpectedVersion, Actual: v}
+					return false
+				}
+			}
+
+			if cur[op.Bucket] == nil {
+				cur[op.Bucket] = map[string]SignedData{}
+			}
+			prev, exists := cur[op.Bucket][op.Key]
+
+			var ne SignedData
+			switch {
+			case op.Delete && l.signer == nil:
+				if exists {
+					delete(cur[op.Bucket], op.Key)
+					changed = true
+				}
+				continue
+			case op.Delete:
+				if !exists || prev.Deleted {
+					res[i] = prev
+					continue
+				}
+				ne = l.makeTombstone(op.Bucket, op.Key, prev, now)
+			default:
+				dat, merr := json.Marshal(op.Value)
+				if merr != nil {
+					err = fmt.Errorf("%s/%s: %w", op.Bucket, op.Key, merr)
+					return false
+				}
+				ne = l.makeEntry(op.Bucket, op.Key, Data(string(dat)), prev, now)
+			}
+
+			if l.mode == OwnershipEnforce && ne.Sig != nil {
+				pol := l.registry.Policy(op.Bucket)
+				if pol.Owned || pol.Restricted() || l.adminOnly(pol) {
+					if health == nil {
+						health = projectValues(cur[protocol.HealthCheckKey])
+					}
+					if reason := l.authorize(op.Bucket, op.Key, ne, prev, exists, pol, cur, health, now); reason != "" {
+						err = fmt.Errorf("%s/%s: %s: %w", op.Bucket, op.Key, reason, ErrForbidden)
+						return false
+					}
+				}
+			}
+
+			if !exists || !sameEntry(prev, ne) {
+				cur[op.Bucket][op.Key] = ne
+				changed = true
+			}
+			res[i] = ne
+		}
+		return changed
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
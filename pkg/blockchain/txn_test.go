@@ -0,0 +1,111 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/protocol"
+)
+
+var _ = Describe("Conditional writes", func() {
+	var l *Ledger
+
+	BeforeEach(func() {
+		l = New(io.Discard, &MemoryStore{}, WithSigner(newTestSigner()))
+	})
+
+	It("writes only over the expected version", func() {
+		first, err := l.AddIf("roles", "leader", 0, "a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(first.Version).NotTo(BeZero())
+		Expect(l.Version("roles", "leader")).To(Equal(first.Version))
+
+		// A second writer that still believes the key is free loses.
+		_, err = l.AddIf("roles", "leader", 0, "b")
+		Expect(errors.Is(err, ErrConflict)).To(BeTrue())
+		var conflict *ConflictError
+		Expect(errors.As(err, &conflict)).To(BeTrue())
+		Expect(conflict.Actual).To(Equal(first.Version))
+
+		second, err := l.AddIf("roles", "leader", first.Version, "b")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second.Version).To(BeNumerically(">", first.Version))
+
+		v, _ := l.GetKey("roles", "leader")
+		Expect(string(v)).To(Equal(`"b"`))
+	})
+
+	It("treats a deleted key as free", func() {
+		_, err := l.AddIf("b", "k", 0, "a")
+		Expect(err).NotTo(HaveOccurred())
+		l.Delete("b", "k")
+		_, err = l.AddIf("b", "k", 0, "again")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("requires a signing ledger", func() {
+		unsigned := New(io.Discard, &MemoryStore{})
+		_, err := unsigned.AddIf("b", "k", 0, "a")
+		Expect(err).To(MatchError(ErrUnversioned))
+	})
+
+	It("commits a batch in one block, or not at all", func() {
+		l.Add("a", map[string]interface{}{"gone": "x"})
+		index := l.Index()
+
+		zero := uint64(0)
+		res, err := l.Batch([]Op{
+			{Bucket: "a", Key: "k", Value: "1", ExpectedVersion: &zero},
+			{Bucket: "b", Key: "k", Value: "2"},
+			{Bucket: "a", Key: "gone", Delete: true},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(3))
+		Expect(res[2].Deleted).To(BeTrue())
+		Expect(l.Index()).To(Equal(index + 1))
+		Expect(l.CurrentData()["a"]).NotTo(HaveKey("gone"))
+
+		_, err = l.Batch([]Op{
+			{Bucket: "c", Key: "k", Value: "3"},
+			{Bucket: "a", Key: "k", Value: "4", ExpectedVersion: &zero},
+		})
+		Expect(errors.Is(err, ErrConflict)).To(BeTrue())
+		Expect(l.Index()).To(Equal(index + 1))
+		Expect(l.CurrentData()).NotTo(HaveKey("c"))
+	})
+
+	It("refuses writes enforcing peers would reject", func() {
+		now := time.Now()
+		owner, other := newTestSigner(), newTestSigner()
+		l := New(io.Discard, &MemoryStore{},
+			WithSigner(other),
+			WithEnforcedOwnership(DefaultRegistry(time.Hour), time.Hour),
+			WithClock(func() time.Time { return now }),
+		)
+		feed(l, heartbeat(owner, now))
+		feed(l, map[string]map[string]SignedData{protocol.MachinesLedgerKey: {
+			"10.1.0.1": mkSignedEntry(owner, protocol.MachinesLedgerKey, "10.1.0.1", machine(owner.ID(), "10.1.0.1"), 1, now),
+		}})
+
+		_, err := l.AddIf(protocol.MachinesLedgerKey, "10.1.0.1", 1, machine(other.ID(), "10.1.0.1"))
+		Expect(errors.Is(err, ErrForbidden)).To(BeTrue())
+		Expect(storedOwner(l, protocol.MachinesLedgerKey, "10.1.0.1")).To(Equal(owner.ID()))
+	})
+})
@@ -0,0 +1,123 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"context"
+	"strings"
+)
+
+// EventType is the kind of change a watch Event reports.
+type EventType string
+
+const (
+	EventAdd    EventType = "add"
+	EventUpdate EventType = "update"
+	// EventDelete is either a signed tombstone (Deleted, with the deleting
+	// peer as Owner) or a physical removal (Removed, no entry metadata).
+	EventDelete EventType = "delete"
+)
+
+// Event is a change delivered to a watcher.
+type Event struct {
+	Type EventType
+	Change
+}
+
+// watchBuffer is how many events a watcher may lag behind before it is
+// disconnected.
+const watchBuffer = 256
+
+type watcher struct {
+	bucket, prefix string
+	ch             chan Event
+	closed         bool
+	done           chan struct{} // closed with ch
+}
+
+func (w *watcher) match(bucket, key string) bool {
+	return (w.bucket == "" || w.bucket == bucket) && strings.HasPrefix(key, w.prefix)
+}
+
+// Watch delivers the changes made to the keys of bucket (every bucket if
+// empty) starting with keyPrefix, as blocks are added to the ledger, whether
+// by a local write or by adopting a peer's state. The channel is closed when
+// ctx is done, or when the watcher falls more than a few hundred events
+// behind: a consumer seeing it closed early should re-read the bucket and
+// watch again.
+func (l *Ledger) Watch(ctx context.Context, bucket, keyPrefix string) <-chan Event {
+	w := &watcher{bucket: bucket, prefix: keyPrefix, ch: make(chan Event, watchBuffer), done: make(chan struct{})}
+	l.Lock()
+	l.watchers = append(l.watchers, w)
+	l.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-w.done:
+			return
+		}
+		l.Lock()
+		l.unwatch(w)
+		l.Unlock()
+	}()
+	return w.ch
+}
+
+// unwatch removes and closes w. Must be called with the lock held.
+func (l *Ledger) unwatch(w *watcher) {
+	for i, ww := range l.watchers {
+		if ww == w {
+			l.watchers = append(l.watchers[:i], l.watchers[i+1:]...)
+			break
+		}
+	}
+	if !w.closed {
+		w.closed = true
+		close(w.ch)
+		close(w.done)
+	}
+}
+
+// appendBlock adds b to the store and notifies the watchers of what changed.
+// Must be called with the lock held; sends never block.
+func (l *Ledger) appendBlock(b Block) {
+	if len(l.watchers) == 0 {
+		l.blockchain.Add(b)
+		return
+	}
+	prev := l.blockchain.Last()
+	l.blockchain.Add(b)
+
+	for _, w := range append([]*watcher(nil), l.watchers...) {
+		for _, c := range blockChanges(prev, b, w.match) {
+			e := Event{Type: EventUpdate, Change: c}
+			if ex, ok := prev.Storage[c.Bucket][c.Key]; !ok || ex.Deleted {
+				e.Type = EventAdd
+			}
+			if c.Deleted || c.Removed {
+				e.Type = EventDelete
+			}
+			select {
+			case w.ch <- e:
+			default:
+				l.warn("ledger watcher on %q/%q is too slow, disconnecting it", w.bucket, w.prefix)
+				l.unwatch(w)
+			}
+			if w.closed {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watch", func() {
+	It("reports adds, updates and deletes on matching keys", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		s := newTestSigner()
+		l := New(io.Discard, &MemoryStore{}, WithSigner(s))
+		events := l.Watch(ctx, "dns", "ex")
+
+		l.Add("dns", map[string]interface{}{"example.com": "1", "other.com": "x"})
+		l.Add("machines", map[string]interface{}{"example.com": "ignored"})
+		l.Add("dns", map[string]interface{}{"example.com": "2"})
+		l.Delete("dns", "example.com")
+
+		var got []EventType
+		for i := 0; i < 3; i++ {
+			e := <-events
+			Expect(e.Bucket).To(Equal("dns"))
+			Expect(e.Key).To(Equal("example.com"))
+			got = append(got, e.Type)
+		}
+		Expect(got).To(Equal([]EventType{EventAdd, EventUpdate, EventDelete}))
+		Expect(events).NotTo(Receive())
+	})
+
+	It("carries the signed metadata", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		s := newTestSigner()
+		l := New(io.Discard, &MemoryStore{}, WithSigner(s))
+		events := l.Watch(ctx, "", "")
+		l.Add("b", map[string]interface{}{"k": "v"})
+
+		var e Event
+		Eventually(events).Should(Receive(&e))
+		Expect(e.Owner).To(Equal(s.ID()))
+		Expect(e.Version).NotTo(BeZero())
+		Expect(e.Block).To(Equal(l.Index()))
+	})
+
+	It("reports blocks adopted from peers", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		ra := &recorder{}
+		a := New(ra, &MemoryStore{})
+		b := New(io.Discard, &MemoryStore{})
+		events := b.Watch(ctx, "x", "")
+
+		a.Add("x", map[string]interface{}{"k": "1"})
+		deliver(b, ra.drain())
+
+		var e Event
+		Eventually(events).Should(Receive(&e))
+		Expect(e.Type).To(Equal(EventAdd))
+	})
+
+	It("closes the channel when the context is done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		l := New(io.Discard, &MemoryStore{})
+		events := l.Watch(ctx, "", "")
+		cancel()
+		Eventually(events).Should(BeClosed())
+		l.Add("x", map[string]interface{}{"k": "1"})
+	})
+
+	It("disconnects watchers that fall behind", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		l := New(io.Discard, &MemoryStore{}, WithViolationLogger(func(string, ...interface{}) {}))
+		events := l.Watch(ctx, "", "")
+		kv := map[string]interface{}{}
+		for i := 0; i <= watchBuffer; i++ {
+			kv[fmt.Sprint(i)] = i
+		}
+		l.Add("x", kv)
+
+		n := 0
+		for range events {
+			n++
+		}
+		Expect(n).To(Equal(watchBuffer))
+	})
+
+	It("does not leave a goroutine behind for a disconnected watcher", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		l := New(io.Discard, &MemoryStore{}, WithViolationLogger(func(string, ...interface{}) {}))
+		kv := map[string]interface{}{}
+		for i := 0; i <= watchBuffer; i++ {
+			kv[fmt.Sprint(i)] = i
+		}
+		before := runtime.NumGoroutine()
+		for i := 0; i < 10; i++ {
+			events := l.Watch(ctx, "", "")
+			l.Add(fmt.Sprint(i), kv)
+			for range events {
+			}
+		}
+		Eventually(runtime.NumGoroutine).Should(BeNumerically("<=", before))
+	})
+})
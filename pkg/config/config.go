@@ -16,6 +16,7 @@ package config
 import (
 	"fmt"
 	"math/bits"
+	"net/netip"
 	"os"
 	"runtime"
 	"strings"
@@ -37,10 +38,10 @@ import (
 	"github.com/mudler/edgevpn/pkg/node"
 	"github.com/mudler/edgevpn/pkg/trustzone"
 	"github.com/mudler/edgevpn/pkg/trustzone/authprovider/ecdsa"
+	"github.com/mudler/edgevpn/pkg/types"
 	"github.com/mudler/edgevpn/pkg/vpn"
 	"github.com/mudler/water"
 	"github.com/multiformats/go-multiaddr"
-	"github.com/peterbourgon/diskv"
 )
 
 // Config is the config struct for the node and the default EdgeVPN services
@@ -51,6 +52,8 @@ type Config struct {
 	ListenMaddrs                               []string
 	DHTAnnounceMaddrs                          []multiaddr.Multiaddr
 	Router                                     string
+	Routes                                     []string
+	IPv6Prefix                                 string
 	Interface                                  string
 	Libp2pLogLevel, LogLevel                   string
 	LowProfile, BootstrapIface                 bool
@@ -73,6 +76,81 @@ type Config struct {
 	Ownership Ownership
 
 	Whitelist []multiaddr.Multiaddr
+
+	// Firewall filters the VPN traffic of the node.
+	Firewall Firewall
+
+	// MSSClamp and MTUExchange fit the VPN traffic to the MTU of each
+	// peer.
+	MSSClamp, MTUExchange bool
+
+	// QoSClasses prioritize and shape the VPN traffic the node sends, in
+	// the syntax of vpn.ParseQoSClass.
+	QoSClasses []string
+
+	// Netstack runs the VPN without a TUN device.
+	Netstack Netstack
+
+	// Multicast forwards multicast and broadcast packets across the VPN.
+	Multicast Multicast
+}
+
+// Multicast forwards multicast and broadcast packets to the peers listening
+// to them, at most Rate per second. The node listens to Groups, multicast
+// addresses, and to the groups its host joins.
+type Multicast struct {
+	Enable bool
+	Groups []string
+	Rate   int
+}
+
+// Firewall holds the VPN packet filter rules, in the syntax of
+// vpn.ParseFirewallRule, and the action when none matches (allow or deny).
+type Firewall struct {
+	Rules   []string
+	Default string
+}
+
+func (f Firewall) toTypes() (types.Firewall, error) {
+	fw := types.Firewall{Default: f.Default}
+	for _, r := range f.Rules {
+		rule, err := vpn.ParseFirewallRule(r)
+		if err != nil {
+			return fw, err
+		}
+		fw.Rules = append(fw.Rules, rule)
+	}
+	return fw, nil
+}
+
+// Netstack runs the VPN on a userspace TCP/IP stack, reachable through a
+// SOCKS5/HTTP proxy listening on Proxy and through port forwards, in the
+// syntax of vpn.ParseForward. Forwards listen on the host and dial through
+// the VPN, RemoteForwards listen on the VPN and dial on the host.
+type Netstack struct {
+	Enable                   bool
+	Proxy                    string
+	DNS                      []string
+	Forwards, RemoteForwards []string
+}
+
+func (n Netstack) forwards() ([]vpn.Forward, error) {
+	var forwards []vpn.Forward
+	for _, s := range n.Forwards {
+		f, err := vpn.ParseForward(s, false)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, f)
+	}
+	for _, s := range n.RemoteForwards {
+		f, err := vpn.ParseForward(s, true)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, f)
+	}
+	return forwards, nil
 }
 
 // Ownership configures ledger ownership enforcement.
@@ -109,6 +187,30 @@ type ResourceLimit struct {
 type Ledger struct {
 	AnnounceInterval, SyncInterval time.Duration
 	StateDir                       string
+
+	// DeltaSync gossips only changed entries between full snapshots, which
+	// are sent every SnapshotEvery sync intervals (0 uses the default).
+	DeltaSync     bool
+	SnapshotEvery int
+
+	// HistoryBlocks and HistoryMaxAge bound the block history the store
+	// retains. With both zero the memory store keeps only the last block
+	// and the disk store keeps every block.
+	HistoryBlocks int
+	HistoryMaxAge time.Duration
+
+	// CompactInterval compacts a disk ledger down to its last CompactKeep
+	// blocks periodically (0 disables it).
+	CompactInterval time.Duration
+	CompactKeep     int
+
+	// Store selects how StateDir is kept: blockchain.StoreDisk (one file per
+	// block) or blockchain.StoreBolt (a single database, migrated from an
+	// existing disk directory on first use). Empty keeps whatever the
+	// directory already holds, disk for a new one. NoSync skips the fsync
+	// after each block with the bolt store.
+	Store  string
+	NoSync bool
 }
 
 // Discovery allows to enable/disable discovery and
@@ -219,6 +321,42 @@ func (c Config) Validate() error {
 	if _, err := blockchain.ParseOwnershipMode(c.Ownership.Mode); err != nil {
 		return err
 	}
+	if _, err := c.Firewall.toTypes(); err != nil {
+		return err
+	}
+	for _, q := range c.QoSClasses {
+		if _, err := vpn.ParseQoSClass(q); err != nil {
+			return err
+		}
+	}
+	for _, r := range c.Routes {
+		if _, err := vpn.ParseRoute(r); err != nil {
+			return err
+		}
+	}
+	if c.IPv6Prefix != "" {
+		if _, err := vpn.ParseIPv6Prefix(c.IPv6Prefix); err != nil {
+			return err
+		}
+	}
+	if _, err := c.Netstack.forwards(); err != nil {
+		return err
+	}
+	for _, d := range c.Netstack.DNS {
+		if _, err := netip.ParseAddr(d); err != nil {
+			return fmt.Errorf("invalid netstack dns server %q: %w", d, err)
+		}
+	}
+	for _, g := range c.Multicast.Groups {
+		if _, err := vpn.ParseMulticastGroup(g); err != nil {
+			return err
+		}
+	}
+	switch c.Ledger.Store {
+	case "", blockchain.StoreDisk, blockchain.StoreBolt:
+	default:
+		return fmt.Errorf("invalid ledger store %q (want %q or %q)", c.Ledger.Store, blockchain.StoreDisk, blockchain.StoreBolt)
+	}
 	return nil
 }
 
@@ -230,6 +368,21 @@ func peers2List(peers []string) discovery.AddrList {
 	return addrsList
 }
 
+// underlayAddrs returns the bootstrap and static relay addresses, the DHT
+// default bootstrap peers if none is given.
+func underlayAddrs(bootstrap discovery.AddrList, relays []string) []multiaddr.Multiaddr {
+	addrs := append([]multiaddr.Multiaddr{}, bootstrap...)
+	if len(addrs) == 0 {
+		addrs = append(addrs, dht.DefaultBootstrapPeers...)
+	}
+	for _, r := range relays {
+		if a, err := multiaddr.NewMultiaddr(r); err == nil {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
 func peers2AddrInfo(peers []string) []peer.AddrInfo {
 	addrsList := []peer.AddrInfo{}
 	for _, p := range peers {
@@ -322,6 +475,10 @@ func (c Config) ToOpts(l log.StandardLogger) ([]node.Option, []vpn.Option, error
 		node.FromYaml(mDNS, dhtE, config, d, m),
 	}
 
+	if c.Ledger.DeltaSync {
+		opts = append(opts, node.WithLedgerOptions(blockchain.WithDeltaSync(c.Ledger.SnapshotEvery)))
+	}
+
 	for ip, peer := range c.Connection.PeerTable {
 		opts = append(opts, node.WithStaticPeer(ip, peer))
 	}
@@ -341,8 +498,51 @@ func (c Config) ToOpts(l log.StandardLogger) ([]node.Option, []vpn.Option, error
 		vpn.WithChannelBufferSize(c.ChannelBufferSize),
 		vpn.WithInterfaceMTU(c.InterfaceMTU),
 		vpn.WithPacketMTU(c.PacketMTU),
+		vpn.WithMSSClamp(c.MSSClamp),
+		vpn.WithMTUExchange(c.MTUExchange),
 		vpn.WithRouterAddress(router),
+		vpn.WithRoutes(c.Routes...),
 		vpn.WithInterfaceName(iface),
+		vpn.WithUnderlay(underlayAddrs(addrsList, c.Connection.StaticRelays)...),
+	}
+
+	// Already validated above.
+	firewall, err := c.Firewall.toTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+	vpnOpts = append(vpnOpts, vpn.WithFirewall(firewall))
+
+	if len(c.QoSClasses) > 0 {
+		var classes []vpn.QoSClass
+		for _, q := range c.QoSClasses {
+			// Already validated above.
+			class, err := vpn.ParseQoSClass(q)
+			if err != nil {
+				return nil, nil, err
+			}
+			classes = append(classes, class)
+		}
+		vpnOpts = append(vpnOpts, vpn.WithQoS(classes...))
+	}
+
+	if c.IPv6Prefix != "" {
+		vpnOpts = append(vpnOpts, vpn.WithIPv6(c.IPv6Prefix))
+	}
+
+	if c.Netstack.Enable {
+		// Already validated above.
+		forwards, err := c.Netstack.forwards()
+		if err != nil {
+			return nil, nil, err
+		}
+		vpnOpts = append(vpnOpts,
+			vpn.WithNetstack(c.Netstack.Proxy, c.Netstack.DNS...),
+			vpn.WithForwards(forwards...))
+	}
+
+	if c.Multicast.Enable {
+		vpnOpts = append(vpnOpts, vpn.WithMulticast(c.Multicast.Rate, c.Multicast.Groups...))
 	}
 
 	libp2pOpts := []libp2p.Option{libp2p.UserAgent("edgevpn")}
@@ -572,13 +772,22 @@ func (c Config) ToOpts(l log.StandardLogger) ([]node.Option, []vpn.Option, error
 
 	opts = append(opts, node.WithLibp2pOptions(libp2pOpts...))
 
+	retention := blockchain.Retention{Blocks: c.Ledger.HistoryBlocks, MaxAge: c.Ledger.HistoryMaxAge}
 	if ledgerState != "" {
-		opts = append(opts, node.WithStore(blockchain.NewDiskStore(diskv.New(diskv.Options{
-			BasePath:     ledgerState,
-			CacheSizeMax: uint64(50), // 50MB
-		}))))
+		store, err := blockchain.OpenStateDir(ledgerState, blockchain.StateOptions{
+			Backend:   c.Ledger.Store,
+			NoSync:    c.Ledger.NoSync,
+			Retention: retention,
+		})
+		if err != nil {
+			return opts, vpnOpts, fmt.Errorf("opening ledger state: %w", err)
+		}
+		opts = append(opts, node.WithStore(store))
+		if c.Ledger.CompactInterval > 0 {
+			opts = append(opts, node.WithLedgerCompaction(c.Ledger.CompactInterval, c.Ledger.CompactKeep))
+		}
 	} else {
-		opts = append(opts, node.WithStore(&blockchain.MemoryStore{}))
+		opts = append(opts, node.WithStore(&blockchain.MemoryStore{Retention: retention}))
 	}
 
 	if c.PeerGuard.Enable {
@@ -58,6 +58,14 @@ type Config struct {
 
 	Store blockchain.Store
 
+	// LedgerOptions are applied when the node builds its ledger.
+	LedgerOptions []blockchain.LedgerOption
+
+	// LedgerCompactInterval, when set, compacts the store down to its last
+	// LedgerCompactKeep blocks periodically (stores that support it only).
+	LedgerCompactInterval time.Duration
+	LedgerCompactKeep     int
+
 	// Handle is a handle consumed by HumanInterfaces to handle received messages
 	Handle                     func(bool, *hub.Message)
 	StreamHandlers             map[protocol.Protocol]StreamHandler
@@ -82,6 +90,13 @@ type Config struct {
 	// entries may be reclaimed/reaped.
 	OwnershipMode blockchain.OwnershipMode
 	OwnershipTTL  time.Duration
+
+	// LedgerPolicies are bucket policies declared in the network config, on
+	// top of the built-in ones. They apply when ownership is enabled.
+	LedgerPolicies map[string]blockchain.PolicySpec
+	// LedgerAdmins are the peer IDs of the admin keys required to write the
+	// privileged buckets (trustzone, trustzoneAuth, dns).
+	LedgerAdmins []string
 }
 
 type Gater interface {
@@ -113,6 +113,15 @@ func New(p ...Option) (*Node, error) {
 	if err := c.Apply(p...); err != nil {
 		return nil, err
 	}
+	// Admin keys are checked by the authorized merge only: without it the
+	// network would run with open trust zone and admin buckets while
+	// believing them protected.
+	if len(c.LedgerAdmins) > 0 && c.OwnershipMode == blockchain.OwnershipOff {
+		return nil, fmt.Errorf("the network declares ledger_admins, which are only enforced with ledger ownership: set the ownership mode to observe or enforce")
+	}
+	if len(c.LedgerPolicies) > 0 && c.OwnershipMode == blockchain.OwnershipOff {
+		return nil, fmt.Errorf("the network declares ledger_policies, which are only enforced with ledger ownership: set the ownership mode to observe or enforce")
+	}
 
 	return &Node{
 		config:       *c,
@@ -136,7 +145,8 @@ func (e *Node) Ledger() (*blockchain.Ledger, error) {
 		return nil, err
 	}
 
-	e.ledger = blockchain.New(mw, e.config.Store, blockchain.WithViolationLogger(e.config.Logger.Warnf))
+	opts := append([]blockchain.LedgerOption{blockchain.WithViolationLogger(e.config.Logger.Warnf)}, e.config.LedgerOptions...)
+	e.ledger = blockchain.New(mw, e.config.Store, opts...)
 	return e.ledger, nil
 }
 
@@ -167,6 +177,7 @@ func (e *Node) Start(ctx context.Context) error {
 
 	// Send periodically messages to the channel with our blockchain content
 	ledger.Syncronizer(ctx, e.config.LedgerSyncronizationTime)
+	ledger.Compactor(ctx, e.config.LedgerCompactInterval, e.config.LedgerCompactKeep)
 
 	// Start eventual declared NetworkServices
 	for _, s := range e.config.NetworkServices {
@@ -220,9 +231,16 @@ func (e *Node) startNetwork(ctx context.Context) error {
 			if ttl == 0 {
 				ttl = DefaultOwnershipTTL
 			}
+			registry, rerr := blockchain.DefaultRegistry(ttl).Extend(e.config.LedgerPolicies)
+			if rerr != nil {
+				return fmt.Errorf("invalid ledger policies: %w", rerr)
+			}
 			ledger.SetSigner(signer)
-			ledger.SetOwnership(e.config.OwnershipMode, blockchain.DefaultRegistry(ttl), ttl)
+			ledger.SetOwnership(e.config.OwnershipMode, registry, ttl)
+			ledger.SetAdminKeys(e.config.LedgerAdmins...)
 			e.config.Logger.Infof("ledger ownership enforcement: mode=%s ttl=%s", e.config.OwnershipMode, ttl)
+		} else if len(e.config.LedgerAdmins) > 0 || len(e.config.LedgerPolicies) > 0 {
+			return fmt.Errorf("ownership enforcement requested but host private key is unavailable: the ledger admin keys and policies cannot be enforced")
 		} else {
 			e.config.Logger.Warn("ownership enforcement requested but host private key is unavailable; running unsigned")
 		}
@@ -41,6 +41,36 @@ var _ = Describe("Node", func() {
 			_, err = New(FromBase64(true, true, token, nil, nil), WithStore(&blockchain.MemoryStore{}), l)
 			Expect(err).ToNot(HaveOccurred())
 		})
+
+		It("reads ledger policies from the network config", func() {
+			c := GenerateNewConnectionData(25)
+			c.LedgerPolicies = map[string]blockchain.PolicySpec{"inventory": {Owned: true, Owner: "key", Expiry: "liveness"}}
+			cfg := &Config{}
+			Expect(FromBase64(true, true, c.Base64(), nil, nil)(cfg)).To(Succeed())
+			Expect(cfg.LedgerPolicies).To(HaveKey("inventory"))
+
+			c.LedgerPolicies = map[string]blockchain.PolicySpec{"inventory": {Expiry: "sometimes"}}
+			_, err := New(FromBase64(true, true, c.Base64(), nil, nil), WithStore(&blockchain.MemoryStore{}), l)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("refuses admin keys without ledger ownership", func() {
+			id := "12D3KooWE5kr4xx7PRTRS5CmX7HajsT1nCwyBFB6xNbzzRTVyKx8"
+			_, err := New(FromBase64(true, true, token, nil, nil), WithLedgerAdmins(id), WithStore(&blockchain.MemoryStore{}), l)
+			Expect(err).To(MatchError(ContainSubstring("ledger_admins")))
+
+			_, err = New(FromBase64(true, true, token, nil, nil), WithLedgerAdmins(id), WithOwnership(blockchain.OwnershipEnforce, 0), WithStore(&blockchain.MemoryStore{}), l)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("refuses ledger policies without ledger ownership", func() {
+			policies := map[string]blockchain.PolicySpec{"inventory": {Owned: true, Owner: "key"}}
+			_, err := New(FromBase64(true, true, token, nil, nil), WithLedgerPolicies(policies), WithStore(&blockchain.MemoryStore{}), l)
+			Expect(err).To(MatchError(ContainSubstring("ledger_policies")))
+
+			_, err = New(FromBase64(true, true, token, nil, nil), WithLedgerPolicies(policies), WithOwnership(blockchain.OwnershipEnforce, 0), WithStore(&blockchain.MemoryStore{}), l)
+			Expect(err).ToNot(HaveOccurred())
+		})
 	})
 
 	Context("Connection", func() {
@@ -85,6 +85,14 @@ func WithStore(s blockchain.Store) func(cfg *Config) error {
 	}
 }
 
+// WithLedgerOptions adds options applied to the ledger when it is created
+func WithLedgerOptions(o ...blockchain.LedgerOption) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.LedgerOptions = append(cfg.LedgerOptions, o...)
+		return nil
+	}
+}
+
 // Handlers adds a handler to the list that is called on each received message
 func Handlers(h ...Handler) func(cfg *Config) error {
 	return func(cfg *Config) error {
@@ -185,6 +193,28 @@ func WithOwnership(mode blockchain.OwnershipMode, ttl time.Duration) func(cfg *C
 	}
 }
 
+// WithLedgerPolicies adds bucket policies to the built-in ones.
+func WithLedgerPolicies(p map[string]blockchain.PolicySpec) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		if _, err := blockchain.DefaultRegistry(0).Extend(p); err != nil {
+			return err
+		}
+		cfg.LedgerPolicies = p
+		return nil
+	}
+}
+
+// WithLedgerAdmins sets the admin keys (peer IDs) of the network.
+func WithLedgerAdmins(ids ...string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		if err := blockchain.ValidateAdminKeys(ids); err != nil {
+			return err
+		}
+		cfg.LedgerAdmins = ids
+		return nil
+	}
+}
+
 func LibP2PLogLevel(l log.LogLevel) func(cfg *Config) error {
 	return func(cfg *Config) error {
 		log.SetAllLoggers(l)
@@ -213,6 +243,16 @@ func WithLedgerAnnounceTime(t time.Duration) func(cfg *Config) error {
 	}
 }
 
+// WithLedgerCompaction compacts the ledger store every interval, keeping the
+// last keep blocks.
+func WithLedgerCompaction(interval time.Duration, keep int) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.LedgerCompactInterval = interval
+		cfg.LedgerCompactKeep = keep
+		return nil
+	}
+}
+
 func WithLedgerInterval(t time.Duration) func(cfg *Config) error {
 	return func(cfg *Config) error {
 		cfg.LedgerSyncronizationTime = t
@@ -269,6 +309,13 @@ type YAMLConnectionConfig struct {
 	Rendezvous     string `yaml:"rendezvous"`
 	MDNS           string `yaml:"mdns"`
 	MaxMessageSize int    `yaml:"max_message_size"`
+
+	// LedgerPolicies declares the policies of application buckets. Every node
+	// of the network must share them, hence they travel with the token.
+	LedgerPolicies map[string]blockchain.PolicySpec `yaml:"ledger_policies,omitempty"`
+	// LedgerAdmins lists the peer IDs of the admin keys whose signatures
+	// are required to write the privileged buckets.
+	LedgerAdmins []string `yaml:"ledger_admins,omitempty"`
 }
 
 // Base64 returns the base64 string representation of the connection
@@ -283,6 +330,13 @@ func (y YAMLConnectionConfig) YAML() string {
 	return string(bytesData)
 }
 
+func (y YAMLConnectionConfig) validate() error {
+	if _, err := blockchain.DefaultRegistry(0).Extend(y.LedgerPolicies); err != nil {
+		return errors.Wrap(err, "ledger policies")
+	}
+	return errors.Wrap(blockchain.ValidateAdminKeys(y.LedgerAdmins), "ledger admins")
+}
+
 func (y YAMLConnectionConfig) copy(mdns, dht bool, cfg *Config, d *discovery.DHT, m *discovery.MDNS) {
 	if d == nil {
 		d = discovery.NewDHT()
@@ -311,6 +365,8 @@ func (y YAMLConnectionConfig) copy(mdns, dht bool, cfg *Config, d *discovery.DHT
 	}
 	cfg.SealKeyLength = y.OTP.Crypto.Length
 	cfg.MaxMessageSize = y.MaxMessageSize
+	cfg.LedgerPolicies = y.LedgerPolicies
+	cfg.LedgerAdmins = y.LedgerAdmins
 }
 
 const defaultKeyLength = 43
@@ -366,6 +422,9 @@ func FromYaml(enablemDNS, enableDHT bool, path string, d *discovery.DHT, m *disc
 		if err := yaml.Unmarshal(data, &t); err != nil {
 			return errors.Wrap(err, "parsing yaml")
 		}
+		if err := t.validate(); err != nil {
+			return err
+		}
 
 		t.copy(enablemDNS, enableDHT, cfg, d, m)
 		return nil
@@ -386,6 +445,9 @@ func FromBase64(enablemDNS, enableDHT bool, bb string, d *discovery.DHT, m *disc
 		if err := yaml.Unmarshal(configDec, &t); err != nil {
 			return errors.Wrap(err, "parsing yaml")
 		}
+		if err := t.validate(); err != nil {
+			return err
+		}
 		t.copy(enablemDNS, enableDHT, cfg, d, m)
 		return nil
 	}
@@ -22,6 +22,14 @@ const (
 	ServiceProtocol Protocol = "/edgevpn/service/0.1"
 	FileProtocol    Protocol = "/edgevpn/file/0.1"
 	EgressProtocol  Protocol = "/edgevpn/egress/0.1"
+
+	// EdgeVPNFramed carries length-prefixed VPN packets with their metadata
+	// on a stream kept open per peer. Nodes fall back to EdgeVPN with peers
+	// that do not support it.
+	EdgeVPNFramed Protocol = "/edgevpn/0.2"
+
+	// EdgeVPNMTU exchanges the MTU of the interfaces of two peers.
+	EdgeVPNMTU Protocol = "/edgevpn/mtu/0.1"
 )
 
 const (
@@ -34,6 +42,12 @@ const (
 	EgressService     = "egress"
 	TrustZoneKey      = "trustzone"
 	TrustZoneAuthKey  = "trustzoneAuth"
+	FirewallKey       = "firewall"
+	ExitNodeKey       = "exitnodes"
+	DHCPLeasesKey     = "dhcpleases"
+	DHCPReservedKey   = "dhcpreservations"
+	TrafficLimitsKey  = "trafficlimits"
+	MulticastKey      = "multicast"
 )
 
 type Protocol string
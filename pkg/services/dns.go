@@ -18,7 +18,9 @@ package services
 import (
 	"context"
 	"fmt"
+	"net"
 	"regexp"
+	"strings"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
@@ -103,6 +105,12 @@ func (d dnsHandler) parseQuery(m *dns.Msg, forward bool) *dns.Msg {
 				}
 			}
 		}
+		// Else it may be the name of a machine
+		if rr := machineRecords(d.b.CurrentData()[protocol.MachinesLedgerKey], d.b.IsOwnerLive, q); len(rr) > 0 {
+			response.Answer = append(m.Answer, rr...)
+			d.ll.Debug("Response from machines", response)
+			return response
+		}
 		if forward {
 			d.ll.Debug("Forwarding DNS request", m)
 			r, err := d.forwardQuery(m)
@@ -115,6 +123,30 @@ func (d dnsHandler) parseQuery(m *dns.Msg, forward bool) *dns.Msg {
 	return response
 }
 
+// machineRecords answers A and AAAA queries for the hostname of the live
+// machines with their VPN addresses.
+func machineRecords(machines map[string]blockchain.Data, live func(string) bool, q dns.Question) []dns.RR {
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return nil
+	}
+	name := strings.TrimSuffix(q.Name, ".")
+	var rr []dns.RR
+	for _, v := range machines {
+		var m types.Machine
+		if err := v.Unmarshal(&m); err != nil || m.Hostname == "" || !strings.EqualFold(m.Hostname, name) || !live(m.PeerID) {
+			continue
+		}
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+		switch ip := net.ParseIP(m.Address); {
+		case q.Qtype == dns.TypeA && ip.To4() != nil:
+			rr = append(rr, &dns.A{Hdr: hdr, A: ip.To4()})
+		case q.Qtype == dns.TypeAAAA && net.ParseIP(m.Address6) != nil:
+			rr = append(rr, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(m.Address6)})
+		}
+	}
+	return rr
+}
+
 func (d dnsHandler) handleDNSRequest() func(w dns.ResponseWriter, r *dns.Msg) {
 	return func(w dns.ResponseWriter, r *dns.Msg) {
 		var resp *dns.Msg
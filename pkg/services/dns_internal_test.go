@@ -0,0 +1,63 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+func TestMachineRecords(t *testing.T) {
+	machines := map[string]blockchain.Data{}
+	for _, m := range []types.Machine{
+		{PeerID: "a", Hostname: "Alpha", Address: "10.1.0.1", Address6: "fd65:6467:6576:706e::1"},
+		{PeerID: "b", Hostname: "beta", Address: "10.1.0.2"},
+		{PeerID: "c", Hostname: "gone", Address: "10.1.0.3"},
+	} {
+		dat, _ := json.Marshal(m)
+		machines[m.Address] = blockchain.Data(dat)
+	}
+	live := func(id string) bool { return id != "c" }
+
+	for _, tc := range []struct {
+		name  string
+		qtype uint16
+		want  string
+	}{
+		{"alpha.", dns.TypeA, "10.1.0.1"},
+		{"alpha.", dns.TypeAAAA, "fd65:6467:6576:706e::1"},
+		{"beta.", dns.TypeA, "10.1.0.2"},
+		{"beta.", dns.TypeAAAA, ""},
+		{"gone.", dns.TypeA, ""},
+		{"alpha.", dns.TypeMX, ""},
+	} {
+		rr := machineRecords(machines, live, dns.Question{Name: tc.name, Qtype: tc.qtype, Qclass: dns.ClassINET})
+		got := ""
+		for _, r := range rr {
+			switch r := r.(type) {
+			case *dns.A:
+				got = r.A.String()
+			case *dns.AAAA:
+				got = r.AAAA.String()
+			}
+		}
+		if len(rr) > 1 || got != tc.want {
+			t.Errorf("%s %s: got %v, want %q", tc.name, dns.TypeToString[tc.qtype], rr, tc.want)
+		}
+	}
+}
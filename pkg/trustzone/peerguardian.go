@@ -45,6 +45,11 @@ func NewPeerGuardian(logger log.StandardLogger, authProviders ...AuthProvider) *
 func (pg *PeerGuardian) ReceiveMessage(l *blockchain.Ledger, m *hub.Message, c chan *hub.Message) error {
 	pg.logger.Debug("Peerguardian received message from", m.SenderID)
 
+	// On networks with admin keys only they may admit peers to the trust zone.
+	if !l.CanWrite(protocol.TrustZoneKey) {
+		return nil
+	}
+
 	for _, a := range pg.authProviders {
 
 		_, exists := l.GetKey(protocol.TrustZoneKey, m.SenderID)
@@ -74,7 +79,7 @@ func (pg *PeerGuardian) Challenger(duration time.Duration, autocleanup bool) nod
 			}
 
 			// Automatically cleanup TZ from peers not anymore in the hub
-			if autocleanup {
+			if autocleanup && b.CanWrite(protocol.TrustZoneKey) {
 				peers, err := n.MessageHub.ListPeers()
 				if err != nil {
 					return
@@ -0,0 +1,38 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import "time"
+
+// DHCPLease is an address a peer got from DHCP. The peer renews it while it
+// runs; once Expires is past the address may be given to another peer.
+type DHCPLease struct {
+	Address  string
+	PeerID   string
+	Hostname string
+	Expires  time.Time
+}
+
+// Expired reports whether the lease has expired at now.
+func (l DHCPLease) Expired(now time.Time) bool {
+	return !l.Expires.IsZero() && now.After(l.Expires)
+}
+
+// DHCPReservation pins Address to a peer, by PeerID, or to a machine, by
+// Hostname. DHCP gives the address to no one else.
+type DHCPReservation struct {
+	Address  string
+	PeerID   string `json:",omitempty"`
+	Hostname string `json:",omitempty"`
+}
@@ -0,0 +1,31 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+// FirewallRule matches VPN packets. Empty fields match any packet.
+type FirewallRule struct {
+	Action   string // "allow" or "deny"
+	From     string // source VPN IP or CIDR
+	To       string // destination VPN IP or CIDR
+	Protocol string // "tcp", "udp" or "icmp"
+	Port     string // destination port ("22") or range ("8000-8100")
+}
+
+// Firewall is the packet filter a peer applies to the VPN traffic it sends
+// and receives. Rules are evaluated in order, the first match wins.
+type Firewall struct {
+	PeerID  string
+	Default string // action when no rule matches: "allow" (if empty) or "deny"
+	Rules   []FirewallRule
+}
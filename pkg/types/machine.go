@@ -20,4 +20,10 @@ type Machine struct {
 	Arch     string
 	Address  string
 	Version  string
+
+	// Address6 is the IPv6 address of the peer, if it has one.
+	Address6 string
+
+	// Routes are the subnets (CIDRs) reachable through the peer.
+	Routes []string
 }
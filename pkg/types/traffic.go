@@ -0,0 +1,25 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+// TrafficLimit caps the VPN traffic, sent and received, of the peer PeerID.
+// Rate is in bytes per second, with bursts of up to Burst bytes (a second at
+// Rate if zero), and Quota in bytes per calendar month, in UTC. Zero values
+// do not limit.
+type TrafficLimit struct {
+	PeerID string
+	Rate   uint64 `json:",omitempty"`
+	Burst  uint64 `json:",omitempty"`
+	Quota  uint64 `json:",omitempty"`
+}
@@ -0,0 +1,390 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultCaptureDuration and DefaultCaptureSize bound the captures that
+	// do not set their own limits.
+	DefaultCaptureDuration = 30 * time.Second
+	DefaultCaptureSize     = 16 << 20
+
+	// MaxCaptureDuration and MaxCaptureSize are the largest limits a
+	// capture may ask for.
+	MaxCaptureDuration = 10 * time.Minute
+	MaxCaptureSize     = 1 << 30
+
+	// captureQueueSize packets may wait to be written before the next ones
+	// are dropped from the capture, not from the VPN.
+	captureQueueSize = 1024
+
+	pcapHeaderSize    = 24
+	pcapRecordSize    = 16
+	pcapSnapLen       = 65535
+	pcapLinkTypeRaw   = 101
+	pcapMagicMicrosec = 0xa1b2c3d4
+)
+
+// ErrCaptureRunning is returned when a capture is asked for while another one
+// is running.
+var ErrCaptureRunning = errors.New("a capture is already running")
+
+// Capture records the packets the VPN moves, on demand. Until a capture runs,
+// recording a packet costs an atomic load.
+type Capture struct {
+	session atomic.Pointer[captureSession]
+}
+
+func NewCapture() *Capture {
+	return &Capture{}
+}
+
+// CaptureOptions limit a capture. Zero values are replaced by the defaults.
+type CaptureOptions struct {
+	// Filter selects the packets to capture, see ParseCaptureFilter.
+	Filter   string
+	Duration time.Duration
+	// MaxBytes is the size of the capture file, MaxPackets the number of
+	// packets it holds, if not zero.
+	MaxBytes   int64
+	MaxPackets int
+}
+
+// CaptureStats reports what a capture recorded.
+type CaptureStats struct {
+	Packets int
+	Bytes   int64
+	// Dropped packets matched the filter but could not be written in time.
+	Dropped uint64
+}
+
+type captureDirection int
+
+const (
+	captureSent captureDirection = iota
+	captureReceived
+)
+
+type capturedPacket struct {
+	time   time.Time
+	packet []byte
+}
+
+type captureSession struct {
+	filter  captureFilter
+	packets chan capturedPacket
+	dropped atomic.Uint64
+}
+
+// record queues a copy of packet, exchanged with peer, for the running
+// capture if any.
+func (c *Capture) record(dir captureDirection, peer string, packet []byte) {
+	if c == nil {
+		return
+	}
+	s := c.session.Load()
+	if s == nil {
+		return
+	}
+	if p, ok := parsePacket(packet); !ok || !s.filter(captureMatch{packetInfo: p, peer: peer, dir: dir}) {
+		return
+	}
+	select {
+	case s.packets <- capturedPacket{time: time.Now(), packet: append([]byte(nil), packet...)}:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// writer records the packets written to w as received from peer.
+func (c *Capture) writer(w io.Writer, peer string) io.Writer {
+	if c == nil {
+		return w
+	}
+	return &captureWriter{Writer: w, capture: c, peer: peer}
+}
+
+type captureWriter struct {
+	io.Writer
+	capture *Capture
+	peer    string
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.capture.record(captureReceived, w.peer, p)
+	return w.Writer.Write(p)
+}
+
+// Run captures the packets matching o.Filter and writes them to w in pcap
+// format, until ctx is done or a limit of o is reached. Only one capture runs
+// at a time.
+func (c *Capture) Run(ctx context.Context, w io.Writer, o CaptureOptions) (CaptureStats, error) {
+	var stats CaptureStats
+	filter, err := ParseCaptureFilter(o.Filter)
+	if err != nil {
+		return stats, err
+	}
+	if o.Duration <= 0 {
+		o.Duration = DefaultCaptureDuration
+	}
+	if o.MaxBytes <= 0 {
+		o.MaxBytes = DefaultCaptureSize
+	}
+	o.Duration = min(o.Duration, MaxCaptureDuration)
+	o.MaxBytes = min(o.MaxBytes, MaxCaptureSize)
+
+	s := &captureSession{filter: filter, packets: make(chan capturedPacket, captureQueueSize)}
+	if !c.session.CompareAndSwap(nil, s) {
+		return stats, ErrCaptureRunning
+	}
+	defer func() {
+		c.session.Store(nil)
+		stats.Dropped = s.dropped.Load()
+	}()
+
+	var hdr [pcapHeaderSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagicMicrosec)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], pcapLinkTypeRaw)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return stats, err
+	}
+	stats.Bytes = pcapHeaderSize
+
+	ctx, cancel := context.WithTimeout(ctx, o.Duration)
+	defer cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return stats, nil
+		case p := <-s.packets:
+			size := int64(pcapRecordSize + len(p.packet))
+			if stats.Bytes+size > o.MaxBytes {
+				return stats, nil
+			}
+			var rec [pcapRecordSize]byte
+			binary.LittleEndian.PutUint32(rec[0:4], uint32(p.time.Unix()))
+			binary.LittleEndian.PutUint32(rec[4:8], uint32(p.time.Nanosecond()/1000))
+			binary.LittleEndian.PutUint32(rec[8:12], uint32(len(p.packet)))
+			binary.LittleEndian.PutUint32(rec[12:16], uint32(len(p.packet)))
+			if _, err := w.Write(append(rec[:], p.packet...)); err != nil {
+				return stats, err
+			}
+			stats.Bytes += size
+			stats.Packets++
+			if o.MaxPackets > 0 && stats.Packets >= o.MaxPackets {
+				return stats, nil
+			}
+		}
+	}
+}
+
+// captureMatch is what capture filters match on.
+type captureMatch struct {
+	packetInfo
+	peer string
+	dir  captureDirection
+}
+
+type captureFilter func(m captureMatch) bool
+
+// ParseCaptureFilter parses a filter in a subset of the tcpdump syntax:
+// primitives combined with "and" (which may be left out), "or", "not" and
+// parentheses, where a primitive is one of
+//
+//	[src|dst] host <ip>
+//	[src|dst] net <cidr>
+//	[src|dst] port <n>
+//	tcp | udp | icmp | ip | ip6
+//	peer <peer id>
+//	inbound | outbound
+//
+// e.g. "peer Qm... and tcp and not port 22". An empty filter matches every
+// packet.
+func ParseCaptureFilter(s string) (captureFilter, error) {
+	p := &filterParser{tokens: tokenizeFilter(s)}
+	if len(p.tokens) == 0 {
+		return func(captureMatch) bool { return true }, nil
+	}
+	f, err := p.or()
+	if err != nil {
+		return nil, fmt.Errorf("invalid capture filter %q: %w", s, err)
+	}
+	if tok := p.peek(); tok != "" {
+		return nil, fmt.Errorf("invalid capture filter %q: unexpected %q", s, tok)
+	}
+	return f, nil
+}
+
+func tokenizeFilter(s string) []string {
+	s = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(s)
+	return strings.Fields(s)
+}
+
+type filterParser struct {
+	tokens []string
+}
+
+func (p *filterParser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *filterParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.tokens = p.tokens[1:]
+	}
+	return tok
+}
+
+func (p *filterParser) or() (captureFilter, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(m captureMatch) bool { return l(m) || right(m) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) and() (captureFilter, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	// As in tcpdump, "and" may be left out: "tcp port 22"
+	for tok := p.peek(); tok != "" && tok != "or" && tok != ")"; tok = p.peek() {
+		if tok == "and" {
+			p.next()
+		}
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(m captureMatch) bool { return l(m) && right(m) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) not() (captureFilter, error) {
+	switch p.peek() {
+	case "not":
+		p.next()
+		f, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(m captureMatch) bool { return !f(m) }, nil
+	case "(":
+		p.next()
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("missing )")
+		}
+		return f, nil
+	}
+	return p.primitive()
+}
+
+func (p *filterParser) primitive() (captureFilter, error) {
+	tok := p.next()
+	switch tok {
+	case "":
+		return nil, errors.New("unexpected end")
+	case "tcp", "udp", "icmp":
+		return func(m captureMatch) bool { return m.proto == tok }, nil
+	case "ip":
+		return func(m captureMatch) bool { return m.src.To4() != nil }, nil
+	case "ip6":
+		return func(m captureMatch) bool { return m.src.To4() == nil }, nil
+	case "inbound":
+		return func(m captureMatch) bool { return m.dir == captureReceived }, nil
+	case "outbound":
+		return func(m captureMatch) bool { return m.dir == captureSent }, nil
+	case "peer":
+		id := p.next()
+		if id == "" {
+			return nil, errors.New("peer needs a peer ID")
+		}
+		return func(m captureMatch) bool { return m.peer == id }, nil
+	}
+
+	src, dst := true, true
+	switch tok {
+	case "src":
+		dst = false
+		tok = p.next()
+	case "dst":
+		src = false
+		tok = p.next()
+	}
+	arg := p.next()
+	if arg == "" {
+		return nil, fmt.Errorf("%s needs an argument", tok)
+	}
+	switch tok {
+	case "host", "net":
+		n, err := parseNet(arg)
+		if err != nil || n == nil || (tok == "host" && strings.Contains(arg, "/")) {
+			return nil, fmt.Errorf("invalid %s %q", tok, arg)
+		}
+		return addrFilter(src, dst, func(ip net.IP) bool { return n.Contains(ip) }), nil
+	case "port":
+		port, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", arg)
+		}
+		return func(m captureMatch) bool {
+			if m.proto != "tcp" && m.proto != "udp" {
+				return false
+			}
+			return (src && m.sport == uint16(port)) || (dst && m.dport == uint16(port))
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown %q", tok)
+}
+
+func addrFilter(src, dst bool, match func(net.IP) bool) captureFilter {
+	return func(m captureMatch) bool {
+		return (src && match(m.src)) || (dst && match(m.dst))
+	}
+}
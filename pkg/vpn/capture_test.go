@@ -0,0 +1,130 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Capture", func() {
+	a, b := newPeerID().String(), newPeerID().String()
+	ssh := tcpPacket("10.1.0.1", "10.1.0.2", 22)
+	web := tcpPacket("10.1.0.2", "10.1.0.3", 80)
+
+	matches := func(filter string, dir captureDirection, peer string, packet []byte) bool {
+		f, err := ParseCaptureFilter(filter)
+		Expect(err).NotTo(HaveOccurred())
+		p, ok := parsePacket(packet)
+		Expect(ok).To(BeTrue())
+		return f(captureMatch{packetInfo: p, peer: peer, dir: dir})
+	}
+
+	It("parses filters", func() {
+		for _, bad := range []string{"host", "host 10.1.0.0/24", "net nope", "port http", "tcp and", "tcp or", "(tcp", "tcp)", "frobnicate", "peer"} {
+			_, err := ParseCaptureFilter(bad)
+			Expect(err).To(HaveOccurred(), bad)
+		}
+	})
+
+	It("matches packets", func() {
+		Expect(matches("", captureSent, a, ssh)).To(BeTrue())
+		Expect(matches("tcp and port 22", captureSent, a, ssh)).To(BeTrue())
+		Expect(matches("tcp port 22", captureSent, a, ssh)).To(BeTrue())
+		Expect(matches("udp port 22", captureSent, a, ssh)).To(BeFalse())
+		Expect(matches("port 40000", captureSent, a, ssh)).To(BeTrue())
+		Expect(matches("dst port 40000", captureSent, a, ssh)).To(BeFalse())
+		Expect(matches("host 10.1.0.2", captureSent, a, ssh)).To(BeTrue())
+		Expect(matches("src host 10.1.0.2", captureSent, a, ssh)).To(BeFalse())
+		Expect(matches("dst net 10.1.0.0/24 and not port 22", captureSent, a, web)).To(BeTrue())
+		Expect(matches("udp or icmp", captureSent, a, web)).To(BeFalse())
+		Expect(matches("ip and not ip6", captureSent, a, web)).To(BeTrue())
+		Expect(matches("peer "+a+" and inbound", captureReceived, a, web)).To(BeTrue())
+		Expect(matches("peer "+a+" and (outbound or port 22)", captureReceived, a, web)).To(BeFalse())
+		Expect(matches("peer "+b, captureSent, a, web)).To(BeFalse())
+	})
+
+	It("records nothing when no capture runs", func() {
+		var c *Capture
+		c.record(captureSent, a, ssh)
+		Expect(c.writer(&bytes.Buffer{}, a)).To(BeAssignableToTypeOf(&bytes.Buffer{}))
+
+		c = NewCapture()
+		c.record(captureSent, a, ssh)
+		Expect(c.session.Load()).To(BeNil())
+	})
+
+	It("writes the matching packets in pcap format, up to the limits", func() {
+		c := NewCapture()
+		out := &bytes.Buffer{}
+		done := make(chan CaptureStats)
+		go func() {
+			defer GinkgoRecover()
+			stats, err := c.Run(context.Background(), out, CaptureOptions{Filter: "peer " + a, MaxPackets: 2})
+			Expect(err).NotTo(HaveOccurred())
+			done <- stats
+		}()
+		Eventually(c.session.Load).ShouldNot(BeNil())
+
+		_, err := c.Run(context.Background(), &bytes.Buffer{}, CaptureOptions{})
+		Expect(err).To(MatchError(ErrCaptureRunning))
+
+		c.record(captureSent, b, web)
+		c.record(captureSent, a, ssh)
+		w := c.writer(&bytes.Buffer{}, a)
+		w.Write(web)
+
+		var stats CaptureStats
+		Eventually(done).Should(Receive(&stats))
+		Expect(stats.Packets).To(Equal(2))
+		Expect(c.session.Load()).To(BeNil())
+
+		r, err := pcapgo.NewReader(out)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.LinkType()).To(Equal(layers.LinkTypeRaw))
+		data, _, err := r.ReadPacketData()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(ssh))
+		data, _, err = r.ReadPacketData()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(Equal(web))
+	})
+
+	It("stops at the size and time limits", func() {
+		c := NewCapture()
+		out := &bytes.Buffer{}
+		go func() {
+			defer GinkgoRecover()
+			Eventually(c.session.Load).ShouldNot(BeNil())
+			c.record(captureSent, a, ssh)
+			c.record(captureSent, a, ssh)
+		}()
+		stats, err := c.Run(context.Background(), out, CaptureOptions{MaxBytes: int64(pcapHeaderSize + pcapRecordSize + len(ssh))})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats.Packets).To(Equal(1))
+		Expect(out.Len()).To(Equal(pcapHeaderSize + pcapRecordSize + len(ssh)))
+
+		start := time.Now()
+		stats, err = c.Run(context.Background(), &bytes.Buffer{}, CaptureOptions{Duration: 100 * time.Millisecond})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats.Packets).To(BeZero())
+		Expect(time.Since(start)).To(BeNumerically(">=", 100*time.Millisecond))
+	})
+})
@@ -15,10 +15,13 @@ package vpn
 
 import (
 	"io"
+	"net/netip"
 	"time"
 
 	"github.com/ipfs/go-log"
+	"github.com/mudler/edgevpn/pkg/types"
 	"github.com/mudler/water"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 type Config struct {
@@ -42,6 +45,69 @@ type Config struct {
 	ChannelBufferSize int
 	MaxStreams        int
 	lowProfile        bool
+
+	// Metrics reports the state of the packet queues and the traffic.
+	Metrics *Metrics
+	limiter *trafficLimiter
+
+	// StateDir, if set, keeps the traffic counted against the quota of the
+	// node across restarts.
+	StateDir string
+
+	// Capture, if set, records the packets of the VPN on demand.
+	Capture *Capture
+
+	// Routes are the subnets this node advertises and forwards to.
+	Routes []string
+
+	// IPv6Prefix, if valid, gives the node an IPv6 address next to its IPv4
+	// one, derived from its peer ID.
+	IPv6Prefix        netip.Prefix
+	interfaceAddress6 netip.Prefix
+
+	// ExitNode advertises the node as exit for the traffic of its peers.
+	// ExitVia is the exit node this node sends its own traffic through: a
+	// peer ID, ExitAuto or empty for none.
+	ExitNode     bool
+	ExitVia      string
+	ExitDeadTime time.Duration
+	exit         *exitSelector
+	// Underlay are the bootstrap and relay addresses routed around the
+	// exit node.
+	Underlay []ma.Multiaddr
+
+	// Firewall is the packet filter of the node, published in the ledger.
+	Firewall types.Firewall
+	firewall *firewall
+
+	// MSSClamp lowers the MSS of TCP connections to what fits the MTU to
+	// the peer. MTUExchange asks each peer for the MTU of its interface,
+	// used instead of the local one when lower, and answers the packets too
+	// large for it with ICMP errors.
+	MSSClamp    bool
+	MTUExchange bool
+	peerMTU     *peerMTUs
+
+	// Multicast fans the multicast and broadcast packets out to the peers
+	// listening to them, at most MulticastRate per second. The node listens
+	// to MulticastGroups and to the groups its host joins.
+	Multicast       bool
+	MulticastGroups []netip.Addr
+	MulticastRate   int
+	multicast       *multicast
+
+	// QoS sorts the packets the node sends into classes, the ones of higher
+	// priority being sent first.
+	QoS []QoSClass
+	qos *qos
+
+	// Netstack runs the TCP/IP stack of the node in process instead of on a
+	// TUN device, so no privileges are needed. The VPN is then reached
+	// through the SOCKS5/HTTP proxy on NetstackProxy and the Forwards.
+	Netstack      bool
+	NetstackProxy string
+	NetstackDNS   []netip.Addr
+	Forwards      []Forward
 }
 
 type Option func(cfg *Config) error
@@ -168,3 +234,149 @@ func WithInterfaceAddress(i string) func(cfg *Config) error {
 		return nil
 	}
 }
+
+// WithMetrics reports the state of the packet queues of the VPN to m.
+func WithMetrics(m *Metrics) Option {
+	return func(cfg *Config) error {
+		cfg.Metrics = m
+		return nil
+	}
+}
+
+// WithCapture lets c record the packets the VPN sends and receives.
+func WithCapture(c *Capture) Option {
+	return func(cfg *Config) error {
+		cfg.Capture = c
+		return nil
+	}
+}
+
+// WithFirewall filters the VPN traffic of the node with f. Other peers learn
+// the rules from the ledger and do not send traffic f denies.
+func WithFirewall(f types.Firewall) Option {
+	return func(cfg *Config) error {
+		if _, err := compileFirewall(f); err != nil {
+			return err
+		}
+		cfg.Firewall = f
+		return nil
+	}
+}
+
+// WithMSSClamp lowers the MSS of the TCP connections over the VPN to fit the
+// MTU of the interface, or of the peer with WithMTUExchange.
+func WithMSSClamp(b bool) Option {
+	return func(cfg *Config) error {
+		cfg.MSSClamp = b
+		return nil
+	}
+}
+
+// WithMTUExchange asks each peer for the MTU of its interface. Packets larger
+// than it are answered with an ICMP fragmentation needed or packet too big
+// error, so that their sender lowers its path MTU.
+func WithMTUExchange(b bool) Option {
+	return func(cfg *Config) error {
+		cfg.MTUExchange = b
+		return nil
+	}
+}
+
+// WithMulticast forwards multicast and broadcast packets across the VPN, to
+// the peers listening to them, such as mDNS. The node listens to groups, and
+// to the ones its host joins on the interface. rate caps the multicast
+// packets sent and received per second, DefaultMulticastRate if zero.
+func WithMulticast(rate int, groups ...string) Option {
+	return func(cfg *Config) error {
+		for _, g := range groups {
+			a, err := ParseMulticastGroup(g)
+			if err != nil {
+				return err
+			}
+			cfg.MulticastGroups = append(cfg.MulticastGroups, a)
+		}
+		cfg.Multicast = true
+		cfg.MulticastRate = rate
+		return nil
+	}
+}
+
+// WithStateDir keeps the state of the VPN that must survive restarts, the
+// traffic counted against the quota of the node, in dir.
+func WithStateDir(dir string) Option {
+	return func(cfg *Config) error {
+		cfg.StateDir = dir
+		return nil
+	}
+}
+
+// WithQoS sorts the packets the node sends into classes, tried in order.
+// Those of higher priority are sent first when the link to a peer is
+// congested, and a class may be shaped to a rate.
+func WithQoS(classes ...QoSClass) Option {
+	return func(cfg *Config) error {
+		// The burst is checked against the MTU once the VPN starts
+		if _, err := newQoS(append(cfg.QoS, classes...), 0); err != nil {
+			return err
+		}
+		cfg.QoS = append(cfg.QoS, classes...)
+		return nil
+	}
+}
+
+// WithIPv6 gives the node an IPv6 address in prefix, derived from its peer
+// ID, next to its IPv4 one.
+func WithIPv6(prefix string) Option {
+	return func(cfg *Config) error {
+		p, err := ParseIPv6Prefix(prefix)
+		if err != nil {
+			return err
+		}
+		cfg.IPv6Prefix = p
+		return nil
+	}
+}
+
+// WithRoutes advertises subnets reachable through this node, so that peers
+// send it the packets addressed to them. Forwarding them on (IP forwarding,
+// routes back to the VPN) is up to the host.
+func WithRoutes(cidrs ...string) Option {
+	return func(cfg *Config) error {
+		for _, c := range cidrs {
+			r, err := ParseRoute(c)
+			if err != nil {
+				return err
+			}
+			cfg.Routes = append(cfg.Routes, r)
+		}
+		return nil
+	}
+}
+
+// WithNetstack runs the node on a userspace TCP/IP stack instead of a TUN
+// device. proxy, if not empty, is the host address of a SOCKS5 and HTTP
+// proxy to the VPN. Names are resolved through the dns servers, which are
+// reached through the VPN.
+func WithNetstack(proxy string, dns ...string) Option {
+	return func(cfg *Config) error {
+		for _, d := range dns {
+			a, err := netip.ParseAddr(d)
+			if err != nil {
+				return err
+			}
+			cfg.NetstackDNS = append(cfg.NetstackDNS, a)
+		}
+		cfg.Netstack = true
+		cfg.NetstackProxy = proxy
+		return nil
+	}
+}
+
+// WithForwards relays TCP connections between the host and the VPN. They
+// only apply with WithNetstack: a TUN device is routed by the host instead.
+func WithForwards(f ...Forward) Option {
+	return func(cfg *Config) error {
+		cfg.Forwards = append(cfg.Forwards, f...)
+		return nil
+	}
+}
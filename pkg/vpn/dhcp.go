@@ -26,9 +26,7 @@ import (
 	"github.com/ipfs/go-log/v2"
 	"github.com/mudler/edgevpn/pkg/crypto"
 	"github.com/mudler/edgevpn/pkg/node"
-	"github.com/mudler/edgevpn/pkg/protocol"
 	"github.com/mudler/edgevpn/pkg/services"
-	"github.com/mudler/edgevpn/pkg/types"
 	"github.com/mudler/edgevpn/pkg/utils"
 
 	"github.com/mudler/edgevpn/pkg/blockchain"
@@ -45,6 +43,16 @@ func checkDHCPLease(c node.Config, leasedir string) string {
 	}
 	return ""
 }
+
+func saveDHCPLease(c node.Config, leasedir, ip string, l log.StandardLogger) {
+	leaseFileName := crypto.MD5(fmt.Sprintf("%s-ek", c.ExchangeKey))
+	leaseFile := filepath.Join(leasedir, leaseFileName)
+	l.Debugf("Writing lease to '%s'", leaseFile)
+	if err := ioutil.WriteFile(leaseFile, []byte(ip), 0600); err != nil {
+		l.Warn(err)
+	}
+}
+
 func contains(slice []string, elem string) bool {
 	for _, s := range slice {
 		if elem == s {
@@ -62,6 +70,19 @@ func DHCPNetworkService(ip chan string, l log.StandardLogger, maxTime time.Durat
 		// retrieve lease if present
 		var wantedIP = checkDHCPLease(c, leasedir)
 
+		// Reservations come first: a reserved address is ours without asking,
+		// once no other live peer holds it
+		self := n.Host().ID().String()
+		hostname, _ := os.Hostname()
+		if state := newDHCPState(b.CurrentData()); state.reservation(self, hostname) != "" {
+			wantedIP = ""
+			if r := state.reservation(self, hostname); !state.heldByOther(r, self, liveNodes(b, maxTime), time.Now()) {
+				wantedIP = r
+			}
+		} else if state.reservedForOthers(wantedIP, self, hostname) {
+			wantedIP = ""
+		}
+
 		//  whoever wants a new IP:
 		//  1. Get available nodes. Filter from Machine those that do not have an IP.
 		//  2. Get the leader among them. If we are not, we wait
@@ -73,16 +94,23 @@ func DHCPNetworkService(ip chan string, l log.StandardLogger, maxTime time.Durat
 			nodes := services.AvailableNodes(b, maxTime)
 
 			currentIPs := map[string]string{}
-			ips := []string{}
+			state := newDHCPState(b.CurrentData())
+			if r := state.reservation(self, hostname); r != "" {
+				if state.heldByOther(r, self, liveNodes(b, maxTime), time.Now()) {
+					l.Infof("%s is reserved for this node but %s still holds it, waiting", r, state.machines[r].PeerID)
+					continue
+				}
+				wantedIP = r
+				break
+			}
 
-			for _, t := range b.CurrentData()[protocol.MachinesLedgerKey] {
-				var m types.Machine
-				t.Unmarshal(&m)
+			for _, m := range state.machines {
 				currentIPs[m.PeerID] = m.Address
 
 				l.Debugf("%s uses %s", m.PeerID, m.Address)
-				ips = append(ips, m.Address)
 			}
+			// Addresses of expired leases can be given again
+			ips := state.inUse(self, hostname, time.Now())
 
 			nodesWithNoIP := []string{}
 			for _, nn := range nodes {
@@ -130,16 +158,12 @@ func DHCPNetworkService(ip chan string, l log.StandardLogger, maxTime time.Durat
 			// We are lead
 			l.Debug("picking up between", ips)
 
-			wantedIP = utils.NextIP(address, ips)
+			wantedIP = nextFreeIP(address, ips)
 		}
 
 		// Save lease to disk
-		leaseFileName := crypto.MD5(fmt.Sprintf("%s-ek", c.ExchangeKey))
-		leaseFile := filepath.Join(leasedir, leaseFileName)
-		l.Debugf("Writing lease to '%s'", leaseFile)
-		if err := ioutil.WriteFile(leaseFile, []byte(wantedIP), 0600); err != nil {
-			l.Warn(err)
-		}
+		saveDHCPLease(c, leasedir, wantedIP, l)
+		go renewLease(ctx, b, self, wantedIP, maxTime)
 
 		// propagate ip to channel that is read while starting vpn
 		ip <- wantedIP
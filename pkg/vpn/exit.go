@@ -0,0 +1,173 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/services"
+)
+
+// ExitAuto selects any live exit node.
+const ExitAuto = "auto"
+
+// AdvertiseExitNode offers the node as exit for the traffic of its peers
+// that is not addressed to the VPN.
+var AdvertiseExitNode Option = func(cfg *Config) error {
+	cfg.ExitNode = true
+	return nil
+}
+
+// WithExitVia sends the traffic that is not addressed to the VPN through an
+// exit node: the peer ID given, or ExitAuto for any. Exits without a
+// heartbeat in deadtime are considered gone, and another one is used until
+// they are back.
+func WithExitVia(id string, deadtime time.Duration) Option {
+	return func(cfg *Config) error {
+		if id != ExitAuto {
+			if _, err := peer.Decode(id); err != nil {
+				return fmt.Errorf("invalid exit node %q: %w", id, err)
+			}
+		}
+		cfg.ExitVia = id
+		cfg.ExitDeadTime = deadtime
+		return nil
+	}
+}
+
+// exitSelector keeps track of the exit node in use.
+type exitSelector struct {
+	preferred string // empty for any
+
+	sync.RWMutex
+	current string
+	to      dest
+}
+
+func newExitSelector(via string) *exitSelector {
+	if via == "" {
+		return nil
+	}
+	if via == ExitAuto {
+		via = ""
+	}
+	return &exitSelector{preferred: via}
+}
+
+// peer returns the exit node in use, if any.
+func (e *exitSelector) peer() string {
+	if e == nil {
+		return ""
+	}
+	e.RLock()
+	defer e.RUnlock()
+	return e.current
+}
+
+// dest returns the exit node in use, if any.
+func (e *exitSelector) dest() (dest, bool) {
+	if e == nil {
+		return dest{}, false
+	}
+	e.RLock()
+	defer e.RUnlock()
+	return e.to, e.to.id != ""
+}
+
+// choose picks the exit among live: the preferred one when live, else the
+// current one while it stays live, else a random one. It reports whether
+// the exit changed.
+func (e *exitSelector) choose(live []string) (string, bool) {
+	e.Lock()
+	defer e.Unlock()
+
+	next := ""
+	for _, p := range live {
+		if p == e.preferred {
+			next = p
+		}
+		if p == e.current && next == "" {
+			next = p
+		}
+	}
+	if next == "" && len(live) > 0 {
+		next = live[rand.Intn(len(live))]
+	}
+	changed := next != e.current
+	e.current = next
+	e.to, _ = newDest(next)
+	return next, changed
+}
+
+// liveExits returns the exit nodes advertised in the ledger that have a
+// heartbeat within deadtime, except self.
+func liveExits(b *blockchain.Ledger, self string, deadtime time.Duration) (live []string) {
+	exits := b.CurrentData()[protocol.ExitNodeKey]
+	for _, p := range services.AvailableNodes(b, deadtime) {
+		if _, ok := exits[p]; ok && p != self {
+			live = append(live, p)
+		}
+	}
+	sort.Strings(live)
+	return
+}
+
+// WithUnderlay gives the bootstrap and relay addresses of the node, which
+// keep being reached outside of the VPN when an exit node carries the
+// default route, next to the peers the node is connected to.
+func WithUnderlay(addrs ...ma.Multiaddr) Option {
+	return func(cfg *Config) error {
+		cfg.Underlay = append(cfg.Underlay, addrs...)
+		return nil
+	}
+}
+
+// underlayIPs returns the addresses of the peers the host is connected to and
+// of the bootstrap and relay nodes, which must keep being reached outside of
+// the VPN when it carries the default route. Peers only known from the
+// peerstore are left out: there can be thousands of them.
+func underlayIPs(h host.Host, underlay []ma.Multiaddr) (ips []net.IP) {
+	seen := map[string]bool{}
+	add := func(a ma.Multiaddr) {
+		v, err := a.ValueForProtocol(ma.P_IP4)
+		if err != nil {
+			v, err = a.ValueForProtocol(ma.P_IP6)
+		}
+		if err != nil || seen[v] {
+			return
+		}
+		seen[v] = true
+		if ip := net.ParseIP(v); ip != nil && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() {
+			ips = append(ips, ip)
+		}
+	}
+	for _, c := range h.Network().Conns() {
+		add(c.RemoteMultiaddr())
+	}
+	for _, a := range underlay {
+		add(a)
+	}
+	return
+}
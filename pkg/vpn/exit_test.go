@@ -0,0 +1,108 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("Exit nodes", func() {
+	It("is disabled without a selection", func() {
+		Expect(newExitSelector("")).To(BeNil())
+		Expect(newExitSelector("").peer()).To(BeEmpty())
+	})
+
+	It("fails over and returns to the preferred exit", func() {
+		e := newExitSelector("exit-b")
+
+		exit, changed := e.choose([]string{"exit-a", "exit-b"})
+		Expect(exit).To(Equal("exit-b"))
+		Expect(changed).To(BeTrue())
+
+		exit, _ = e.choose([]string{"exit-a"})
+		Expect(exit).To(Equal("exit-a"))
+
+		exit, changed = e.choose([]string{"exit-a", "exit-b"})
+		Expect(exit).To(Equal("exit-b"))
+		Expect(changed).To(BeTrue())
+
+		exit, changed = e.choose(nil)
+		Expect(exit).To(BeEmpty())
+		Expect(changed).To(BeTrue())
+		Expect(e.peer()).To(BeEmpty())
+	})
+
+	It("sticks to a live exit when choosing automatically", func() {
+		e := newExitSelector(ExitAuto)
+
+		exit, _ := e.choose([]string{"exit-a"})
+		Expect(exit).To(Equal("exit-a"))
+		for i := 0; i < 10; i++ {
+			exit, changed := e.choose([]string{"exit-a", "exit-b", "exit-c"})
+			Expect(exit).To(Equal("exit-a"))
+			Expect(changed).To(BeFalse())
+		}
+		exit, _ = e.choose([]string{"exit-b", "exit-c"})
+		Expect(exit).To(BeElementOf("exit-b", "exit-c"))
+	})
+
+	It("rejects an invalid exit", func() {
+		c := &Config{}
+		Expect(c.Apply(WithExitVia("not-a-peer", time.Minute))).To(HaveOccurred())
+		Expect(c.Apply(WithExitVia(ExitAuto, time.Minute))).To(Succeed())
+	})
+
+	It("lists the exits with a recent heartbeat", func() {
+		l := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		now := time.Now().UTC()
+		l.Add(protocol.HealthCheckKey, map[string]interface{}{
+			"exit-a": now.Format(time.RFC3339),
+			"exit-b": now.Add(-time.Hour).Format(time.RFC3339),
+			"me":     now.Format(time.RFC3339),
+			"peer":   now.Format(time.RFC3339),
+		})
+		l.Add(protocol.ExitNodeKey, map[string]interface{}{
+			"exit-a": types.ExitNode{PeerID: "exit-a"},
+			"exit-b": types.ExitNode{PeerID: "exit-b"},
+			"me":     types.ExitNode{PeerID: "me"},
+		})
+
+		Expect(liveExits(l, "me", time.Minute)).To(Equal([]string{"exit-a"}))
+	})
+
+	It("routes around the exit the connected peers and the bootstrap and relay nodes only", func() {
+		h, err := libp2p.New(libp2p.NoListenAddrs)
+		Expect(err).ToNot(HaveOccurred())
+		defer h.Close()
+		h.Peerstore().AddAddr(newPeerID(), ma.StringCast("/ip4/203.0.113.5/tcp/4001"), peerstore.PermanentAddrTTL)
+
+		Expect(underlayIPs(h, []ma.Multiaddr{
+			ma.StringCast("/ip4/198.51.100.1/tcp/4001"),
+			ma.StringCast("/dnsaddr/bootstrap.libp2p.io"),
+			ma.StringCast("/ip4/127.0.0.1/udp/4001/quic-v1"),
+		})).To(Equal([]net.IP{net.ParseIP("198.51.100.1")}))
+	})
+})
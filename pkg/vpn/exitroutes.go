@@ -0,0 +1,207 @@
+//go:build !windows && !darwin && !freebsd
+// +build !windows,!darwin,!freebsd
+
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+)
+
+// defaultRoutes cover the whole address space while being more specific
+// than the default routes, which are left in place.
+var defaultRoutes = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(1, 32)},
+	{IP: net.IPv4(128, 0, 0, 0), Mask: net.CIDRMask(1, 32)},
+	{IP: net.ParseIP("::"), Mask: net.CIDRMask(1, 128)},
+	{IP: net.ParseIP("8000::"), Mask: net.CIDRMask(1, 128)},
+}
+
+// exitRoutes sends the traffic of the host through the VPN interface while
+// an exit node is in use. The addresses of the peers keep going through the
+// gateways the host used before, so the VPN does not carry itself.
+//
+// IPv6 goes to the VPN too, so that it does not leak around the exit. The
+// exit only forwards it for nodes with an IPv6 address: for the others it is
+// blocked.
+type exitRoutes struct {
+	sync.Mutex
+	underlay, underlay6 *netlink.Route
+	bypass              map[string]*netlink.Route
+	active              bool
+}
+
+func (r *exitRoutes) sync(c *Config, on bool, peers []net.IP) error {
+	r.Lock()
+	defer r.Unlock()
+
+	link, err := netlink.LinkByName(c.InterfaceName)
+	if err != nil {
+		return err
+	}
+
+	if !on {
+		if !r.active {
+			return nil
+		}
+		for _, d := range defaultRoutes {
+			netlink.RouteDel(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: d})
+		}
+		for k, rt := range r.bypass {
+			netlink.RouteDel(rt)
+			delete(r.bypass, k)
+		}
+		r.active = false
+		return nil
+	}
+
+	if r.underlay == nil {
+		routes, err := netlink.RouteGet(net.IPv4(1, 1, 1, 1))
+		if err != nil {
+			return err
+		}
+		if len(routes) == 0 || routes[0].LinkIndex == link.Attrs().Index {
+			return errors.New("no default route outside of the VPN")
+		}
+		r.underlay = &routes[0]
+		// Without an IPv6 route out there are no IPv6 peers to reach either
+		if routes, err := netlink.RouteGet(net.ParseIP("2001:4860:4860::8888")); err == nil && len(routes) > 0 && routes[0].LinkIndex != link.Attrs().Index {
+			r.underlay6 = &routes[0]
+		}
+		r.bypass = map[string]*netlink.Route{}
+	}
+
+	local := localNetworks(c.InterfaceName)
+	_, vpnNet, _ := net.ParseCIDR(c.InterfaceAddress)
+	wanted := map[string]bool{}
+NEXT:
+	for _, ip := range peers {
+		underlay, bits := r.underlay, 32
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		} else {
+			underlay, bits = r.underlay6, 128
+		}
+		if underlay == nil || (vpnNet != nil && vpnNet.Contains(ip)) {
+			continue
+		}
+		if a, ok := netip.AddrFromSlice(ip); ok && c.IPv6Prefix.IsValid() && c.IPv6Prefix.Contains(a) {
+			continue
+		}
+		for _, l := range local {
+			if l.Contains(ip) {
+				continue NEXT
+			}
+		}
+		rt := &netlink.Route{Dst: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, Gw: underlay.Gw, LinkIndex: underlay.LinkIndex}
+		k := rt.Dst.String()
+		wanted[k] = true
+		if r.bypass[k] != nil {
+			continue
+		}
+		if err := netlink.RouteReplace(rt); err != nil {
+			return err
+		}
+		r.bypass[k] = rt
+	}
+	for k, rt := range r.bypass {
+		if !wanted[k] {
+			netlink.RouteDel(rt)
+			delete(r.bypass, k)
+		}
+	}
+
+	if !r.active {
+		for _, d := range defaultRoutes {
+			err := netlink.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: d})
+			// A host without IPv6 has nothing to leak
+			if err != nil && (d.IP.To4() != nil || c.interfaceAddress6.IsValid()) {
+				return err
+			}
+		}
+		r.active = true
+	}
+	return nil
+}
+
+// forwardingSysctls are the switches enableExitNAT turns on, IPv4 first.
+var forwardingSysctls = []string{
+	"/proc/sys/net/ipv4/ip_forward",
+	"/proc/sys/net/ipv6/conf/all/forwarding",
+}
+
+// natRules returns the rules masquerading the traffic of the VPN leaving
+// through the other interfaces, for op (-C, -A or -D): IPv4 first, then
+// IPv6 when the network has an IPv6 prefix.
+func natRules(c *Config, op string) ([]*exec.Cmd, error) {
+	_, vpnNet, err := net.ParseCIDR(c.InterfaceAddress)
+	if err != nil {
+		return nil, err
+	}
+	rules := []*exec.Cmd{exec.Command("iptables", "-t", "nat", op, "POSTROUTING", "-s", vpnNet.String(), "!", "-o", c.InterfaceName, "-j", "MASQUERADE")}
+	if c.IPv6Prefix.IsValid() {
+		rules = append(rules, exec.Command("ip6tables", "-t", "nat", op, "POSTROUTING", "-s", c.IPv6Prefix.Masked().String(), "!", "-o", c.InterfaceName, "-j", "MASQUERADE"))
+	}
+	return rules, nil
+}
+
+// enableExitNAT turns on IP forwarding and masquerades the traffic of the
+// VPN leaving through the other interfaces. The returned function puts the
+// forwarding switches back as they were and removes the rules it added.
+func enableExitNAT(c *Config) (func(), error) {
+	checks, err := natRules(c, "-C")
+	if err != nil {
+		return nil, err
+	}
+	adds, _ := natRules(c, "-A")
+	dels, _ := natRules(c, "-D")
+
+	var undo []func()
+	restore := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+
+	for _, path := range forwardingSysctls[:len(checks)] {
+		prev, err := os.ReadFile(path)
+		if err == nil {
+			err = os.WriteFile(path, []byte("1"), 0644)
+		}
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		undo = append(undo, func() { os.WriteFile(path, prev, 0644) })
+	}
+	for i, check := range checks {
+		if check.Run() == nil {
+			continue
+		}
+		if out, err := adds[i].CombinedOutput(); err != nil {
+			restore()
+			return nil, errors.New(string(out))
+		}
+		undo = append(undo, func() { dels[i].Run() })
+	}
+	return restore, nil
+}
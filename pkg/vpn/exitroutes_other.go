@@ -0,0 +1,36 @@
+//go:build windows || darwin || freebsd
+// +build windows darwin freebsd
+
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+var errExitUnsupported = fmt.Errorf("exit node routing is not automated on %s, configure it on the host", runtime.GOOS)
+
+type exitRoutes struct{}
+
+func (r *exitRoutes) sync(c *Config, on bool, peers []net.IP) error {
+	if !on {
+		return nil
+	}
+	return errExitUnsupported
+}
+
+func enableExitNAT(c *Config) (func(), error) { return nil, errExitUnsupported }
@@ -0,0 +1,355 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// ParseFirewallRule parses a rule written as
+//
+//	allow|deny [from <ip|cidr>] [to <ip|cidr>] [proto tcp|udp|icmp] [port <n>[-<m>]]
+//
+// e.g. "deny from 10.1.0.0/24 proto tcp port 22".
+func ParseFirewallRule(s string) (types.FirewallRule, error) {
+	f := strings.Fields(s)
+	if len(f) == 0 || len(f)%2 == 0 {
+		return types.FirewallRule{}, fmt.Errorf("invalid firewall rule %q", s)
+	}
+	r := types.FirewallRule{Action: f[0]}
+	for i := 1; i < len(f); i += 2 {
+		switch f[i] {
+		case "from":
+			r.From = f[i+1]
+		case "to":
+			r.To = f[i+1]
+		case "proto":
+			r.Protocol = f[i+1]
+		case "port":
+			r.Port = f[i+1]
+		default:
+			return r, fmt.Errorf("invalid firewall rule %q: unknown %q", s, f[i])
+		}
+	}
+	_, err := compileRule(r)
+	return r, err
+}
+
+type firewallRule struct {
+	allow    bool
+	from, to *net.IPNet
+	proto    string
+	lo, hi   uint16
+}
+
+// ruleset is a compiled types.Firewall. A nil ruleset allows everything.
+type ruleset struct {
+	allow bool
+	rules []firewallRule
+}
+
+func compileRule(r types.FirewallRule) (firewallRule, error) {
+	var (
+		c   firewallRule
+		err error
+	)
+	switch r.Action {
+	case "allow":
+		c.allow = true
+	case "deny":
+	default:
+		return c, fmt.Errorf("invalid firewall action %q (want allow or deny)", r.Action)
+	}
+	if c.from, err = parseNet(r.From); err != nil {
+		return c, err
+	}
+	if c.to, err = parseNet(r.To); err != nil {
+		return c, err
+	}
+	switch r.Protocol {
+	case "", "tcp", "udp", "icmp":
+		c.proto = r.Protocol
+	default:
+		return c, fmt.Errorf("invalid firewall protocol %q (want tcp, udp or icmp)", r.Protocol)
+	}
+	if r.Port != "" {
+		if c.proto != "tcp" && c.proto != "udp" {
+			return c, fmt.Errorf("firewall port %q needs proto tcp or udp", r.Port)
+		}
+		var ok bool
+		if c.lo, c.hi, ok = parsePortRange(r.Port); !ok {
+			return c, fmt.Errorf("invalid firewall port %q", r.Port)
+		}
+	}
+	return c, nil
+}
+
+// parsePortRange parses a port or a range of ports, "<n>[-<m>]".
+func parsePortRange(s string) (lo, hi uint16, ok bool) {
+	l, h := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		l, h = s[:i], s[i+1:]
+	}
+	a, err1 := strconv.ParseUint(l, 10, 16)
+	b, err2 := strconv.ParseUint(h, 10, 16)
+	if err1 != nil || err2 != nil || a > b {
+		return 0, 0, false
+	}
+	return uint16(a), uint16(b), true
+}
+
+func parseNet(s string) (*net.IPNet, error) {
+	if s == "" || s == "any" {
+		return nil, nil
+	}
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid firewall address %q", s)
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// compileFirewall compiles f, returning nil if it allows everything.
+func compileFirewall(f types.Firewall) (*ruleset, error) {
+	rs := &ruleset{}
+	switch f.Default {
+	case "", "allow":
+		rs.allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("invalid firewall default %q (want allow or deny)", f.Default)
+	}
+	for _, r := range f.Rules {
+		c, err := compileRule(r)
+		if err != nil {
+			return nil, err
+		}
+		rs.rules = append(rs.rules, c)
+	}
+	if rs.allow && len(rs.rules) == 0 {
+		return nil, nil
+	}
+	return rs, nil
+}
+
+// packetInfo is what rules match on.
+type packetInfo struct {
+	src, dst     net.IP
+	proto        string
+	sport, dport uint16
+}
+
+// parsePacket reads the IP header of an IPv4 or IPv6 packet and the ports of
+// an unfragmented TCP or UDP payload.
+func parsePacket(b []byte) (packetInfo, bool) {
+	var (
+		p       packetInfo
+		next    byte
+		payload []byte
+	)
+	switch {
+	case len(b) >= 20 && b[0]>>4 == 4:
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < 20 || len(b) < ihl {
+			return p, false
+		}
+		p.src, p.dst = net.IP(b[12:16]), net.IP(b[16:20])
+		next = b[9]
+		// Only the first fragment carries the transport header.
+		if binary.BigEndian.Uint16(b[6:8])&0x1fff == 0 {
+			payload = b[ihl:]
+		}
+	case len(b) >= 40 && b[0]>>4 == 6:
+		p.src, p.dst = net.IP(b[8:24]), net.IP(b[24:40])
+		next = b[6]
+		payload = b[40:]
+	default:
+		return p, false
+	}
+
+	switch next {
+	case 1, 58:
+		p.proto = "icmp"
+	case 6:
+		p.proto = "tcp"
+	case 17:
+		p.proto = "udp"
+	}
+	if (p.proto == "tcp" || p.proto == "udp") && len(payload) >= 4 {
+		p.sport = binary.BigEndian.Uint16(payload[0:2])
+		p.dport = binary.BigEndian.Uint16(payload[2:4])
+	}
+	return p, true
+}
+
+func (r firewallRule) matches(p packetInfo) bool {
+	if r.from != nil && !r.from.Contains(p.src) {
+		return false
+	}
+	if r.to != nil && !r.to.Contains(p.dst) {
+		return false
+	}
+	if r.proto != "" && r.proto != p.proto {
+		return false
+	}
+	if r.hi != 0 && (p.dport < r.lo || p.dport > r.hi) {
+		return false
+	}
+	return true
+}
+
+func (rs *ruleset) allows(p packetInfo) bool {
+	if rs == nil {
+		return true
+	}
+	for _, r := range rs.rules {
+		if r.matches(p) {
+			return r.allow
+		}
+	}
+	return rs.allow
+}
+
+// firewall filters the VPN traffic of the node. Its own rules (local) come
+// from the configuration and are applied to the packets it receives. The
+// rules other peers publish in the ledger are applied to the packets sent to
+// them, so that traffic they would drop does not cross the network. The
+// filter is stateless: applying the local rules to the packets sent too would
+// drop the replies to the connections they allow.
+type firewall struct {
+	local *ruleset
+
+	sync.RWMutex
+	remote map[string]*ruleset
+}
+
+func newFirewall(local *ruleset) *firewall {
+	return &firewall{local: local, remote: map[string]*ruleset{}}
+}
+
+// allowSend reports whether the frame may be sent to the peer to.
+func (f *firewall) allowSend(frame []byte, to string) bool {
+	if f == nil {
+		return true
+	}
+	f.RLock()
+	remote := f.remote[to]
+	f.RUnlock()
+	if remote == nil {
+		return true
+	}
+	p, ok := parsePacket(frame)
+	return ok && remote.allows(p)
+}
+
+// allowReceive reports whether a frame received from another peer may be
+// written to the interface. The rules match the source address, so a frame
+// whose source the sending peer does not own, as told by owns, is dropped
+// first.
+func (f *firewall) allowReceive(frame []byte, owns func(netip.Addr) bool) bool {
+	if f == nil || f.local == nil {
+		return true
+	}
+	p, ok := parsePacket(frame)
+	if !ok {
+		return false
+	}
+	src, ok := netip.AddrFromSlice(p.src)
+	return ok && owns(src.Unmap()) && f.local.allows(p)
+}
+
+// update replaces the remote rules with the content of the firewall bucket.
+// Invalid rulesets are ignored, as the peer would fail to start with them.
+func (f *firewall) update(bucket map[string]blockchain.Data) {
+	remote := map[string]*ruleset{}
+	for peerID, d := range bucket {
+		var fw types.Firewall
+		if err := d.Unmarshal(&fw); err != nil {
+			continue
+		}
+		if rs, err := compileFirewall(fw); err == nil && rs != nil {
+			remote[peerID] = rs
+		}
+	}
+	f.Lock()
+	f.remote = remote
+	f.Unlock()
+}
+
+// watch keeps the remote rules in sync with the ledger until ctx is done.
+func (f *firewall) watch(ctx context.Context, l *blockchain.Ledger) {
+	for ctx.Err() == nil {
+		events := l.Watch(ctx, protocol.FirewallKey, "")
+		f.update(l.CurrentData()[protocol.FirewallKey])
+		for range events {
+			f.update(l.CurrentData()[protocol.FirewallKey])
+		}
+	}
+}
+
+// copyPackets writes the IP packets read from r to w one at a time, dropping
+// the ones allow rejects (if not nil). Packets are delimited by the length in
+// their header, as a stream may carry several of them.
+func copyPackets(w io.Writer, r io.Reader, allow func([]byte) bool) error {
+	buf := make([]byte, 65535+40)
+	for {
+		if _, err := io.ReadFull(r, buf[:6]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var size int
+		switch buf[0] >> 4 {
+		case 4:
+			size = int(binary.BigEndian.Uint16(buf[2:4]))
+		case 6:
+			size = 40 + int(binary.BigEndian.Uint16(buf[4:6]))
+		default:
+			return fmt.Errorf("not an IP packet (version %d)", buf[0]>>4)
+		}
+		if size < 20 {
+			return fmt.Errorf("invalid IP packet length %d", size)
+		}
+		if _, err := io.ReadFull(r, buf[6:size]); err != nil {
+			return err
+		}
+		if allow != nil && !allow(buf[:size]) {
+			continue
+		}
+		if _, err := w.Write(buf[:size]); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/netip"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+func mustRules(f types.Firewall, rules ...string) *ruleset {
+	for _, r := range rules {
+		rule, err := ParseFirewallRule(r)
+		Expect(err).NotTo(HaveOccurred())
+		f.Rules = append(f.Rules, rule)
+	}
+	rs, err := compileFirewall(f)
+	Expect(err).NotTo(HaveOccurred())
+	return rs
+}
+
+var _ = Describe("Firewall", func() {
+	It("parses rules", func() {
+		r, err := ParseFirewallRule("deny from 10.1.0.0/24 to 10.1.1.5 proto tcp port 22-23")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r).To(Equal(types.FirewallRule{Action: "deny", From: "10.1.0.0/24", To: "10.1.1.5", Protocol: "tcp", Port: "22-23"}))
+
+		for _, bad := range []string{"", "drop", "allow from", "allow from nowhere", "allow port 22", "deny proto tcp port 30-20", "allow via x"} {
+			_, err := ParseFirewallRule(bad)
+			Expect(err).To(HaveOccurred(), bad)
+		}
+	})
+
+	It("applies the first matching rule, then the default", func() {
+		rs := mustRules(types.Firewall{Default: "deny"},
+			"deny from 10.1.0.0/24 proto tcp port 22",
+			"allow from 10.1.0.0/16",
+		)
+		check := func(src string, port uint16) bool {
+			p, ok := parsePacket(tcpPacket(src, "10.1.2.1", port))
+			Expect(ok).To(BeTrue())
+			return rs.allows(p)
+		}
+		Expect(check("10.1.0.3", 22)).To(BeFalse())
+		Expect(check("10.1.0.3", 80)).To(BeTrue())
+		Expect(check("10.1.5.3", 22)).To(BeTrue())
+		Expect(check("192.168.0.1", 80)).To(BeFalse())
+	})
+
+	It("allows everything without rules", func() {
+		rs, err := compileFirewall(types.Firewall{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rs).To(BeNil())
+		Expect(newFirewall(nil).allowSend(tcpPacket("10.1.0.1", "10.1.0.2", 22), "peer")).To(BeTrue())
+	})
+
+	It("honours the rules peers publish when sending to them", func() {
+		fw := newFirewall(nil)
+		remote, _ := json.Marshal(types.Firewall{PeerID: "prod", Default: "deny", Rules: []types.FirewallRule{{Action: "allow", From: "10.1.1.0/24"}}})
+		fw.update(map[string]blockchain.Data{"prod": blockchain.Data(remote)})
+
+		Expect(fw.allowSend(tcpPacket("10.1.0.1", "10.1.1.9", 22), "prod")).To(BeFalse())
+		Expect(fw.allowSend(tcpPacket("10.1.1.1", "10.1.1.9", 22), "prod")).To(BeTrue())
+		Expect(fw.allowSend(tcpPacket("10.1.0.1", "10.1.1.9", 22), "dev")).To(BeTrue())
+	})
+
+	It("does not filter the packets the node sends with its own rules", func() {
+		fw := newFirewall(mustRules(types.Firewall{Default: "deny"}, "allow proto tcp port 22"))
+
+		// A reply to an allowed connection goes to the ephemeral port of the
+		// client
+		Expect(fw.allowSend(tcpPacket("10.1.0.2", "10.1.0.1", 40000), "client")).To(BeTrue())
+		Expect(fw.allowReceive(tcpPacket("10.1.0.1", "10.1.0.2", 22), anySource)).To(BeTrue())
+		Expect(fw.allowReceive(tcpPacket("10.1.0.1", "10.1.0.2", 80), anySource)).To(BeFalse())
+	})
+
+	It("drops the packets whose source the sending peer does not own", func() {
+		prod, dev := newPeerID(), newPeerID()
+		r := ledgerRoutes(machines(
+			types.Machine{PeerID: prod.String(), Address: "10.1.0.1", Routes: []string{"192.168.1.0/24"}},
+			types.Machine{PeerID: dev.String(), Address: "10.1.0.2"},
+		), "", nil)
+		fw := newFirewall(mustRules(types.Firewall{Default: "deny"}, "allow from 10.1.0.1", "allow from 192.168.1.0/24"))
+		from := func(id peer.ID) func(netip.Addr) bool {
+			return func(src netip.Addr) bool { return sentBy(&Config{}, r, dest{id: id, name: id.String()}, src) }
+		}
+
+		Expect(fw.allowReceive(tcpPacket("10.1.0.1", "10.1.0.3", 22), from(prod))).To(BeTrue())
+		Expect(fw.allowReceive(tcpPacket("192.168.1.5", "10.1.0.3", 22), from(prod))).To(BeTrue())
+		Expect(fw.allowReceive(tcpPacket("10.1.0.1", "10.1.0.3", 22), from(dev))).To(BeFalse())
+		Expect(fw.allowReceive(tcpPacket("192.168.1.5", "10.1.0.3", 22), from(dev))).To(BeFalse())
+		Expect(fw.allowReceive(tcpPacket("172.16.0.1", "10.1.0.3", 22), from(prod))).To(BeFalse())
+	})
+
+	It("splits and filters the packets of a stream", func() {
+		fw := newFirewall(mustRules(types.Firewall{}, "deny proto tcp port 22"))
+		a, b, c := tcpPacket("10.1.0.1", "10.1.0.2", 80), tcpPacket("10.1.0.1", "10.1.0.2", 22), tcpPacket("10.1.0.1", "10.1.0.2", 443)
+
+		var (
+			in      bytes.Buffer
+			written [][]byte
+		)
+		in.Write(a)
+		in.Write(b)
+		in.Write(c)
+		err := copyPackets(writerFunc(func(p []byte) (int, error) {
+			written = append(written, append([]byte{}, p...))
+			return len(p), nil
+		}), &in, func(p []byte) bool { return fw.allowReceive(p, anySource) })
+		Expect(err).NotTo(HaveOccurred())
+		Expect(written).To(Equal([][]byte{a, c}))
+	})
+})
+
+func anySource(netip.Addr) bool { return true }
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
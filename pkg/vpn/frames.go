@@ -0,0 +1,96 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+)
+
+// Packets sent with protocol.EdgeVPNFramed are each preceded by a header:
+//
+//	length   uint16 (big endian, of the packet)
+//	priority uint8
+//	flags    uint8  (reserved, 0)
+//	flow     uint32 (big endian)
+const frameHeaderSize = 8
+
+// frameMeta is the metadata sent along with a packet.
+type frameMeta struct {
+	Priority uint8
+	Flow     uint32
+}
+
+// packetMeta computes the metadata of an IP packet: the flow hashes the
+// addresses, protocol and ports, so that the packets of a connection share
+// it; the priority is the class selector of its DSCP.
+func packetMeta(b []byte) frameMeta {
+	var m frameMeta
+	h := fnv.New32a()
+	switch {
+	case len(b) >= 20 && b[0]>>4 == 4:
+		m.Priority = b[1] >> 5
+		h.Write(b[12:20])
+		h.Write(b[9:10])
+		if ihl := int(b[0]&0x0f) * 4; (b[9] == 6 || b[9] == 17) && len(b) >= ihl+4 {
+			h.Write(b[ihl : ihl+4])
+		}
+	case len(b) >= 40 && b[0]>>4 == 6:
+		m.Priority = (b[0]&0x0f)<<4 | b[1]>>4
+		m.Priority >>= 5
+		h.Write(b[8:40])
+		h.Write(b[6:7])
+		if (b[6] == 6 || b[6] == 17) && len(b) >= 44 {
+			h.Write(b[40:44])
+		}
+	default:
+		return m
+	}
+	m.Flow = h.Sum32()
+	return m
+}
+
+// appendFrame appends the packet with its header to buf.
+func appendFrame(buf, packet []byte) []byte {
+	m := packetMeta(packet)
+	var hdr [frameHeaderSize]byte
+	binary.BigEndian.PutUint16(hdr[0:2], uint16(len(packet)))
+	hdr[2] = m.Priority
+	binary.BigEndian.PutUint32(hdr[4:8], m.Flow)
+	return append(append(buf, hdr[:]...), packet...)
+}
+
+// readFrames reads the packets from a framed stream and calls handle with
+// each, until r is exhausted or handle fails.
+func readFrames(r io.Reader, handle func(frameMeta, []byte) error) error {
+	var hdr [frameHeaderSize]byte
+	buf := make([]byte, 65535)
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := int(binary.BigEndian.Uint16(hdr[0:2]))
+		if _, err := io.ReadFull(r, buf[:size]); err != nil {
+			return err
+		}
+		m := frameMeta{Priority: hdr[2], Flow: binary.BigEndian.Uint32(hdr[4:8])}
+		if err := handle(m, buf[:size]); err != nil {
+			return err
+		}
+	}
+}
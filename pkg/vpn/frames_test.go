@@ -0,0 +1,56 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func readAll(b []byte) (metas []frameMeta, packets [][]byte) {
+	err := readFrames(bytes.NewReader(b), func(m frameMeta, p []byte) error {
+		metas = append(metas, m)
+		packets = append(packets, append([]byte(nil), p...))
+		return nil
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return
+}
+
+var _ = Describe("Framing", func() {
+	It("carries packets with their flow and priority", func() {
+		a, b, c := tcpPacket("10.1.0.1", "10.1.0.2", 80), tcpPacket("10.1.0.1", "10.1.0.2", 80), tcpPacket("10.1.0.1", "10.1.0.2", 443)
+		c[1] = 0xb8 // DSCP EF
+
+		var buf []byte
+		for _, p := range [][]byte{a, b, c} {
+			buf = appendFrame(buf, p)
+		}
+		metas, packets := readAll(buf)
+		Expect(packets).To(Equal([][]byte{a, b, c}))
+		Expect(metas[0].Flow).NotTo(BeZero())
+		Expect(metas[0].Flow).To(Equal(metas[1].Flow))
+		Expect(metas[2].Flow).NotTo(Equal(metas[0].Flow))
+		Expect(metas[0].Priority).To(BeZero())
+		Expect(metas[2].Priority).To(Equal(uint8(5)))
+	})
+
+	It("rejects a truncated frame", func() {
+		buf := appendFrame(nil, tcpPacket("10.1.0.1", "10.1.0.2", 80))
+		err := readFrames(bytes.NewReader(buf[:len(buf)-1]), func(frameMeta, []byte) error { return nil })
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,206 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/ipfs/go-log/v2"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// hashTries is how many addresses derived from the peer ID are tried before
+// scanning the subnet for a free one.
+const hashTries = 8
+
+// hashCandidate returns the address a peer tries at the given attempt: the
+// first hashTries come from a hash of the peer ID, the next ones walk the
+// subnet from the first, so that every host address is tried in the end.
+func hashCandidate(prefix netip.Prefix, id string, attempt int) netip.Addr {
+	hosts := uint64(1)<<(32-prefix.Bits()) - 2
+	offset := func(i int) uint64 {
+		h := sha256.Sum256([]byte(fmt.Sprintf("%s-%d", id, i)))
+		return binary.BigEndian.Uint64(h[:8]) % hosts
+	}
+	o := offset(attempt)
+	if attempt >= hashTries {
+		o = (offset(0) + uint64(attempt-hashTries+1)) % hosts
+	}
+	base := prefix.Masked().Addr().As4()
+	a := binary.BigEndian.Uint32(base[:]) + uint32(o) + 1
+	var out [4]byte
+	binary.BigEndian.PutUint32(out[:], a)
+	return netip.AddrFrom4(out)
+}
+
+// freeHashIP returns the first address from attempt on that is not taken, and
+// the attempt to resume from if it turns out to be claimed by another peer.
+func freeHashIP(prefix netip.Prefix, id string, attempt int, taken func(netip.Addr) bool) (netip.Addr, int, bool) {
+	last := hashTries + int(uint64(1)<<(32-prefix.Bits())-2)
+	for ; attempt < last; attempt++ {
+		if a := hashCandidate(prefix, id, attempt); !taken(a) {
+			return a, attempt + 1, true
+		}
+	}
+	return netip.Addr{}, 0, false
+}
+
+// ParseDHCPPrefix checks that cidr is an IPv4 subnet addresses can be
+// allocated from.
+func ParseDHCPPrefix(cidr string) (netip.Prefix, error) {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return p, err
+	}
+	if !p.Addr().Is4() || p.Bits() > 30 {
+		return p, fmt.Errorf("%s is not an IPv4 subnet of at least 4 addresses", cidr)
+	}
+	return p.Masked(), nil
+}
+
+// HashDHCPNetworkService returns a network service allocating the address of
+// the node in cidr without a leader. The node tries addresses derived from
+// its peer ID, skipping the reserved ones and the ones live peers hold in the
+// machines bucket under a valid lease, and claims the first free one. The
+// ledger keeps a single claim per address: after settle the node checks it
+// still holds it, else it moves on to the next address. A node with a
+// reservation waits for the reserved address to be free the same way.
+func HashDHCPNetworkService(ip chan string, l log.StandardLogger, maxTime, settle time.Duration, leasedir string, cidr string) node.NetworkService {
+	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
+		prefix, err := ParseDHCPPrefix(cidr)
+		if err != nil {
+			return err
+		}
+		os.MkdirAll(leasedir, 0600)
+		self := n.Host().ID().String()
+
+		holder := func(a netip.Addr) string {
+			v, exists := b.GetKey(protocol.MachinesLedgerKey, a.String())
+			if !exists {
+				return ""
+			}
+			var m types.Machine
+			v.Unmarshal(&m)
+			return m.PeerID
+		}
+
+		// retrieve lease if present. Reservations come first
+		var wantedIP string
+		hostname, _ := os.Hostname()
+		state := newDHCPState(b.CurrentData())
+		if lease, err := netip.ParseAddr(checkDHCPLease(c, leasedir)); err == nil && prefix.Contains(lease) && !state.reservedForOthers(lease.String(), self, hostname) {
+			wantedIP = lease.String()
+		}
+		if r := state.reservation(self, hostname); r != "" {
+			wantedIP = ""
+			if !state.heldByOther(r, self, liveNodes(b, maxTime), time.Now()) {
+				wantedIP = r
+			}
+		}
+
+		for attempt := 0; wantedIP == ""; {
+			live := liveNodes(b, maxTime)
+			state := newDHCPState(b.CurrentData())
+			now := time.Now()
+			if r := state.reservation(self, hostname); r != "" {
+				if !state.heldByOther(r, self, live, now) {
+					wantedIP = r
+					break
+				}
+				l.Infof("%s is reserved for this node but %s still holds it, waiting", r, state.machines[r].PeerID)
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(settle):
+				}
+				continue
+			}
+			addr, next, ok := freeHashIP(prefix, self, attempt, func(a netip.Addr) bool {
+				return state.reservedForOthers(a.String(), self, hostname) || state.heldByOther(a.String(), self, live, now)
+			})
+			if !ok {
+				l.Warnf("no free address left in %s, retrying", prefix)
+				attempt = 0
+			} else {
+				l.Debugf("claiming %s", addr)
+				b.Add(protocol.MachinesLedgerKey, map[string]interface{}{addr.String(): newBlockChainData(n, addr.String(), "", nil)})
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(settle):
+			}
+
+			if !ok {
+				continue
+			}
+			if holder(addr) == self {
+				wantedIP = addr.String()
+			} else {
+				l.Infof("%s was claimed by another peer, trying the next address", addr)
+				attempt = next
+			}
+		}
+
+		saveDHCPLease(c, leasedir, wantedIP, l)
+		go renewLease(ctx, b, self, wantedIP, maxTime)
+
+		// propagate ip to channel that is read while starting vpn
+		ip <- wantedIP
+
+		// Gate connections from VPN
+		return n.BlockSubnet(prefix.String())
+	}
+}
+
+// HashDHCP returns a network service allocating the address of the node in
+// cidr from its peer ID, without electing a leader as DHCP does, and the VPN
+// options reading it back. Like DHCP it requires the Alive Service, to tell
+// the addresses of peers gone for maxTime from the ones in use.
+func HashDHCP(l log.StandardLogger, maxTime, settle time.Duration, leasedir string, cidr string) ([]node.Option, []Option) {
+	ip := make(chan string, 1)
+	bits := 24
+	if p, err := netip.ParsePrefix(cidr); err == nil {
+		bits = p.Bits()
+	}
+	return []node.Option{
+		func(cfg *node.Config) error {
+			// retrieve lease if present. consumed by conngater when starting the node
+			lease := checkDHCPLease(*cfg, leasedir)
+			if lease != "" {
+				cfg.InterfaceAddress = fmt.Sprintf("%s/%d", lease, bits)
+			}
+			return nil
+		},
+		node.WithNetworkService(HashDHCPNetworkService(ip, l, maxTime, settle, leasedir, cidr)),
+	}, []Option{
+		func(cfg *Config) error {
+			// read back IP when starting vpn
+			cfg.InterfaceAddress = fmt.Sprintf("%s/%d", <-ip, bits)
+			close(ip)
+			l.Debug("IP Received", cfg.InterfaceAddress)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"net/netip"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Hash DHCP", func() {
+	prefix := netip.MustParsePrefix("10.1.0.0/24")
+
+	It("accepts IPv4 subnets only", func() {
+		p, err := ParseDHCPPrefix("10.1.0.1/24")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p).To(Equal(prefix))
+
+		_, err = ParseDHCPPrefix("10.1.0.1/31")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseDHCPPrefix("fd00::/64")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("derives host addresses of the subnet from the peer ID", func() {
+		seen := map[netip.Addr]bool{}
+		for i := 0; i < 300; i++ {
+			a := hashCandidate(prefix, "peer", i)
+			Expect(prefix.Contains(a)).To(BeTrue())
+			Expect(a).NotTo(Equal(netip.MustParseAddr("10.1.0.0")))
+			Expect(a).NotTo(Equal(netip.MustParseAddr("10.1.0.255")))
+			Expect(hashCandidate(prefix, "peer", i)).To(Equal(a))
+			seen[a] = true
+		}
+		// Every host address is tried in the end
+		Expect(seen).To(HaveLen(254))
+		Expect(hashCandidate(prefix, "other", 0)).NotTo(Equal(hashCandidate(prefix, "peer", 0)))
+	})
+
+	It("skips the taken addresses and resumes after a lost claim", func() {
+		first := hashCandidate(prefix, "peer", 0)
+		a, next, ok := freeHashIP(prefix, "peer", 0, func(a netip.Addr) bool { return a == first })
+		Expect(ok).To(BeTrue())
+		Expect(a).To(Equal(hashCandidate(prefix, "peer", 1)))
+		Expect(next).To(Equal(2))
+
+		b, _, ok := freeHashIP(prefix, "peer", next, func(netip.Addr) bool { return false })
+		Expect(ok).To(BeTrue())
+		Expect(b).To(Equal(hashCandidate(prefix, "peer", 2)))
+	})
+
+	It("fails when the subnet is full", func() {
+		small := netip.MustParsePrefix("10.1.0.0/30")
+		taken := map[netip.Addr]bool{netip.MustParseAddr("10.1.0.1"): true}
+		a, _, ok := freeHashIP(small, "peer", 0, func(a netip.Addr) bool { return taken[a] })
+		Expect(ok).To(BeTrue())
+		Expect(a).To(Equal(netip.MustParseAddr("10.1.0.2")))
+
+		taken[a] = true
+		_, _, ok = freeHashIP(small, "peer", 0, func(a netip.Addr) bool { return taken[a] })
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -17,6 +17,8 @@ limitations under the License.
 package vpn
 
 import (
+	"net"
+
 	"github.com/mudler/water"
 	"github.com/vishvananda/netlink"
 )
@@ -52,9 +54,35 @@ func prepareInterface(c *Config) error {
 		return err
 	}
 
+	if c.interfaceAddress6.IsValid() {
+		addr6, err := netlink.ParseAddr(c.interfaceAddress6.String())
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrAdd(link, addr6); err != nil {
+			return err
+		}
+	}
+
 	err = netlink.LinkSetUp(link)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+func addRoute(c *Config, n *net.IPNet) error {
+	link, err := netlink.LinkByName(c.InterfaceName)
+	if err != nil {
+		return err
+	}
+	return netlink.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: n})
+}
+
+func delRoute(c *Config, n *net.IPNet) error {
+	link, err := netlink.LinkByName(c.InterfaceName)
+	if err != nil {
+		return err
+	}
+	return netlink.RouteDel(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: n})
+}
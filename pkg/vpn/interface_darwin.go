@@ -81,5 +81,23 @@ func prepareInterface(c *Config) error {
 		return err
 	}
 
+	if c.interfaceAddress6.IsValid() {
+		a := c.interfaceAddress6
+		if err := exec.Command("ifconfig", iface.Name, "inet6", a.Addr().String(), "prefixlen", strconv.Itoa(a.Bits())).Run(); err != nil {
+			return err
+		}
+		if err := exec.Command("route", "-n", "add", "-inet6", "-net", a.Masked().String(), "-interface", iface.Name).Run(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+func addRoute(c *Config, n *net.IPNet) error {
+	return exec.Command("route", "-n", "add", "-net", n.String(), "-interface", c.InterfaceName).Run()
+}
+
+func delRoute(c *Config, n *net.IPNet) error {
+	return exec.Command("route", "-n", "delete", "-net", n.String(), "-interface", c.InterfaceName).Run()
+}
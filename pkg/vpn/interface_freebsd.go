@@ -19,6 +19,7 @@ package vpn
 import (
 	"fmt"
 	"github.com/mudler/water"
+	"net"
 	"os/exec"
 )
 
@@ -40,9 +41,23 @@ func prepareInterface(c *Config) error {
 	if err != nil {
 		return err
 	}
+	if a := c.interfaceAddress6; a.IsValid() {
+		err = sh(fmt.Sprintf("ifconfig %s inet6 %s prefixlen %d", c.InterfaceName, a.Addr(), a.Bits()))
+		if err != nil {
+			return err
+		}
+	}
 	return sh(fmt.Sprintf("ifconfig %s up", c.InterfaceName))
 }
 
+func addRoute(c *Config, n *net.IPNet) error {
+	return sh(fmt.Sprintf("route add -net %s -interface %s", n.String(), c.InterfaceName))
+}
+
+func delRoute(c *Config, n *net.IPNet) error {
+	return sh(fmt.Sprintf("route delete -net %s -interface %s", n.String(), c.InterfaceName))
+}
+
 func sh(c string) (err error) {
 	_, err = exec.Command("/bin/sh", "-c", c).CombinedOutput()
 	return
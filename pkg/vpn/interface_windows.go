@@ -17,6 +17,7 @@ limitations under the License.
 package vpn
 
 import (
+	"net"
 	"net/netip"
 
 	"github.com/mudler/water"
@@ -24,13 +25,17 @@ import (
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
 )
 
-func prepareInterface(c *Config) error {
-	// find interface created by water
+// interfaceLUID finds the interface created by water.
+func interfaceLUID() (winipcfg.LUID, error) {
 	guid, err := windows.GUIDFromString("{00000000-FFFF-FFFF-FFE9-76E58C74063E}")
 	if err != nil {
-		return err
+		return 0, err
 	}
-	luid, err := winipcfg.LUIDFromGUID(&guid)
+	return winipcfg.LUIDFromGUID(&guid)
+}
+
+func prepareInterface(c *Config) error {
+	luid, err := interfaceLUID()
 	if err != nil {
 		return err
 	}
@@ -40,17 +45,24 @@ func prepareInterface(c *Config) error {
 		return err
 	}
 	addresses := append([]netip.Prefix{}, prefix)
+	families := []winipcfg.AddressFamily{windows.AF_INET}
+	if c.interfaceAddress6.IsValid() {
+		addresses = append(addresses, c.interfaceAddress6)
+		families = append(families, windows.AF_INET6)
+	}
 	if err := luid.SetIPAddresses(addresses); err != nil {
 		return err
 	}
 
-	iface, err := luid.IPInterface(windows.AF_INET)
-	if err != nil {
-		return err
-	}
-	iface.NLMTU = uint32(c.InterfaceMTU)
-	if err := iface.Set(); err != nil {
-		return err
+	for _, family := range families {
+		iface, err := luid.IPInterface(family)
+		if err != nil {
+			return err
+		}
+		iface.NLMTU = uint32(c.InterfaceMTU)
+		if err := iface.Set(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -62,3 +74,38 @@ func createInterface(c *Config) (*water.Interface, error) {
 	config.Name = c.InterfaceName
 	return water.New(config)
 }
+
+func routePrefix(n *net.IPNet) (netip.Prefix, netip.Addr, error) {
+	p, err := netip.ParsePrefix(n.String())
+	if err != nil {
+		return p, netip.Addr{}, err
+	}
+	if p.Addr().Is4() {
+		return p, netip.IPv4Unspecified(), nil
+	}
+	return p, netip.IPv6Unspecified(), nil
+}
+
+func addRoute(c *Config, n *net.IPNet) error {
+	luid, err := interfaceLUID()
+	if err != nil {
+		return err
+	}
+	p, hop, err := routePrefix(n)
+	if err != nil {
+		return err
+	}
+	return luid.AddRoute(p, hop, 0)
+}
+
+func delRoute(c *Config, n *net.IPNet) error {
+	luid, err := interfaceLUID()
+	if err != nil {
+		return err
+	}
+	p, hop, err := routePrefix(n)
+	if err != nil {
+		return err
+	}
+	return luid.DeleteRoute(p, hop)
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/netip"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// DefaultIPv6Prefix is the ULA prefix the IPv6 addresses of the nodes are
+// taken from when none is given ("edgevpn" in hex). Networks that may run on
+// the same hosts should each use their own.
+const DefaultIPv6Prefix = "fd65:6467:6576:706e::/64"
+
+// ParseIPv6Prefix checks that prefix is an IPv6 prefix leaving at least 64
+// bits to the nodes, and returns it canonicalized.
+func ParseIPv6Prefix(prefix string) (netip.Prefix, error) {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return p, err
+	}
+	if !p.Addr().Is6() || p.Addr().Is4In6() {
+		return p, fmt.Errorf("%s is not an IPv6 prefix", prefix)
+	}
+	if p.Bits() > 64 {
+		return p, fmt.Errorf("IPv6 prefix %s is too small, it must be /64 or larger", prefix)
+	}
+	return p.Masked(), nil
+}
+
+// IPv6Address returns the address of the peer id in prefix: the bits after
+// the prefix are taken from a hash of the peer ID, so every node knows the
+// address of any other without a lease.
+func IPv6Address(prefix netip.Prefix, id peer.ID) netip.Addr {
+	a := prefix.Masked().Addr().As16()
+	h := sha256.Sum256([]byte(id))
+	for i := range a {
+		host := 0xff >> max(0, min(8, prefix.Bits()-8*i))
+		a[i] |= h[i] & byte(host)
+	}
+	return netip.AddrFrom16(a)
+}
+
+// isIPv6Of reports whether addr may be the address of id, in any prefix:
+// peers cannot take over each other's IPv6 address by announcing it.
+func isIPv6Of(addr netip.Addr, id peer.ID) bool {
+	if !addr.Is6() || addr.Is4In6() {
+		return false
+	}
+	a, h := addr.As16(), sha256.Sum256([]byte(id))
+	return [8]byte(a[8:]) == [8]byte(h[8:16])
+}
+
+// address6 is the IPv6 address of the node, if it has one.
+func (c *Config) address6() string {
+	if !c.interfaceAddress6.IsValid() {
+		return ""
+	}
+	return c.interfaceAddress6.Addr().String()
+}
@@ -0,0 +1,63 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"net/netip"
+
+	"github.com/mudler/edgevpn/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IPv6 addresses", func() {
+	a, b := newPeerID(), newPeerID()
+	prefix := netip.MustParsePrefix(DefaultIPv6Prefix)
+
+	It("parses the prefix", func() {
+		p, err := ParseIPv6Prefix("fd00:1:2:3:4::/48")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.String()).To(Equal("fd00:1:2::/48"))
+
+		_, err = ParseIPv6Prefix("10.0.0.0/8")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseIPv6Prefix("fd00::/96")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("derives a distinct address in the prefix for each peer", func() {
+		addr := IPv6Address(prefix, a)
+		Expect(prefix.Contains(addr)).To(BeTrue())
+		Expect(IPv6Address(prefix, a)).To(Equal(addr))
+		Expect(IPv6Address(prefix, b)).NotTo(Equal(addr))
+
+		wide := netip.MustParsePrefix("fd00:aa00::/20")
+		Expect(wide.Contains(IPv6Address(wide, a))).To(BeTrue())
+		Expect(isIPv6Of(IPv6Address(wide, a), a)).To(BeTrue())
+		Expect(isIPv6Of(addr, b)).To(BeFalse())
+	})
+
+	It("routes the IPv6 address of a machine, unless it belongs to another peer", func() {
+		r := ledgerRoutes(machines(
+			types.Machine{PeerID: a.String(), Address: "10.1.0.1", Address6: IPv6Address(prefix, a).String()},
+			types.Machine{PeerID: b.String(), Address: "10.1.0.2", Address6: IPv6Address(prefix, a).Next().String()},
+		), "", nil)
+
+		to, ok := r.lookup(IPv6Address(prefix, a))
+		Expect(ok).To(BeTrue())
+		Expect(to.id).To(Equal(a))
+		_, ok = r.lookup(IPv6Address(prefix, a).Next())
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -0,0 +1,170 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
+	"github.com/mudler/edgevpn/pkg/utils"
+)
+
+// dhcpState is what DHCP knows from the ledger about the addresses in use.
+type dhcpState struct {
+	machines map[string]types.Machine
+	leases   map[string]types.DHCPLease
+	reserved []types.DHCPReservation
+}
+
+func newDHCPState(data map[string]map[string]blockchain.Data) dhcpState {
+	s := dhcpState{machines: map[string]types.Machine{}, leases: map[string]types.DHCPLease{}}
+	for ip, d := range data[protocol.MachinesLedgerKey] {
+		var m types.Machine
+		if d.Unmarshal(&m) == nil {
+			s.machines[ip] = m
+		}
+	}
+	for ip, d := range data[protocol.DHCPLeasesKey] {
+		var l types.DHCPLease
+		if d.Unmarshal(&l) == nil {
+			s.leases[ip] = l
+		}
+	}
+	for _, d := range data[protocol.DHCPReservedKey] {
+		var r types.DHCPReservation
+		if d.Unmarshal(&r) == nil && net.ParseIP(r.Address) != nil {
+			s.reserved = append(s.reserved, r)
+		}
+	}
+	sort.Slice(s.reserved, func(i, j int) bool { return s.reserved[i].Address < s.reserved[j].Address })
+	return s
+}
+
+// reservation returns the address reserved for the peer id, else for its
+// hostname, if any.
+func (s dhcpState) reservation(id, hostname string) string {
+	for _, r := range s.reserved {
+		if r.PeerID != "" && r.PeerID == id {
+			return r.Address
+		}
+	}
+	for _, r := range s.reserved {
+		if r.PeerID == "" && r.Hostname != "" && r.Hostname == hostname {
+			return r.Address
+		}
+	}
+	return ""
+}
+
+// reservedForOthers reports whether ip is reserved for another peer than id.
+func (s dhcpState) reservedForOthers(ip, id, hostname string) bool {
+	for _, r := range s.reserved {
+		if r.Address == ip {
+			return r.PeerID != id && (r.PeerID != "" || r.Hostname != hostname)
+		}
+	}
+	return false
+}
+
+// expired reports whether the lease of the machine holding ip has expired.
+// Machines of peers that do not keep leases never expire.
+func (s dhcpState) expired(ip string, now time.Time) bool {
+	l, ok := s.leases[ip]
+	m, held := s.machines[ip]
+	return ok && held && l.PeerID == m.PeerID && l.Expired(now)
+}
+
+// liveNodes returns the peers the Alive Service saw within maxTime.
+func liveNodes(b *blockchain.Ledger, maxTime time.Duration) map[string]bool {
+	live := map[string]bool{}
+	for _, p := range services.AvailableNodes(b, maxTime) {
+		live[p] = true
+	}
+	return live
+}
+
+// heldByOther reports whether ip is held in the machines bucket by a live
+// peer other than id, under a lease that has not expired.
+func (s dhcpState) heldByOther(ip, id string, live map[string]bool, now time.Time) bool {
+	m, ok := s.machines[ip]
+	return ok && m.PeerID != "" && m.PeerID != id && live[m.PeerID] && !s.expired(ip, now)
+}
+
+// inUse returns the addresses DHCP must not give to the peer id: the ones
+// other machines hold under a valid lease, and the ones reserved for others.
+func (s dhcpState) inUse(id, hostname string, now time.Time) []string {
+	used := []string{}
+	for ip, m := range s.machines {
+		if m.PeerID != id && !s.expired(ip, now) {
+			used = append(used, ip)
+		}
+	}
+	for _, r := range s.reserved {
+		if s.reservedForOthers(r.Address, id, hostname) {
+			used = append(used, r.Address)
+		}
+	}
+	return used
+}
+
+// nextFreeIP returns the address after the highest one in use, as
+// utils.NextIP does, or the lowest free address of the /24 of defaultIP once
+// the end of it is reached, so that expired leases are given again.
+func nextFreeIP(defaultIP string, used []string) string {
+	next := utils.NextIP(defaultIP, used)
+	subnet, err := netip.ParsePrefix(defaultIP + "/24")
+	if err != nil {
+		return next
+	}
+	subnet = subnet.Masked()
+	taken := map[string]bool{}
+	for _, ip := range used {
+		taken[ip] = true
+	}
+	if a, err := netip.ParseAddr(next); err == nil && subnet.Contains(a) && subnet.Contains(a.Next()) && !taken[next] {
+		return next
+	}
+	for a := subnet.Addr().Next(); subnet.Contains(a.Next()); a = a.Next() {
+		if !taken[a.String()] {
+			return a.String()
+		}
+	}
+	return next
+}
+
+// renewLease keeps the lease of ip in the ledger until ctx is done, valid for
+// ttl after each renewal.
+func renewLease(ctx context.Context, b *blockchain.Ledger, id, ip string, ttl time.Duration) {
+	hostname, _ := os.Hostname()
+	t := time.NewTicker(ttl / 3)
+	defer t.Stop()
+	for {
+		b.Add(protocol.DHCPLeasesKey, map[string]interface{}{
+			ip: types.DHCPLease{Address: ip, PeerID: id, Hostname: hostname, Expires: time.Now().Add(ttl)},
+		})
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func bucket(values map[string]interface{}) map[string]blockchain.Data {
+	out := map[string]blockchain.Data{}
+	for k, v := range values {
+		dat, _ := json.Marshal(v)
+		out[k] = blockchain.Data(dat)
+	}
+	return out
+}
+
+var _ = Describe("DHCP leases", func() {
+	now := time.Now()
+
+	state := newDHCPState(map[string]map[string]blockchain.Data{
+		protocol.MachinesLedgerKey: machines(
+			types.Machine{PeerID: "a", Address: "10.1.0.1"},
+			types.Machine{PeerID: "b", Address: "10.1.0.2"},
+			types.Machine{PeerID: "legacy", Address: "10.1.0.3"},
+		),
+		protocol.DHCPLeasesKey: bucket(map[string]interface{}{
+			"10.1.0.1": types.DHCPLease{Address: "10.1.0.1", PeerID: "a", Expires: now.Add(time.Minute)},
+			"10.1.0.2": types.DHCPLease{Address: "10.1.0.2", PeerID: "b", Expires: now.Add(-time.Minute)},
+		}),
+		protocol.DHCPReservedKey: bucket(map[string]interface{}{
+			"10.1.0.10": types.DHCPReservation{Address: "10.1.0.10", Hostname: "printer"},
+			"10.1.0.11": types.DHCPReservation{Address: "10.1.0.11", PeerID: "c"},
+			"10.1.0.12": types.DHCPReservation{Address: "10.1.0.12", Hostname: "nas"},
+		}),
+	})
+
+	It("finds the reservation of a peer, by ID first", func() {
+		Expect(state.reservation("c", "printer")).To(Equal("10.1.0.11"))
+		Expect(state.reservation("d", "printer")).To(Equal("10.1.0.10"))
+		Expect(state.reservation("d", "laptop")).To(BeEmpty())
+
+		Expect(state.reservedForOthers("10.1.0.10", "d", "printer")).To(BeFalse())
+		Expect(state.reservedForOthers("10.1.0.10", "d", "laptop")).To(BeTrue())
+		Expect(state.reservedForOthers("10.1.0.11", "c", "")).To(BeFalse())
+		Expect(state.reservedForOthers("10.1.0.50", "c", "")).To(BeFalse())
+	})
+
+	It("frees the addresses of expired leases only", func() {
+		Expect(state.expired("10.1.0.1", now)).To(BeFalse())
+		Expect(state.expired("10.1.0.2", now)).To(BeTrue())
+		Expect(state.expired("10.1.0.3", now)).To(BeFalse())
+
+		Expect(state.inUse("d", "printer", now)).To(ConsistOf("10.1.0.1", "10.1.0.3", "10.1.0.11", "10.1.0.12"))
+		Expect(state.inUse("a", "", now)).To(ConsistOf("10.1.0.3", "10.1.0.10", "10.1.0.11", "10.1.0.12"))
+	})
+
+	It("leaves a reserved address to its live holder until it is gone or expired", func() {
+		live := map[string]bool{"a": true, "b": true, "legacy": true}
+		Expect(state.heldByOther("10.1.0.1", "c", live, now)).To(BeTrue())
+		Expect(state.heldByOther("10.1.0.1", "a", live, now)).To(BeFalse())
+		Expect(state.heldByOther("10.1.0.1", "c", map[string]bool{}, now)).To(BeFalse())
+		Expect(state.heldByOther("10.1.0.2", "c", live, now)).To(BeFalse())
+		Expect(state.heldByOther("10.1.0.3", "c", live, now)).To(BeTrue())
+		Expect(state.heldByOther("10.1.0.11", "c", live, now)).To(BeFalse())
+	})
+
+	It("gives addresses again once the end of the subnet is reached", func() {
+		Expect(nextFreeIP("10.1.0.1", nil)).To(Equal("10.1.0.1"))
+		Expect(nextFreeIP("10.1.0.1", []string{"10.1.0.1", "10.1.0.2"})).To(Equal("10.1.0.3"))
+		Expect(nextFreeIP("10.1.0.1", []string{"10.1.0.1", "10.1.0.254"})).To(Equal("10.1.0.2"))
+	})
+})
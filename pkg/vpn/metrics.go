@@ -0,0 +1,110 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/songgao/packets/ethernet"
+)
+
+// Metrics reports the state of the packet queues of the VPN: one per worker,
+// fed by flow, and one per destination peer, and the traffic of the node.
+type Metrics struct {
+	sync.Mutex
+	workers []chan ethernet.Frame
+	peers   map[string]*peerStats
+	limiter *trafficLimiter
+	qos     *qos
+
+	// flows counts the traffic by source and destination address.
+	flows  sync.Map // flowKey -> *flowStats
+	nflows atomic.Int64
+}
+
+type peerStats struct {
+	queues        []chan []byte
+	sent, dropped atomic.Uint64
+}
+
+// QueueMetrics is the state of a worker queue.
+type QueueMetrics struct {
+	Depth, Capacity int
+}
+
+// PeerQueueMetrics is the state of the queue of a destination peer. Dropped
+// counts the packets lost because the queue was full or the peer could not
+// be reached.
+type PeerQueueMetrics struct {
+	Depth, Capacity int
+	Sent, Dropped   uint64
+}
+
+// MetricsSnapshot is the state of the queues at a point in time, and the
+// counters of the QoS classes if any.
+type MetricsSnapshot struct {
+	Workers []QueueMetrics
+	Peers   map[string]PeerQueueMetrics
+	Dropped uint64
+	Classes []QoSClassMetrics `json:",omitempty"`
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{peers: map[string]*peerStats{}}
+}
+
+func (m *Metrics) setWorkers(w []chan ethernet.Frame) {
+	m.Lock()
+	defer m.Unlock()
+	m.workers = w
+}
+
+func (m *Metrics) setQoS(q *qos) {
+	m.Lock()
+	defer m.Unlock()
+	m.qos = q
+}
+
+// peer returns the counters of a destination, which outlive its queue.
+func (m *Metrics) peer(name string) *peerStats {
+	m.Lock()
+	defer m.Unlock()
+	s, ok := m.peers[name]
+	if !ok {
+		s = &peerStats{}
+		m.peers[name] = s
+	}
+	return s
+}
+
+// Snapshot returns the current state of the queues.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.Lock()
+	defer m.Unlock()
+	out := MetricsSnapshot{Peers: map[string]PeerQueueMetrics{}}
+	for _, w := range m.workers {
+		out.Workers = append(out.Workers, QueueMetrics{Depth: len(w), Capacity: cap(w)})
+	}
+	for name, s := range m.peers {
+		pm := PeerQueueMetrics{Sent: s.sent.Load(), Dropped: s.dropped.Load()}
+		for _, q := range s.queues {
+			pm.Depth, pm.Capacity = pm.Depth+len(q), pm.Capacity+cap(q)
+		}
+		out.Peers[name] = pm
+		out.Dropped += pm.Dropped
+	}
+	out.Classes = m.qos.metrics()
+	return out
+}
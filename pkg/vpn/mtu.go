@@ -0,0 +1,173 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+)
+
+// clampMSS lowers the MSS option of a TCP SYN to what fits in mtu, so that
+// neither end of the connection sends segments the path cannot carry. The
+// packet is changed in place, its checksum fixed. It tells whether the
+// packet was changed.
+func clampMSS(packet []byte, mtu int) bool {
+	var tcp []byte
+	limit := mtu - 40
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if packet[9] != 6 || ihl < 20 || len(packet) < ihl || binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return false
+		}
+		tcp = packet[ihl:]
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		if packet[6] != 6 {
+			return false
+		}
+		tcp, limit = packet[40:], mtu-60
+	default:
+		return false
+	}
+	if len(tcp) < 20 || tcp[13]&0x02 == 0 || limit <= 0 {
+		return false
+	}
+	off := int(tcp[12]>>4) * 4
+	if off < 20 || len(tcp) < off {
+		return false
+	}
+	for i := 20; i < off; {
+		switch tcp[i] {
+		case 0:
+			return false
+		case 1:
+			i++
+			continue
+		}
+		if i+2 > off || tcp[i+1] < 2 || i+int(tcp[i+1]) > off {
+			return false
+		}
+		if tcp[i] == 2 && tcp[i+1] == 4 {
+			mss := binary.BigEndian.Uint16(tcp[i+2 : i+4])
+			if int(mss) <= limit {
+				return false
+			}
+			binary.BigEndian.PutUint16(tcp[i+2:i+4], uint16(limit))
+			old, new := mss, uint16(limit)
+			if i%2 == 1 {
+				// The checksum sums aligned words: the MSS straddles two
+				old, new = bits.ReverseBytes16(old), bits.ReverseBytes16(new)
+			}
+			sum := binary.BigEndian.Uint16(tcp[16:18])
+			binary.BigEndian.PutUint16(tcp[16:18], updateChecksum(sum, old, new))
+			return true
+		}
+		i += int(tcp[i+1])
+	}
+	return false
+}
+
+// updateChecksum updates an internet checksum for a 16 bit word changed
+// from old to new (RFC 1624).
+func updateChecksum(sum, old, new uint16) uint16 {
+	s := uint32(^sum) + uint32(^old) + uint32(new)
+	s = s&0xffff + s>>16
+	s = s&0xffff + s>>16
+	return ^uint16(s)
+}
+
+// checksum computes the internet checksum of b, starting from sum.
+func checksum(sum uint32, b []byte) uint16 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(binary.BigEndian.Uint16(b))
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// packetTooBig returns the ICMP error telling the sender of packet, which
+// is larger than mtu, the largest packet that fits: fragmentation needed
+// for IPv4, packet too big for IPv6. The error comes from the address of
+// the node of the same family, from4 or from6. It returns nil when no error
+// is due: IPv4 packets that may be fragmented, errors about ICMP errors, or
+// when the node has no address to send it from.
+func packetTooBig(packet []byte, mtu int, from4, from6 netip.Addr) []byte {
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if packet[6]&0x40 == 0 || !from4.Is4() || len(packet) < ihl+1 || (packet[9] == 1 && isICMPError(packet[ihl])) {
+			return nil
+		}
+		// As much of the packet as fits in 576 bytes
+		quoted := packet[:min(len(packet), 576-28)]
+		out := make([]byte, 28+len(quoted))
+		out[0], out[1] = 0x45, 0xc0
+		binary.BigEndian.PutUint16(out[2:4], uint16(len(out)))
+		out[8], out[9] = 64, 1
+		src := from4.As4()
+		copy(out[12:16], src[:])
+		copy(out[16:20], packet[12:16])
+		binary.BigEndian.PutUint16(out[10:12], checksum(0, out[:20]))
+
+		icmp := out[20:]
+		icmp[0], icmp[1] = 3, 4
+		binary.BigEndian.PutUint16(icmp[6:8], uint16(max(mtu, 68)))
+		copy(icmp[8:], quoted)
+		binary.BigEndian.PutUint16(icmp[2:4], checksum(0, icmp))
+		return out
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		if !from6.Is6() || (packet[6] == 58 && len(packet) > 40 && packet[40] < 128) {
+			return nil
+		}
+		// As much of the packet as fits in the minimum IPv6 MTU
+		quoted := packet[:min(len(packet), 1280-48)]
+		out := make([]byte, 48+len(quoted))
+		out[0] = 0x60
+		binary.BigEndian.PutUint16(out[4:6], uint16(len(out)-40))
+		out[6], out[7] = 58, 64
+		src := from6.As16()
+		copy(out[8:24], src[:])
+		copy(out[24:40], packet[8:24])
+
+		icmp := out[40:]
+		icmp[0] = 2
+		binary.BigEndian.PutUint32(icmp[4:8], uint32(max(mtu, 1280)))
+		copy(icmp[8:], quoted)
+		// Checksum over the pseudo header and the message
+		var sum uint32
+		for i := 8; i < 40; i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(out[i : i+2]))
+		}
+		sum += uint32(len(icmp)) + 58
+		binary.BigEndian.PutUint16(icmp[2:4], checksum(sum, icmp))
+		return out
+	}
+	return nil
+}
+
+// isICMPError tells whether an ICMP type is an error, which must not be
+// answered with another one.
+func isICMPError(t byte) bool {
+	switch t {
+	case 3, 4, 5, 11, 12:
+		return true
+	}
+	return false
+}
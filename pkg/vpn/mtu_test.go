@@ -0,0 +1,193 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// synPacket returns a TCP SYN with the given MSS, over IPv4 or IPv6. The
+// MSS option comes after nops NOP options.
+func synPacket(src, dst string, mss uint16, df bool, nops int) []byte {
+	var options []layers.TCPOption
+	for i := 0; i < nops; i++ {
+		options = append(options, layers.TCPOption{OptionType: layers.TCPOptionKindNop})
+	}
+	options = append(options, layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{byte(mss >> 8), byte(mss)}})
+	return testPacket{src: src, dst: dst, proto: layers.IPProtocolTCP, dport: 22, df: df, options: options, payload: make([]byte, 1300)}.bytes()
+}
+
+// reserialize decodes a packet and serializes it back with its checksums
+// computed: the result only matches if the checksums were right.
+func reserialize(b []byte) []byte {
+	first := layers.LayerTypeIPv4
+	if b[0]>>4 == 6 {
+		first = layers.LayerTypeIPv6
+	}
+	p := gopacket.NewPacket(b, first, gopacket.Default)
+	Expect(p.ErrorLayer()).To(BeNil())
+	var ls []gopacket.SerializableLayer
+	for _, l := range p.Layers() {
+		switch l := l.(type) {
+		case *layers.TCP:
+			l.SetNetworkLayerForChecksum(p.NetworkLayer())
+		case *layers.ICMPv6:
+			l.SetNetworkLayerForChecksum(p.NetworkLayer())
+		}
+		if s, ok := l.(gopacket.SerializableLayer); ok {
+			ls = append(ls, s)
+		}
+	}
+	buf := gopacket.NewSerializeBuffer()
+	Expect(gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true}, ls...)).To(Succeed())
+	return buf.Bytes()
+}
+
+func mssOf(b []byte) uint16 {
+	first := layers.LayerTypeIPv4
+	if b[0]>>4 == 6 {
+		first = layers.LayerTypeIPv6
+	}
+	tcp := gopacket.NewPacket(b, first, gopacket.Default).Layer(layers.LayerTypeTCP).(*layers.TCP)
+	for _, o := range tcp.Options {
+		if o.OptionType == layers.TCPOptionKindMSS {
+			return uint16(o.OptionData[0])<<8 | uint16(o.OptionData[1])
+		}
+	}
+	return 0
+}
+
+var _ = Describe("MTU", func() {
+	Context("MSS clamping", func() {
+		It("lowers the MSS of SYNs to fit the MTU", func() {
+			p := synPacket("10.1.0.1", "10.1.0.2", 1460, true, 0)
+			Expect(clampMSS(p, 1200)).To(BeTrue())
+			Expect(mssOf(p)).To(Equal(uint16(1160)))
+			Expect(reserialize(p)).To(Equal(p))
+
+			// Not aligned on 16 bits
+			p = synPacket("10.1.0.1", "10.1.0.2", 1460, true, 1)
+			Expect(clampMSS(p, 1200)).To(BeTrue())
+			Expect(mssOf(p)).To(Equal(uint16(1160)))
+			Expect(reserialize(p)).To(Equal(p))
+
+			p = synPacket("fd00::1", "fd00::2", 1440, false, 3)
+			Expect(clampMSS(p, 1280)).To(BeTrue())
+			Expect(mssOf(p)).To(Equal(uint16(1220)))
+			Expect(reserialize(p)).To(Equal(p))
+		})
+
+		It("leaves the other packets alone", func() {
+			p := synPacket("10.1.0.1", "10.1.0.2", 1000, true, 0)
+			Expect(clampMSS(p, 1200)).To(BeFalse())
+			Expect(mssOf(p)).To(Equal(uint16(1000)))
+
+			p = tcpPacket("10.1.0.1", "10.1.0.2", 22)
+			p[33] &^= 0x02 // not a SYN
+			Expect(clampMSS(p, 500)).To(BeFalse())
+			Expect(clampMSS(testPacket{src: "10.1.0.1", dst: "10.1.0.2", proto: layers.IPProtocolUDP, dport: 53}.bytes(), 100)).To(BeFalse())
+			Expect(clampMSS([]byte{0x45}, 100)).To(BeFalse())
+		})
+	})
+
+	Context("ICMP errors", func() {
+		from4, from6 := netip.MustParseAddr("10.1.0.9"), netip.MustParseAddr("fd00::9")
+
+		It("answers IPv4 packets that may not be fragmented", func() {
+			p := synPacket("10.1.0.1", "10.1.0.2", 1460, true, 0)
+			reply := packetTooBig(p, 1200, from4, from6)
+			Expect(reply).NotTo(BeNil())
+			Expect(len(reply)).To(Equal(576))
+			Expect(reserialize(reply)).To(Equal(reply))
+
+			pkt := gopacket.NewPacket(reply, layers.LayerTypeIPv4, gopacket.Default)
+			ip := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			Expect(ip.SrcIP.String()).To(Equal("10.1.0.9"))
+			Expect(ip.DstIP.String()).To(Equal("10.1.0.1"))
+			icmp := pkt.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+			Expect(icmp.TypeCode).To(Equal(layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded)))
+			Expect(icmp.Seq).To(Equal(uint16(1200)))
+			Expect(icmp.Payload).To(Equal(p[:548]))
+
+			Expect(packetTooBig(synPacket("10.1.0.1", "10.1.0.2", 1460, false, 0), 1200, from4, from6)).To(BeNil())
+			Expect(packetTooBig(reply, 500, from4, from6)).To(BeNil())
+		})
+
+		It("answers IPv6 packets", func() {
+			p := synPacket("fd00::1", "fd00::2", 1440, false, 0)
+			reply := packetTooBig(p, 1280, from4, from6)
+			Expect(reply).NotTo(BeNil())
+			Expect(len(reply)).To(Equal(1280))
+			Expect(reserialize(reply)).To(Equal(reply))
+
+			pkt := gopacket.NewPacket(reply, layers.LayerTypeIPv6, gopacket.Default)
+			ip := pkt.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+			Expect(ip.SrcIP.String()).To(Equal("fd00::9"))
+			Expect(ip.DstIP.String()).To(Equal("fd00::1"))
+			icmp := pkt.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+			Expect(icmp.TypeCode.Type()).To(Equal(uint8(layers.ICMPv6TypePacketTooBig)))
+			Expect(icmp.Payload[:4]).To(Equal([]byte{0, 0, 0x05, 0x00}))
+
+			Expect(packetTooBig(p, 1280, from4, netip.Addr{})).To(BeNil())
+			Expect(packetTooBig(reply, 1280, from4, from6)).To(BeNil())
+		})
+	})
+
+	Context("MTU exchange", func() {
+		It("takes the smaller MTU of the two ends", func() {
+			for _, c := range []struct{ local, remote, want int }{{1420, 1200, 1200}, {1200, 1420, 1200}, {1200, 0, 1200}} {
+				a, b := net.Pipe()
+				go answerMTU(b, c.remote)
+				mtu, err := exchangeMTU(a, c.local)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mtu).To(Equal(c.want))
+				a.Close()
+				b.Close()
+			}
+		})
+
+		It("asks each peer in the background", func() {
+			id := newPeerID()
+			to := dest{id: id, name: id.String()}
+			var asked atomic.Int32
+			fail := errors.New("unreachable")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			p := newPeerMTUs(ctx, func(_ context.Context, d dest) (int, error) {
+				if asked.Add(1) > 1 {
+					return 0, fail
+				}
+				return 1000, nil
+			}, func(string, ...interface{}) {})
+			c := &Config{InterfaceMTU: 1200, peerMTU: p}
+
+			Expect(c.mtuTo(to)).To(Equal(1200))
+			Eventually(func() int { return c.mtuTo(to) }).Should(Equal(1000))
+			Consistently(asked.Load).Should(Equal(int32(1)))
+
+			c.peerMTU = nil
+			Expect(c.mtuTo(to)).To(Equal(1200))
+		})
+	})
+})
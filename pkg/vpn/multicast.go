@@ -0,0 +1,324 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// DefaultMulticastRate is how many multicast and broadcast packets per
+// second a node sends, and takes, at most.
+const DefaultMulticastRate = 100
+
+var (
+	allHosts4 = netip.MustParseAddr("224.0.0.1")
+	allNodes6 = netip.MustParseAddr("ff02::1")
+	// solicitedNode6 are the groups of the IPv6 neighbor discovery, which
+	// does not cross the VPN.
+	solicitedNode6 = netip.MustParsePrefix("ff02::1:ff00:0/104")
+)
+
+// ParseMulticastGroup parses the address of a multicast group.
+func ParseMulticastGroup(s string) (netip.Addr, error) {
+	a, err := netip.ParseAddr(s)
+	if err != nil || !a.IsMulticast() {
+		return netip.Addr{}, fmt.Errorf("invalid multicast group %q", s)
+	}
+	return a, nil
+}
+
+// multicast fans the multicast and broadcast packets of the host out to the
+// peers that listen to them. Peers publish the groups they listen to in the
+// ledger: the ones given in the configuration, and the ones the host joins,
+// learned from the IGMP and MLD reports it sends on the interface. Broadcast
+// packets, and the ones to all hosts, go to every peer with multicast on.
+type multicast struct {
+	self      string
+	broadcast netip.Addr
+	static    []netip.Addr
+
+	sync.Mutex
+	joined map[netip.Addr]bool
+
+	members atomic.Pointer[multicastMembers]
+	send    *tokenBucket
+	receive *tokenBucket
+	dropped atomic.Uint64
+}
+
+type multicastMembers struct {
+	all    []dest
+	groups map[netip.Addr][]dest
+}
+
+func newMulticast(self string, prefix netip.Prefix, groups []netip.Addr, rate int) *multicast {
+	if rate <= 0 {
+		rate = DefaultMulticastRate
+	}
+	m := &multicast{
+		self:      self,
+		broadcast: broadcastAddr(prefix),
+		static:    groups,
+		joined:    map[netip.Addr]bool{},
+		send:      newTokenBucket(uint64(rate), 0, 1),
+		receive:   newTokenBucket(uint64(rate), 0, 1),
+	}
+	m.members.Store(&multicastMembers{})
+	return m
+}
+
+// broadcastAddr returns the broadcast address of an IPv4 prefix.
+func broadcastAddr(p netip.Prefix) netip.Addr {
+	if !p.Addr().Is4() || p.Bits() >= 31 {
+		return netip.Addr{}
+	}
+	a := p.Masked().Addr().As4()
+	v := binary.BigEndian.Uint32(a[:]) | (1<<(32-p.Bits()) - 1)
+	binary.BigEndian.PutUint32(a[:], v)
+	return netip.AddrFrom4(a)
+}
+
+// isGroup tells whether packets to dst are fanned out rather than routed.
+// A nil multicast routes everything.
+func (m *multicast) isGroup(dst netip.Addr) bool {
+	if m == nil {
+		return false
+	}
+	return dst.IsMulticast() || dst == netip.AddrFrom4([4]byte{255, 255, 255, 255}) || dst == m.broadcast
+}
+
+// targets returns the peers a packet to dst goes to.
+func (m *multicast) targets(dst netip.Addr) []dest {
+	members := m.members.Load()
+	if dst.IsMulticast() && dst != allHosts4 && dst != allNodes6 {
+		return members.groups[dst]
+	}
+	return members.all
+}
+
+// allowSend and allowReceive rate limit the multicast packets the node
+// sends and receives, so that a storm does not flood the network.
+func (m *multicast) allowSend(now time.Time) bool {
+	if m.send.allow(now, 1) {
+		return true
+	}
+	m.dropped.Add(1)
+	return false
+}
+
+func (m *multicast) allowReceive(now time.Time) bool {
+	if m.receive.allow(now, 1) {
+		return true
+	}
+	m.dropped.Add(1)
+	return false
+}
+
+// groups returns the groups the node listens to.
+func (m *multicast) groups() []string {
+	m.Lock()
+	defer m.Unlock()
+	var out []string
+	for _, g := range m.static {
+		out = append(out, g.String())
+	}
+	for g := range m.joined {
+		if !slices.Contains(m.static, g) {
+			out = append(out, g.String())
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+func (m *multicast) join(group netip.Addr, joined bool) {
+	if !group.IsMulticast() || group == allHosts4 || group == allNodes6 || solicitedNode6.Contains(group) {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	if joined {
+		m.joined[group] = true
+	} else {
+		delete(m.joined, group)
+	}
+}
+
+// snoop learns the groups the host joins and leaves from the IGMP and MLD
+// packets it sends. It tells whether packet was one of them: they are not
+// forwarded, each node answers for its own host.
+func (m *multicast) snoop(packet []byte) bool {
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4 && packet[9] == 2:
+		ihl := int(packet[0]&0x0f) * 4
+		if len(packet) < ihl+8 {
+			return true
+		}
+		m.snoopIGMP(packet[ihl:])
+		return true
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		// MLD messages follow a hop-by-hop options header
+		next, b := packet[6], packet[40:]
+		if next == 0 && len(b) >= 8 && len(b) >= 8*(int(b[1])+1) {
+			next, b = b[0], b[8*(int(b[1])+1):]
+		}
+		if next != 58 || len(b) < 8 || b[0] < 130 || (b[0] > 132 && b[0] != 143) {
+			return false
+		}
+		m.snoopMLD(b)
+		return true
+	}
+	return false
+}
+
+func (m *multicast) snoopIGMP(b []byte) {
+	switch b[0] {
+	case 0x12, 0x16: // v1 and v2 reports
+		m.join(netip.AddrFrom4([4]byte(b[4:8])), true)
+	case 0x17: // v2 leave
+		m.join(netip.AddrFrom4([4]byte(b[4:8])), false)
+	case 0x22: // v3 report
+		records, b := int(binary.BigEndian.Uint16(b[6:8])), b[8:]
+		for i := 0; i < records && len(b) >= 8; i++ {
+			sources, aux := int(binary.BigEndian.Uint16(b[2:4])), int(b[1])
+			m.join(netip.AddrFrom4([4]byte(b[4:8])), joins(b[0], sources))
+			b = b[min(len(b), 8+4*sources+4*aux):]
+		}
+	}
+}
+
+func (m *multicast) snoopMLD(b []byte) {
+	switch b[0] {
+	case 131, 132: // v1 report and done
+		if len(b) >= 24 {
+			m.join(netip.AddrFrom16([16]byte(b[8:24])), b[0] == 131)
+		}
+	case 143: // v2 report
+		records, b := int(binary.BigEndian.Uint16(b[6:8])), b[8:]
+		for i := 0; i < records && len(b) >= 20; i++ {
+			sources, aux := int(binary.BigEndian.Uint16(b[2:4])), int(b[1])
+			m.join(netip.AddrFrom16([16]byte(b[4:20])), joins(b[0], sources))
+			b = b[min(len(b), 20+16*sources+4*aux):]
+		}
+	}
+}
+
+// joins tells whether an IGMPv3 or MLDv2 group record of type t with the
+// given number of sources leaves the host listening to the group: only an
+// include list without sources (MODE_IS_INCLUDE or CHANGE_TO_INCLUDE_MODE)
+// does not.
+func joins(t byte, sources int) bool {
+	return (t != 1 && t != 3) || sources > 0
+}
+
+// update reads the memberships of the peers from the multicast bucket,
+// leaving out inactive peers (see blockchain.Ledger.IsOwnerLive).
+func (m *multicast) update(bucket map[string]blockchain.Data, live func(string) bool) {
+	members := &multicastMembers{groups: map[netip.Addr][]dest{}}
+	for peerID, d := range bucket {
+		if peerID == m.self || (live != nil && !live(peerID)) {
+			continue
+		}
+		var mc types.Multicast
+		if err := d.Unmarshal(&mc); err != nil {
+			continue
+		}
+		to, err := newDest(peerID)
+		if err != nil {
+			continue
+		}
+		members.all = append(members.all, to)
+		for _, g := range mc.Groups {
+			if a, err := ParseMulticastGroup(g); err == nil {
+				members.groups[a] = append(members.groups[a], to)
+			}
+		}
+	}
+	m.members.Store(members)
+}
+
+// watch keeps the memberships in sync with the ledger, and reads them again
+// every interval as peers go inactive.
+func (m *multicast) watch(ctx context.Context, l *blockchain.Ledger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for ctx.Err() == nil {
+		events := l.Watch(ctx, protocol.MulticastKey, "")
+		m.update(l.CurrentData()[protocol.MulticastKey], l.IsOwnerLive)
+	EVENTS:
+		for {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					break EVENTS
+				}
+				m.update(l.CurrentData()[protocol.MulticastKey], l.IsOwnerLive)
+			case <-ticker.C:
+				m.update(l.CurrentData()[protocol.MulticastKey], l.IsOwnerLive)
+			}
+		}
+	}
+}
+
+// handleMulticast sends a multicast or broadcast packet of the host to the
+// peers listening to it.
+func handleMulticast(queues *peerQueues, frame []byte, c *Config, dst netip.Addr) error {
+	m := c.multicast
+	if m.snoop(frame) {
+		return nil
+	}
+	targets := m.targets(dst)
+	if len(targets) == 0 {
+		return nil
+	}
+	now := time.Now()
+	if !m.allowSend(now) {
+		return fmt.Errorf("packet to '%s' dropped: over the multicast rate", dst)
+	}
+	class := c.qos.classify(frame)
+	if !class.allow(now, len(frame)) {
+		return fmt.Errorf("packet to '%s' dropped: over the rate of class %s", dst, class.Name)
+	}
+	// Each copy sent counts against the traffic limit
+	for _, d := range targets {
+		if !c.firewall.allowSend(frame, d.name) {
+			continue
+		}
+		if !c.limiter.admits(now, len(frame)) {
+			return fmt.Errorf("packet to '%s' dropped for %s and the next peers: over the traffic limit", dst, d.name)
+		}
+		err := queues.send(d, frame, class.queue())
+		class.queued(len(frame), err)
+		if err != nil {
+			c.Logger.Debugf("packet to '%s' dropped for %s: %s", dst, d.name, err.Error())
+			continue
+		}
+		c.limiter.charge(now, len(frame))
+		c.Metrics.count(frame)
+		c.Capture.record(captureSent, d.name, frame)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// igmpPacket returns an IPv4 packet carrying an IGMP message.
+func igmpPacket(dst string, igmp []byte) []byte {
+	return testPacket{src: "10.1.0.1", dst: dst, proto: layers.IPProtocolIGMP, ttl: 1, payload: igmp}.bytes()
+}
+
+// mldPacket returns an IPv6 packet carrying an MLD message after a
+// hop-by-hop header with the router alert option, as hosts send them.
+func mldPacket(mld []byte) []byte {
+	b := make([]byte, 48, 48+len(mld))
+	b[0], b[6], b[7] = 0x60, 0, 1
+	copy(b[8:24], net.ParseIP("fe80::1"))
+	copy(b[24:40], net.ParseIP("ff02::16"))
+	copy(b[40:48], []byte{58, 0, 5, 2, 0, 0, 1, 0})
+	return append(b, mld...)
+}
+
+// mdnsQuery is an mDNS query, as sent to 224.0.0.251.
+var mdnsQuery = testPacket{src: "10.1.0.1", dst: "224.0.0.251", proto: layers.IPProtocolUDP, sport: 5353, dport: 5353, ttl: 255, payload: []byte("query")}
+
+var _ = Describe("Multicast", func() {
+	var (
+		m     *multicast
+		peerA dest
+		peerB dest
+	)
+
+	BeforeEach(func() {
+		m = newMulticast("self", netip.MustParsePrefix("10.1.0.1/24"), []netip.Addr{netip.MustParseAddr("239.255.255.250")}, 0)
+		a, b := newPeerID(), newPeerID()
+		peerA, peerB = dest{id: a, name: a.String()}, dest{id: b, name: b.String()}
+	})
+
+	It("recognizes broadcast and multicast destinations", func() {
+		Expect(m.isGroup(netip.MustParseAddr("224.0.0.251"))).To(BeTrue())
+		Expect(m.isGroup(netip.MustParseAddr("ff02::fb"))).To(BeTrue())
+		Expect(m.isGroup(netip.MustParseAddr("255.255.255.255"))).To(BeTrue())
+		Expect(m.isGroup(netip.MustParseAddr("10.1.0.255"))).To(BeTrue())
+		Expect(m.isGroup(netip.MustParseAddr("10.1.0.2"))).To(BeFalse())
+
+		var off *multicast
+		Expect(off.isGroup(netip.MustParseAddr("224.0.0.251"))).To(BeFalse())
+		Expect(broadcastAddr(netip.MustParsePrefix("10.1.0.0/16"))).To(Equal(netip.MustParseAddr("10.1.255.255")))
+		Expect(broadcastAddr(netip.MustParsePrefix("fd00::/64")).IsValid()).To(BeFalse())
+	})
+
+	It("learns the groups the host joins from IGMP", func() {
+		Expect(m.snoop(igmpPacket("224.0.0.251", []byte{0x16, 0, 0, 0, 224, 0, 0, 251}))).To(BeTrue())
+		Expect(m.groups()).To(Equal([]string{"224.0.0.251", "239.255.255.250"}))
+
+		Expect(m.snoop(igmpPacket("224.0.0.2", []byte{0x17, 0, 0, 0, 224, 0, 0, 251}))).To(BeTrue())
+		Expect(m.groups()).To(Equal([]string{"239.255.255.250"}))
+
+		// v3: join 224.0.0.251 (CHANGE_TO_EXCLUDE) and 239.1.1.1 with a
+		// source (ALLOW_NEW_SOURCES), leave 239.2.2.2 (CHANGE_TO_INCLUDE)
+		Expect(m.snoop(igmpPacket("224.0.0.22", []byte{
+			0x22, 0, 0, 0, 0, 0, 0, 3,
+			4, 0, 0, 0, 224, 0, 0, 251,
+			5, 0, 0, 1, 239, 1, 1, 1, 10, 0, 0, 1,
+			3, 0, 0, 0, 239, 2, 2, 2,
+		}))).To(BeTrue())
+		Expect(m.groups()).To(Equal([]string{"224.0.0.251", "239.1.1.1", "239.255.255.250"}))
+
+		Expect(m.snoop(mdnsQuery.bytes())).To(BeFalse())
+	})
+
+	It("learns the groups the host joins from MLD", func() {
+		record := func(t byte, group string) []byte {
+			return append([]byte{t, 0, 0, 0}, net.ParseIP(group)...)
+		}
+		report := []byte{143, 0, 0, 0, 0, 0, 0, 3}
+		report = append(report, record(4, "ff02::fb")...)
+		report = append(report, record(4, "ff02::1:ff00:1")...)
+		report = append(report, record(4, "ff05::c")...)
+		Expect(m.snoop(mldPacket(report))).To(BeTrue())
+		Expect(m.groups()).To(ContainElements("ff02::fb", "ff05::c"))
+		Expect(m.groups()).NotTo(ContainElement("ff02::1:ff00:1"))
+
+		done := append([]byte{132, 0, 0, 0, 0, 0, 0, 0}, net.ParseIP("ff05::c")...)
+		Expect(m.snoop(mldPacket(done))).To(BeTrue())
+		Expect(m.groups()).NotTo(ContainElement("ff05::c"))
+	})
+
+	It("sends to the peers listening to a group", func() {
+		m.update(bucket(map[string]interface{}{
+			peerA.name: types.Multicast{PeerID: peerA.name, Groups: []string{"224.0.0.251"}},
+			peerB.name: types.Multicast{PeerID: peerB.name},
+			"self":     types.Multicast{PeerID: "self", Groups: []string{"224.0.0.251"}},
+		}), nil)
+
+		Expect(m.targets(netip.MustParseAddr("224.0.0.251"))).To(Equal([]dest{peerA}))
+		Expect(m.targets(netip.MustParseAddr("239.9.9.9"))).To(BeEmpty())
+		Expect(m.targets(netip.MustParseAddr("10.1.0.255"))).To(ConsistOf(peerA, peerB))
+		Expect(m.targets(netip.MustParseAddr("224.0.0.1"))).To(ConsistOf(peerA, peerB))
+	})
+
+	It("leaves out the peers that are not live", func() {
+		m.update(bucket(map[string]interface{}{
+			peerA.name: types.Multicast{PeerID: peerA.name, Groups: []string{"224.0.0.251"}},
+			peerB.name: types.Multicast{PeerID: peerB.name, Groups: []string{"224.0.0.251"}},
+		}), func(p string) bool { return p == peerA.name })
+
+		Expect(m.targets(netip.MustParseAddr("224.0.0.251"))).To(Equal([]dest{peerA}))
+		Expect(m.targets(netip.MustParseAddr("10.1.0.255"))).To(Equal([]dest{peerA}))
+	})
+
+	It("fans packets out within the rate", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		streams := map[string]*recorder{peerA.name: {}, peerB.name: {}}
+		q := newPeerQueues(ctx, func(_ context.Context, to dest) (packetStream, bool, error) {
+			return streams[to.name], true, nil
+		}, NewMetrics(), 1, func(string, ...interface{}) {})
+
+		m = newMulticast("self", netip.MustParsePrefix("10.1.0.1/24"), nil, 2)
+		m.update(bucket(map[string]interface{}{
+			peerA.name: types.Multicast{PeerID: peerA.name, Groups: []string{"224.0.0.251"}},
+			peerB.name: types.Multicast{PeerID: peerB.name, Groups: []string{"224.0.0.251"}},
+		}), nil)
+		c := &Config{Metrics: NewMetrics(), multicast: m}
+
+		p := mdnsQuery.bytes()
+		Expect(handleMulticast(q, p, c, netip.MustParseAddr("224.0.0.251"))).To(Succeed())
+		Expect(handleMulticast(q, p, c, netip.MustParseAddr("224.0.0.251"))).To(Succeed())
+		Expect(handleMulticast(q, p, c, netip.MustParseAddr("224.0.0.251"))).NotTo(Succeed())
+		Expect(m.dropped.Load()).To(Equal(uint64(1)))
+
+		Eventually(streams[peerA.name].packets).Should(Equal([][]byte{p, p}))
+		Eventually(streams[peerB.name].packets).Should(Equal([][]byte{p, p}))
+
+		// IGMP stays local
+		Expect(handleMulticast(q, igmpPacket("224.0.0.251", []byte{0x16, 0, 0, 0, 224, 0, 0, 251}), c, netip.MustParseAddr("224.0.0.251"))).To(Succeed())
+		Consistently(streams[peerA.name].packets, 100*time.Millisecond).Should(HaveLen(2))
+
+		Expect(m.allowReceive(time.Now())).To(BeTrue())
+	})
+
+	It("counts the copies it sends against the traffic limit, and only those", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		streams := map[string]*recorder{peerA.name: {}, peerB.name: {}}
+		q := newPeerQueues(ctx, func(_ context.Context, to dest) (packetStream, bool, error) {
+			return streams[to.name], true, nil
+		}, NewMetrics(), 1, func(string, ...interface{}) {})
+
+		m.update(bucket(map[string]interface{}{
+			peerA.name: types.Multicast{PeerID: peerA.name, Groups: []string{"224.0.0.251"}},
+			peerB.name: types.Multicast{PeerID: peerB.name, Groups: []string{"224.0.0.251"}},
+		}), nil)
+		fw := newFirewall(nil)
+		fw.update(bucket(map[string]interface{}{peerB.name: types.Firewall{PeerID: peerB.name, Default: "deny"}}))
+		limiter := newTrafficLimiter("self", 0, "")
+		limiter.update(bucket(map[string]interface{}{"self": types.TrafficLimit{PeerID: "self", Quota: 10000}}))
+		c := &Config{Metrics: NewMetrics(), multicast: m, firewall: fw, limiter: limiter}
+
+		p := mdnsQuery.bytes()
+		Expect(handleMulticast(q, p, c, netip.MustParseAddr("224.0.0.251"))).To(Succeed())
+		Eventually(streams[peerA.name].packets).Should(Equal([][]byte{p}))
+		Expect(streams[peerB.name].packets()).To(BeEmpty())
+		Expect(limiter.status(time.Now()).Used).To(Equal(uint64(len(p))))
+	})
+})
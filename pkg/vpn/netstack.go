@@ -0,0 +1,149 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Forward relays TCP connections between the host network and the VPN when
+// the node runs on a userspace stack, as there is no interface to route
+// through.
+type Forward struct {
+	// Listen is the address connections are accepted on and Target the one
+	// they are relayed to.
+	Listen, Target string
+	// Remote forwards listen on the VPN address of the node, on the port of
+	// Listen, and dial Target on the host network. Other forwards listen on
+	// the host and dial Target through the VPN.
+	Remote bool
+}
+
+// ParseForward parses a "listen=target" forward. Remote forwards take a port
+// to listen on, as the address is the one of the node.
+func ParseForward(s string, remote bool) (Forward, error) {
+	listen, target, ok := strings.Cut(s, "=")
+	if !ok {
+		return Forward{}, fmt.Errorf("invalid forward %q: expected listen=target", s)
+	}
+	if remote {
+		// Accept both "80" and ":80"
+		listen = strings.TrimPrefix(listen, ":")
+		if _, err := strconv.ParseUint(listen, 10, 16); err != nil {
+			return Forward{}, fmt.Errorf("invalid forward %q: %s is not a port", s, listen)
+		}
+	} else if _, _, err := net.SplitHostPort(listen); err != nil {
+		return Forward{}, fmt.Errorf("invalid forward %q: %w", s, err)
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return Forward{}, fmt.Errorf("invalid forward %q: %w", s, err)
+	}
+	return Forward{Listen: listen, Target: target, Remote: remote}, nil
+}
+
+// userStack is the TCP/IP stack of a node running without a TUN device.
+// Connections to VPN addresses go through it.
+type userStack interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	// Listen accepts TCP connections to the given VPN address.
+	Listen(addr netip.AddrPort) (net.Listener, error)
+}
+
+// startUserStack binds the proxy and the forwards of the configuration, and
+// serves them until ctx is done. Binding errors are returned, so the node
+// does not come up with nothing listening.
+func startUserStack(ctx context.Context, c *Config, s userStack, ip netip.Addr) error {
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	if c.NetstackProxy != "" {
+		l, err := net.Listen("tcp", c.NetstackProxy)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
+		go serveProxy(l, s.DialContext, c.Logger.Debugf)
+	}
+
+	for _, f := range c.Forwards {
+		var l net.Listener
+		var err error
+		dial := s.DialContext
+		if f.Remote {
+			port, _ := strconv.ParseUint(f.Listen, 10, 16)
+			l, err = s.Listen(netip.AddrPortFrom(ip, uint16(port)))
+			dial = (&net.Dialer{}).DialContext
+		} else {
+			l, err = net.Listen("tcp", f.Listen)
+		}
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, l)
+		go serveForward(l, dial, f.Target, c.Logger.Debugf)
+	}
+
+	go func() {
+		<-ctx.Done()
+		closeAll()
+	}()
+	return nil
+}
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// serveForward relays the connections accepted by l to target, until l is
+// closed.
+func serveForward(l net.Listener, dial dialFunc, target string, logf func(string, ...interface{})) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			upstream, err := dial(context.Background(), "tcp", target)
+			if err != nil {
+				logf("could not forward %s to %s: %s", conn.RemoteAddr(), target, err.Error())
+				return
+			}
+			defer upstream.Close()
+			pipe(conn, upstream)
+		}()
+	}
+}
+
+// pipe copies between a and b until either side is done.
+func pipe(a, b io.ReadWriter) {
+	closer := make(chan struct{}, 2)
+	go copyConn(closer, a, b)
+	go copyConn(closer, b, a)
+	<-closer
+}
+
+func copyConn(closer chan struct{}, dst io.Writer, src io.Reader) {
+	defer func() { closer <- struct{}{} }()
+	io.Copy(dst, src)
+}
@@ -0,0 +1,80 @@
+//go:build netstack
+// +build netstack
+
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"io"
+	"net"
+	"net/netip"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// newUserStack runs the TCP/IP stack of the node in process, on gVisor: the
+// returned interface carries the packets of the stack in place of a TUN
+// device.
+func newUserStack(c *Config) (io.ReadWriteCloser, userStack, error) {
+	prefix, err := netip.ParsePrefix(c.InterfaceAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs := []netip.Addr{prefix.Addr()}
+	if c.interfaceAddress6.IsValid() {
+		addrs = append(addrs, c.interfaceAddress6.Addr())
+	}
+
+	dev, tnet, err := netstack.CreateNetTUN(addrs, c.NetstackDNS, c.InterfaceMTU)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &netstackInterface{dev: dev}, &netstackNet{tnet}, nil
+}
+
+// netstackInterface reads and writes one packet at a time from the batches
+// of the stack device.
+type netstackInterface struct {
+	dev tun.Device
+}
+
+func (i *netstackInterface) Read(p []byte) (int, error) {
+	sizes := []int{0}
+	if _, err := i.dev.Read([][]byte{p}, sizes, 0); err != nil {
+		return 0, err
+	}
+	return sizes[0], nil
+}
+
+func (i *netstackInterface) Write(p []byte) (int, error) {
+	if _, err := i.dev.Write([][]byte{p}, 0); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (i *netstackInterface) Close() error {
+	return i.dev.Close()
+}
+
+// netstackNet dials and listens on the VPN addresses of the stack.
+type netstackNet struct {
+	*netstack.Net
+}
+
+func (n *netstackNet) Listen(addr netip.AddrPort) (net.Listener, error) {
+	return n.ListenTCPAddrPort(addr)
+}
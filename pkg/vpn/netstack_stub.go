@@ -0,0 +1,28 @@
+//go:build !netstack
+// +build !netstack
+
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"errors"
+	"io"
+)
+
+// newUserStack fails when the userspace stack is not compiled in, which
+// keeps gVisor out of the default build.
+func newUserStack(c *Config) (io.ReadWriteCloser, userStack, error) {
+	return nil, nil, errors.New("edgevpn was built without the userspace network stack, rebuild it with -tags netstack")
+}
@@ -0,0 +1,212 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+
+	"github.com/ipfs/go-log"
+	"github.com/mudler/edgevpn/pkg/logger"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// hostStack stands in for the userspace stack with the network of the host.
+type hostStack struct {
+	net.Dialer
+	listeners []net.Listener
+}
+
+func (s *hostStack) Listen(addr netip.AddrPort) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr.String())
+	if err == nil {
+		s.listeners = append(s.listeners, l)
+	}
+	return l, err
+}
+
+// echoServer returns the address of a server writing back what it reads.
+func echoServer() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	DeferCleanup(l.Close)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func expectEcho(conn net.Conn) {
+	_, err := conn.Write([]byte("ping"))
+	Expect(err).NotTo(HaveOccurred())
+	b := make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(string(b)).To(Equal("ping"))
+}
+
+var _ = Describe("Userspace stack", func() {
+	var c *Config
+	var stack *hostStack
+	var ctx context.Context
+
+	BeforeEach(func() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		c = &Config{Logger: logger.New(log.LevelError)}
+		stack = &hostStack{}
+	})
+
+	It("parses forwards", func() {
+		f, err := ParseForward("127.0.0.1:8080=10.1.0.2:80", false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f).To(Equal(Forward{Listen: "127.0.0.1:8080", Target: "10.1.0.2:80"}))
+
+		f, err = ParseForward(":22=127.0.0.1:2222", true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f).To(Equal(Forward{Listen: "22", Target: "127.0.0.1:2222", Remote: true}))
+
+		for _, bad := range []string{"127.0.0.1:8080", "8080=10.1.0.2:80", "127.0.0.1:8080=10.1.0.2"} {
+			_, err = ParseForward(bad, false)
+			Expect(err).To(HaveOccurred(), bad)
+		}
+		_, err = ParseForward("127.0.0.1:22=127.0.0.1:2222", true)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("relays forwards both ways", func() {
+		echo := echoServer()
+		c.Forwards = []Forward{
+			{Listen: "127.0.0.1:0", Target: echo},
+			{Listen: "0", Target: echo, Remote: true},
+		}
+		Expect(startUserStack(ctx, c, stack, netip.MustParseAddr("127.0.0.1"))).To(Succeed())
+		Expect(stack.listeners).To(HaveLen(1))
+
+		conn, err := net.Dial("tcp", stack.listeners[0].Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		expectEcho(conn)
+	})
+
+	It("fails when a forward cannot listen", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer l.Close()
+		c.Forwards = []Forward{{Listen: l.Addr().String(), Target: "127.0.0.1:1"}}
+		Expect(startUserStack(ctx, c, stack, netip.MustParseAddr("127.0.0.1"))).NotTo(Succeed())
+	})
+
+	Context("proxy", func() {
+		var proxyAddr string
+
+		BeforeEach(func() {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(l.Close)
+			proxyAddr = l.Addr().String()
+			go serveProxy(l, stack.DialContext, c.Logger.Debugf)
+		})
+
+		It("serves SOCKS5 clients", func() {
+			echo := netip.MustParseAddrPort(echoServer())
+
+			conn, err := net.Dial("tcp", proxyAddr)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+
+			_, err = conn.Write([]byte{socks5Version, 1, socks5NoAuth})
+			Expect(err).NotTo(HaveOccurred())
+			method := make([]byte, 2)
+			_, err = io.ReadFull(r, method)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(method).To(Equal([]byte{socks5Version, socks5NoAuth}))
+
+			ip := echo.Addr().As4()
+			req := append([]byte{socks5Version, socks5Connect, 0, socks5IPv4}, ip[:]...)
+			req = append(req, byte(echo.Port()>>8), byte(echo.Port()))
+			_, err = conn.Write(req)
+			Expect(err).NotTo(HaveOccurred())
+			reply := make([]byte, 10)
+			_, err = io.ReadFull(r, reply)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reply[1]).To(Equal(byte(socks5Succeeded)))
+
+			expectEcho(conn)
+		})
+
+		It("refuses SOCKS5 commands other than CONNECT", func() {
+			conn, err := net.Dial("tcp", proxyAddr)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			_, err = conn.Write([]byte{socks5Version, 1, socks5NoAuth,
+				socks5Version, 0x02, 0, socks5IPv4, 127, 0, 0, 1, 0, 80})
+			Expect(err).NotTo(HaveOccurred())
+			reply := make([]byte, 12)
+			_, err = io.ReadFull(conn, reply)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reply[3]).To(Equal(byte(socks5CmdNotSupported)))
+		})
+
+		It("serves HTTP clients, with and without CONNECT", func() {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "hello")
+			})
+			plain := httptest.NewServer(handler)
+			defer plain.Close()
+			tls := httptest.NewTLSServer(handler)
+			defer tls.Close()
+
+			proxy, _ := url.Parse("http://" + proxyAddr)
+			for _, server := range []*httptest.Server{plain, tls} {
+				client := server.Client()
+				client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxy)
+				resp, err := client.Get(server.URL)
+				Expect(err).NotTo(HaveOccurred())
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(body)).To(Equal("hello"))
+			}
+		})
+
+		It("answers with a gateway error when the destination is unreachable", func() {
+			proxy, _ := url.Parse("http://" + proxyAddr)
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}}
+			resp, err := client.Get("http://127.0.0.1:1/")
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+		})
+	})
+})
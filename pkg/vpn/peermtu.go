@@ -0,0 +1,168 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+)
+
+// peerMTUInterval is how long the MTU learned from a peer is trusted, or how
+// long a peer that could not be asked is left alone.
+const peerMTUInterval = 10 * time.Minute
+
+// exchangeFunc asks a peer for the MTU of its interface.
+type exchangeFunc func(ctx context.Context, to dest) (int, error)
+
+// peerMTUs keeps the MTU of the interface of each peer, asked in the
+// background the first time a packet goes to it and every peerMTUInterval
+// after.
+//
+// This is not path MTU discovery: the packets travel in libp2p streams,
+// which split and reassemble them whatever the path between the peers
+// carries, so only the MTU the peer writes packets to its interface with
+// can be learned.
+type peerMTUs struct {
+	ctx      context.Context
+	exchange exchangeFunc
+	logf     func(string, ...interface{})
+
+	sync.Mutex
+	peers map[string]*peerMTU
+}
+
+type peerMTU struct {
+	mtu    int
+	at     time.Time
+	asking bool
+}
+
+func newPeerMTUs(ctx context.Context, exchange exchangeFunc, logf func(string, ...interface{})) *peerMTUs {
+	return &peerMTUs{ctx: ctx, exchange: exchange, logf: logf, peers: map[string]*peerMTU{}}
+}
+
+// get returns the MTU of a peer, 0 while it is not known. A nil peerMTUs
+// never knows it.
+func (p *peerMTUs) get(to dest) int {
+	if p == nil {
+		return 0
+	}
+	p.Lock()
+	defer p.Unlock()
+	e, ok := p.peers[to.name]
+	if !ok {
+		e = &peerMTU{}
+		p.peers[to.name] = e
+	}
+	if !e.asking && time.Since(e.at) > peerMTUInterval {
+		e.asking = true
+		go p.run(to)
+	}
+	return e.mtu
+}
+
+func (p *peerMTUs) run(to dest) {
+	mtu, err := p.exchange(p.ctx, to)
+	if err != nil {
+		p.logf("could not exchange the MTU with %s: %s", to.name, err.Error())
+	}
+	p.Lock()
+	defer p.Unlock()
+	e := p.peers[to.name]
+	if err == nil {
+		e.mtu = mtu
+	}
+	e.at, e.asking = time.Now(), false
+}
+
+// mtuTo returns the largest packet that can be sent to a peer: the MTU of
+// the interface, or the one of the peer if lower. 0 means unknown.
+func (c *Config) mtuTo(to dest) int {
+	mtu := c.InterfaceMTU
+	if p := c.peerMTU.get(to); p > 0 && (mtu <= 0 || p < mtu) {
+		mtu = p
+	}
+	return mtu
+}
+
+// Each end of an exchange writes the MTU of its interface, two bytes, and
+// reads the one of the other.
+
+// exchangeMTU writes mtu to rw and returns the MTU the peer answers, or mtu
+// if lower.
+func exchangeMTU(rw io.ReadWriter, mtu int) (int, error) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(max(mtu, 0)))
+	if _, err := rw.Write(b[:]); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(rw, b[:]); err != nil {
+		return 0, err
+	}
+	if remote := int(binary.BigEndian.Uint16(b[:])); remote > 0 && (mtu <= 0 || remote < mtu) {
+		return remote, nil
+	}
+	return mtu, nil
+}
+
+// answerMTU answers an exchange read from rw with mtu.
+func answerMTU(rw io.ReadWriter, mtu int) error {
+	var b [2]byte
+	if _, err := io.ReadFull(rw, b[:]); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(b[:], uint16(max(mtu, 0)))
+	_, err := rw.Write(b[:])
+	return err
+}
+
+// exchangeStream asks a peer for its MTU over a protocol.EdgeVPNMTU stream.
+func exchangeStream(c *Config, n *node.Node) exchangeFunc {
+	return func(ctx context.Context, to dest) (int, error) {
+		ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+
+		s, err := n.Host().NewStream(ctx, to.id, protocol.EdgeVPNMTU.ID())
+		if err != nil {
+			return 0, err
+		}
+		defer s.Close()
+		s.SetDeadline(time.Now().Add(c.Timeout))
+		mtu, err := exchangeMTU(s, c.InterfaceMTU)
+		if err != nil {
+			s.Reset()
+		}
+		return mtu, err
+	}
+}
+
+// mtuHandler answers the MTU exchanges of the peers.
+func mtuHandler(c *Config) func(network.Stream) {
+	return func(s network.Stream) {
+		s.SetDeadline(time.Now().Add(c.Timeout))
+		if err := answerMTU(s, c.InterfaceMTU); err != nil {
+			s.Reset()
+			return
+		}
+		s.Close()
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+)
+
+// SOCKS5 (RFC 1928) values the proxy deals with. Only CONNECT without
+// authentication is supported.
+const (
+	socks5Version   = 0x05
+	socks5NoAuth    = 0x00
+	socks5NoMethods = 0xff
+	socks5Connect   = 0x01
+
+	socks5IPv4   = 0x01
+	socks5Domain = 0x03
+	socks5IPv6   = 0x04
+
+	socks5Succeeded        = 0x00
+	socks5HostUnreachable  = 0x04
+	socks5CmdNotSupported  = 0x07
+	socks5AddrNotSupported = 0x08
+)
+
+// serveProxy serves SOCKS5 and HTTP proxy clients on l, dialing their
+// destinations with dial, until l is closed. The protocol is told apart from
+// the first byte sent by the client.
+func serveProxy(l net.Listener, dial dialFunc, logf func(string, ...interface{})) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			first, err := r.Peek(1)
+			if err != nil {
+				return
+			}
+			if first[0] == socks5Version {
+				err = serveSOCKS5(bufferedConn{r, conn}, r, dial)
+			} else {
+				err = serveHTTPProxy(bufferedConn{r, conn}, r, dial)
+			}
+			if err != nil {
+				logf("proxy: %s: %s", conn.RemoteAddr(), err.Error())
+			}
+		}()
+	}
+}
+
+// bufferedConn reads a connection through the reader that already consumed
+// part of it.
+type bufferedConn struct {
+	r *bufio.Reader
+	net.Conn
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func serveSOCKS5(conn net.Conn, r *bufio.Reader, dial dialFunc) error {
+	// Greeting: version, number of methods, methods
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return err
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+	method := byte(socks5NoMethods)
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			method = socks5NoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	if method == socks5NoMethods {
+		return errors.New("socks5 client offered no supported authentication method")
+	}
+
+	// Request: version, command, reserved, address type, address, port
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return err
+	}
+	var host string
+	switch req[3] {
+	case socks5IPv4, socks5IPv6:
+		ip := make([]byte, 4)
+		if req[3] == socks5IPv6 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return err
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.String()
+	case socks5Domain:
+		l, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		name := make([]byte, l)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return err
+		}
+		host = string(name)
+	default:
+		socks5Reply(conn, socks5AddrNotSupported)
+		return fmt.Errorf("socks5 address type %d not supported", req[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return err
+	}
+	if req[1] != socks5Connect {
+		socks5Reply(conn, socks5CmdNotSupported)
+		return fmt.Errorf("socks5 command %d not supported", req[1])
+	}
+
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	upstream, err := dial(context.Background(), "tcp", target)
+	if err != nil {
+		socks5Reply(conn, socks5HostUnreachable)
+		return err
+	}
+	defer upstream.Close()
+	if err := socks5Reply(conn, socks5Succeeded); err != nil {
+		return err
+	}
+	pipe(conn, upstream)
+	return nil
+}
+
+// socks5Reply answers a request with status. The bound address is not
+// meaningful for CONNECT through the VPN and is left unset.
+func socks5Reply(w io.Writer, status byte) error {
+	_, err := w.Write([]byte{socks5Version, status, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func serveHTTPProxy(conn net.Conn, r *bufio.Reader, dial dialFunc) error {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return err
+	}
+	defer req.Body.Close()
+
+	target := req.Host
+	if req.Method != http.MethodConnect {
+		if req.URL.Host == "" {
+			httpProxyError(conn, http.StatusBadRequest)
+			return fmt.Errorf("request for %s is not a proxy request", req.URL)
+		}
+		target = req.URL.Host
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "80")
+	}
+
+	upstream, err := dial(req.Context(), "tcp", target)
+	if err != nil {
+		httpProxyError(conn, http.StatusBadGateway)
+		return err
+	}
+	defer upstream.Close()
+
+	if req.Method == http.MethodConnect {
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			return err
+		}
+		pipe(conn, upstream)
+		return nil
+	}
+
+	// One request per connection: following ones may be for another host.
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Close = true
+	if err := req.Write(upstream); err != nil {
+		httpProxyError(conn, http.StatusBadGateway)
+		return err
+	}
+	_, err = io.Copy(conn, upstream)
+	return err
+}
+
+func httpProxyError(w io.Writer, code int) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+}
@@ -0,0 +1,310 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultQoSClass is the class of the packets no configured class matches.
+const DefaultQoSClass = "default"
+
+// QoSClass is a class of VPN traffic. Packets are matched against the
+// classes in order, fields left empty matching anything; the packets of the
+// classes with a higher Priority are sent first. Rate, if not zero, shapes
+// the class to Rate bytes per second with bursts of Burst bytes.
+type QoSClass struct {
+	Name     string
+	Priority uint8
+	DSCP     string
+	Protocol string
+	Port     string
+
+	Rate, Burst uint64
+}
+
+// ParseQoSClass parses a class written as
+//
+//	<name> [priority <0-7>] [dscp <0-63|ef|csN|afXY>] [proto tcp|udp|icmp] [port <n>[-<m>]] [rate <bytes/s>] [burst <bytes>]
+//
+// e.g. "ssh priority 6 proto tcp port 22". The port matches either end of
+// the connection.
+func ParseQoSClass(s string) (QoSClass, error) {
+	f := strings.Fields(s)
+	if len(f) == 0 || len(f)%2 == 0 {
+		return QoSClass{}, fmt.Errorf("invalid QoS class %q", s)
+	}
+	c := QoSClass{Name: f[0]}
+	for i := 1; i < len(f); i += 2 {
+		var err error
+		switch f[i] {
+		case "priority":
+			var p uint64
+			p, err = strconv.ParseUint(f[i+1], 10, 8)
+			c.Priority = uint8(p)
+		case "dscp":
+			c.DSCP = f[i+1]
+		case "proto":
+			c.Protocol = f[i+1]
+		case "port":
+			c.Port = f[i+1]
+		case "rate":
+			c.Rate, err = strconv.ParseUint(f[i+1], 10, 64)
+		case "burst":
+			c.Burst, err = strconv.ParseUint(f[i+1], 10, 64)
+		default:
+			return c, fmt.Errorf("invalid QoS class %q: unknown %q", s, f[i])
+		}
+		if err != nil {
+			return c, fmt.Errorf("invalid QoS class %q: bad %s %q", s, f[i], f[i+1])
+		}
+	}
+	_, err := compileQoSClass(c, 0)
+	return c, err
+}
+
+// parseDSCP parses a DSCP value, as a number or by its name.
+func parseDSCP(s string) (uint8, bool) {
+	s = strings.ToLower(s)
+	switch {
+	case s == "ef":
+		return 46, true
+	case len(s) == 3 && strings.HasPrefix(s, "cs") && s[2] >= '0' && s[2] <= '7':
+		return (s[2] - '0') << 3, true
+	case len(s) == 4 && strings.HasPrefix(s, "af") && s[2] >= '1' && s[2] <= '4' && s[3] >= '1' && s[3] <= '3':
+		return (s[2]-'0')<<3 | (s[3]-'0')<<1, true
+	}
+	d, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || d > 63 {
+		return 0, false
+	}
+	return uint8(d), true
+}
+
+// packetDSCP returns the DSCP of an IPv4 or IPv6 packet.
+func packetDSCP(b []byte) uint8 {
+	switch {
+	case len(b) >= 20 && b[0]>>4 == 4:
+		return b[1] >> 2
+	case len(b) >= 40 && b[0]>>4 == 6:
+		return ((b[0]&0x0f)<<4 | b[1]>>4) >> 2
+	}
+	return 0
+}
+
+// qosClass is a compiled QoSClass along with its counters.
+type qosClass struct {
+	QoSClass
+	dscp   int
+	lo, hi uint16
+	bucket *tokenBucket
+
+	// level is the queue of the class in the peer queues, 0 being the most
+	// urgent.
+	level int
+
+	packets, bytes, shaped, dropped atomic.Uint64
+}
+
+func compileQoSClass(c QoSClass, mtu int) (*qosClass, error) {
+	q := &qosClass{QoSClass: c, dscp: -1}
+	if c.Name == "" {
+		return nil, fmt.Errorf("QoS class without a name")
+	}
+	if c.Priority > 7 {
+		return nil, fmt.Errorf("invalid priority %d of QoS class %s (want 0 to 7)", c.Priority, c.Name)
+	}
+	if c.DSCP != "" {
+		d, ok := parseDSCP(c.DSCP)
+		if !ok {
+			return nil, fmt.Errorf("invalid DSCP %q of QoS class %s", c.DSCP, c.Name)
+		}
+		q.dscp = int(d)
+	}
+	switch c.Protocol {
+	case "", "tcp", "udp", "icmp":
+	default:
+		return nil, fmt.Errorf("invalid protocol %q of QoS class %s (want tcp, udp or icmp)", c.Protocol, c.Name)
+	}
+	if c.Port != "" {
+		if c.Protocol != "tcp" && c.Protocol != "udp" {
+			return nil, fmt.Errorf("port %q of QoS class %s needs proto tcp or udp", c.Port, c.Name)
+		}
+		var ok bool
+		if q.lo, q.hi, ok = parsePortRange(c.Port); !ok {
+			return nil, fmt.Errorf("invalid port %q of QoS class %s", c.Port, c.Name)
+		}
+	}
+	if c.Burst != 0 && c.Rate == 0 {
+		return nil, fmt.Errorf("burst of QoS class %s needs a rate", c.Name)
+	}
+	if c.Burst != 0 && c.Burst < uint64(max(mtu, 0)) {
+		return nil, fmt.Errorf("burst %d of QoS class %s is below the MTU %d: its largest packets could never be sent", c.Burst, c.Name, mtu)
+	}
+	if c.Rate != 0 {
+		q.bucket = newTokenBucket(c.Rate, c.Burst, uint64(max(mtu, 0)))
+	}
+	return q, nil
+}
+
+func (c *qosClass) matches(dscp uint8, p packetInfo) bool {
+	if c.dscp >= 0 && uint8(c.dscp) != dscp {
+		return false
+	}
+	if c.Protocol != "" && c.Protocol != p.proto {
+		return false
+	}
+	if c.hi != 0 && (p.sport < c.lo || p.sport > c.hi) && (p.dport < c.lo || p.dport > c.hi) {
+		return false
+	}
+	return true
+}
+
+// allow tells whether the shaping of the class lets n bytes through at now.
+// Every class of a nil qos is the nil class, which allows everything.
+func (c *qosClass) allow(now time.Time, n int) bool {
+	if c == nil || c.bucket == nil || c.bucket.allow(now, n) {
+		return true
+	}
+	c.shaped.Add(1)
+	return false
+}
+
+// queued counts a packet of n bytes handed to the peer queues, or dropped
+// because they were full.
+func (c *qosClass) queued(n int, err error) {
+	switch {
+	case c == nil:
+	case err != nil:
+		c.dropped.Add(1)
+	default:
+		c.packets.Add(1)
+		c.bytes.Add(uint64(n))
+	}
+}
+
+func (c *qosClass) queue() int {
+	if c == nil {
+		return 0
+	}
+	return c.level
+}
+
+// qos sorts the packets the node sends into classes. A nil qos puts them
+// all in one queue.
+type qos struct {
+	classes []*qosClass
+	levels  int
+}
+
+// newQoS compiles classes, returning nil if there are none. Packets no
+// class matches go to DefaultQoSClass, of priority 0, unless a class takes
+// them all.
+func newQoS(classes []QoSClass, mtu int) (*qos, error) {
+	if len(classes) == 0 {
+		return nil, nil
+	}
+	q := &qos{}
+	seen := map[string]bool{}
+	for _, c := range classes {
+		if seen[c.Name] {
+			return nil, fmt.Errorf("duplicate QoS class %s", c.Name)
+		}
+		seen[c.Name] = true
+		compiled, err := compileQoSClass(c, mtu)
+		if err != nil {
+			return nil, err
+		}
+		q.classes = append(q.classes, compiled)
+	}
+	if last := q.classes[len(q.classes)-1]; last.dscp >= 0 || last.Protocol != "" {
+		if seen[DefaultQoSClass] {
+			return nil, fmt.Errorf("QoS class %s must match every packet", DefaultQoSClass)
+		}
+		q.classes = append(q.classes, &qosClass{QoSClass: QoSClass{Name: DefaultQoSClass}, dscp: -1})
+	}
+
+	// One queue per priority, the highest first
+	priorities := []int{}
+	for _, c := range q.classes {
+		priorities = append(priorities, int(c.Priority))
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+	levels := map[uint8]int{}
+	for _, p := range priorities {
+		if _, ok := levels[uint8(p)]; !ok {
+			levels[uint8(p)] = len(levels)
+		}
+	}
+	for _, c := range q.classes {
+		c.level = levels[c.Priority]
+	}
+	q.levels = len(levels)
+	return q, nil
+}
+
+// classify returns the class of packet.
+func (q *qos) classify(packet []byte) *qosClass {
+	if q == nil {
+		return nil
+	}
+	p, _ := parsePacket(packet)
+	dscp := packetDSCP(packet)
+	for _, c := range q.classes {
+		if c.matches(dscp, p) {
+			return c
+		}
+	}
+	return q.classes[len(q.classes)-1]
+}
+
+// queues returns how many priority queues the peer queues need.
+func (q *qos) queues() int {
+	if q == nil {
+		return 1
+	}
+	return q.levels
+}
+
+// QoSClassMetrics are the counters of a QoS class. Packets and Bytes were
+// queued to be sent; Shaped were dropped over the rate of the class and
+// Dropped because the queue of their peer was full.
+type QoSClassMetrics struct {
+	Name                            string
+	Priority                        uint8
+	Packets, Bytes, Shaped, Dropped uint64
+}
+
+func (q *qos) metrics() []QoSClassMetrics {
+	if q == nil {
+		return nil
+	}
+	out := make([]QoSClassMetrics, 0, len(q.classes))
+	for _, c := range q.classes {
+		out = append(out, QoSClassMetrics{
+			Name:     c.Name,
+			Priority: c.Priority,
+			Packets:  c.packets.Load(),
+			Bytes:    c.bytes.Load(),
+			Shaped:   c.shaped.Load(),
+			Dropped:  c.dropped.Load(),
+		})
+	}
+	return out
+}
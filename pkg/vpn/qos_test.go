@@ -0,0 +1,156 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func mustQoS(classes ...string) *qos {
+	var parsed []QoSClass
+	for _, s := range classes {
+		c, err := ParseQoSClass(s)
+		Expect(err).NotTo(HaveOccurred())
+		parsed = append(parsed, c)
+	}
+	q, err := newQoS(parsed, 0)
+	Expect(err).NotTo(HaveOccurred())
+	return q
+}
+
+var _ = Describe("QoS", func() {
+	It("parses classes", func() {
+		c, err := ParseQoSClass("bulk priority 1 proto tcp port 873 rate 1000000 burst 65536")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c).To(Equal(QoSClass{Name: "bulk", Priority: 1, Protocol: "tcp", Port: "873", Rate: 1000000, Burst: 65536}))
+
+		for _, bad := range []string{
+			"",
+			"ssh priority",
+			"ssh priority 8",
+			"ssh port 22",
+			"voip dscp ex",
+			"voip dscp 64",
+			"bulk burst 10",
+			"bulk weight 3",
+		} {
+			_, err := ParseQoSClass(bad)
+			Expect(err).To(HaveOccurred(), bad)
+		}
+	})
+
+	It("parses DSCP names", func() {
+		for name, want := range map[string]uint8{"ef": 46, "cs0": 0, "cs6": 48, "af11": 10, "af43": 38, "34": 34} {
+			d, ok := parseDSCP(name)
+			Expect(ok).To(BeTrue(), name)
+			Expect(d).To(Equal(want), name)
+		}
+	})
+
+	It("classifies packets by DSCP, protocol and port, in order", func() {
+		q := mustQoS("voip priority 7 dscp ef", "ssh priority 6 proto tcp port 22", "bulk priority 1 proto tcp port 873")
+
+		Expect(q.classify(testPacket{src: "10.1.0.1", dst: "10.1.0.2", proto: layers.IPProtocolUDP, dport: 5060, dscp: 46}.bytes()).Name).To(Equal("voip"))
+		Expect(q.classify(tcpPacket("10.1.0.1", "10.1.0.2", 22)).Name).To(Equal("ssh"))
+		Expect(q.classify(tcpPacket("10.1.0.1", "10.1.0.2", 873)).Name).To(Equal("bulk"))
+		Expect(q.classify(testPacket{src: "10.1.0.1", dst: "10.1.0.2", proto: layers.IPProtocolUDP, dport: 5060}.bytes()).Name).To(Equal(DefaultQoSClass))
+		Expect(q.classify([]byte{0xff})).To(HaveField("Name", DefaultQoSClass))
+
+		// Replies come from the port
+		reply := tcpPacket("10.1.0.2", "10.1.0.1", 40000)
+		reply[20], reply[21] = 0, 22
+		Expect(q.classify(reply).Name).To(Equal("ssh"))
+	})
+
+	It("gives a queue to each priority, the highest first", func() {
+		q := mustQoS("voip priority 7 dscp ef", "ssh priority 7 proto tcp port 22", "bulk priority 1 proto tcp port 873")
+		Expect(q.queues()).To(Equal(3))
+		levels := map[string]int{}
+		for _, c := range q.classes {
+			levels[c.Name] = c.level
+		}
+		Expect(levels).To(Equal(map[string]int{"voip": 0, "ssh": 0, "bulk": 1, DefaultQoSClass: 2}))
+
+		Expect(mustQoS("ssh priority 6 proto tcp port 22", "other priority 2").queues()).To(Equal(2))
+		var none *qos
+		Expect(none.queues()).To(Equal(1))
+		Expect(none.classify(tcpPacket("10.1.0.1", "10.1.0.2", 22)).queue()).To(Equal(0))
+	})
+
+	It("rejects duplicate classes and a default that does not match everything", func() {
+		_, err := newQoS([]QoSClass{{Name: "ssh", Protocol: "tcp", Port: "22"}, {Name: "ssh"}}, 0)
+		Expect(err).To(HaveOccurred())
+		_, err = newQoS([]QoSClass{{Name: DefaultQoSClass, Protocol: "udp"}}, 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects a burst below the MTU", func() {
+		_, err := newQoS([]QoSClass{{Name: "bulk", Rate: 1000, Burst: 1000}}, 1500)
+		Expect(err).To(MatchError(ContainSubstring("below the MTU")))
+
+		q, err := newQoS([]QoSClass{{Name: "bulk", Rate: 1000}}, 1500)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(q.classes[0].allow(time.Now(), 1500)).To(BeTrue())
+	})
+
+	It("shapes a class to its rate and counts its packets", func() {
+		q := mustQoS("bulk proto tcp port 873 rate 1000 burst 1000")
+		m := NewMetrics()
+		m.setQoS(q)
+
+		bulk := q.classify(tcpPacket("10.1.0.1", "10.1.0.2", 873))
+		now := time.Now()
+		Expect(bulk.allow(now, 800)).To(BeTrue())
+		bulk.queued(800, nil)
+		Expect(bulk.allow(now, 800)).To(BeFalse())
+		Expect(bulk.allow(now.Add(time.Second), 800)).To(BeTrue())
+		bulk.queued(800, errQueueFull)
+		Expect(q.classify(testPacket{src: "10.1.0.1", dst: "10.1.0.2", proto: layers.IPProtocolUDP, dport: 53}.bytes()).allow(now, 1<<20)).To(BeTrue())
+
+		Expect(m.Snapshot().Classes).To(Equal([]QoSClassMetrics{
+			{Name: "bulk", Packets: 1, Bytes: 800, Shaped: 1, Dropped: 1},
+			{Name: DefaultQoSClass},
+		}))
+	})
+
+	It("sends the packets of higher priority first", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		id := newPeerID()
+		to := dest{id: id, name: id.String()}
+
+		r := &recorder{release: make(chan struct{})}
+		m := NewMetrics()
+		q := newPeerQueues(ctx, func(context.Context, dest) (packetStream, bool, error) { return r, true, nil }, m, 2, func(string, ...interface{}) {})
+
+		// The first packet holds the stream while the others queue up
+		first := tcpPacket("10.1.0.1", "10.1.0.2", 873)
+		Expect(q.send(to, first, 1)).To(Succeed())
+		Eventually(func() int { return m.Snapshot().Peers[to.name].Depth }).Should(Equal(0))
+		time.Sleep(10 * time.Millisecond)
+
+		bulk := tcpPacket("10.1.0.1", "10.1.0.2", 874)
+		ssh := tcpPacket("10.1.0.1", "10.1.0.2", 22)
+		Expect(q.send(to, bulk, 1)).To(Succeed())
+		Expect(q.send(to, ssh, 0)).To(Succeed())
+		close(r.release)
+
+		Eventually(r.packets).Should(Equal([][]byte{first, ssh, bulk}))
+	})
+})
@@ -0,0 +1,191 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxBatchSize is how many bytes of packets are coalesced into one write to
+// a peer that supports framing.
+const maxBatchSize = 64 * 1024
+
+// peerQueueSize is how many packets may wait to be sent to a peer, in each
+// priority queue.
+const peerQueueSize = 128
+
+// redialInterval is how long a peer that could not be reached is given
+// before trying again. Its packets are dropped meanwhile.
+const redialInterval = time.Second
+
+var errQueueFull = errors.New("queue full")
+
+// packetStream is a stream to a peer, with framing or not.
+type packetStream interface {
+	io.WriteCloser
+	Reset() error
+}
+
+// openFunc opens a stream to a peer, telling whether it uses framing.
+type openFunc func(ctx context.Context, to dest) (s packetStream, framed bool, err error)
+
+// peerQueues holds a queue per destination peer, each written to its own
+// stream by its own goroutine: a peer that is slow or unreachable only
+// fills its queue and loses its packets, the others are not held up.
+// The queue of a peer is split by priority, the most urgent packets being
+// sent first, so that bulk traffic filling its queue does not hold up the
+// interactive one.
+type peerQueues struct {
+	ctx     context.Context
+	open    openFunc
+	metrics *Metrics
+	levels  int
+	logf    func(string, ...interface{})
+
+	sync.Mutex
+	queues map[string]*peerQueue
+}
+
+// newPeerQueues returns queues with levels priorities.
+func newPeerQueues(ctx context.Context, open openFunc, m *Metrics, levels int, logf func(string, ...interface{})) *peerQueues {
+	return &peerQueues{ctx: ctx, open: open, metrics: m, levels: max(levels, 1), logf: logf, queues: map[string]*peerQueue{}}
+}
+
+// send queues a copy of packet for to, at level (0 being the most urgent).
+// It never blocks: it fails with errQueueFull when the peer is not keeping
+// up.
+func (q *peerQueues) send(to dest, packet []byte, level int) error {
+	q.Lock()
+	pq, ok := q.queues[to.name]
+	if !ok {
+		pq = &peerQueue{to: to, ready: make(chan struct{}, 1), stats: q.metrics.peer(to.name)}
+		for i := 0; i < q.levels; i++ {
+			pq.queues = append(pq.queues, make(chan []byte, peerQueueSize))
+		}
+		pq.stats.queues = pq.queues
+		q.queues[to.name] = pq
+		go pq.run(q.ctx, q.open, q.logf)
+	}
+	q.Unlock()
+
+	select {
+	case pq.queues[min(level, len(pq.queues)-1)] <- append([]byte(nil), packet...):
+	default:
+		pq.stats.dropped.Add(1)
+		return errQueueFull
+	}
+	select {
+	case pq.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+type peerQueue struct {
+	to     dest
+	queues []chan []byte
+	// ready is signaled when packets are queued.
+	ready chan struct{}
+	stats *peerStats
+}
+
+// next returns the most urgent packet queued, if any.
+func (pq *peerQueue) next() ([]byte, bool) {
+	for _, q := range pq.queues {
+		select {
+		case p := <-q:
+			return p, true
+		default:
+		}
+	}
+	return nil, false
+}
+
+func (pq *peerQueue) run(ctx context.Context, open openFunc, logf func(string, ...interface{})) {
+	var (
+		s        packetStream
+		framed   bool
+		err      error
+		lastFail time.Time
+		buf      = make([]byte, 0, maxBatchSize+frameHeaderSize+65535)
+	)
+	defer func() {
+		if s != nil {
+			s.Close()
+		}
+	}()
+
+	for {
+		p, ok := pq.next()
+		if !ok {
+			select {
+			case <-pq.ready:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if s == nil {
+			if time.Since(lastFail) < redialInterval {
+				pq.stats.dropped.Add(1)
+				continue
+			}
+			if s, framed, err = open(ctx, pq.to); err != nil {
+				logf("could not open stream to %s: %s", pq.to.name, err.Error())
+				s, lastFail = nil, time.Now()
+				pq.stats.dropped.Add(1)
+				continue
+			}
+		}
+
+		buf = buf[:0]
+		n := uint64(1)
+		if framed {
+			// Take whatever queued up meanwhile along, the most urgent first
+			buf = appendFrame(buf, p)
+			for len(buf) < maxBatchSize {
+				p, ok := pq.next()
+				if !ok {
+					break
+				}
+				buf, n = appendFrame(buf, p), n+1
+			}
+		} else {
+			buf = append(buf, p...)
+		}
+		if _, err := s.Write(buf); err != nil {
+			logf("could not write to %s: %s", pq.to.name, err.Error())
+			s.Reset()
+			s = nil
+			pq.stats.dropped.Add(n)
+			continue
+		}
+		pq.stats.sent.Add(n)
+
+		if !framed {
+			// Old nodes copy a stream straight into their interface: they
+			// take a single packet per stream, as they used to send them
+			s.Close()
+			s = nil
+		}
+	}
+}
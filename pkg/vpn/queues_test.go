@@ -0,0 +1,206 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// recorder records each write, blocking the first one until released.
+type recorder struct {
+	sync.Mutex
+	writes  [][]byte
+	release chan struct{}
+	err     error
+	resets  int
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	if r.release != nil {
+		<-r.release
+		r.release = nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.err != nil {
+		return 0, r.err
+	}
+	r.writes = append(r.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (r *recorder) Reset() error {
+	r.Lock()
+	defer r.Unlock()
+	r.resets++
+	return nil
+}
+
+func (r *recorder) Close() error { return nil }
+
+func (r *recorder) recorded() [][]byte {
+	r.Lock()
+	defer r.Unlock()
+	return r.writes
+}
+
+func (r *recorder) packets() (all [][]byte) {
+	for _, b := range r.recorded() {
+		_, p := readAll(b)
+		all = append(all, p...)
+	}
+	return
+}
+
+var _ = Describe("Peer queues", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+		m      *Metrics
+		to     dest
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+		m = NewMetrics()
+		id := newPeerID()
+		to = dest{id: id, name: id.String()}
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	queues := func(open openFunc) *peerQueues {
+		return newPeerQueues(ctx, open, m, 1, func(string, ...interface{}) {})
+	}
+	streams := func(s ...*recorder) openFunc {
+		var opened atomic.Int32
+		return func(context.Context, dest) (packetStream, bool, error) {
+			return s[min(int(opened.Add(1)), len(s))-1], true, nil
+		}
+	}
+
+	It("coalesces the packets queued during a write", func() {
+		r := &recorder{release: make(chan struct{})}
+		q := queues(streams(r))
+
+		packets := [][]byte{}
+		for i := 0; i < 5; i++ {
+			p := tcpPacket("10.1.0.1", "10.1.0.2", uint16(1000+i))
+			packets = append(packets, p)
+			Expect(q.send(to, p, 0)).To(Succeed())
+		}
+		close(r.release)
+
+		Eventually(r.packets).Should(Equal(packets))
+		Expect(len(r.recorded())).To(BeNumerically("<", 5))
+		Eventually(func() uint64 { return m.Snapshot().Peers[to.name].Sent }).Should(Equal(uint64(5)))
+	})
+
+	It("drops the packets of a peer that does not keep up", func() {
+		r := &recorder{release: make(chan struct{})}
+		defer close(r.release)
+		q := queues(streams(r))
+
+		full := 0
+		for i := 0; i < 2*peerQueueSize; i++ {
+			if err := q.send(to, tcpPacket("10.1.0.1", "10.1.0.2", 80), 0); err != nil {
+				Expect(err).To(MatchError(errQueueFull))
+				full++
+			}
+		}
+		Expect(full).To(BeNumerically(">", 0))
+
+		s := m.Snapshot()
+		Expect(s.Dropped).To(Equal(uint64(full)))
+		Expect(s.Peers[to.name].Depth).To(Equal(peerQueueSize))
+		Expect(s.Peers[to.name].Capacity).To(Equal(peerQueueSize))
+	})
+
+	It("opens a new stream after a write error", func() {
+		broken, r := &recorder{err: errors.New("reset")}, &recorder{}
+		q := queues(streams(broken, r))
+
+		Expect(q.send(to, tcpPacket("10.1.0.1", "10.1.0.2", 80), 0)).To(Succeed())
+		Eventually(func() uint64 { return m.Snapshot().Peers[to.name].Dropped }).Should(Equal(uint64(1)))
+		Expect(broken.resets).To(Equal(1))
+
+		p := tcpPacket("10.1.0.1", "10.1.0.2", 443)
+		Expect(q.send(to, p, 0)).To(Succeed())
+		Eventually(r.packets).Should(Equal([][]byte{p}))
+	})
+
+	It("sends unframed packets to old peers one stream each", func() {
+		var (
+			mu     sync.Mutex
+			opened []*recorder
+		)
+		first := &recorder{release: make(chan struct{})}
+		q := queues(func(context.Context, dest) (packetStream, bool, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			r := &recorder{}
+			if len(opened) == 0 {
+				r = first
+			}
+			opened = append(opened, r)
+			return r, false, nil
+		})
+
+		packets := [][]byte{}
+		for i := 0; i < 5; i++ {
+			p := tcpPacket("10.1.0.1", "10.1.0.2", uint16(1000+i))
+			packets = append(packets, p)
+			Expect(q.send(to, p, 0)).To(Succeed())
+		}
+		close(first.release)
+
+		// An old node copies each stream into its interface as it comes: a
+		// stream must hold a single packet
+		received := func() (tun [][]byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, r := range opened {
+				var stream []byte
+				for _, w := range r.recorded() {
+					stream = append(stream, w...)
+				}
+				tun = append(tun, stream)
+			}
+			return
+		}
+		Eventually(received).Should(Equal(packets))
+		Eventually(func() uint64 { return m.Snapshot().Peers[to.name].Sent }).Should(Equal(uint64(5)))
+	})
+})
+
+var _ = Describe("Workers", func() {
+	It("hands the packets of a flow to the same worker", func() {
+		a := workerFor(tcpPacket("10.1.0.1", "10.1.0.2", 80), 8)
+		Expect(workerFor(tcpPacket("10.1.0.1", "10.1.0.2", 80), 8)).To(Equal(a))
+
+		seen := map[int]bool{}
+		for i := 0; i < 64; i++ {
+			seen[workerFor(tcpPacket("10.1.0.1", "10.1.0.2", uint16(1000+i)), 8)] = true
+		}
+		Expect(len(seen)).To(BeNumerically(">", 1))
+	})
+})
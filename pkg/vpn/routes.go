@@ -0,0 +1,196 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// ParseRoute parses a subnet to advertise and returns it in canonical form
+// (the network address), e.g. "192.168.10.1/24" -> "192.168.10.0/24".
+func ParseRoute(s string) (string, error) {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid route %q: %w", s, err)
+	}
+	if ones, _ := n.Mask.Size(); ones == 0 {
+		return "", fmt.Errorf("invalid route %q: the default route cannot be advertised", s)
+	}
+	return n.String(), nil
+}
+
+type subnetRoute struct {
+	net  *net.IPNet
+	peer string
+}
+
+// routeConflict is a prefix advertised by more than one peer. Every node
+// elects the same winner: the lowest peer ID.
+type routeConflict struct {
+	Prefix string
+	Winner string
+	Losers []string
+}
+
+// routeTable holds the subnets advertised by the peers in the machines
+// bucket, most specific first.
+type routeTable struct {
+	routes    []subnetRoute
+	conflicts []routeConflict
+}
+
+// buildRoutes collects the routes advertised in machines, skipping the ones
+// of self and of peers for which live returns false.
+func buildRoutes(machines map[string]blockchain.Data, self string, live func(string) bool) *routeTable {
+	byPrefix := map[string][]string{}
+	nets := map[string]*net.IPNet{}
+	seen := map[string]bool{}
+	for _, d := range machines {
+		m := &types.Machine{}
+		if err := d.Unmarshal(m); err != nil || m.PeerID == "" || m.PeerID == self {
+			continue
+		}
+		for _, r := range m.Routes {
+			_, n, err := net.ParseCIDR(r)
+			if err != nil {
+				continue
+			}
+			if ones, _ := n.Mask.Size(); ones == 0 {
+				continue
+			}
+			prefix := n.String()
+			// A peer may hold several machine entries (e.g. during an
+			// address change): count it once per prefix.
+			if seen[prefix+" "+m.PeerID] {
+				continue
+			}
+			seen[prefix+" "+m.PeerID] = true
+			if live != nil && !live(m.PeerID) {
+				continue
+			}
+			nets[prefix] = n
+			byPrefix[prefix] = append(byPrefix[prefix], m.PeerID)
+		}
+	}
+
+	t := &routeTable{}
+	for prefix, peers := range byPrefix {
+		sort.Strings(peers)
+		t.routes = append(t.routes, subnetRoute{net: nets[prefix], peer: peers[0]})
+		if len(peers) > 1 {
+			t.conflicts = append(t.conflicts, routeConflict{Prefix: prefix, Winner: peers[0], Losers: peers[1:]})
+		}
+	}
+	sort.Slice(t.routes, func(i, j int) bool {
+		oi, _ := t.routes[i].net.Mask.Size()
+		oj, _ := t.routes[j].net.Mask.Size()
+		if oi != oj {
+			return oi > oj
+		}
+		return t.routes[i].net.String() < t.routes[j].net.String()
+	})
+	sort.Slice(t.conflicts, func(i, j int) bool { return t.conflicts[i].Prefix < t.conflicts[j].Prefix })
+	return t
+}
+
+// prefixes returns the advertised subnets.
+func (t *routeTable) prefixes() []*net.IPNet {
+	out := make([]*net.IPNet, 0, len(t.routes))
+	for _, r := range t.routes {
+		out = append(out, r.net)
+	}
+	return out
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// kernelRoutes points the subnets advertised by peers at the VPN interface in
+// the host routing table.
+type kernelRoutes struct {
+	installed map[string]*net.IPNet
+}
+
+// sync installs the routes in want that are missing and removes the ones
+// no longer advertised. Subnets overlapping a network the host is directly
+// attached to are left alone, so a remote site using the same LAN range does
+// not hijack the local one.
+func (k *kernelRoutes) sync(c *Config, want []*net.IPNet) {
+	if k.installed == nil {
+		k.installed = map[string]*net.IPNet{}
+	}
+	local := localNetworks(c.InterfaceName)
+
+	wanted := map[string]bool{}
+NEXT:
+	for _, n := range want {
+		key := n.String()
+		for _, l := range local {
+			if overlaps(n, l) {
+				if k.installed[key] == nil {
+					c.Logger.Warnf("not routing %s through the VPN: it overlaps the local network %s", key, l)
+				}
+				continue NEXT
+			}
+		}
+		wanted[key] = true
+		if k.installed[key] != nil {
+			continue
+		}
+		if err := addRoute(c, n); err != nil {
+			c.Logger.Warnf("could not add route to %s: %s", key, err.Error())
+			continue
+		}
+		k.installed[key] = n
+	}
+	for key, n := range k.installed {
+		if wanted[key] {
+			continue
+		}
+		if err := delRoute(c, n); err != nil {
+			c.Logger.Warnf("could not remove route to %s: %s", key, err.Error())
+		}
+		delete(k.installed, key)
+	}
+}
+
+// localNetworks returns the networks of the host interfaces other than the
+// VPN one.
+func localNetworks(vpnInterface string) (nets []*net.IPNet) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	for _, i := range ifaces {
+		if i.Name == vpnInterface || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && !n.IP.IsLinkLocalUnicast() {
+				nets = append(nets, &net.IPNet{IP: n.IP.Mask(n.Mask), Mask: n.Mask})
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,99 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"encoding/json"
+	"net/netip"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+func machines(m ...types.Machine) map[string]blockchain.Data {
+	out := map[string]blockchain.Data{}
+	for _, mm := range m {
+		dat, _ := json.Marshal(mm)
+		out[mm.Address] = blockchain.Data(dat)
+	}
+	return out
+}
+
+var _ = Describe("Subnet routes", func() {
+	It("parses routes to their network address", func() {
+		r, err := ParseRoute("192.168.10.7/24")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r).To(Equal("192.168.10.0/24"))
+
+		_, err = ParseRoute("192.168.10.7")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseRoute("0.0.0.0/0")
+		Expect(err).To(HaveOccurred())
+	})
+
+	a, b := newPeerID(), newPeerID()
+	lo, hi := a, b
+	if hi.String() < lo.String() {
+		lo, hi = hi, lo
+	}
+
+	It("picks the most specific route", func() {
+		m := machines(
+			types.Machine{PeerID: a.String(), Address: "10.1.0.1", Routes: []string{"192.168.0.0/16"}},
+			types.Machine{PeerID: b.String(), Address: "10.1.0.2", Routes: []string{"192.168.10.0/24"}},
+		)
+		r := ledgerRoutes(m, "", nil)
+
+		to, ok := r.lookup(netip.MustParseAddr("192.168.10.5"))
+		Expect(ok).To(BeTrue())
+		Expect(to.id).To(Equal(b))
+		to, ok = r.lookup(netip.MustParseAddr("192.168.20.5"))
+		Expect(ok).To(BeTrue())
+		Expect(to.id).To(Equal(a))
+		_, ok = r.lookup(netip.MustParseAddr("172.16.0.1"))
+		Expect(ok).To(BeFalse())
+		Expect(buildRoutes(m, "", nil).conflicts).To(BeEmpty())
+	})
+
+	It("elects the same peer for a prefix advertised twice", func() {
+		m := machines(
+			types.Machine{PeerID: hi.String(), Address: "10.1.0.2", Routes: []string{"192.168.10.0/24"}},
+			types.Machine{PeerID: lo.String(), Address: "10.1.0.1", Routes: []string{"192.168.10.1/24"}},
+		)
+
+		to, _ := ledgerRoutes(m, "", nil).lookup(netip.MustParseAddr("192.168.10.5"))
+		Expect(to.id).To(Equal(lo))
+		Expect(buildRoutes(m, "", nil).conflicts).To(Equal([]routeConflict{{Prefix: "192.168.10.0/24", Winner: lo.String(), Losers: []string{hi.String()}}}))
+	})
+
+	It("skips its own routes and the ones of inactive peers", func() {
+		me := newPeerID()
+		m := machines(
+			types.Machine{PeerID: me.String(), Address: "10.1.0.1", Routes: []string{"192.168.10.0/24"}},
+			types.Machine{PeerID: a.String(), Address: "10.1.0.2", Routes: []string{"192.168.10.0/24", "172.16.0.0/12"}},
+			types.Machine{PeerID: b.String(), Address: "10.1.0.3", Routes: []string{"172.16.0.0/12"}},
+		)
+		live := func(p string) bool { return p != a.String() }
+		r := ledgerRoutes(m, me.String(), live)
+
+		_, ok := r.lookup(netip.MustParseAddr("192.168.10.5"))
+		Expect(ok).To(BeFalse())
+		to, _ := r.lookup(netip.MustParseAddr("172.16.1.1"))
+		Expect(to.id).To(Equal(b))
+		Expect(buildRoutes(m, me.String(), live).conflicts).To(BeEmpty())
+	})
+})
@@ -0,0 +1,179 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// dest is a peer packets are routed to.
+type dest struct {
+	id   peer.ID
+	name string // as found in the ledger
+}
+
+func newDest(name string) (dest, error) {
+	id, err := peer.Decode(name)
+	return dest{id: id, name: name}, err
+}
+
+type subnetDest struct {
+	prefix netip.Prefix
+	to     dest
+}
+
+// routes is a snapshot of the routing table.
+type routes struct {
+	hosts   map[netip.Addr]dest
+	subnets []subnetDest // most specific first
+	// static is set for a routing table given in the configuration, which
+	// the ledger does not change.
+	static bool
+}
+
+// lookup returns the peer owning dst, else the one advertising the most
+// specific subnet containing it.
+func (r *routes) lookup(dst netip.Addr) (dest, bool) {
+	if to, ok := r.hosts[dst]; ok {
+		return to, true
+	}
+	for _, s := range r.subnets {
+		if s.prefix.Contains(dst) {
+			return s.to, true
+		}
+	}
+	return dest{}, false
+}
+
+// staticRoutes builds the routes of a static peer table (IP -> peer).
+func staticRoutes(table map[string]peer.ID) *routes {
+	r := &routes{hosts: map[netip.Addr]dest{}, static: true}
+	for ip, p := range table {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			r.hosts[addr] = dest{id: p, name: p.String()}
+		}
+	}
+	return r
+}
+
+// ledgerRoutes builds the routes from the machines bucket, leaving out the
+// machines of inactive owners (see blockchain.Ledger.IsOwnerLive) and the
+// subnets advertised by self.
+func ledgerRoutes(machines map[string]blockchain.Data, self string, live func(string) bool) *routes {
+	r := &routes{hosts: map[netip.Addr]dest{}}
+	for ip, d := range machines {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			continue
+		}
+		m := &types.Machine{}
+		if err := d.Unmarshal(m); err != nil || (live != nil && !live(m.PeerID)) {
+			continue
+		}
+		to, err := newDest(m.PeerID)
+		if err != nil {
+			continue
+		}
+		r.hosts[addr] = to
+		if addr6, err := netip.ParseAddr(m.Address6); err == nil && isIPv6Of(addr6, to.id) {
+			r.hosts[addr6] = to
+		}
+	}
+	for _, s := range buildRoutes(machines, self, live).routes {
+		prefix, err := netip.ParsePrefix(s.net.String())
+		if err != nil {
+			continue
+		}
+		if to, err := newDest(s.peer); err == nil {
+			r.subnets = append(r.subnets, subnetDest{prefix: prefix, to: to})
+		}
+	}
+	return r
+}
+
+// routingTable maps the destination of a packet to the peer to send it to.
+// Lookups read an immutable snapshot, replaced as a whole when the ledger
+// changes, so routing a packet neither locks nor reads the ledger.
+type routingTable struct {
+	current atomic.Pointer[routes]
+}
+
+func newRoutingTable(r *routes) *routingTable {
+	t := &routingTable{}
+	t.current.Store(r)
+	return t
+}
+
+func (t *routingTable) load() *routes { return t.current.Load() }
+
+// refresh rebuilds the table from the ledger.
+func (t *routingTable) refresh(l *blockchain.Ledger, self string) {
+	t.current.Store(ledgerRoutes(l.CurrentData()[protocol.MachinesLedgerKey], self, l.IsOwnerLive))
+}
+
+// watch keeps the table in sync with the machines in the ledger. Heartbeats
+// change on every announce, so they do not trigger a rebuild: the table is
+// rebuilt every interval instead, as owners go inactive.
+func (t *routingTable) watch(ctx context.Context, l *blockchain.Ledger, self string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for ctx.Err() == nil {
+		events := l.Watch(ctx, protocol.MachinesLedgerKey, "")
+		t.refresh(l, self)
+	EVENTS:
+		for {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					break EVENTS
+				}
+				// Rebuild once for a whole block of changes
+				for drained := false; !drained; {
+					select {
+					case _, ok := <-events:
+						if !ok {
+							break EVENTS
+						}
+					default:
+						drained = true
+					}
+				}
+				t.refresh(l, self)
+			case <-ticker.C:
+				t.refresh(l, self)
+			}
+		}
+	}
+}
+
+// packetAddrs returns the source and destination addresses of an IP packet.
+func packetAddrs(b []byte) (src, dst netip.Addr, ok bool) {
+	switch {
+	case len(b) >= 20 && b[0]>>4 == 4:
+		return netip.AddrFrom4([4]byte(b[12:16])), netip.AddrFrom4([4]byte(b[16:20])), true
+	case len(b) >= 40 && b[0]>>4 == 6:
+		return netip.AddrFrom16([16]byte(b[8:24])), netip.AddrFrom16([16]byte(b[24:40])), true
+	}
+	return
+}
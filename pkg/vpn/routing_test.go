@@ -0,0 +1,212 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+func newPeerID() peer.ID {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+var _ = Describe("Routing table", func() {
+	a, b := newPeerID(), newPeerID()
+
+	It("routes VPN addresses, then advertised subnets", func() {
+		r := ledgerRoutes(machines(
+			types.Machine{PeerID: a.String(), Address: "10.1.0.1", Routes: []string{"192.168.0.0/16"}},
+			types.Machine{PeerID: b.String(), Address: "10.1.0.2"},
+			types.Machine{PeerID: "not-a-peer", Address: "10.1.0.3"},
+		), "", nil)
+
+		to, ok := r.lookup(netip.MustParseAddr("10.1.0.2"))
+		Expect(ok).To(BeTrue())
+		Expect(to).To(Equal(dest{id: b, name: b.String()}))
+		to, ok = r.lookup(netip.MustParseAddr("192.168.3.4"))
+		Expect(ok).To(BeTrue())
+		Expect(to.id).To(Equal(a))
+		_, ok = r.lookup(netip.MustParseAddr("10.1.0.3"))
+		Expect(ok).To(BeFalse())
+		_, ok = r.lookup(netip.MustParseAddr("172.16.0.1"))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("leaves out inactive owners", func() {
+		r := ledgerRoutes(machines(
+			types.Machine{PeerID: a.String(), Address: "10.1.0.1"},
+			types.Machine{PeerID: b.String(), Address: "10.1.0.2"},
+		), "", func(p string) bool { return p == a.String() })
+
+		_, ok := r.lookup(netip.MustParseAddr("10.1.0.1"))
+		Expect(ok).To(BeTrue())
+		_, ok = r.lookup(netip.MustParseAddr("10.1.0.2"))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("uses a static peer table as is", func() {
+		r := staticRoutes(map[string]peer.ID{"10.1.0.1": a})
+		Expect(r.static).To(BeTrue())
+		to, ok := r.lookup(netip.MustParseAddr("10.1.0.1"))
+		Expect(ok).To(BeTrue())
+		Expect(to.id).To(Equal(a))
+	})
+
+	It("follows the ledger", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		l := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		t := newRoutingTable(&routes{})
+		go t.watch(ctx, l, "", time.Minute)
+
+		l.Add(protocol.MachinesLedgerKey, map[string]interface{}{"10.1.0.1": types.Machine{PeerID: a.String(), Address: "10.1.0.1"}})
+		Eventually(func() bool {
+			_, ok := t.load().lookup(netip.MustParseAddr("10.1.0.1"))
+			return ok
+		}).Should(BeTrue())
+
+		l.Delete(protocol.MachinesLedgerKey, "10.1.0.1")
+		Eventually(func() bool {
+			_, ok := t.load().lookup(netip.MustParseAddr("10.1.0.1"))
+			return ok
+		}).Should(BeFalse())
+	})
+
+	It("does not rebuild on heartbeats", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		l := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		l.Add(protocol.MachinesLedgerKey, map[string]interface{}{"10.1.0.1": types.Machine{PeerID: a.String(), Address: "10.1.0.1"}})
+		t := newRoutingTable(&routes{})
+		go t.watch(ctx, l, "", time.Minute)
+		Eventually(func() bool {
+			_, ok := t.load().lookup(netip.MustParseAddr("10.1.0.1"))
+			return ok
+		}).Should(BeTrue())
+
+		built := t.load()
+		l.Add(protocol.HealthCheckKey, map[string]interface{}{a.String(): time.Now().UTC().Format(time.RFC3339)})
+		Consistently(t.load, "200ms").Should(BeIdenticalTo(built))
+	})
+
+	It("reads the addresses of IPv4 and IPv6 packets", func() {
+		src, dst, ok := packetAddrs(tcpPacket("10.1.0.1", "10.1.0.2", 80))
+		Expect(ok).To(BeTrue())
+		Expect(src).To(Equal(netip.MustParseAddr("10.1.0.1")))
+		Expect(dst).To(Equal(netip.MustParseAddr("10.1.0.2")))
+
+		v6 := make([]byte, 40)
+		v6[0] = 6 << 4
+		copy(v6[8:24], net.ParseIP("fd00::1"))
+		copy(v6[24:40], net.ParseIP("fd00::2"))
+		src, dst, ok = packetAddrs(v6)
+		Expect(ok).To(BeTrue())
+		Expect(src).To(Equal(netip.MustParseAddr("fd00::1")))
+		Expect(dst).To(Equal(netip.MustParseAddr("fd00::2")))
+
+		_, _, ok = packetAddrs([]byte{0x45, 0})
+		Expect(ok).To(BeFalse())
+	})
+})
+
+// benchLedger returns a ledger with n machines and their heartbeats, under
+// ownership observation so that liveness is checked as in a real network.
+func benchLedger(n int) (*blockchain.Ledger, []netip.Addr) {
+	l := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+	l.SetOwnership(blockchain.OwnershipObserve, nil, time.Hour)
+	now := time.Now().UTC().Format(time.RFC3339)
+	m, h := map[string]interface{}{}, map[string]interface{}{}
+	addrs := []netip.Addr{}
+	for i := 0; i < n; i++ {
+		id := newPeerID().String()
+		ip := fmt.Sprintf("10.1.%d.%d", i/250, i%250+1)
+		m[ip] = types.Machine{PeerID: id, Address: ip}
+		h[id] = now
+		addrs = append(addrs, netip.MustParseAddr(ip))
+	}
+	l.Add(protocol.HealthCheckKey, h)
+	l.Add(protocol.MachinesLedgerKey, m)
+	return l, addrs
+}
+
+// BenchmarkRouteLedger is the lookup done for every packet before the
+// routing table: read the ledger, check the owner, decode the peer.
+func BenchmarkRouteLedger(b *testing.B) {
+	l, addrs := benchLedger(500)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		value, found := l.GetKey(protocol.MachinesLedgerKey, addrs[i%len(addrs)].String())
+		if !found {
+			b.Fatal("not found")
+		}
+		machine := &types.Machine{}
+		value.Unmarshal(machine)
+		if !l.IsOwnerLive(machine.PeerID) {
+			b.Fatal("not live")
+		}
+		if _, err := peer.Decode(machine.PeerID); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRouteTable(b *testing.B) {
+	l, addrs := benchLedger(500)
+	t := newRoutingTable(&routes{})
+	t.refresh(l, "")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, found := t.load().lookup(addrs[i%len(addrs)]); !found {
+			b.Fatal("not found")
+		}
+	}
+}
+
+func BenchmarkRouteTableParallel(b *testing.B) {
+	l, addrs := benchLedger(500)
+	t := newRoutingTable(&routes{})
+	t.refresh(l, "")
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			t.load().lookup(addrs[i%len(addrs)])
+			i++
+		}
+	})
+}
@@ -0,0 +1,421 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// trafficSaveInterval is how often the traffic counted against the quota is
+// saved, at most: a crash loses what was counted since.
+const trafficSaveInterval = time.Minute
+
+// maxFlows bounds the source and destination pairs counted one by one, as
+// the traffic of exit nodes and advertised routes is addressed to any host.
+// The packets of the pairs beyond are counted together.
+const maxFlows = 4096
+
+type flowKey struct {
+	src, dst netip.Addr
+}
+
+type flowStats struct {
+	packets, bytes atomic.Uint64
+}
+
+// TrafficFlow is the traffic from Source to Destination. Both are empty for
+// the total of the pairs beyond the ones counted one by one.
+type TrafficFlow struct {
+	Source, Destination string
+	Packets, Bytes      uint64
+}
+
+// TrafficLimitStatus is the limit of the node and what it let through this
+// month.
+type TrafficLimitStatus struct {
+	types.TrafficLimit
+	Used    uint64
+	Dropped uint64
+}
+
+// TrafficSnapshot is the traffic of the node, by source and destination
+// address, and its limit if any.
+type TrafficSnapshot struct {
+	Flows []TrafficFlow
+	Limit *TrafficLimitStatus `json:",omitempty"`
+}
+
+// count adds a packet of the VPN, sent or received, to the traffic of its
+// flow.
+func (m *Metrics) count(packet []byte) {
+	if m == nil {
+		return
+	}
+	src, dst, ok := packetAddrs(packet)
+	if !ok {
+		return
+	}
+	key := flowKey{src, dst}
+	v, ok := m.flows.Load(key)
+	if !ok {
+		if m.nflows.Load() >= maxFlows {
+			key = flowKey{}
+		}
+		var loaded bool
+		if v, loaded = m.flows.LoadOrStore(key, &flowStats{}); !loaded {
+			m.nflows.Add(1)
+		}
+	}
+	s := v.(*flowStats)
+	s.packets.Add(1)
+	s.bytes.Add(uint64(len(packet)))
+}
+
+// Traffic returns the traffic of the node so far.
+func (m *Metrics) Traffic() TrafficSnapshot {
+	out := TrafficSnapshot{Flows: []TrafficFlow{}}
+	m.flows.Range(func(k, v any) bool {
+		key, s := k.(flowKey), v.(*flowStats)
+		f := TrafficFlow{Packets: s.packets.Load(), Bytes: s.bytes.Load()}
+		if key.src.IsValid() {
+			f.Source, f.Destination = key.src.String(), key.dst.String()
+		}
+		out.Flows = append(out.Flows, f)
+		return true
+	})
+	sort.Slice(out.Flows, func(i, j int) bool {
+		if out.Flows[i].Source != out.Flows[j].Source {
+			return out.Flows[i].Source < out.Flows[j].Source
+		}
+		return out.Flows[i].Destination < out.Flows[j].Destination
+	})
+	m.Lock()
+	limiter := m.limiter
+	m.Unlock()
+	out.Limit = limiter.status(time.Now())
+	return out
+}
+
+func (m *Metrics) setLimiter(l *trafficLimiter) {
+	m.Lock()
+	defer m.Unlock()
+	m.limiter = l
+}
+
+// tokenBucket lets through rate bytes per second on average, and up to
+// burst at once.
+type tokenBucket struct {
+	sync.Mutex
+	rate, burst, tokens float64
+	last                time.Time
+}
+
+// newTokenBucket returns a bucket of rate, with bursts of a second at rate
+// unless burst is set. The burst is at least packet, the largest amount taken
+// at once, which a smaller bucket would never let through.
+func newTokenBucket(rate, burst, packet uint64) *tokenBucket {
+	if burst == 0 {
+		burst = rate
+	}
+	burst = max(burst, packet)
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst)}
+}
+
+// allow takes n bytes from the bucket at now, if it holds them.
+func (b *tokenBucket) allow(now time.Time, n int) bool {
+	b.Lock()
+	defer b.Unlock()
+	if !b.holds(now, n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// fits reports whether the bucket holds n bytes at now, without taking them.
+func (b *tokenBucket) fits(now time.Time, n int) bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.holds(now, n)
+}
+
+// take takes n bytes from the bucket at now, even if it holds less.
+func (b *tokenBucket) take(now time.Time, n int) {
+	b.Lock()
+	defer b.Unlock()
+	b.holds(now, n)
+	b.tokens -= float64(n)
+}
+
+func (b *tokenBucket) holds(now time.Time, n int) bool {
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	return b.tokens >= float64(n)
+}
+
+// trafficLimiter enforces the limit the ledger sets for the node on the
+// packets it sends and receives. Received packets have crossed the link
+// already, but dropping them slows their senders down.
+//
+// With a state file, the traffic counted against the quota survives
+// restarts.
+type trafficLimiter struct {
+	self    string
+	mtu     uint64
+	file    string
+	current atomic.Pointer[limitState]
+	dropped atomic.Uint64
+
+	// saved is the usage while the node has no limit.
+	sync.Mutex
+	saved trafficUsage
+}
+
+// trafficUsage is the traffic counted against the quota in a month, in UTC.
+type trafficUsage struct {
+	Year  int
+	Month time.Month
+	Used  uint64
+}
+
+type limitState struct {
+	limit  types.TrafficLimit
+	bucket *tokenBucket
+
+	sync.Mutex
+	trafficUsage
+}
+
+// rollover starts the usage over when now is in another month.
+func (s *limitState) rollover(now time.Time) {
+	now = now.UTC()
+	if now.Year() != s.Year || now.Month() != s.Month {
+		s.trafficUsage = trafficUsage{Year: now.Year(), Month: now.Month()}
+	}
+}
+
+func (s *limitState) usage() trafficUsage {
+	s.Lock()
+	defer s.Unlock()
+	return s.trafficUsage
+}
+
+// newTrafficLimiter returns the limiter of the node self, whose packets are
+// up to mtu bytes. The usage is kept in stateDir, if set.
+func newTrafficLimiter(self string, mtu int, stateDir string) *trafficLimiter {
+	l := &trafficLimiter{self: self, mtu: uint64(max(mtu, 0))}
+	if stateDir != "" {
+		l.file = filepath.Join(stateDir, "traffic-"+self+".json")
+		l.saved = l.load()
+	}
+	return l
+}
+
+// allow reports whether a packet of n bytes is within the limit at now, and
+// counts it against the quota if so.
+func (l *trafficLimiter) allow(now time.Time, n int) bool {
+	if !l.admits(now, n) {
+		return false
+	}
+	l.charge(now, n)
+	return true
+}
+
+// admits reports whether a packet of n bytes is within the limit at now,
+// without counting it: the packets the node sends are counted once sent,
+// with charge.
+func (l *trafficLimiter) admits(now time.Time, n int) bool {
+	if l == nil {
+		return true
+	}
+	s := l.current.Load()
+	if s == nil {
+		return true
+	}
+	if s.bucket != nil && !s.bucket.fits(now, n) {
+		l.dropped.Add(1)
+		return false
+	}
+	if s.limit.Quota == 0 {
+		return true
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.rollover(now)
+	if s.Used+uint64(n) > s.limit.Quota {
+		l.dropped.Add(1)
+		return false
+	}
+	return true
+}
+
+// charge counts a packet of n bytes against the limit at now.
+func (l *trafficLimiter) charge(now time.Time, n int) {
+	if l == nil {
+		return
+	}
+	s := l.current.Load()
+	if s == nil {
+		return
+	}
+	if s.bucket != nil {
+		s.bucket.take(now, n)
+	}
+	if s.limit.Quota == 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.rollover(now)
+	s.Used += uint64(n)
+}
+
+// update applies the limit of the node from the content of the limits bucket.
+// The quota used so far is kept across changes of the limit. A burst below
+// the MTU is raised to it.
+func (l *trafficLimiter) update(bucket map[string]blockchain.Data) {
+	var limit types.TrafficLimit
+	old := l.current.Load()
+	if d, ok := bucket[l.self]; !ok || d.Unmarshal(&limit) != nil || (limit.Rate == 0 && limit.Quota == 0) {
+		if old != nil {
+			l.Lock()
+			l.saved = old.usage()
+			l.Unlock()
+			l.current.Store(nil)
+		}
+		return
+	}
+	if old != nil && old.limit == limit {
+		return
+	}
+	s := &limitState{limit: limit}
+	if limit.Rate > 0 {
+		s.bucket = newTokenBucket(limit.Rate, limit.Burst, l.mtu)
+	}
+	s.trafficUsage = l.usage()
+	l.current.Store(s)
+}
+
+// watch keeps the limit in sync with the ledger until ctx is done. Limits
+// are only applied when admin keys alone may write them: else any peer could
+// cut another off.
+func (l *trafficLimiter) watch(ctx context.Context, ledger *blockchain.Ledger, logf func(string, ...interface{})) {
+	warned := false
+	refresh := func() {
+		bucket := ledger.CurrentData()[protocol.TrafficLimitsKey]
+		if !ledger.AdminEnforced(protocol.TrafficLimitsKey) {
+			if _, limited := bucket[l.self]; limited && !warned {
+				logf("ignoring the traffic limit of this node: limits need ledger admin keys and --ownership enforce")
+				warned = true
+			}
+			bucket = nil
+		}
+		l.update(bucket)
+	}
+	for ctx.Err() == nil {
+		events := ledger.Watch(ctx, protocol.TrafficLimitsKey, "")
+		refresh()
+		for range events {
+			refresh()
+		}
+	}
+}
+
+func (l *trafficLimiter) status(now time.Time) *TrafficLimitStatus {
+	if l == nil {
+		return nil
+	}
+	s := l.current.Load()
+	if s == nil {
+		return nil
+	}
+	st := &TrafficLimitStatus{TrafficLimit: s.limit, Dropped: l.dropped.Load()}
+	now = now.UTC()
+	if u := s.usage(); now.Year() == u.Year && now.Month() == u.Month {
+		st.Used = u.Used
+	}
+	return st
+}
+
+// usage returns the traffic counted against the quota.
+func (l *trafficLimiter) usage() trafficUsage {
+	if s := l.current.Load(); s != nil {
+		return s.usage()
+	}
+	l.Lock()
+	defer l.Unlock()
+	return l.saved
+}
+
+// load reads the usage from the state file, if any.
+func (l *trafficLimiter) load() (u trafficUsage) {
+	if b, err := os.ReadFile(l.file); err == nil {
+		json.Unmarshal(b, &u)
+	}
+	return
+}
+
+// save writes u to the state file, replacing it whole.
+func (l *trafficLimiter) save(u trafficUsage) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := l.file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.file)
+}
+
+// persist saves the usage to the state file when it changed, every
+// trafficSaveInterval and once ctx is done.
+func (l *trafficLimiter) persist(ctx context.Context, logf func(string, ...interface{})) {
+	if l.file == "" {
+		return
+	}
+	t := time.NewTicker(trafficSaveInterval)
+	defer t.Stop()
+	last := l.load()
+	for {
+		select {
+		case <-ctx.Done():
+		case <-t.C:
+		}
+		if u := l.usage(); u != last {
+			if err := l.save(u); err != nil {
+				logf("could not save the traffic usage: %s", err.Error())
+			} else {
+				last = u
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Traffic", func() {
+	self := newPeerID().String()
+	now := time.Date(2026, time.March, 31, 23, 59, 0, 0, time.UTC)
+
+	limits := func(l ...types.TrafficLimit) map[string]blockchain.Data {
+		values := map[string]interface{}{}
+		for _, limit := range l {
+			values[limit.PeerID] = limit
+		}
+		return bucket(values)
+	}
+
+	It("counts the packets by source and destination", func() {
+		m := NewMetrics()
+		m.count(tcpPacket("10.1.0.1", "10.1.0.2", 22))
+		m.count(tcpPacket("10.1.0.1", "10.1.0.2", 80))
+		m.count(tcpPacket("10.1.0.2", "10.1.0.1", 40000))
+
+		size := uint64(len(tcpPacket("10.1.0.1", "10.1.0.2", 22)))
+		Expect(m.Traffic().Flows).To(Equal([]TrafficFlow{
+			{Source: "10.1.0.1", Destination: "10.1.0.2", Packets: 2, Bytes: 2 * size},
+			{Source: "10.1.0.2", Destination: "10.1.0.1", Packets: 1, Bytes: size},
+		}))
+		Expect(m.Traffic().Limit).To(BeNil())
+	})
+
+	It("counts the flows beyond the limit together", func() {
+		m := NewMetrics()
+		for i := 0; i < maxFlows+10; i++ {
+			m.count(tcpPacket("10.1.0.1", fmt.Sprintf("192.168.%d.%d", i/256, i%256), 80))
+		}
+		flows := m.Traffic().Flows
+		Expect(len(flows)).To(BeNumerically("<=", maxFlows+1))
+		Expect(flows[0].Source).To(BeEmpty())
+		Expect(flows[0].Packets).To(BeNumerically(">=", 10))
+	})
+
+	It("limits the rate", func() {
+		b := newTokenBucket(1000, 1500, 0)
+		Expect(b.allow(now, 1500)).To(BeTrue())
+		Expect(b.allow(now, 1)).To(BeFalse())
+		Expect(b.allow(now.Add(500*time.Millisecond), 500)).To(BeTrue())
+		Expect(b.allow(now.Add(500*time.Millisecond), 1)).To(BeFalse())
+		// The bucket does not fill beyond the burst
+		Expect(b.allow(now.Add(time.Hour), 1501)).To(BeFalse())
+
+		l := newTrafficLimiter(self, 0, "")
+		Expect(l.allow(now, 1<<20)).To(BeTrue())
+		l.update(limits(types.TrafficLimit{PeerID: self, Rate: 1000}))
+		Expect(l.allow(now, 1000)).To(BeTrue())
+		Expect(l.allow(now, 1)).To(BeFalse())
+		Expect(l.status(now).Dropped).To(Equal(uint64(1)))
+	})
+
+	It("lets full-size packets through a rate below the MTU", func() {
+		l := newTrafficLimiter(self, 1500, "")
+		l.update(limits(types.TrafficLimit{PeerID: self, Rate: 100, Burst: 200}))
+		Expect(l.allow(now, 1500)).To(BeTrue())
+		Expect(l.allow(now, 1500)).To(BeFalse())
+		Expect(l.allow(now.Add(15*time.Second), 1500)).To(BeTrue())
+	})
+
+	It("enforces the monthly quota, and keeps its use across limit changes", func() {
+		l := newTrafficLimiter(self, 0, "")
+		l.update(limits(types.TrafficLimit{PeerID: newPeerID().String(), Quota: 1}))
+		Expect(l.status(now)).To(BeNil())
+
+		l.update(limits(types.TrafficLimit{PeerID: self, Quota: 3000}))
+		Expect(l.allow(now, 2000)).To(BeTrue())
+		Expect(l.allow(now, 2000)).To(BeFalse())
+
+		l.update(limits(types.TrafficLimit{PeerID: self, Quota: 4000}))
+		Expect(l.status(now).Used).To(Equal(uint64(2000)))
+		Expect(l.allow(now, 2000)).To(BeTrue())
+		Expect(l.allow(now, 1)).To(BeFalse())
+
+		// A new month starts over
+		Expect(l.allow(now.Add(time.Minute), 4000)).To(BeTrue())
+		Expect(l.status(now.Add(time.Minute)).Used).To(Equal(uint64(4000)))
+
+		l.update(limits())
+		Expect(l.allow(now, 1<<30)).To(BeTrue())
+	})
+
+	It("applies the limits of the ledger only when admin keys alone write them", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		nolog := func(string, ...interface{}) {}
+		limit := map[string]interface{}{self: types.TrafficLimit{PeerID: self, Quota: 3000}}
+
+		open := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		open.Add(protocol.TrafficLimitsKey, limit)
+		l := newTrafficLimiter(self, 0, "")
+		go l.watch(ctx, open, nolog)
+		Consistently(func() *TrafficLimitStatus { return l.status(now) }, "200ms").Should(BeNil())
+
+		priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		admin, err := blockchain.NewSigner(priv)
+		Expect(err).NotTo(HaveOccurred())
+		guarded := blockchain.New(io.Discard, &blockchain.MemoryStore{},
+			blockchain.WithEnforcedOwnership(blockchain.DefaultRegistry(time.Minute), time.Minute),
+			blockchain.WithAdminKeys(admin.ID()),
+			blockchain.WithSigner(admin))
+		guarded.Add(protocol.TrafficLimitsKey, limit)
+		l = newTrafficLimiter(self, 0, "")
+		go l.watch(ctx, guarded, nolog)
+		Eventually(func() *TrafficLimitStatus { return l.status(now) }).ShouldNot(BeNil())
+	})
+
+	It("keeps the use of the quota across restarts", func() {
+		dir := GinkgoT().TempDir()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		l := newTrafficLimiter(self, 0, dir)
+		l.update(limits(types.TrafficLimit{PeerID: self, Quota: 3000}))
+		Expect(l.allow(now, 2000)).To(BeTrue())
+		l.persist(ctx, func(string, ...interface{}) {})
+
+		l = newTrafficLimiter(self, 0, dir)
+		l.update(limits(types.TrafficLimit{PeerID: self, Quota: 3000}))
+		Expect(l.status(now).Used).To(Equal(uint64(2000)))
+		Expect(l.allow(now, 2000)).To(BeFalse())
+
+		// The use is kept while the node has no limit
+		l.update(limits())
+		l.persist(ctx, func(string, ...interface{}) {})
+		l = newTrafficLimiter(self, 0, dir)
+		l.update(limits(types.TrafficLimit{PeerID: self, Quota: 3000}))
+		Expect(l.status(now).Used).To(Equal(uint64(2000)))
+	})
+})
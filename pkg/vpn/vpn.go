@@ -18,7 +18,9 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"os"
+	"reflect"
 	"runtime"
 	"sync"
 	"time"
@@ -27,8 +29,6 @@ import (
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/mudler/edgevpn/internal"
 	"github.com/mudler/edgevpn/pkg/blockchain"
 	"github.com/mudler/edgevpn/pkg/logger"
@@ -60,9 +60,30 @@ func VPNNetworkService(p ...Option) node.NetworkService {
 		if err := c.Apply(p...); err != nil {
 			return err
 		}
+		if c.IPv6Prefix.IsValid() {
+			c.interfaceAddress6 = netip.PrefixFrom(IPv6Address(c.IPv6Prefix, n.Host().ID()), c.IPv6Prefix.Bits())
+		}
 
 		ifce := c.Interface
-		if ifce == nil {
+		if ifce == nil && c.Netstack {
+			// There is no interface for the host to configure or route
+			// through: the stack lives in this process.
+			c.NetLinkBootstrap = false
+			created, stack, err := newUserStack(c)
+			if err != nil {
+				return err
+			}
+			prefix, err := netip.ParsePrefix(c.InterfaceAddress)
+			if err != nil {
+				created.Close()
+				return err
+			}
+			if err := startUserStack(ctx, c, stack, prefix.Addr()); err != nil {
+				created.Close()
+				return err
+			}
+			ifce = created
+		} else if ifce == nil {
 			created, err := createInterface(c)
 			if err != nil {
 				return err
@@ -86,9 +107,76 @@ func VPNNetworkService(p ...Option) node.NetworkService {
 				mgr.Close()
 			}()
 		}
+		if c.Metrics == nil {
+			c.Metrics = NewMetrics()
+		}
+		// The largest packet that goes through the token buckets
+		maxPacket := max(c.InterfaceMTU, c.MTU)
+		c.qos, err = newQoS(c.QoS, maxPacket)
+		if err != nil {
+			return err
+		}
+		c.Metrics.setQoS(c.qos)
+		queues := newPeerQueues(ctx, openStream(mgr, c, n), c.Metrics, c.qos.queues(), c.Logger.Debugf)
+
+		local, err := compileFirewall(c.Firewall)
+		if err != nil {
+			return err
+		}
+		c.firewall = newFirewall(local)
+		go c.firewall.watch(ctx, b)
+
+		if c.StateDir != "" {
+			if err := os.MkdirAll(c.StateDir, 0700); err != nil {
+				return err
+			}
+		}
+		c.limiter = newTrafficLimiter(n.Host().ID().String(), maxPacket, c.StateDir)
+		c.Metrics.setLimiter(c.limiter)
+		go c.limiter.watch(ctx, b, c.Logger.Warnf)
+		go c.limiter.persist(ctx, c.Logger.Warnf)
+
+		if c.Multicast {
+			prefix, err := netip.ParsePrefix(c.InterfaceAddress)
+			if err != nil {
+				return err
+			}
+			self := n.Host().ID().String()
+			c.multicast = newMulticast(self, prefix, c.MulticastGroups, c.MulticastRate)
+			go c.multicast.watch(ctx, b, c.LedgerAnnounceTime)
+			// Publish the groups we listen to, as the host joins and leaves
+			b.Announce(
+				ctx,
+				c.LedgerAnnounceTime,
+				func() {
+					want := types.Multicast{PeerID: self, Groups: c.multicast.groups()}
+					existing, found := b.GetKey(protocol.MulticastKey, self)
+					var current types.Multicast
+					existing.Unmarshal(&current)
+					if !found || !reflect.DeepEqual(current, want) {
+						b.Add(protocol.MulticastKey, map[string]interface{}{self: want})
+					}
+				},
+			)
+		}
+
+		if c.MTUExchange {
+			c.peerMTU = newPeerMTUs(ctx, exchangeStream(c, n), c.Logger.Debugf)
+		}
+
+		// Routing table, from the configuration or kept in sync with the ledger
+		var table *routingTable
+		if len(nc.PeerTable) > 0 {
+			table = newRoutingTable(staticRoutes(nc.PeerTable))
+		} else {
+			table = newRoutingTable(&routes{})
+			go table.watch(ctx, b, n.Host().ID().String(), c.LedgerAnnounceTime)
+		}
 
 		// Set stream handler during runtime
-		n.Host().SetStreamHandler(protocol.EdgeVPN.ID(), streamHandler(b, ifce, c, nc))
+		n.Host().SetStreamHandler(protocol.EdgeVPNFramed.ID(), streamHandler(b, ifce, c, nc, table))
+		n.Host().SetStreamHandler(protocol.EdgeVPN.ID(), streamHandler(b, ifce, c, nc, table))
+		n.Host().SetStreamHandler(protocol.EdgeVPNMTU.ID(), mtuHandler(c))
 
 		// Announce our IP
 		ip, _, err := net.ParseCIDR(c.InterfaceAddress)
@@ -106,22 +194,109 @@ func VPNNetworkService(p ...Option) node.NetworkService {
 				existingValue.Unmarshal(machine)
 
 				// If mismatch, update the blockchain
-				if !found || machine.PeerID != n.Host().ID().String() {
+				want := newBlockChainData(n, ip.String(), c.address6(), c.Routes)
+				if !found || machine.PeerID != want.PeerID || machine.Address6 != want.Address6 || !reflect.DeepEqual(machine.Routes, want.Routes) {
 					updatedMap := map[string]interface{}{}
-					updatedMap[ip.String()] = newBlockChainData(n, ip.String())
+					updatedMap[ip.String()] = want
 					b.Add(protocol.MachinesLedgerKey, updatedMap)
 				}
 			},
 		)
 
+		// Keep track of the subnets advertised by the peers
+		kernel := &kernelRoutes{}
+		b.Announce(
+			ctx,
+			c.LedgerAnnounceTime,
+			func() {
+				machines := b.CurrentData()[protocol.MachinesLedgerKey]
+				self := n.Host().ID().String()
+				for _, conflict := range buildRoutes(machines, "", b.IsOwnerLive).conflicts {
+					if conflict.Winner == self {
+						c.Logger.Warnf("route %s is also advertised by %v, traffic is sent to this node", conflict.Prefix, conflict.Losers)
+					}
+					for _, l := range conflict.Losers {
+						if l == self {
+							c.Logger.Warnf("route %s is also advertised by %s, which gets the traffic", conflict.Prefix, conflict.Winner)
+						}
+					}
+				}
+				if c.NetLinkBootstrap {
+					kernel.sync(c, buildRoutes(machines, self, b.IsOwnerLive).prefixes())
+				}
+			},
+		)
+
+		if local != nil {
+			// Publish our rules so peers drop what we would refuse before
+			// sending it.
+			fw := c.Firewall
+			fw.PeerID = n.Host().ID().String()
+			b.Announce(
+				ctx,
+				c.LedgerAnnounceTime,
+				func() {
+					existing, found := b.GetKey(protocol.FirewallKey, fw.PeerID)
+					var current types.Firewall
+					existing.Unmarshal(&current)
+					if !found || !reflect.DeepEqual(current, fw) {
+						b.Add(protocol.FirewallKey, map[string]interface{}{fw.PeerID: fw})
+					}
+				},
+			)
+		}
+
 		if c.NetLinkBootstrap {
 			if err := prepareInterface(c); err != nil {
 				return err
 			}
 		}
 
+		if c.ExitNode {
+			self := n.Host().ID().String()
+			b.AnnounceUpdate(ctx, c.LedgerAnnounceTime, protocol.ExitNodeKey, self, types.ExitNode{PeerID: self, Address: ip.String()})
+			if c.NetLinkBootstrap {
+				if restore, err := enableExitNAT(c); err != nil {
+					c.Logger.Warnf("could not set up NAT for the exit node: %s", err.Error())
+				} else {
+					go func() {
+						<-ctx.Done()
+						restore()
+					}()
+				}
+			}
+		}
+
+		c.exit = newExitSelector(c.ExitVia)
+		if c.exit != nil {
+			routes := &exitRoutes{}
+			b.Announce(
+				ctx,
+				c.LedgerAnnounceTime,
+				func() {
+					exit, changed := c.exit.choose(liveExits(b, n.Host().ID().String(), c.ExitDeadTime))
+					if changed && exit == "" {
+						c.Logger.Warnf("no exit node available")
+					} else if changed {
+						c.Logger.Infof("using exit node %s", exit)
+					}
+					if c.NetLinkBootstrap {
+						if err := routes.sync(c, exit != "", underlayIPs(n.Host(), c.Underlay)); err != nil {
+							c.Logger.Warnf("could not route through the exit node: %s", err.Error())
+						}
+					}
+				},
+			)
+			if c.NetLinkBootstrap {
+				go func() {
+					<-ctx.Done()
+					routes.sync(c, false, nil)
+				}()
+			}
+		}
+
 		// read packets from the interface
-		return readPackets(ctx, mgr, c, n, b, ifce, nc)
+		return readPackets(ctx, queues, c, n, table, ifce)
 	}
 }
 
@@ -131,7 +306,7 @@ func Register(p ...Option) ([]node.Option, error) {
 	return []node.Option{node.WithNetworkService(VPNNetworkService(p...))}, nil
 }
 
-func streamHandler(l *blockchain.Ledger, ifce io.ReadWriteCloser, c *Config, nc node.Config) func(stream network.Stream) {
+func streamHandler(l *blockchain.Ledger, ifce io.ReadWriteCloser, c *Config, nc node.Config, table *routingTable) func(stream network.Stream) {
 	return func(stream network.Stream) {
 		if len(nc.PeerTable) == 0 && !l.Exists(protocol.MachinesLedgerKey,
 			func(d blockchain.Data) bool {
@@ -154,7 +329,37 @@ func streamHandler(l *blockchain.Ledger, ifce io.ReadWriteCloser, c *Config, nc
 				return
 			}
 		}
-		_, err := io.Copy(ifce, stream)
+		from := dest{id: stream.Conn().RemotePeer(), name: stream.Conn().RemotePeer().String()}
+		owns := func(src netip.Addr) bool { return sentBy(c, table.load(), from, src) }
+		allow := func(packet []byte) bool {
+			now := time.Now()
+			if !c.firewall.allowReceive(packet, owns) || !c.limiter.allow(now, len(packet)) {
+				return false
+			}
+			if _, dst, ok := packetAddrs(packet); ok && c.multicast.isGroup(dst) && !c.multicast.allowReceive(now) {
+				return false
+			}
+			if c.MSSClamp {
+				clampMSS(packet, c.mtuTo(from))
+			}
+			c.Metrics.count(packet)
+			return true
+		}
+		w := c.Capture.writer(ifce, stream.Conn().RemotePeer().String())
+		var err error
+		if stream.Protocol() == protocol.EdgeVPNFramed.ID() {
+			err = readFrames(stream, func(_ frameMeta, packet []byte) error {
+				if !allow(packet) {
+					return nil
+				}
+				_, err := w.Write(packet)
+				return err
+			})
+		} else {
+			// Streams may be reused for several packets: write them one at
+			// a time
+			err = copyPackets(w, stream, allow)
+		}
 		if err != nil {
 			stream.Reset()
 		}
@@ -162,7 +367,25 @@ func streamHandler(l *blockchain.Ledger, ifce io.ReadWriteCloser, c *Config, nc
 	}
 }
 
-func newBlockChainData(n *node.Node, address string) types.Machine {
+// sentBy reports whether the peer from may send packets from src: src is
+// one of its addresses or in a subnet it advertises, or from is the exit node
+// or the router forwarding the traffic of other hosts.
+func sentBy(c *Config, r *routes, from dest, src netip.Addr) bool {
+	if owner, ok := r.lookup(src); ok {
+		return owner.id == from.id
+	}
+	if exit, ok := c.exit.dest(); ok && exit.id == from.id {
+		return true
+	}
+	if router, err := netip.ParseAddr(c.RouterAddress); err == nil {
+		if to, ok := r.hosts[router]; ok && to.id == from.id {
+			return true
+		}
+	}
+	return false
+}
+
+func newBlockChainData(n *node.Node, address, address6 string, routes []string) types.Machine {
 	hostname, _ := os.Hostname()
 
 	return types.Machine{
@@ -172,6 +395,8 @@ func newBlockChainData(n *node.Node, address string) types.Machine {
 		Arch:     runtime.GOARCH,
 		Version:  internal.Version,
 		Address:  address,
+		Address6: address6,
+		Routes:   routes,
 	}
 }
 
@@ -188,133 +413,153 @@ func getFrame(ifce io.Reader, c *Config) (ethernet.Frame, error) {
 	return frame, nil
 }
 
-func handleFrame(mgr streamManager, frame ethernet.Frame, c *Config, n *node.Node, ip net.IP, ledger *blockchain.Ledger, ifce io.ReadWriteCloser, nc node.Config) error {
-	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
-	defer cancel()
+func handleFrame(queues *peerQueues, ifce io.Writer, frame ethernet.Frame, c *Config, ip netip.Addr, table *routingTable) error {
+	src, dst, ok := packetAddrs(frame)
+	if !ok {
+		return errors.New("could not parse header from frame")
+	}
 
-	var dstIP, srcIP net.IP
-	var packet layers.IPv4
-	if err := packet.DecodeFromBytes(frame, gopacket.NilDecodeFeedback); err != nil {
-		var packet layers.IPv6
-		if err := packet.DecodeFromBytes(frame, gopacket.NilDecodeFeedback); err != nil {
-			return errors.Wrap(err, "could not parse header from frame")
-		} else {
-			dstIP = packet.DstIP
-			srcIP = packet.SrcIP
-		}
-	} else {
-		dstIP = packet.DstIP
-		srcIP = packet.SrcIP
+	if c.multicast.isGroup(dst) {
+		return handleMulticast(queues, frame, c, dst)
 	}
 
-	dst := dstIP.String()
-	if c.RouterAddress != "" && srcIP.Equal(ip) {
-		if _, found := ledger.GetKey(protocol.MachinesLedgerKey, dst); !found {
-			dst = c.RouterAddress
+	// Destinations that are not VPN addresses may be in a subnet advertised
+	// by a peer, else they go to the router or the exit node if any.
+	r := table.load()
+	d, found := r.lookup(dst)
+	switch {
+	case found:
+	case c.RouterAddress != "":
+		if router, err := netip.ParseAddr(c.RouterAddress); err == nil && src == ip {
+			d, found = r.hosts[router]
 		}
+	case !r.static && (dst.Is4() || c.interfaceAddress6.IsValid()):
+		// The exit only forwards the IPv6 traffic of VPN addresses
+		d, found = c.exit.dest()
+	}
+	if !found {
+		return fmt.Errorf("'%s' not found in the routing table", dst)
 	}
 
-	var d peer.ID
-	var err error
-	notFoundErr := fmt.Errorf("'%s' not found in the routing table", dst)
-	if len(nc.PeerTable) > 0 {
-		found := false
-		for ip, p := range nc.PeerTable {
-			if ip == dst {
-				found = true
-				d = peer.ID(p)
-			}
-		}
-		if !found {
-			return notFoundErr
-		}
-	} else {
-		// Query the routing table
-		value, found := ledger.GetKey(protocol.MachinesLedgerKey, dst)
-		if !found {
-			return notFoundErr
-		}
-		machine := &types.Machine{}
-		value.Unmarshal(machine)
+	if !c.firewall.allowSend(frame, d.name) {
+		return fmt.Errorf("packet to '%s' dropped by the firewall", dst)
+	}
 
-		// Don't route to an owner that has gone inactive (under ownership
-		// enforcement); this is a no-op when enforcement is disabled.
-		if !ledger.IsOwnerLive(machine.PeerID) {
-			return notFoundErr
+	mtu := c.mtuTo(d)
+	if mtu > 0 && len(frame) > mtu {
+		// Tell the sender to send smaller packets rather than have the
+		// peer drop them
+		if reply := packetTooBig(frame, mtu, ip, c.interfaceAddress6.Addr()); reply != nil {
+			ifce.Write(reply)
+			return fmt.Errorf("packet to '%s' dropped: larger than the MTU %d", d.name, mtu)
 		}
-
-		// Decode the Peer
-		d, err = peer.Decode(machine.PeerID)
+	}
+	if c.MSSClamp {
+		clampMSS(frame, mtu)
 	}
 
-	if err != nil {
-		return errors.Wrap(err, "could not decode peer")
+	now := time.Now()
+	if !c.limiter.admits(now, len(frame)) {
+		return fmt.Errorf("packet to '%s' dropped: over the traffic limit", d.name)
 	}
 
-	var stream network.Stream
-	if mgr != nil {
-		// Open a stream if necessary
-		stream, err = mgr.HasStream(n.Host().Network(), d)
-		if err == nil {
-			_, err = stream.Write(frame)
-			if err == nil {
-				return nil
-			}
-			mgr.Disconnected(n.Host().Network(), stream)
-		}
+	class := c.qos.classify(frame)
+	if !class.allow(now, len(frame)) {
+		return fmt.Errorf("packet to '%s' dropped: over the rate of class %s", d.name, class.Name)
 	}
 
-	stream, err = n.Host().NewStream(ctx, d, protocol.EdgeVPN.ID())
+	err := queues.send(d, frame, class.queue())
+	class.queued(len(frame), err)
 	if err != nil {
-		return fmt.Errorf("could not open stream to %s: %w", d.String(), err)
+		return fmt.Errorf("packet to '%s' dropped: %w", d.name, err)
 	}
-	defer stream.Close()
+	c.limiter.charge(now, len(frame))
+	c.Metrics.count(frame)
+	c.Capture.record(captureSent, d.name, frame)
+	return nil
+}
+
+// openStream opens the streams the peer queues write to. Framing is preferred,
+// old nodes only speak EdgeVPN. In low profile mode the streams are handed to
+// mgr, which closes the least used ones beyond MaxStreams.
+func openStream(mgr streamManager, c *Config, n *node.Node) openFunc {
+	return func(ctx context.Context, to dest) (packetStream, bool, error) {
+		ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
 
-	if mgr != nil {
-		mgr.Connected(n.Host().Network(), stream)
+		s, err := n.Host().NewStream(ctx, to.id, protocol.EdgeVPNFramed.ID(), protocol.EdgeVPN.ID())
+		if err != nil {
+			return nil, false, err
+		}
+		framed := s.Protocol() == protocol.EdgeVPNFramed.ID()
+		if mgr == nil {
+			return s, framed, nil
+		}
+		mgr.Connected(n.Host().Network(), s)
+		return &managedStream{Stream: s, release: func() { mgr.Disconnected(n.Host().Network(), s) }}, framed, nil
 	}
+}
 
-	_, err = stream.Write(frame)
-	return err
+// managedStream releases the stream from the stream manager once it is done.
+type managedStream struct {
+	network.Stream
+	release func()
+}
+
+func (s *managedStream) Reset() error {
+	s.release()
+	return s.Stream.Reset()
+}
+
+func (s *managedStream) Close() error {
+	s.release()
+	return s.Stream.Close()
 }
 
 func connectionWorker(
 	p chan ethernet.Frame,
-	mgr streamManager,
+	queues *peerQueues,
+	ifce io.Writer,
 	c *Config,
-	n *node.Node,
-	ip net.IP,
+	ip netip.Addr,
 	wg *sync.WaitGroup,
-	ledger *blockchain.Ledger,
-	ifce io.ReadWriteCloser,
-	nc node.Config) {
+	table *routingTable) {
 	defer wg.Done()
 	for f := range p {
-		if err := handleFrame(mgr, f, c, n, ip, ledger, ifce, nc); err != nil {
+		if err := handleFrame(queues, ifce, f, c, ip, table); err != nil {
 			c.Logger.Debugf("could not handle frame: %s", err.Error())
 		}
 	}
 }
 
-// readPackets packets from the interface to the node using the routing table in the blockchain
-func readPackets(ctx context.Context, mgr streamManager, c *Config, n *node.Node, ledger *blockchain.Ledger, ifce io.ReadWriteCloser, nc node.Config) error {
-	ip, _, err := net.ParseCIDR(c.InterfaceAddress)
+// readPackets packets from the interface to the node using the routing table.
+// Packets are spread over the workers by flow, so that the packets of a flow
+// are handled by the same worker and stay in order.
+func readPackets(ctx context.Context, queues *peerQueues, c *Config, n *node.Node, table *routingTable, ifce io.ReadWriteCloser) error {
+	prefix, err := netip.ParsePrefix(c.InterfaceAddress)
 	if err != nil {
 		return err
 	}
+	ip := prefix.Addr()
 
 	wg := new(sync.WaitGroup)
 
-	packets := make(chan ethernet.Frame, c.ChannelBufferSize)
+	workers := make([]chan ethernet.Frame, max(c.Concurrency, 1))
+	for i := range workers {
+		workers[i] = make(chan ethernet.Frame, c.ChannelBufferSize)
+	}
+	c.Metrics.setWorkers(workers)
 
 	defer func() {
-		close(packets)
+		for _, w := range workers {
+			close(w)
+		}
 		wg.Wait()
 	}()
 
-	for i := 0; i < c.Concurrency; i++ {
+	for _, w := range workers {
 		wg.Add(1)
-		go connectionWorker(packets, mgr, c, n, ip, wg, ledger, ifce, nc)
+		go connectionWorker(w, queues, ifce, c, ip, wg, table)
 	}
 
 	for {
@@ -328,7 +573,12 @@ func readPackets(ctx context.Context, mgr streamManager, c *Config, n *node.Node
 				continue
 			}
 
-			packets <- frame
+			workers[workerFor(frame, len(workers))] <- frame
 		}
 	}
 }
+
+// workerFor returns the worker handling the flow of frame.
+func workerFor(frame ethernet.Frame, workers int) int {
+	return int(packetMeta(frame).Flow % uint32(workers))
+}
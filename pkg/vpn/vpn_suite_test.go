@@ -0,0 +1,85 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestVPN(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "VPN Suite")
+}
+
+// testPacket is a packet of the tests: an IPv4 or IPv6 header from src to
+// dst, then a TCP SYN or a UDP datagram if proto is one of them, else the
+// payload as is. sport, ttl and payload default to 40000, 64 and "hello".
+type testPacket struct {
+	src, dst     string
+	proto        layers.IPProtocol
+	sport, dport uint16
+	dscp, ttl    uint8
+	df           bool
+	options      []layers.TCPOption
+	payload      []byte
+}
+
+func (p testPacket) bytes() []byte {
+	if p.sport == 0 {
+		p.sport = 40000
+	}
+	if p.ttl == 0 {
+		p.ttl = 64
+	}
+	if p.payload == nil {
+		p.payload = []byte("hello")
+	}
+
+	var ip gopacket.NetworkLayer
+	if net.ParseIP(p.src).To4() != nil {
+		v4 := &layers.IPv4{Version: 4, TTL: p.ttl, TOS: p.dscp << 2, Protocol: p.proto, SrcIP: net.ParseIP(p.src), DstIP: net.ParseIP(p.dst)}
+		if p.df {
+			v4.Flags = layers.IPv4DontFragment
+		}
+		ip = v4
+	} else {
+		ip = &layers.IPv6{Version: 6, HopLimit: p.ttl, TrafficClass: p.dscp << 2, NextHeader: p.proto, SrcIP: net.ParseIP(p.src), DstIP: net.ParseIP(p.dst)}
+	}
+	ls := []gopacket.SerializableLayer{ip.(gopacket.SerializableLayer)}
+	switch p.proto {
+	case layers.IPProtocolTCP:
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(p.sport), DstPort: layers.TCPPort(p.dport), SYN: true, Options: p.options}
+		tcp.SetNetworkLayerForChecksum(ip)
+		ls = append(ls, tcp)
+	case layers.IPProtocolUDP:
+		udp := &layers.UDP{SrcPort: layers.UDPPort(p.sport), DstPort: layers.UDPPort(p.dport)}
+		udp.SetNetworkLayerForChecksum(ip)
+		ls = append(ls, udp)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, append(ls, gopacket.Payload(p.payload))...)
+	Expect(err).NotTo(HaveOccurred())
+	return buf.Bytes()
+}
+
+// tcpPacket returns an IPv4 TCP SYN from src to dst:port.
+func tcpPacket(src, dst string, port uint16) []byte {
+	return testPacket{src: src, dst: dst, proto: layers.IPProtocolTCP, dport: port}.bytes()
+}